@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+
+	"github.com/musl/gost/server"
+)
+
+/*
+ * The gost binary: everything lives in the server package, so it can
+ * be built into other programs too.
+ */
+func main() {
+	os.Exit(server.Main(os.Args[1:]))
+}
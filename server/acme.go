@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	acme_client "golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+/*
+ * Certificates from Let's Encrypt or any other ACME (RFC 8555) CA, so
+ * the TLS listener can get and renew its own.  autocert does the
+ * talking to the CA and the renewing; gost answers its http-01
+ * challenges on the plain listener, so the CA must be able to reach
+ * that on port 80, directly or through a redirect.
+ *
+ * The account key and certificates are cached in a directory so
+ * restarts don't hit the CA's rate limits.  Until there's one from the
+ * CA, and whenever the CA can't be had, the -cert and -key files are
+ * served if they're there, or else the certificate an older gost kept
+ * in the cache.
+ */
+const acme_lets_encrypt = "https://acme-v02.api.letsencrypt.org/directory"
+const acme_challenge_prefix = "/.well-known/acme-challenge/"
+
+/*
+ * Renew this long before expiry.  A domain the CA hasn't given a
+ * certificate for yet is tried again after acme_retry_min, backing off
+ * to acme_retry_max.
+ */
+const acme_renew_before = 30 * 24 * time.Hour
+const acme_retry_min = time.Minute
+const acme_retry_max = time.Hour
+
+type acme_manager struct {
+	domains   []string
+	cache_dir string
+	manager   *autocert.Manager
+	challenge http.Handler
+	fallback  func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	obtained  atomic.Bool
+
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+var acme *acme_manager
+
+/*
+ * Set up ACME from the configuration, or leave it off when no domain
+ * is configured.
+ */
+func new_acme_manager(c *configuration) *acme_manager {
+	if(c.acme_domain == "") {
+		return nil
+	}
+
+	domains := []string{}
+	for _, d := range strings.Split(c.acme_domain, ",") {
+		d = strings.TrimSpace(d)
+		if(d != "") {
+			domains = append(domains, d)
+		}
+	}
+
+	m := &acme_manager{
+		domains:   domains,
+		cache_dir: c.acme_cache_dir,
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       autocert.DirCache(c.acme_cache_dir),
+			HostPolicy:  autocert.HostWhitelist(domains...),
+			RenewBefore: acme_renew_before,
+			Email:       c.acme_email,
+			Client: &acme_client.Client{
+				DirectoryURL: c.acme_directory,
+				HTTPClient:   &http.Client{Timeout: 30 * time.Second},
+			},
+		},
+	}
+	m.ctx, m.stop = context.WithCancel(context.Background())
+	// Asking for the handler is what turns http-01 on.
+	m.challenge = m.manager.HTTPHandler(http.NotFoundHandler())
+	return m
+}
+
+/*
+ * Get a certificate for each domain now, retrying with backoff until
+ * the CA comes through or we stop, and leave autocert to renew them.
+ */
+func (m *acme_manager) go_renew() error {
+	err := os.MkdirAll(m.cache_dir, 0700)
+	if(err != nil) {
+		return err
+	}
+	if(m.fallback == nil) {
+		cert, err := tls.LoadX509KeyPair(filepath.Join(m.cache_dir, "cert.pem"), filepath.Join(m.cache_dir, "cert.key"))
+		if(err == nil) {
+			m.fallback = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			}
+		}
+	}
+
+	go func() {
+		pending := m.domains
+		wait := acme_retry_min
+		for {
+			failed := []string{}
+			for _, d := range pending {
+				err := m.obtain(d)
+				if(err != nil) {
+					log_at(log_level_error, "Can't get a certificate for %s: %v", d, err)
+					failed = append(failed, d)
+				}
+			}
+			pending = failed
+			if(len(pending) == 0) {
+				return
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-m.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			wait = min(2 * wait, acme_retry_max)
+		}
+	}()
+	return nil
+}
+
+/*
+ * Have autocert get the certificate for domain, from its cache or the
+ * CA, giving up on waiting for it once we stop.
+ */
+func (m *acme_manager) obtain(domain string) error {
+	type obtained struct {
+		cert *tls.Certificate
+		err  error
+	}
+	done := make(chan obtained, 1)
+	go func() {
+		cert, err := m.manager.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+		done <- obtained{cert, err}
+	}()
+
+	select {
+	case <-m.ctx.Done():
+		return m.ctx.Err()
+	case got := <-done:
+		if(got.err != nil) {
+			return got.err
+		}
+		m.obtained.Store(true)
+		if(got.cert.Leaf != nil) {
+			log_at(log_level_info, "Have a certificate for %s, valid until %v", domain, got.cert.Leaf.NotAfter)
+		}
+		return nil
+	}
+}
+
+/*
+ * Stop retrying, for shutting down.
+ */
+func (m *acme_manager) shutdown() {
+	m.stop()
+}
+
+/*
+ * Have we a certificate from the CA yet?
+ */
+func (m *acme_manager) has_certificate() bool {
+	return m.obtained.Load()
+}
+
+/*
+ * A tls.Config GetCertificate hook: autocert's own for a CA's
+ * tls-alpn-01 check, the fallback until the CA has come through, then autocert's certificate for the name asked for, or the
+ * first domain's for a client that asked for another or none, or the
+ * fallback again if autocert can't say.
+ */
+func (m *acme_manager) get_certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for _, proto := range hello.SupportedProtos {
+		if(proto == acme_client.ALPNProto) {
+			return m.manager.GetCertificate(hello)
+		}
+	}
+	if(m.fallback != nil && !m.has_certificate()) {
+		return m.fallback(hello)
+	}
+	cert, err := m.manager.GetCertificate(hello)
+	if(err != nil && hello.ServerName != m.domains[0]) {
+		named := *hello
+		named.ServerName = m.domains[0]
+		cert, err = m.manager.GetCertificate(&named)
+	}
+	if(err != nil && m.fallback != nil) {
+		return m.fallback(hello)
+	}
+	return cert, err
+}
+
+/*
+ * GET: Answer an http-01 challenge.
+ */
+func route_acme_challenge(res http.ResponseWriter, req *http.Request) {
+	if(acme == nil) {
+		res.WriteHeader(404)
+		io.WriteString(res, "Not Found")
+		return
+	}
+	acme.challenge.ServeHTTP(res, req)
+}
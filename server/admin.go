@@ -0,0 +1,537 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * The admin API, on a listener of its own given with -admin so that it
+ * can be kept off the public ports: bind it to localhost or a
+ * management network.  It takes tokens from -admin-tokens, or JWTs with
+ * the admin grant, never the tests' own tokens: with only those set it
+ * refuses every request.  It can dump the configuration in force, change the
+ * settings a reload could change, and list and cancel running tests.
+ * The status, health and metrics routes are served there too.
+ */
+const admin_tests_prefix = "/admin/tests/"
+
+var admin_listeners = &listener_manager{mux: http.NewServeMux()}
+
+/*
+ * The admin listener, if there is one.
+ */
+func (c *configuration) admin_spec() listener_spec {
+	return listener_spec{name: "admin", address: c.admin_address}
+}
+
+func go_serve_admin(c *configuration) error {
+	if(c.admin_address == "") {
+		return nil
+	}
+	return admin_listeners.start(c, []listener_spec{c.admin_spec()}, nil)
+}
+
+/*
+ * A running test, as /admin/tests lists it.
+ */
+type active_test struct {
+	ID        string    `json:"id"`
+	RequestID string    `json:"request_id,omitempty"`
+	Direction string    `json:"direction"`
+	Started   time.Time `json:"started"`
+	Bytes     int64     `json:"bytes"`
+	Requested int64     `json:"requested,omitempty"`
+	Seconds   float64   `json:"seconds"`
+	ClientIP  string    `json:"client_ip"`
+	Protocol  string    `json:"protocol"`
+}
+
+/*
+ * How t stands at now.
+ */
+func (t *test_run) report(now time.Time) active_test {
+	return active_test{
+		ID:        t.id,
+		RequestID: t.request_id,
+		Direction: t.direction,
+		Started:   t.start,
+		Bytes:     t.moved.Load(),
+		Requested: t.requested,
+		Seconds:   now.Sub(t.start).Seconds(),
+		ClientIP:  t.client_ip,
+		Protocol:  t.protocol,
+	}
+}
+
+/*
+ * GET: The configuration in force, laid out as a -config file would be.
+ * PATCH: Change settings, given in the same layout.  Only those a reload
+ * could change are accepted, and the next SIGHUP puts the file's back.
+ */
+func route_admin_config(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD", "":
+		write_json(res, 200, config_dump(settings()))
+		return
+	case "PATCH":
+	default:
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+
+	var f config_file_layout
+	decoder := json.NewDecoder(http.MaxBytesReader(res, req.Body, 1 << 20))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&f)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+	if(layout_has_redacted(&f)) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, "Secrets shown as \"" + redacted + "\" need their real values")
+		return
+	}
+
+	current := settings()
+	next := *current
+	next.listeners = append([]listener_spec(nil), current.listeners...)
+	err = apply_config_layout(&f, &next, "request")
+	if(err == nil) {
+		err = next.validate()
+	}
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+	if(next.needs_restart(current)) {
+		res.WriteHeader(409) // Conflict
+		io.WriteString(res, "Listener, TLS and results file changes need a restart")
+		return
+	}
+	err = open_log_files(&next)
+	if(err == nil) {
+		err = load_vhost_certificates(&next)
+	}
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	apply_configuration(next)
+	err = refresh_tokens()
+	if(err != nil) {
+		log_at(log_level_error, "Can't reload tokens, keeping the old ones: %v", err)
+	}
+	log_fields(log_level_info, "settings changed", "remote", client_ip(req))
+	write_json(res, 200, config_dump(settings()))
+}
+
+/*
+ * GET: The tests running now, oldest first.
+ */
+func route_admin_tests(res http.ResponseWriter, req *http.Request) {
+	if(req.Method != "GET" && req.Method != "HEAD" && req.Method != "") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+
+	write_json(res, 200, running_tests())
+}
+
+/*
+ * The tests running now, oldest first.
+ */
+func running_tests() []active_test {
+	now := time.Now()
+	tests := []active_test{}
+	active_runs.Range(func(_, v any) bool {
+		tests = append(tests, v.(*test_run).report(now))
+		return true
+	})
+	sort.Slice(tests, func(i, j int) bool {
+		return tests[i].Started.Before(tests[j].Started)
+	})
+	return tests
+}
+
+/*
+ * GET: One running test.  DELETE: Cancel it; it gives back its slot at
+ * once and ends, aborted, as soon as its read or write fails.
+ */
+func route_admin_test(res http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, admin_tests_prefix)
+	v, running := active_runs.Load(id)
+	g, grouped := grouped_tests.Load(id)
+	if(!running && grouped) {
+		route_admin_grouped_test(res, req, id, g.(grouped_test))
+		return
+	}
+	if(!running) {
+		res.WriteHeader(404)
+		io.WriteString(res, "No such test")
+		return
+	}
+	t := v.(*test_run)
+
+	switch req.Method {
+	case "GET", "HEAD", "":
+		write_json(res, 200, t.report(time.Now()))
+	case "DELETE":
+		t.cancel()
+		log_fields(log_level_info, "test cancelled", "test", t.id, "remote", client_ip(req))
+		res.WriteHeader(202) // Accepted
+	default:
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+	}
+}
+
+/*
+ * Likewise for a multi-stream or duplex test.
+ */
+func route_admin_grouped_test(res http.ResponseWriter, req *http.Request, id string, g grouped_test) {
+	switch req.Method {
+	case "GET", "HEAD", "":
+		write_json(res, 200, g.so_far())
+	case "DELETE":
+		g.cancel()
+		log_fields(log_level_info, "test cancelled", "test", id, "remote", client_ip(req))
+		res.WriteHeader(202) // Accepted
+	default:
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+	}
+}
+
+/*
+ * The configuration as a -config file would give it.  Sizes and rates
+ * come out as plain numbers, which read back the same.  Tokens for
+ * peers and the mesh, and webhook secrets, are left out.
+ */
+func config_dump(c *configuration) map[string]any {
+	listeners := []map[string]any{}
+	for _, spec := range c.listeners {
+		listeners = append(listeners, map[string]any{
+			"name":       spec.name,
+			"address":    spec.address,
+			"unix":       spec.unix,
+			"mode":       fmt.Sprintf("%04o", spec.mode),
+			"tls":        spec.tls,
+			"http2":      spec.http2,
+			"congestion": spec.congestion,
+			"dscp":       spec.dscp,
+			"family":     spec.family,
+			"sndbuf":     strconv.Itoa(spec.sndbuf),
+			"rcvbuf":     strconv.Itoa(spec.rcvbuf),
+			"nodelay":    !spec.nagle,
+		})
+	}
+
+	peers := []map[string]any{}
+	for _, p := range c.peers {
+		peers = append(peers, map[string]any{
+			"name":     p.name,
+			"url":      p.url.Redacted(),
+			"schedule": p.schedule.text,
+			"jitter":   p.jitter.String(),
+			"enabled":  p.enabled,
+			"bytes":    strconv.FormatInt(p.bytes, 10),
+			"token":    redacted_secret(p.token),
+			"insecure": p.insecure,
+		})
+	}
+
+	dump := map[string]any{
+		"listen": map[string]any{
+			"bind":       c.bind_address,
+			"http_port":  c.http_port,
+			"https_port": c.https_port,
+			"udp_port":   c.udp_port,
+			"iperf_port": c.iperf_port,
+			"h3_port":    c.h3_port,
+			"unix":       c.unix_socket,
+			"unix_mode":  fmt.Sprintf("%04o", c.unix_mode),
+			"family":     c.listen_family,
+			"acceptors":  c.acceptors,
+		},
+		"tls": map[string]any{
+			"cert":           c.cert_file,
+			"key":            c.key_file,
+			"save_generated": c.self_signed_save,
+			"min_version":    c.tls_min_version,
+			"ciphers":        c.tls_ciphers,
+			"curves":         c.tls_curves,
+			"alpn":           c.tls_alpn,
+			"client_ca":      c.tls_client_ca,
+		},
+		"acme": map[string]any{
+			"domain":    c.acme_domain,
+			"email":     c.acme_email,
+			"directory": c.acme_directory,
+			"cache_dir": c.acme_cache_dir,
+		},
+		"protocols": map[string]any{
+			"http2": c.http2,
+			"h2c":   c.h2c,
+		},
+		"congestion": map[string]any{
+			"http":  c.http_congestion,
+			"https": c.https_congestion,
+			"iperf": c.iperf_congestion,
+		},
+		"dscp": map[string]any{
+			"http":  c.http_dscp,
+			"https": c.https_dscp,
+		},
+		"limits": map[string]any{
+			"max_bytes":   strconv.FormatInt(c.max_test_bytes, 10),
+			"max_seconds": c.max_test_duration.String(),
+			"max_active":  c.max_active_tests,
+			"max_rate":    strconv.FormatInt(c.max_aggregate_bps, 10),
+			"burst":       strconv.FormatInt(c.throttle_burst, 10),
+
+			"ip_active": c.ip_max_active,
+			"ip_bytes":  strconv.FormatInt(c.ip_max_bytes, 10),
+			"ip_window": c.ip_window.String(),
+
+			"max_header_bytes":    strconv.FormatInt(c.max_header_bytes, 10),
+			"read_header_timeout": c.read_header_timeout.String(),
+			"idle_timeout":        c.idle_timeout.String(),
+			"conn_upload":         strconv.FormatInt(c.max_conn_upload, 10),
+			"min_upload_rate":     strconv.FormatInt(c.min_upload_bps, 10),
+			"min_rate_window":     c.min_rate_window.String(),
+		},
+		"payload": map[string]any{
+			"fill": c.payload_fill,
+		},
+		"tuning": map[string]any{
+			"sndbuf":     strconv.FormatInt(c.tcp_sndbuf, 10),
+			"rcvbuf":     strconv.FormatInt(c.tcp_rcvbuf, 10),
+			"nodelay":    c.tcp_nodelay,
+			"write_size": strconv.FormatInt(c.write_size, 10),
+			"gomaxprocs": c.gomaxprocs,
+		},
+		"tests": map[string]any{
+			"windows":          test_window_texts(c.test_windows),
+			"maintenance_file": c.maintenance_file,
+		},
+		"files": map[string]any{
+			"dir": c.files_dir,
+			"max": strconv.FormatInt(c.files_max, 10),
+		},
+		"auth": map[string]any{
+			"tokens_file": c.auth_tokens_file,
+		},
+		"jwt": map[string]any{
+			"issuer":   c.jwt_issuer,
+			"jwks":     c.jwt_jwks_url,
+			"audience": c.jwt_audience,
+			"tests":    c.jwt_tests,
+			"grants":   jwt_grant_dump(c.jwt_grants),
+		},
+		"results": map[string]any{
+			"kept":    c.results_kept,
+			"max_age": c.results_max_age.String(),
+			"file":    c.results_file,
+			"db":      c.results_db,
+			"db_rows": c.results_db_rows,
+
+			"expect_tolerance":     c.expect_tolerance,
+			"webhook_dead_letters": c.webhook_dead_letters,
+		},
+		"log": map[string]any{
+			"level":  log_level_name(c.log_level),
+			"format": c.log_format,
+
+			"file":        c.log_file,
+			"access_file": c.access_log,
+			"max_size":    strconv.FormatInt(c.log_max_size, 10),
+			"max_age":     c.log_max_age.String(),
+			"keep":        c.log_keep,
+			"compress":    c.log_compress,
+
+			"syslog":          c.syslog_address,
+			"syslog_facility": c.syslog_facility,
+			"syslog_tag":      c.syslog_tag,
+		},
+		"proxy": map[string]any{
+			"trusted":  format_prefixes(c.trusted_proxies),
+			"protocol": c.proxy_protocol,
+		},
+		"geoip": map[string]any{
+			"asn":     c.geoip_asn_db,
+			"country": c.geoip_country_db,
+		},
+		"cors": map[string]any{
+			"origins": c.cors_origins,
+			"methods": c.cors_methods,
+			"headers": c.cors_headers,
+			"max_age": c.cors_max_age.String(),
+		},
+		"shutdown": map[string]any{
+			"drain_timeout": c.drain_timeout.String(),
+		},
+		"mesh": map[string]any{
+			"name":     c.node_name,
+			"push":     c.mesh_push,
+			"token":    redacted_secret(c.mesh_token),
+			"insecure": c.mesh_insecure,
+		},
+		"statsd": map[string]any{
+			"address":   c.statsd_address,
+			"prefix":    c.statsd_prefix,
+			"dogstatsd": c.dogstatsd,
+		},
+		"tracing": map[string]any{
+			"otlp": c.otlp_endpoint,
+		},
+		"admin": map[string]any{
+			"address":     c.admin_address,
+			"pprof":       c.admin_pprof,
+			"tokens_file": c.admin_tokens_file,
+		},
+		"grpc": map[string]any{
+			"address": c.grpc_address,
+		},
+	}
+	if(len(listeners) > 0) {
+		dump["listeners"] = listeners
+	}
+	if(len(peers) > 0) {
+		dump["peers"] = peers
+	}
+	if(len(c.webhooks) > 0) {
+		webhooks := []map[string]any{}
+		for _, w := range c.webhooks {
+			webhooks = append(webhooks, map[string]any{
+				"name":      w.name,
+				"url":       w.url.Redacted(),
+				"below":     strconv.FormatInt(w.below_bps, 10),
+				"direction": w.direction,
+				"insecure":  w.insecure,
+			})
+		}
+		dump["webhooks"] = webhooks
+	}
+	if(len(c.alerts) > 0) {
+		alerts := []map[string]any{}
+		for _, r := range c.alerts {
+			alerts = append(alerts, map[string]any{
+				"name":      r.name,
+				"direction": r.direction,
+				"stat":      r.stat,
+				"over":      r.window.String(),
+				"below":     strconv.FormatInt(r.below_bps, 10),
+				"above":     strconv.FormatInt(r.above_bps, 10),
+				"min_tests": r.min_tests,
+			})
+		}
+		dump["alerts"] = alerts
+	}
+	if(len(c.tenants) > 0) {
+		tenants := []map[string]any{}
+		for _, t := range c.tenants {
+			tenants = append(tenants, map[string]any{
+				"name":       t.name,
+				"tokens":     redacted_secrets(t.tokens),
+				"max_active": t.max_active,
+				"max_bytes":  strconv.FormatInt(t.max_bytes, 10),
+				"window":     t.window.String(),
+			})
+		}
+		dump["tenants"] = tenants
+	}
+	if(len(c.vhosts) > 0) {
+		vhosts := []map[string]any{}
+		for _, v := range c.vhosts {
+			vhosts = append(vhosts, map[string]any{
+				"hosts":             v.hosts,
+				"cert":              v.cert_file,
+				"key":               v.key_file,
+				"max_test_bytes":    strconv.FormatInt(v.max_test_bytes, 10),
+				"max_test_seconds":  v.max_test_duration.String(),
+				"max_active":        v.max_active,
+				"max_bytes":         strconv.FormatInt(v.max_bytes, 10),
+				"window":            v.window.String(),
+			})
+		}
+		dump["vhosts"] = vhosts
+	}
+	return dump
+}
+
+/*
+ * What the dump shows in place of a secret, so that it's plain there
+ * is one without giving it away.
+ */
+const redacted = "redacted"
+
+func redacted_secret(secret string) string {
+	if(secret == "") {
+		return ""
+	}
+	return redacted
+}
+
+func redacted_secrets(secrets []string) []string {
+	out := make([]string, len(secrets))
+	for i := range out {
+		out[i] = redacted
+	}
+	return out
+}
+
+/*
+ * Whether a change hands back a secret as the dump showed it, which
+ * would otherwise become the secret.
+ */
+func layout_has_redacted(f *config_file_layout) bool {
+	if(f.Mesh != nil && f.Mesh.Token != nil && *f.Mesh.Token == redacted) {
+		return true
+	}
+	for _, p := range f.Peers {
+		if(p.Token == redacted) {
+			return true
+		}
+	}
+	for _, t := range f.Tenants {
+		for _, token := range t.Tokens {
+			if(token == redacted) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * The JWT grants, in the layout of a -config file.
+ */
+func jwt_grant_dump(grants []jwt_grant) []map[string]any {
+	out := []map[string]any{}
+	for _, g := range grants {
+		grant := map[string]any{
+			"claim": g.claim,
+			"value": g.value,
+			"admin": g.admin,
+		}
+		if(g.max_bytes > 0) {
+			grant["max_test_bytes"] = strconv.FormatInt(g.max_bytes, 10)
+		}
+		out = append(out, grant)
+	}
+	return out
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Alert rules, evaluated against the results kept, so that gost can
+ * watch throughput rather than just measure it.  A rule in the config
+ * file takes a statistic of the throughput of completed tests in a
+ * direction over a window, such as the 95th percentile of downloads
+ * over the last hour, and fires when it's below or above a rate.  With
+ * fewer than min_tests results in the window there's no data, which
+ * isn't firing.  Rules are evaluated every alert_interval; each time
+ * one starts or stops firing, that's logged, published on /events, and
+ * sent to every webhook.  GET /alerts shows each rule's state.
+ */
+const alert_interval = 30 * time.Second
+
+type alert_rule struct {
+	name      string
+	direction string
+	stat      string
+	window    time.Duration
+	below_bps int64
+	above_bps int64
+	min_tests int
+}
+
+/*
+ * Where a rule stands.  Since is when it last changed state.
+ */
+type alert_state struct {
+	Name      string    `json:"name"`
+	Rule      string    `json:"rule"`
+	State     string    `json:"state"`
+	Mbps      float64   `json:"mbps"`
+	Tests     int       `json:"tests"`
+	Since     time.Time `json:"since"`
+	Evaluated time.Time `json:"evaluated"`
+}
+
+var alert_states = struct {
+	sync.Mutex
+	byname map[string]alert_state
+}{byname: map[string]alert_state{}}
+
+/*
+ * The statistics a rule can take: min, max, mean, median, or a
+ * percentile as p1 to p99.
+ */
+func valid_alert_stat(stat string) bool {
+	switch stat {
+	case "min", "max", "mean", "median":
+		return true
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(stat, "p"))
+	return strings.HasPrefix(stat, "p") && err == nil && n >= 1 && n <= 99
+}
+
+/*
+ * The rule in words, as /alerts shows it.
+ */
+func (r alert_rule) String() string {
+	what := "all tests"
+	if(r.direction != "") {
+		what = r.direction
+	}
+	text := fmt.Sprintf("%s of %s over %s", r.stat, what, r.window)
+	if(r.below_bps > 0) {
+		text += " below " + format_rate(r.below_bps)
+	}
+	if(r.above_bps > 0) {
+		text += " above " + format_rate(r.above_bps)
+	}
+	return text
+}
+
+/*
+ * The rule's statistic of rates, in Mbps.
+ */
+func (r alert_rule) measure(rates []float64) float64 {
+	switch r.stat {
+	case "min":
+		return slices.Min(rates)
+	case "max":
+		return slices.Max(rates)
+	case "mean":
+		sum := 0.0
+		for _, rate := range rates {
+			sum += rate
+		}
+		return sum / float64(len(rates))
+	case "median":
+		return percentile(rates, 0.5)
+	}
+	n, _ := strconv.Atoi(strings.TrimPrefix(r.stat, "p"))
+	return percentile(rates, float64(n) / 100)
+}
+
+/*
+ * Evaluate the rule against the results kept as of now.
+ */
+func (r alert_rule) evaluate(now time.Time) alert_state {
+	filter := result_filter{since: now.Add(-r.window), direction: r.direction}
+	results, _ := recent_results.page(filter, 0, settings().results_kept)
+	var rates []float64
+	for _, result := range results {
+		if(result.Outcome == "completed") {
+			rates = append(rates, result.Mbps)
+		}
+	}
+
+	state := alert_state{Name: r.name, Rule: r.String(), State: "no_data", Tests: len(rates), Evaluated: now.UTC()}
+	if(len(rates) < r.min_tests || len(rates) == 0) {
+		return state
+	}
+	state.Mbps = r.measure(rates)
+	state.State = "ok"
+	if((r.below_bps > 0 && state.Mbps * 1e6 < float64(r.below_bps)) || (r.above_bps > 0 && state.Mbps * 1e6 > float64(r.above_bps))) {
+		state.State = "firing"
+	}
+	return state
+}
+
+/*
+ * Evaluate every rule now, and announce the ones that started or
+ * stopped firing.
+ */
+func evaluate_alerts(now time.Time) {
+	rules := settings().alerts
+	alert_states.Lock()
+	defer alert_states.Unlock()
+
+	seen := map[string]bool{}
+	for _, r := range rules {
+		seen[r.name] = true
+		state := r.evaluate(now)
+		last, known := alert_states.byname[r.name]
+		state.Since = state.Evaluated
+		if(known && last.State == state.State && last.Rule == state.Rule) {
+			state.Since = last.Since
+		}
+		alert_states.byname[r.name] = state
+
+		was_firing := known && last.State == "firing"
+		if(was_firing == (state.State == "firing")) {
+			continue
+		}
+		if(state.State == "firing") {
+			log_fields(log_level_error, "alert firing", "alert", r.name, "rule", state.Rule, "mbps", state.Mbps, "tests", state.Tests)
+		} else {
+			log_fields(log_level_info, "alert resolved", "alert", r.name, "rule", state.Rule, "state", state.State)
+		}
+		publish_event("alert", state)
+		notify_webhooks_alert(state)
+	}
+
+	// Forget rules a reload took away.
+	for name := range alert_states.byname {
+		if(!seen[name]) {
+			delete(alert_states.byname, name)
+		}
+	}
+}
+
+func go_evaluate_alerts() {
+	go func() {
+		for now := range time.Tick(alert_interval) {
+			evaluate_alerts(now)
+		}
+	}()
+}
+
+/*
+ * GET: Every rule's state, by name.
+ */
+func route_alerts(res http.ResponseWriter, req *http.Request) {
+	if(req.Method != "GET" && req.Method != "HEAD" && req.Method != "") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+
+	alert_states.Lock()
+	states := []alert_state{}
+	for _, r := range settings().alerts {
+		state, ok := alert_states.byname[r.name]
+		if(!ok) {
+			state = alert_state{Name: r.name, Rule: r.String(), State: "pending"}
+		}
+		states = append(states, state)
+	}
+	alert_states.Unlock()
+	write_json(res, 200, states)
+}
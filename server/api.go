@@ -0,0 +1,132 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+ * A versioned JSON API under /api/v1/, for clients generated from its
+ * OpenAPI document at /api/v1/openapi.json.  Every response, errors
+ * included, is the same envelope: "data" on success, "error" with a
+ * code and message on failure, and the request's ID.  Lists of results
+ * come a page at a time, described by "page".
+ *
+ *	GET /api/v1/status         the server's status, as /status/
+ *	GET /api/v1/capabilities   what it supports, as /capabilities
+ *	GET /api/v1/tests          the tests running now
+ *	GET /api/v1/tests/{id}     one test, running or finished
+ *	GET /api/v1/results        recent results, filtered as /results
+ *	GET /api/v1/results/{id}   one result
+ *
+ * The older endpoints stay as they are.
+ */
+const api_prefix = "/api/v1/"
+
+//go:embed openapi.json
+var openapi_document []byte
+
+type api_envelope struct {
+	Data      any        `json:"data,omitempty"`
+	Error     *api_error `json:"error,omitempty"`
+	Page      *api_page  `json:"page,omitempty"`
+	RequestID string     `json:"request_id,omitempty"`
+}
+
+type api_error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type api_page struct {
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+/*
+ * A test by ID: running, with how far it's got, or finished, with its
+ * result.
+ */
+type api_test struct {
+	State    string       `json:"state"`
+	Progress *active_test `json:"progress,omitempty"`
+	Result   *test_result `json:"result,omitempty"`
+}
+
+func write_api(res http.ResponseWriter, req *http.Request, status int, data any, page *api_page) {
+	write_json(res, status, api_envelope{Data: data, Page: page, RequestID: request_id(req)})
+}
+
+func write_api_error(res http.ResponseWriter, req *http.Request, status int, code string, message string) {
+	write_json(res, status, api_envelope{Error: &api_error{code, message}, RequestID: request_id(req)})
+}
+
+/*
+ * Dispatch /api/v1/*.
+ */
+func route_api(res http.ResponseWriter, req *http.Request) {
+	if(req.Method != "GET" && req.Method != "HEAD" && req.Method != "") {
+		res.Header().Set("Allow", "GET, HEAD")
+		write_api_error(res, req, 405, "method_not_allowed", "Method Not Allowed")
+		return
+	}
+
+	rest := strings.TrimPrefix(req.URL.Path, api_prefix)
+	collection, id, _ := strings.Cut(rest, "/")
+	switch {
+	case rest == "openapi.json":
+		res.Header().Set("Content-Type", "application/json")
+		res.Write(openapi_document)
+	case rest == "status":
+		report := current_status(req)
+		status := 200
+		if(report.Status != "healthy") {
+			status = 503 // Service Unavailable
+		}
+		write_api(res, req, status, report, nil)
+	case rest == "capabilities":
+		write_api(res, req, 200, current_capabilities(req), nil)
+	case rest == "tests":
+		write_api(res, req, 200, running_tests(), nil)
+	case collection == "tests" && id != "":
+		api_test_by_id(res, req, id)
+	case rest == "results":
+		page, err := query_results(req)
+		if(err != nil) {
+			write_api_error(res, req, 400, "bad_request", err.Error())
+			return
+		}
+		write_api(res, req, 200, page.Results, &api_page{page.Total, page.Offset, page.Limit})
+	case collection == "results" && id != "":
+		result, ok := find_result(req, id)
+		if(!ok) {
+			write_api_error(res, req, 404, "not_found", "No such result")
+			return
+		}
+		write_api(res, req, 200, result, nil)
+	default:
+		write_api_error(res, req, 404, "not_found", "Not Found")
+	}
+}
+
+/*
+ * GET /api/v1/tests/{id}.
+ */
+func api_test_by_id(res http.ResponseWriter, req *http.Request, id string) {
+	v, running := active_runs.Load(id)
+	if(running) {
+		t := v.(*test_run)
+		progress := t.report(time.Now())
+		write_api(res, req, 200, api_test{State: "running", Progress: &progress}, nil)
+		return
+	}
+	result, ok := find_result(req, id)
+	if(!ok) {
+		write_api_error(res, req, 404, "not_found", "No such test")
+		return
+	}
+	write_api(res, req, 200, api_test{State: result.Outcome, Result: &result}, nil)
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * A test for links whose downstream collapses when the upstream is
+ * full, as DOCSIS and ADSL links do: the acknowledgements for a
+ * download queue behind the upload, and the download starves for
+ * them.  /asym runs over a WebSocket, in three phases of ?rounds=
+ * rounds each, every round moving a burst of ?burst= bytes:
+ *
+ *	down    gost sends {"phase":"down","round":i,"bytes":n} and n bytes
+ *	        of payload; the client answers with a small text ack,
+ *	        {"round":i,"ms":...}, the milliseconds it took to receive
+ *	        them
+ *	up      gost sends {"phase":"up","round":i,"bytes":n}; the client
+ *	        sends n bytes and gost acks them the same way
+ *	loaded  gost sends {"phase":"load"}, and the client floods binary
+ *	        messages upstream until the test's over; after
+ *	        asym_warmup, the down rounds are run again under the flood
+ *
+ * Each round's throughput is taken from when gost starts sending, or
+ * asks, to when it has the ack, or the last byte.  The skew is how much
+ * longer a down round took as gost saw it than as the client did: the
+ * time the ack took to come back.  Finally gost sends
+ * {"result": {...}}, the report, and closes.  A download that's half
+ * as fast, or worse, once the upstream is loaded is a collapse.
+ */
+const (
+	asym_default_rounds = 10
+	asym_max_rounds     = 100
+	asym_default_burst  = 256 * 1024
+	asym_max_burst      = 4 << 20
+	asym_flood_message  = 64 * 1024
+	asym_warmup         = time.Second
+	asym_collapse_pct   = 50
+)
+
+/*
+ * One phase's rounds: the median throughput of a round and, for the
+ * downstream phases, of the skew.  With a flood, the rate it got
+ * upstream meanwhile.
+ */
+type asym_phase struct {
+	Rounds    int     `json:"rounds"`
+	Mbps      float64 `json:"mbps"`
+	SkewMs    float64 `json:"skew_ms,omitempty"`
+	FloodMbps float64 `json:"flood_mbps,omitempty"`
+}
+
+type asym_report struct {
+	BurstBytes   int64      `json:"burst_bytes"`
+	Down         asym_phase `json:"down"`
+	Up           asym_phase `json:"up"`
+	Loaded       asym_phase `json:"loaded"`
+	CollapsePct  float64    `json:"collapse_pct"`
+	SkewGrowthMs float64    `json:"skew_growth_ms"`
+	Verdict      string     `json:"verdict"`
+}
+
+type asym_control struct {
+	Phase string `json:"phase"`
+	Round int    `json:"round"`
+	Bytes int64  `json:"bytes,omitempty"`
+}
+
+type asym_ack struct {
+	Round int     `json:"round"`
+	Ms    float64 `json:"ms"`
+}
+
+/*
+ * Work out the collapse, the skew's growth, and the verdict.
+ */
+func (r *asym_report) judge() {
+	if(r.Down.Mbps > 0) {
+		r.CollapsePct = max(0, 100 * (1 - r.Loaded.Mbps / r.Down.Mbps))
+	}
+	r.SkewGrowthMs = r.Loaded.SkewMs - r.Down.SkewMs
+	r.Verdict = "ok"
+	if(r.CollapsePct >= asym_collapse_pct) {
+		r.Verdict = "collapse"
+	}
+}
+
+/*
+ * The client's side of the connection, as the reader sees it: acks,
+ * uploaded bursts, and bytes flooded while loading.
+ */
+type asym_inbox struct {
+	acks    chan asym_ack
+	bursts  chan int
+	closed  chan error
+	done    chan struct{}
+	loading atomic.Bool
+	flooded atomic.Int64
+}
+
+func new_asym_inbox() *asym_inbox {
+	return &asym_inbox{
+		acks:   make(chan asym_ack),
+		bursts: make(chan int),
+		closed: make(chan error, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+/*
+ * Read what the client sends until it closes or the test's done.
+ */
+func (in *asym_inbox) read(ws *ws_conn) {
+	for {
+		opcode, message, err := ws.read_message()
+		if(err == nil && opcode == ws_op_text) {
+			var ack asym_ack
+			err = json.Unmarshal(message, &ack)
+			if(err == nil) {
+				select {
+				case in.acks <- ack:
+				case <-in.done:
+					return
+				}
+				continue
+			}
+			err = errors.New("bad ack: " + err.Error())
+		}
+		if(err != nil) {
+			in.closed <- err
+			return
+		}
+		if(in.loading.Load()) {
+			in.flooded.Add(int64(len(message)))
+			continue
+		}
+		select {
+		case in.bursts <- len(message):
+		case <-in.done:
+			return
+		}
+	}
+}
+
+func (in *asym_inbox) ack(round int) (asym_ack, error) {
+	select {
+	case ack := <-in.acks:
+		if(ack.Round != round) {
+			return ack, fmt.Errorf("ack for round %d in round %d", ack.Round, round)
+		}
+		return ack, nil
+	case err := <-in.closed:
+		return asym_ack{}, err
+	}
+}
+
+func (in *asym_inbox) burst(size int64) error {
+	select {
+	case n := <-in.bursts:
+		if(int64(n) != size) {
+			return fmt.Errorf("sent %d bytes, not %d", n, size)
+		}
+		return nil
+	case err := <-in.closed:
+		return err
+	}
+}
+
+/*
+ * Run downstream rounds: the median round throughput and skew.
+ */
+func asym_down_rounds(ws *ws_conn, t *test_run, in *asym_inbox, phase string, rounds int, burst int64) (asym_phase, error) {
+	var rates, skews []float64
+	for i := 0; i < rounds; i++ {
+		control, _ := json.Marshal(asym_control{Phase: phase, Round: i, Bytes: burst})
+		start := time.Now()
+		err := ws.write_message(ws_op_text, control)
+		if(err == nil) {
+			_, err = ws.write_payload_message(t.writer(ws.conn), burst)
+		}
+		var ack asym_ack
+		if(err == nil) {
+			ack, err = in.ack(i)
+		}
+		if(err != nil) {
+			return asym_phase{}, err
+		}
+		took := time.Since(start)
+		rates = append(rates, mbps(burst, took))
+		skews = append(skews, max(0, float64(took.Microseconds()) / 1000 - ack.Ms))
+	}
+	return asym_phase{Rounds: rounds, Mbps: percentile(rates, 0.5), SkewMs: percentile(skews, 0.5)}, nil
+}
+
+/*
+ * Run upstream rounds, acking each burst.
+ */
+func asym_up_rounds(ws *ws_conn, in *asym_inbox, rounds int, burst int64) (asym_phase, error) {
+	var rates []float64
+	for i := 0; i < rounds; i++ {
+		control, _ := json.Marshal(asym_control{Phase: "up", Round: i, Bytes: burst})
+		start := time.Now()
+		err := ws.write_message(ws_op_text, control)
+		if(err == nil) {
+			err = in.burst(burst)
+		}
+		took := time.Since(start)
+		if(err == nil) {
+			ack, _ := json.Marshal(asym_ack{Round: i, Ms: float64(took.Microseconds()) / 1000})
+			err = ws.write_message(ws_op_text, ack)
+		}
+		if(err != nil) {
+			return asym_phase{}, err
+		}
+		rates = append(rates, mbps(burst, took))
+	}
+	return asym_phase{Rounds: rounds, Mbps: percentile(rates, 0.5)}, nil
+}
+
+/*
+ * GET: Upgrade to a WebSocket and run the asymmetry test.
+ */
+func route_asym(res http.ResponseWriter, req *http.Request) {
+	c := request_settings(req)
+	rounds, err := query_int(req, "rounds", asym_default_rounds)
+	if(err == nil && (rounds < 1 || rounds > asym_max_rounds)) {
+		err = fmt.Errorf("rounds must be between 1 and %d", asym_max_rounds)
+	}
+	burst := int64(asym_default_burst)
+	if(err == nil && req.URL.Query().Get("burst") != "") {
+		burst, err = parse_size(req.URL.Query().Get("burst"))
+		if(err == nil && (burst < 1 || burst > asym_max_burst)) {
+			err = errors.New("burst must be between 1 byte and 4M")
+		}
+	}
+	if(err == nil && 3 * int64(rounds) * burst > c.max_test_bytes) {
+		err = errors.New("three phases of rounds of burst bytes are more than the largest test allows")
+	}
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	t := begin_test(res, req, "asym", 3 * int64(rounds) * burst)
+	if(t == nil) {
+		return
+	}
+	ws, err := ws_upgrade(res, req, nil)
+	if(err != nil) {
+		log_request(req, log_level_debug, "asym upgrade failed", "remote", req.RemoteAddr, "error", err)
+		t.end(0, err)
+		return
+	}
+	defer ws.conn.Close()
+	ws.max_message = max(burst, asym_flood_message)
+	ws.conn.SetDeadline(t.start.Add(c.max_test_duration))
+
+	// Uploads count towards the test as they're read.
+	ws.rw = bufio.NewReadWriter(bufio.NewReader(t.reader(ws.rw.Reader)), ws.rw.Writer)
+	in := new_asym_inbox()
+	defer close(in.done)
+	go in.read(ws)
+
+	report := asym_report{BurstBytes: burst}
+	report.Down, err = asym_down_rounds(ws, t, in, "down", rounds, burst)
+	if(err == nil) {
+		report.Up, err = asym_up_rounds(ws, in, rounds, burst)
+	}
+	if(err == nil) {
+		in.loading.Store(true)
+		load, _ := json.Marshal(asym_control{Phase: "load"})
+		err = ws.write_message(ws_op_text, load)
+	}
+	if(err == nil) {
+		loaded := time.Now()
+		time.Sleep(asym_warmup)
+		report.Loaded, err = asym_down_rounds(ws, t, in, "loaded", rounds, burst)
+		report.Loaded.FloodMbps = mbps(in.flooded.Load(), time.Since(loaded))
+	}
+
+	if(err == nil) {
+		report.judge()
+		t.asym = &report
+		message, _ := json.Marshal(map[string]any{"result": report})
+		err = ws.write_message(ws_op_text, message)
+		ws.close(ws_close_normal, "")
+	}
+	t.end(t.moved.Load(), err)
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Optional authentication for the endpoints that consume bandwidth.
+ * Tokens live one per line in a file (blank lines and # comments are
+ * ignored), which is watched and re-read when it changes.  A client
+ * presents either
+ *
+ *	Authorization: Bearer <token>
+ *
+ * or a signed URL, carrying ?expires=<unix seconds>&sig=<hex>, where
+ * sig is the HMAC-SHA256, keyed with a token, of the path, a "?", and
+ * the rest of the query in url.Values.Encode() order.  Signed URLs let
+ * a server hand out one-off links without revealing a token.
+ */
+const auth_poll_interval = 5 * time.Second
+
+/*
+ * A token file being watched, and the last good set of tokens in it.
+ */
+type token_file struct {
+	tokens   atomic.Pointer[[]string]
+	mu       sync.Mutex
+	path     string
+	modified time.Time
+	size     int64
+}
+
+var auth_tokens token_file
+
+/*
+ * The admin API's own tokens, from -admin-tokens, which the tests'
+ * tokens never stand in for.
+ */
+var admin_tokens token_file
+
+var auth_watching sync.Once
+
+/*
+ * Read a token file.
+ */
+func read_tokens(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if(err != nil) {
+		return nil, err
+	}
+
+	tokens := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if(line == "" || strings.HasPrefix(line, "#")) {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	return tokens, scanner.Err()
+}
+
+/*
+ * Load the configured token files if they're new or have changed.
+ * With no token file configured, authentication is off; with no admin
+ * token file, admin tokens are.
+ */
+func refresh_tokens() error {
+	c := settings()
+	err := auth_tokens.refresh(c.auth_tokens_file, "tokens")
+	if(err != nil) {
+		return err
+	}
+	return admin_tokens.refresh(c.admin_tokens_file, "admin tokens")
+}
+
+/*
+ * Load the token file at path, named what in the log, if it's new or
+ * has changed since last time.
+ */
+func (f *token_file) refresh(path string, what string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if(path == "") {
+		f.tokens.Store(nil)
+		f.path = ""
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if(err != nil) {
+		return err
+	}
+	if(path == f.path && info.ModTime().Equal(f.modified) && info.Size() == f.size) {
+		return nil
+	}
+
+	tokens, err := read_tokens(path)
+	if(err != nil) {
+		return err
+	}
+
+	f.tokens.Store(&tokens)
+	f.path = path
+	f.modified = info.ModTime()
+	f.size = info.Size()
+	log_at(log_level_info, "Loaded %d %s from %s", len(tokens), what, path)
+	return nil
+}
+
+/*
+ * The tokens in force, or nil if there's no token file.
+ */
+func (f *token_file) current() *[]string {
+	return f.tokens.Load()
+}
+
+/*
+ * Load the token files now and keep an eye on them.  A file that goes
+ * bad keeps the last good set of tokens in force.
+ */
+func go_watch_tokens() error {
+	err := refresh_tokens()
+	if(err != nil) {
+		return err
+	}
+
+	auth_watching.Do(func() {
+		go func() {
+			for range time.Tick(auth_poll_interval) {
+				err := refresh_tokens()
+				if(err != nil) {
+					log_at(log_level_error, "Can't reload tokens, keeping the old ones: %v", err)
+				}
+			}
+		}()
+	})
+	return nil
+}
+
+/*
+ * Does the request carry a valid bearer token?
+ */
+func bearer_ok(req *http.Request, tokens []string) bool {
+	header := req.Header.Get("Authorization")
+	if(len(header) < 7 || !strings.EqualFold(header[:7], "bearer ")) {
+		return false
+	}
+	presented := []byte(strings.TrimSpace(header[7:]))
+
+	for _, token := range tokens {
+		if(subtle.ConstantTimeCompare(presented, []byte(token)) == 1) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * The signature a URL should carry under one token.
+ */
+func url_signature(token string, path string, query string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	io.WriteString(mac, path + "?" + query)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+ * Does the request carry a valid, unexpired URL signature?
+ */
+func signature_ok(req *http.Request, tokens []string) bool {
+	query := req.URL.Query()
+	sig, err := hex.DecodeString(query.Get("sig"))
+	if(err != nil || len(sig) == 0) {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if(err != nil || time.Now().Unix() > expires) {
+		return false
+	}
+
+	query.Del("sig")
+	signed := query.Encode()
+	for _, token := range tokens {
+		want, _ := hex.DecodeString(url_signature(token, req.URL.Path, signed))
+		if(hmac.Equal(sig, want)) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Wrap a handler so that it's only reachable with a valid token, a
+ * tenant's token, a signed URL, a client certificate from the client
+ * CA, or with -jwt-tests a JWT, when any of those are on.
+ */
+func require_auth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		c := settings()
+		req = with_request_jwt(req)
+		tokens := auth_tokens.current()
+		client_ca := c.tls_client_ca != ""
+		jwt := c.jwt_enabled() && c.jwt_tests
+		if(tokens == nil && !client_ca && len(c.tenants) == 0 && !jwt) {
+			handler(res, req)
+			return
+		}
+		if(jwt && jwt_decides(handler, res, req, c, false)) {
+			return
+		}
+		if((client_ca && client_certificate_ok(req)) ||
+			(tokens != nil && (bearer_ok(req, *tokens) || signature_ok(req, *tokens))) ||
+			request_tenant(req) != "") {
+			handler(res, req)
+			return
+		}
+		refuse_unauthorized(res, req)
+	}
+}
+
+/*
+ * Wrap a handler for the operator alone: it takes a token from
+ * -admin-tokens, as a bearer token or a signed URL, or a JWT granted
+ * admin.  The tests' tokens, tenants' tokens and client certificates
+ * never will do.  A server with none of those open to the tests
+ * leaves the admin API open too, on its own listener, but one that
+ * locks up its tests and has no admin credentials turns it away.
+ */
+func require_admin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		c := settings()
+		req = with_request_jwt(req)
+		tokens := admin_tokens.current()
+		jwt := c.jwt_enabled()
+		if(tokens == nil && !jwt) {
+			if(auth_tokens.current() == nil && c.tls_client_ca == "" && len(c.tenants) == 0) {
+				handler(res, req)
+				return
+			}
+			log_request(req, log_level_info, "forbidden without admin credentials", "path", req.URL.Path, "remote", req.RemoteAddr)
+			res.WriteHeader(403) // Forbidden
+			io.WriteString(res, "The admin API needs -admin-tokens or -jwt-issuer")
+			return
+		}
+		if(jwt && jwt_decides(handler, res, req, c, true)) {
+			return
+		}
+		if(tokens != nil && (bearer_ok(req, *tokens) || signature_ok(req, *tokens))) {
+			handler(res, req)
+			return
+		}
+		refuse_unauthorized(res, req)
+	}
+}
+
+/*
+ * Settle a request by its JWT, if it carries a valid one: go on to
+ * handler if its grants allow the tests, or with admin the admin API,
+ * or answer 403.  Reports whether it did either; if not, the request
+ * is left for the other credentials to decide.
+ */
+func jwt_decides(handler http.HandlerFunc, res http.ResponseWriter, req *http.Request, c *configuration, admin bool) bool {
+	claims, err := request_jwt(req)
+	if(err != nil) {
+		metric_jwt_checks.add("rejected", 1)
+		log_request(req, log_level_info, "JWT rejected", "path", req.URL.Path, "remote", req.RemoteAddr, "error", err)
+	}
+	if(claims == nil) {
+		return false
+	}
+	access := c.jwt_access(claims)
+	if(access.any && (access.admin || !admin)) {
+		metric_jwt_checks.add("accepted", 1)
+		handler(res, req)
+		return true
+	}
+	metric_jwt_checks.add("forbidden", 1)
+	log_request(req, log_level_info, "forbidden", "path", req.URL.Path, "remote", req.RemoteAddr, "subject", claims["sub"])
+	res.WriteHeader(403) // Forbidden
+	io.WriteString(res, "Forbidden")
+	return true
+}
+
+/*
+ * Answer 401, asking for a bearer token.
+ */
+func refuse_unauthorized(res http.ResponseWriter, req *http.Request) {
+	log_request(req, log_level_info, "unauthorized", "path", req.URL.Path, "remote", req.RemoteAddr)
+	res.Header().Set("WWW-Authenticate", `Bearer realm="gost"`)
+	res.WriteHeader(401) // Unauthorized
+	io.WriteString(res, "Unauthorized")
+}
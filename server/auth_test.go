@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	t.Cleanup(func() {
+		live_config.Store(nil)
+		auth_tokens.tokens.Store(nil)
+		admin_tokens.tokens.Store(nil)
+	})
+	ok := require_admin(func(res http.ResponseWriter, req *http.Request) {})
+
+	tests := []struct {
+		name   string
+		tokens []string
+		admin  []string
+		ca     bool
+		bearer string
+		status int
+	}{
+		{"nothing locked", nil, nil, false, "", 200},
+		{"test tokens alone", []string{"test"}, nil, false, "test", 403},
+		{"test tokens alone, no token", []string{"test"}, nil, false, "", 403},
+		{"client CA alone", nil, nil, true, "", 403},
+		{"admin token", []string{"test"}, []string{"admin"}, false, "admin", 200},
+		{"test token with admin tokens", []string{"test"}, []string{"admin"}, false, "test", 401},
+		{"no token with admin tokens", []string{"test"}, []string{"admin"}, false, "", 401},
+		{"admin tokens alone", nil, []string{"admin"}, false, "admin", 200},
+		{"admin tokens alone, no token", nil, []string{"admin"}, false, "", 401},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := defaults
+			if(test.ca) {
+				c.tls_client_ca = "ca.pem"
+			}
+			live_config.Store(&c)
+			auth_tokens.tokens.Store(nil)
+			if(test.tokens != nil) {
+				auth_tokens.tokens.Store(&test.tokens)
+			}
+			admin_tokens.tokens.Store(nil)
+			if(test.admin != nil) {
+				admin_tokens.tokens.Store(&test.admin)
+			}
+
+			req := httptest.NewRequest("GET", "/admin/tests", nil)
+			if(test.bearer != "") {
+				req.Header.Set("Authorization", "Bearer " + test.bearer)
+			}
+			res := httptest.NewRecorder()
+			ok(res, req)
+			if(res.Code != test.status) {
+				t.Fatalf("status %d, want %d", res.Code, test.status)
+			}
+		})
+	}
+}
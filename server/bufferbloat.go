@@ -0,0 +1,139 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+ * Latency under load, the bufferbloat figure.  Pings carrying the
+ * ?test_id= of a test measure its latency: those arriving before the
+ * test starts measure the idle latency, and those arriving while it
+ * runs the loaded latency.  Each is the gap since the previous ping on
+ * the same connection, as with ?count=, so the pings need a keep-alive
+ * connection of their own with one ping in flight at a time.  When the
+ * test ends its result gets the median of each, the increase, and a
+ * grade, from A+ for under 5ms added down to F for 400ms or more.
+ */
+const bufferbloat_expiry = 10 * time.Minute
+const bufferbloat_max_gap = 5 * time.Second
+const bufferbloat_max_samples = 10000
+const bufferbloat_max_probes = 10000
+
+type latency_probe struct {
+	mu     sync.Mutex
+	idle   []float64
+	loaded []float64
+	last   map[uint64]int64
+	expiry *time.Timer
+}
+
+var latency_probes = struct {
+	sync.Mutex
+	byid map[string]*latency_probe
+}{byid: map[string]*latency_probe{}}
+
+type bufferbloat_report struct {
+	IdleMs      float64 `json:"idle_ms"`
+	LoadedMs    float64 `json:"loaded_ms"`
+	IncreaseMs  float64 `json:"increase_ms"`
+	Grade       string  `json:"grade"`
+	IdlePings   int     `json:"idle_pings"`
+	LoadedPings int     `json:"loaded_pings"`
+}
+
+var bufferbloat_grades = []struct {
+	below float64
+	grade string
+}{
+	{5, "A+"},
+	{30, "A"},
+	{60, "B"},
+	{200, "C"},
+	{400, "D"},
+}
+
+/*
+ * Count a ping that arrived at now over connection conn towards test
+ * id's latency.
+ */
+func note_test_ping(id string, conn uint64, now int64) {
+	latency_probes.Lock()
+	p, ok := latency_probes.byid[id]
+	if(!ok) {
+		if(len(latency_probes.byid) >= bufferbloat_max_probes) {
+			latency_probes.Unlock()
+			return
+		}
+		p = &latency_probe{last: map[uint64]int64{}}
+		p.expiry = time.AfterFunc(bufferbloat_expiry, func() {
+			latency_probes.Lock()
+			delete(latency_probes.byid, id)
+			latency_probes.Unlock()
+		})
+		latency_probes.byid[id] = p
+	}
+	latency_probes.Unlock()
+
+	_, running := active_runs.Load(id)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	last, seen := p.last[conn]
+	p.last[conn] = now
+	p.expiry.Reset(bufferbloat_expiry)
+
+	gap := time.Duration(now - last)
+	if(!seen || gap > bufferbloat_max_gap || len(p.idle) + len(p.loaded) >= bufferbloat_max_samples) {
+		return
+	}
+	ms := float64(gap) / float64(time.Millisecond)
+	if(running) {
+		p.loaded = append(p.loaded, ms)
+	} else {
+		p.idle = append(p.idle, ms)
+	}
+}
+
+/*
+ * The bufferbloat report for test id, which is then forgotten, or nil
+ * if there weren't pings both before and during it.
+ */
+func take_bufferbloat(id string) *bufferbloat_report {
+	latency_probes.Lock()
+	p, ok := latency_probes.byid[id]
+	delete(latency_probes.byid, id)
+	latency_probes.Unlock()
+	if(!ok) {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expiry.Stop()
+	if(len(p.idle) == 0 || len(p.loaded) == 0) {
+		return nil
+	}
+
+	round := func(ms float64) float64 {
+		return math.Round(ms * 100) / 100
+	}
+	idle := percentile(p.idle, 0.5)
+	loaded := percentile(p.loaded, 0.5)
+	r := &bufferbloat_report{
+		IdleMs:      round(idle),
+		LoadedMs:    round(loaded),
+		IncreaseMs:  round(max(loaded - idle, 0)),
+		Grade:       "F",
+		IdlePings:   len(p.idle),
+		LoadedPings: len(p.loaded),
+	}
+	for _, g := range bufferbloat_grades {
+		if(r.IncreaseMs < g.below) {
+			r.Grade = g.grade
+			break
+		}
+	}
+	return r
+}
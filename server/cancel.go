@@ -0,0 +1,141 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * DELETE /tests/{id} lets a client stop its own test, when its user
+ * gives up on it or it was started by mistake, rather than leave it
+ * running until the server notices the connection has gone.  The test
+ * is cancelled: its slot and quota are given back at once, so the
+ * client may start another, and it ends, aborted with "test
+ * cancelled", as soon as the read or write it's in fails.  The answer
+ * is the partial result, or, if the test hasn't ended within
+ * cancel_wait, 202 and how far it had got.  Only the client that
+ * started the test, from the same address and as the same tenant, may
+ * cancel it; /admin/tests/{id} cancels anyone's.
+ */
+const tests_prefix = "/tests/"
+
+const cancel_wait = 5 * time.Second
+
+func route_test_cancel(res http.ResponseWriter, req *http.Request) {
+	if(req.Method != "DELETE") {
+		res.Header().Set("Allow", "DELETE")
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, tests_prefix)
+	v, running := active_runs.Load(id)
+	if(!running) {
+		cancel_grouped_test(res, req, id)
+		return
+	}
+	t := v.(*test_run)
+	if(t.client_ip != client_ip(req) || t.tenant != request_tenant(req)) {
+		// As good as not there, so IDs can't be probed for.
+		res.WriteHeader(404)
+		io.WriteString(res, "No such test")
+		return
+	}
+
+	t.cancel()
+	log_request(req, log_level_info, "test cancelled by client", "test", t.id, "remote", client_ip(req))
+	select {
+	case <-t.done:
+		write_json(res, 200, t.result)
+	case <-time.After(cancel_wait):
+		write_json(res, 202, t.report(time.Now())) // Accepted
+	case <-req.Context().Done():
+	}
+}
+
+/*
+ * Tests of several transfers, multi-stream and duplex ones, aren't a
+ * single test_run, so they're found by the ID they hand out here
+ * instead.  Cancelling one gives back the slots of the transfers
+ * running, interrupts them, and keeps the rest from starting; it ends,
+ * aborted with "test cancelled", once the running ones have noticed.
+ */
+type grouped_test interface {
+	owned_by(client string, tenant string) bool
+	cancel()
+	concluded() <-chan struct{}
+	final() *test_result
+	so_far() any
+}
+
+var grouped_tests sync.Map
+
+func cancel_grouped_test(res http.ResponseWriter, req *http.Request, id string) {
+	v, running := grouped_tests.Load(id)
+	if(!running || !v.(grouped_test).owned_by(client_ip(req), request_tenant(req))) {
+		res.WriteHeader(404)
+		io.WriteString(res, "No such test")
+		return
+	}
+	g := v.(grouped_test)
+
+	g.cancel()
+	log_request(req, log_level_info, "test cancelled by client", "test", id, "remote", client_ip(req))
+	select {
+	case <-g.concluded():
+		write_json(res, 200, g.final())
+	case <-time.After(cancel_wait):
+		write_json(res, 202, g.so_far()) // Accepted
+	case <-req.Context().Done():
+	}
+}
+
+/*
+ * One transfer of a grouped test, holding a slot of its own.  Guarded
+ * by its test's mutex.
+ */
+type grouped_part struct {
+	interrupt func()
+	moved     atomic.Int64
+	released  bool
+	charged   int64
+}
+
+/*
+ * Note that the part is running as req's handler.
+ */
+func (p *grouped_part) begin(res http.ResponseWriter, req *http.Request) {
+	p.interrupt = interrupter(res, req)
+}
+
+/*
+ * Give back a running part's slot now, and interrupt it.
+ */
+func (p *grouped_part) cancel(client string, tenant string, vhost string) {
+	if(p.released) {
+		return
+	}
+	p.interrupt()
+	p.released = true
+	p.charged = p.moved.Load()
+	release_test(client, tenant, vhost, p.charged)
+}
+
+/*
+ * Count the part as finished after moving n bytes, giving back its slot
+ * if cancelling hasn't already.
+ */
+func (p *grouped_part) end(client string, tenant string, vhost string, n int64, err error) {
+	if(p.released) {
+		charge_test(client, tenant, vhost, n - p.charged)
+		count_end(err)
+		return
+	}
+	p.released = true
+	track_end(client, tenant, vhost, n, err)
+}
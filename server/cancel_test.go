@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCancelTest(t *testing.T) {
+	const owner = "192.0.2.1"
+	interrupted := errors.New("i/o timeout")
+
+	tests := []struct {
+		name    string
+		before  int64
+		after   int64
+		cancels int
+		method  string
+		from    string
+		status  int
+		outcome string
+	}{
+		{"finished", 1000, 0, 0, "", "", 0, "completed"},
+		{"cancelled", 1000, 0, 1, "", "", 0, "aborted"},
+		{"cancelled with more in flight", 600, 400, 1, "", "", 0, "aborted"},
+		{"cancelled twice", 600, 400, 2, "", "", 0, "aborted"},
+		{"cancelled by its client", 600, 400, 0, "DELETE", owner, 200, "aborted"},
+		{"by another client", 1000, 0, 0, "DELETE", "192.0.2.2", 404, "completed"},
+		{"by GET", 1000, 0, 0, "GET", owner, 405, "completed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := defaults
+			admitting(t, c, 0)
+			completed, aborted := test_tracker.completed.Load(), test_tracker.aborted.Load()
+
+			reason, _ := reserve_test(owner, "", "")
+			if(reason != "") {
+				t.Fatalf("refused: %s", reason)
+			}
+			run := new_test_run(context.Background(), "", "", "up", owner, "HTTP/1.1", 0)
+			run.moved.Add(test.before)
+			ended := make(chan test_result, 1)
+			end := func() {
+				run.moved.Add(test.after)
+				var err error
+				if(run.cancelled.Load()) {
+					err = interrupted
+				}
+				ended <- run.end(test.before + test.after, err)
+			}
+
+			for range test.cancels {
+				run.cancel()
+			}
+			if(test.cancels > 0 && test_tracker.active.Load() != 0) {
+				t.Fatalf("cancelled, and %d tests still hold slots", test_tracker.active.Load())
+			}
+			if(test.method != "") {
+				go func() {
+					<-run.ctx.Done()
+					if(run.cancelled.Load()) {
+						end()
+					}
+				}()
+				req := httptest.NewRequest(test.method, tests_prefix + run.id, nil)
+				req.RemoteAddr = test.from + ":1234"
+				res := httptest.NewRecorder()
+				route_test_cancel(res, req)
+				if(res.Code != test.status) {
+					t.Fatalf("status %d, want %d", res.Code, test.status)
+				}
+			}
+			if(test.method == "" || !run.cancelled.Load()) {
+				end()
+			}
+
+			var result test_result
+			select {
+			case result = <-ended:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the test never ended")
+			}
+			if(result.Outcome != test.outcome) {
+				t.Fatalf("outcome %s, want %s", result.Outcome, test.outcome)
+			}
+			if(test.outcome == "aborted" && result.Error != test_cancelled.Error()) {
+				t.Fatalf("error %q, want %q", result.Error, test_cancelled.Error())
+			}
+			if(result.Bytes != test.before + test.after) {
+				t.Fatalf("%d bytes, want %d", result.Bytes, test.before + test.after)
+			}
+
+			if(test_tracker.active.Load() != 0) {
+				t.Fatalf("%d tests still hold slots", test_tracker.active.Load())
+			}
+			length, slot := quota_slot(time.Now(), c.ip_window)
+			client_quotas.Lock()
+			u := client_quotas.byip[owner]
+			active := u.active
+			used, _ := u.window_bytes(slot, length, time.Now())
+			client_quotas.Unlock()
+			if(active != 0 || used != test.before + test.after) {
+				t.Fatalf("client has %d running and %d bytes used, want none running and %d", active, used, test.before + test.after)
+			}
+
+			want_completed, want_aborted := completed, aborted
+			if(test.outcome == "completed") {
+				want_completed++
+			} else {
+				want_aborted++
+			}
+			if(test_tracker.completed.Load() != want_completed || test_tracker.aborted.Load() != want_aborted) {
+				t.Fatalf("%d completed and %d aborted, want %d and %d", test_tracker.completed.Load(), test_tracker.aborted.Load(), want_completed, want_aborted)
+			}
+			_, running := active_runs.Load(run.id)
+			if(running) {
+				t.Fatal("the test is still listed as running")
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"runtime"
+)
+
+/*
+ * GET /capabilities says what this server supports, so that clients
+ * meeting many gost servers of different versions and configurations
+ * can find out what each one offers rather than guess: the protocols it
+ * speaks, the largest tests it allows on the host it was asked of, how
+ * it authenticates, and which of the optional tests and features are
+ * on.  It's open, like /status/, and so says nothing of tokens
+ * themselves.  The same report is at /api/v1/capabilities, in the
+ * API's envelope.
+ */
+const capabilities_api_version = "v1"
+
+type capabilities_limits struct {
+	MaxTestBytes   int64   `json:"max_test_bytes"`
+	MaxTestSeconds float64 `json:"max_test_seconds"`
+	MaxStreams     int     `json:"max_streams"`
+	MaxActiveTests int     `json:"max_active_tests,omitempty"`
+	IPMaxActive    int     `json:"ip_max_active,omitempty"`
+	IPMaxBytes     int64   `json:"ip_max_bytes,omitempty"`
+	MaxUploadBytes int64   `json:"max_connection_upload_bytes,omitempty"`
+	MaxProfiles    int     `json:"max_profiles"`
+}
+
+type capabilities_auth struct {
+	Required bool     `json:"required"`
+	Methods  []string `json:"methods"`
+}
+
+type capabilities_report struct {
+	APIVersion string              `json:"api_version"`
+	Version    string              `json:"version"`
+	Node       string              `json:"node,omitempty"`
+	Protocols  map[string]bool     `json:"protocols"`
+	Ports      map[string]int      `json:"ports,omitempty"`
+	Limits     capabilities_limits `json:"limits"`
+	Auth       capabilities_auth   `json:"auth"`
+	Features   map[string]bool     `json:"features"`
+}
+
+func current_capabilities(req *http.Request) capabilities_report {
+	c := request_settings(req)
+	r := capabilities_report{
+		APIVersion: capabilities_api_version,
+		Version:    current_build().Version,
+		Node:       c.node_name,
+		Protocols: map[string]bool{
+			"h1":     false,
+			"h2":     false,
+			"h2c":    false,
+			"h3":     c.h3_port > 0,
+			"ws":     true,
+			"udp":    c.udp_port > 0,
+			"iperf3": c.iperf_port > 0,
+			"grpc":   c.grpc_address != "",
+		},
+		Ports: map[string]int{},
+		Limits: capabilities_limits{
+			MaxTestBytes:   c.max_test_bytes,
+			MaxTestSeconds: c.max_test_duration.Seconds(),
+			MaxStreams:     multi_max_streams,
+			MaxActiveTests: c.max_active_tests,
+			IPMaxActive:    c.ip_max_active,
+			IPMaxBytes:     c.ip_max_bytes,
+			MaxUploadBytes: c.max_conn_upload,
+			MaxProfiles:    profile_max_kept,
+		},
+		Auth: capabilities_auth{Methods: []string{}},
+		Features: map[string]bool{
+			"multi_stream":   true,
+			"duplex":         true,
+			"ndt7":           true,
+			"librespeed":     true,
+			"ookla":          true,
+			"asym":           true,
+			"profiles":       true,
+			"cancel":         true,
+			"checksum":       true,
+			"compressible":   true,
+			"bufferbloat":    true,
+			"files":          c.files_dir != "",
+			"geoip":          c.geoip_asn_db != "" || c.geoip_country_db != "",
+			"mtu":            c.udp_port > 0 && mtu_dont_fragment,
+			"tcp_info":       runtime.GOOS == "linux",
+			"congestion":     runtime.GOOS == "linux",
+			"dscp":           runtime.GOOS == "linux",
+			"peers":          len(c.peers) > 0,
+			"vhosts":         len(c.vhosts) > 0,
+			"cors":           c.cors_origins != "",
+			"proxy_protocol": c.proxy_protocol,
+		},
+	}
+
+	for _, l := range http_listeners.report() {
+		for _, p := range l.Protocols {
+			switch p {
+			case "http/1.1":
+				r.Protocols["h1"] = true
+			case "h2", "h2c":
+				r.Protocols[p] = true
+			}
+		}
+	}
+	if(c.udp_port > 0) {
+		r.Ports["udp"] = c.udp_port
+	}
+	if(c.iperf_port > 0) {
+		r.Ports["iperf3"] = c.iperf_port
+	}
+	if(c.h3_port > 0) {
+		r.Ports["h3"] = c.h3_port
+	}
+
+	if(auth_tokens.current() != nil || len(c.tenants) > 0) {
+		r.Auth.Methods = append(r.Auth.Methods, "bearer", "signed_url")
+	}
+	if(len(c.tenants) > 0) {
+		r.Auth.Methods = append(r.Auth.Methods, "tenant")
+	}
+	if(c.tls_client_ca != "") {
+		r.Auth.Methods = append(r.Auth.Methods, "client_certificate")
+	}
+	if(c.jwt_enabled() && c.jwt_tests) {
+		r.Auth.Methods = append(r.Auth.Methods, "jwt")
+	}
+	r.Auth.Required = len(r.Auth.Methods) > 0
+	return r
+}
+
+/*
+ * GET: What this server supports.
+ */
+func route_capabilities(res http.ResponseWriter, req *http.Request) {
+	if(req.Method != "GET" && req.Method != "HEAD" && req.Method != "") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+	write_json(res, 200, current_capabilities(req))
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * The certificate and key files are watched and re-read when either
+ * changes, so that certbot or vault-agent can rotate them without a
+ * restart cutting running tests short.  New connections get the new
+ * certificate; ones already open carry on with the old.  A pair that
+ * doesn't load, such as the cert written before its key, keeps the last
+ * good certificate in force until both are in place.
+ */
+const cert_poll_interval = 5 * time.Second
+
+var served_certificate atomic.Pointer[tls.Certificate]
+
+var cert_watch struct {
+	once sync.Once
+	mu   sync.Mutex
+
+	// What the files looked like when they were last loaded.
+	cert_modified time.Time
+	cert_size     int64
+	key_modified  time.Time
+	key_size      int64
+}
+
+/*
+ * Load the certificate and key files if either has changed.
+ */
+func refresh_certificate(c *configuration) error {
+	cert_watch.mu.Lock()
+	defer cert_watch.mu.Unlock()
+
+	cert_info, err := os.Stat(c.cert_file)
+	if(err != nil) {
+		return err
+	}
+	key_info, err := os.Stat(c.key_file)
+	if(err != nil) {
+		return err
+	}
+	if(served_certificate.Load() != nil &&
+		cert_info.ModTime().Equal(cert_watch.cert_modified) && cert_info.Size() == cert_watch.cert_size &&
+		key_info.ModTime().Equal(cert_watch.key_modified) && key_info.Size() == cert_watch.key_size) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.cert_file, c.key_file)
+	if(err != nil) {
+		return err
+	}
+
+	reloaded := served_certificate.Load() != nil
+	served_certificate.Store(&cert)
+	cert_watch.cert_modified = cert_info.ModTime()
+	cert_watch.cert_size = cert_info.Size()
+	cert_watch.key_modified = key_info.ModTime()
+	cert_watch.key_size = key_info.Size()
+	if(reloaded) {
+		log_at(log_level_info, "Reloaded the certificate from %s", c.cert_file)
+	}
+	return nil
+}
+
+/*
+ * Load the certificate now and keep an eye on its files.
+ */
+func go_watch_certificate(c *configuration) error {
+	err := refresh_certificate(c)
+	if(err != nil) {
+		return err
+	}
+
+	cert_watch.once.Do(func() {
+		go func() {
+			for range time.Tick(cert_poll_interval) {
+				err := refresh_certificate(c)
+				if(err != nil) {
+					log_at(log_level_error, "Can't reload the certificate, keeping the old one: %v", err)
+				}
+			}
+		}()
+	})
+	return nil
+}
+
+/*
+ * The certificate to present, for tls.Config.GetCertificate.
+ */
+func get_served_certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return served_certificate.Load(), nil
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+/*
+ * gost check-config takes the server's flags and environment, loads
+ * the configuration as gost serve would, and then checks what serve
+ * would only find out by starting: that the addresses are free to
+ * listen on, the certificate and keys load and aren't expiring, the
+ * files it reads are there and the directories it writes to exist, and
+ * the limits make sense together.  It prints a JSON report, with each
+ * error and warning saying which check and what it was about, and
+ * exits 1 if there were errors, for CI to gate changes before they're
+ * deployed.  -no-listen skips trying the addresses, to check a
+ * configuration on the machine already serving it.
+ */
+const cert_expiry_warning = 30 * 24 * time.Hour
+
+type config_problem struct {
+	Check   string `json:"check"`
+	Subject string `json:"subject,omitempty"`
+	Message string `json:"message"`
+}
+
+type config_check_report struct {
+	Valid    bool             `json:"valid"`
+	Source   string           `json:"source"`
+	Errors   []config_problem `json:"errors"`
+	Warnings []config_problem `json:"warnings"`
+}
+
+func (r *config_check_report) fail(check string, subject string, format string, v ...any) {
+	r.Errors = append(r.Errors, config_problem{check, subject, fmt.Sprintf(format, v...)})
+}
+
+func (r *config_check_report) warn(check string, subject string, format string, v ...any) {
+	r.Warnings = append(r.Warnings, config_problem{check, subject, fmt.Sprintf(format, v...)})
+}
+
+/*
+ * Take a boolean flag of check-config's own out of args, which are
+ * otherwise the server's.
+ */
+func take_flag(args []string, name string) (bool, []string) {
+	rest := []string{}
+	found := false
+	for i, arg := range args {
+		if(arg == "--") {
+			return found, append(rest, args[i:]...)
+		}
+		if(arg == "-" + name || arg == "--" + name) {
+			found = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return found, rest
+}
+
+func run_check_config(args []string) int {
+	no_listen, args := take_flag(args, "no-listen")
+	c, err := load_configuration(args)
+	if(err == flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, "  -no-listen\n    \tdon't try listening on the configured addresses")
+		return 0
+	}
+
+	report := config_check_report{Source: config_source(c), Errors: []config_problem{}, Warnings: []config_problem{}}
+	if(err != nil) {
+		report.fail("config", "", "%v", err)
+	} else {
+		if(!no_listen) {
+			check_addresses(&c, &report)
+		}
+		check_certificates(&c, &report)
+		check_files(&c, &report)
+		check_limits(&c, &report)
+	}
+	report.Valid = len(report.Errors) == 0
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if(!report.Valid) {
+		return 1
+	}
+	return 0
+}
+
+/*
+ * Try listening on every address the server would, and let go again.
+ */
+func check_addresses(c *configuration, r *config_check_report) {
+	specs := c.listener_specs()
+	if(c.admin_address != "") {
+		specs = append(specs, c.admin_spec())
+	}
+	if(c.grpc_address != "") {
+		specs = append(specs, c.grpc_spec())
+	}
+	for _, spec := range specs {
+		if(spec.unix != "") {
+			check_directory(r, "listen", spec.name, spec.unix)
+			continue
+		}
+		l, err := net.Listen(listen_families[spec.family], spec.address)
+		if(err != nil) {
+			r.fail("listen", spec.name, "can't listen on %s: %v", spec.address, err)
+			continue
+		}
+		l.Close()
+	}
+
+	if(c.iperf_port != 0) {
+		address := net.JoinHostPort(c.bind_address, strconv.Itoa(c.iperf_port))
+		l, err := net.Listen("tcp", address)
+		if(err != nil) {
+			r.fail("listen", "iperf", "can't listen on %s: %v", address, err)
+		} else {
+			l.Close()
+		}
+	}
+	if(c.udp_port != 0) {
+		address := net.JoinHostPort(c.bind_address, strconv.Itoa(c.udp_port))
+		conn, err := net.ListenPacket("udp", address)
+		if(err != nil) {
+			r.fail("listen", "udp", "can't listen on %s: %v", address, err)
+		} else {
+			conn.Close()
+		}
+	}
+	if(c.h3_port != 0) {
+		address := net.JoinHostPort(c.bind_address, strconv.Itoa(c.h3_port))
+		conn, err := net.ListenPacket("udp", address)
+		if(err != nil) {
+			r.fail("listen", "h3", "can't listen on %s: %v", address, err)
+		} else {
+			conn.Close()
+		}
+	}
+}
+
+/*
+ * Load the certificate and key, unless ACME or a self-signed
+ * certificate takes their place, along with the rest of the TLS policy.
+ */
+func check_certificates(c *configuration, r *config_check_report) {
+	if(!c.any_tls()) {
+		return
+	}
+
+	err := apply_tls_policy(&tls.Config{}, c)
+	if(err != nil) {
+		r.fail("tls", "policy", "%v", err)
+	}
+
+	switch {
+	case c.acme_domain != "":
+		check_directory(r, "tls", "acme", filepath.Join(c.acme_cache_dir, "x"))
+	case certificate_files_missing(c):
+		r.warn("tls", c.cert_file, "no certificate or key; a self-signed certificate will be made up")
+	default:
+		check_certificate_pair(r, c.cert_file, c.key_file)
+	}
+	for _, v := range c.vhosts {
+		if(v.cert_file != "") {
+			check_certificate_pair(r, v.cert_file, v.key_file)
+		}
+	}
+}
+
+/*
+ * A certificate and key must load, and the certificate be in date.
+ */
+func check_certificate_pair(r *config_check_report, cert_file string, key_file string) {
+	cert, err := tls.LoadX509KeyPair(cert_file, key_file)
+	if(err != nil) {
+		r.fail("tls", cert_file, "%v", err)
+		return
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if(err != nil) {
+		r.fail("tls", cert_file, "%v", err)
+		return
+	}
+	now := time.Now()
+	switch {
+	case now.After(leaf.NotAfter):
+		r.fail("tls", cert_file, "certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	case now.Before(leaf.NotBefore):
+		r.fail("tls", cert_file, "certificate isn't valid until %s", leaf.NotBefore.Format(time.RFC3339))
+	case leaf.NotAfter.Sub(now) < cert_expiry_warning:
+		r.warn("tls", cert_file, "certificate expires at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+}
+
+/*
+ * Files that are read must be readable, and those that are written
+ * need a directory to go in.
+ */
+func check_files(c *configuration, r *config_check_report) {
+	for _, file := range []struct{name, path string}{{"tokens", c.auth_tokens_file}, {"admin tokens", c.admin_tokens_file}} {
+		if(file.path == "") {
+			continue
+		}
+		tokens, err := read_tokens(file.path)
+		if(err != nil) {
+			r.fail("files", file.name, "%v", err)
+		} else if(len(tokens) == 0) {
+			r.warn("files", file.name, "%s has no tokens, so nothing can authenticate", file.path)
+		}
+	}
+	for _, db := range []string{c.geoip_asn_db, c.geoip_country_db} {
+		if(db == "") {
+			continue
+		}
+		_, err := open_geoip(db)
+		if(err != nil) {
+			r.fail("files", "geoip", "%v", err)
+		}
+	}
+	if(c.files_dir != "") {
+		info, err := os.Stat(c.files_dir)
+		if(err != nil || !info.IsDir()) {
+			r.fail("files", "files_dir", "%s isn't a directory", c.files_dir)
+		}
+	}
+
+	written := map[string]string{
+		"results_file":         c.results_file,
+		"results_db":           c.results_db,
+		"log_file":             c.log_file,
+		"access_log":           c.access_log,
+		"webhook_dead_letters": c.webhook_dead_letters,
+	}
+	for _, name := range sorted_keys(written) {
+		if(written[name] != "") {
+			check_directory(r, "files", name, written[name])
+		}
+	}
+}
+
+/*
+ * The directory path would be created in must exist.
+ */
+func check_directory(r *config_check_report, check string, subject string, path string) {
+	dir := filepath.Dir(path)
+	info, err := os.Stat(dir)
+	if(err != nil || !info.IsDir()) {
+		r.fail(check, subject, "directory %s for %s doesn't exist", dir, path)
+	}
+}
+
+/*
+ * Limits that are each fine but don't go together.
+ */
+func check_limits(c *configuration, r *config_check_report) {
+	if(c.max_active_tests == 0 && c.max_aggregate_bps == 0) {
+		r.warn("limits", "max_active", "neither the number of tests nor their total rate is limited")
+	}
+	if(c.drain_timeout < c.max_test_duration) {
+		r.warn("limits", "drain_timeout", "the drain timeout of %s is shorter than tests may run (%s), so shutdown can cut them off", c.drain_timeout, c.max_test_duration)
+	}
+	if(c.ip_max_bytes > 0 && c.ip_max_bytes < c.max_test_bytes) {
+		r.warn("limits", "ip_bytes", "a client's quota of %d bytes is less than the largest test, %d bytes", c.ip_max_bytes, c.max_test_bytes)
+	}
+	if(c.idle_timeout > 0 && c.idle_timeout < c.min_rate_window) {
+		r.warn("limits", "idle_timeout", "the idle timeout of %s is shorter than the minimum rate window, %s", c.idle_timeout, c.min_rate_window)
+	}
+}
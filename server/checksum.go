@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Downloads with ?checksum=sha256 end with a SHA-256 digest of exactly
+ * the bytes the server sent, in the X-Gost-Sha256 trailer.  A client
+ * that hashes what it received and gets something else has a
+ * middlebox rewriting or truncating the payload.  The response is
+ * chunked rather than sized so that HTTP/1.1 clients get the trailer
+ * too.  Hashing costs CPU, so it's only done when asked for.
+ *
+ * Uploads work the other way round: with ?checksum= given the hex
+ * SHA-256 of the body the client is about to send, the server hashes
+ * what arrives and says whether it matches, proving the bytes it
+ * counted are the bytes that were sent.  ?checksum=sha256 just reports
+ * the digest.
+ */
+const checksum_header = "X-Gost-Sha256"
+
+/*
+ * Whether ?checksum= asks for a digest.
+ */
+func requested_checksum(req *http.Request) (bool, error) {
+	switch req.URL.Query().Get("checksum") {
+	case "":
+		return false, nil
+	case "sha256":
+		return true, nil
+	}
+	return false, errors.New("checksum must be sha256")
+}
+
+/*
+ * Whether an upload's ?checksum= asks for a digest, and the one the
+ * client expects, if it said.
+ */
+func requested_upload_checksum(req *http.Request) (bool, string, error) {
+	value := strings.ToLower(req.URL.Query().Get("checksum"))
+	switch value {
+	case "":
+		return false, "", nil
+	case "sha256":
+		return true, "", nil
+	}
+	b, err := hex.DecodeString(value)
+	if(err != nil || len(b) != sha256.Size) {
+		return false, "", errors.New("checksum must be sha256 or a hex SHA-256 digest")
+	}
+	return true, value, nil
+}
+
+/*
+ * Hashes whatever makes it through to w.
+ */
+type hash_writer struct {
+	w io.Writer
+	h hash.Hash
+}
+
+func new_hash_writer(w io.Writer) *hash_writer {
+	return &hash_writer{w, sha256.New()}
+}
+
+func (hw *hash_writer) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	return n, err
+}
+
+func (hw *hash_writer) sum() string {
+	return hex.EncodeToString(hw.h.Sum(nil))
+}
+
+/*
+ * Hashes whatever is read from r.
+ */
+type hash_reader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func new_hash_reader(r io.Reader) *hash_reader {
+	return &hash_reader{r, sha256.New()}
+}
+
+func (hr *hash_reader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	return n, err
+}
+
+func (hr *hash_reader) sum() string {
+	return hex.EncodeToString(hr.h.Sum(nil))
+}
@@ -0,0 +1,1389 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+ * How long -bufferbloat loads the link for.
+ */
+const client_bufferbloat_seconds = 10
+
+/*
+ * How long -duplex downloads and uploads for.
+ */
+const client_duplex_seconds = 10
+
+/*
+ * How many more times each DNS lookup is timed after the first.
+ */
+const client_dns_repeats = 3
+
+/*
+ * The download or upload running now, by the ID the client gave it, so
+ * that Ctrl-C can cancel it on the server and free its slot there
+ * rather than leave it to time out.  How long that may take before the
+ * client exits anyway.
+ */
+var client_running_test atomic.Value
+
+const client_cancel_timeout = 5 * time.Second
+
+/*
+ * Client mode turns gost into the measuring end.  Usage:
+ *
+ *	gost client [flags] https://host:8443
+ */
+type client_options struct {
+	server   *url.URL
+	bytes    int64
+	pings    int
+	setups   int
+	mtu      bool
+	bloat    bool
+	duplex   bool
+	stack    bool
+	asym     bool
+	trace    bool
+	dresses  []string
+	streams  int
+	omit     time.Duration
+	dscp     string
+	insecure bool
+	token    string
+	json     bool
+	timeout  time.Duration
+}
+
+type latency_report struct {
+	Samples  int     `json:"samples"`
+	MinMs    float64 `json:"min_ms"`
+	AvgMs    float64 `json:"avg_ms"`
+	MaxMs    float64 `json:"max_ms"`
+	JitterMs float64 `json:"jitter_ms"`
+}
+
+type transfer_report struct {
+	Bytes      int64   `json:"bytes"`
+	Streams    int     `json:"streams,omitempty"`
+	Seconds    float64 `json:"seconds"`
+	Mbps       float64 `json:"mbps"`
+	ServerMbps float64 `json:"server_mbps,omitempty"`
+}
+
+/*
+ * Median connection setup times.  DNS, connect, TLS and TTFB are the
+ * phases of a request over a fresh connection, and total is all of
+ * them; reused is a whole request over a kept-alive one, for
+ * comparison.  Server is how long after accepting a fresh connection
+ * the server saw its request, which covers the TLS handshake, and
+ * server TLS is the handshake as the server timed it.
+ */
+type setup_report struct {
+	Samples     int     `json:"samples"`
+	DNSMs       float64 `json:"dns_ms"`
+	ConnectMs   float64 `json:"connect_ms"`
+	TLSMs       float64 `json:"tls_ms,omitempty"`
+	TTFBMs      float64 `json:"ttfb_ms"`
+	TotalMs     float64 `json:"total_ms"`
+	ReusedMs    float64 `json:"reused_ms"`
+	ServerMs    float64 `json:"server_ms"`
+	ServerTLSMs float64 `json:"server_tls_ms,omitempty"`
+}
+
+/*
+ * The path MTU from the server, found by which of its don't-fragment
+ * UDP echoes made it back.  Received is the biggest datagram that
+ * reached the server, which can be less than was sent if the way there
+ * is the narrower one.
+ */
+type path_mtu_report struct {
+	MTU          int  `json:"mtu"`
+	LargestEcho  int  `json:"largest_echo"`
+	Received     int  `json:"largest_received"`
+	DontFragment bool `json:"dont_fragment"`
+}
+
+/*
+ * Each direction's throughput during a duplex test, as the server saw
+ * it.
+ */
+type client_duplex_report struct {
+	DownMbps       float64 `json:"down_mbps"`
+	UpMbps         float64 `json:"up_mbps"`
+	Mbps           float64 `json:"mbps"`
+	OverlapSeconds float64 `json:"overlap_seconds"`
+}
+
+/*
+ * A download dressed up as something else with ?as=, against the plain
+ * one.  Difference is how much faster (or, negative, slower) it was,
+ * as a percentage of the plain download's rate.
+ */
+type disguise_report struct {
+	As         string  `json:"as"`
+	Mbps       float64 `json:"mbps"`
+	Difference float64 `json:"difference_percent"`
+}
+
+/*
+ * Latency and download throughput over one IP version, or why it
+ * couldn't be measured.
+ */
+type family_report struct {
+	ServerIP  string  `json:"server_ip,omitempty"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	Mbps      float64 `json:"mbps,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+/*
+ * The same tests over IPv4 and over IPv6.  The deltas are IPv6's
+ * figures less IPv4's, when both worked.
+ */
+type stack_compare_report struct {
+	IPv4           family_report `json:"ipv4"`
+	IPv6           family_report `json:"ipv6"`
+	LatencyDeltaMs float64       `json:"latency_delta_ms"`
+	MbpsDelta      float64       `json:"mbps_delta"`
+}
+
+/*
+ * How long the server's name took to look up for one record type: the
+ * first time, which the resolver may have had to chase, and the median
+ * of client_dns_repeats lookups straight after, which its cache should
+ * answer.
+ */
+type dns_lookup struct {
+	Addresses []string `json:"addresses,omitempty"`
+	FirstMs   float64  `json:"first_ms"`
+	CachedMs  float64  `json:"cached_ms"`
+	Error     string   `json:"error,omitempty"`
+}
+
+/*
+ * A and AAAA lookups of the server's name, and the resolver that
+ * answered them.
+ */
+type dns_report struct {
+	Host     string     `json:"host"`
+	Resolver string     `json:"resolver,omitempty"`
+	A        dns_lookup `json:"a"`
+	AAAA     dns_lookup `json:"aaaa"`
+}
+
+type client_report struct {
+	Server   string           `json:"server"`
+	DNS      *dns_report      `json:"dns,omitempty"`
+	Setup    *setup_report    `json:"setup,omitempty"`
+	MTU      *path_mtu_report `json:"mtu,omitempty"`
+	Latency  *latency_report  `json:"latency"`
+	Download *transfer_report `json:"download"`
+	Upload   *transfer_report `json:"upload"`
+
+	Bufferbloat *bufferbloat_report   `json:"bufferbloat,omitempty"`
+	Duplex      *client_duplex_report `json:"duplex,omitempty"`
+	Disguises   []disguise_report     `json:"disguises,omitempty"`
+	Stack       *stack_compare_report `json:"stack,omitempty"`
+	Asym        *asym_report          `json:"asym,omitempty"`
+	Traceroute  *traceroute_report    `json:"traceroute,omitempty"`
+}
+
+/*
+ * Parse client mode arguments.
+ */
+func parse_client_options(args []string) (client_options, error) {
+	var o client_options
+	size := "25M"
+	dresses := ""
+
+	flags := flag.NewFlagSet("gost client", flag.ContinueOnError)
+	flags.StringVar(&size, "bytes", size, "payload size for download and upload")
+	flags.IntVar(&o.pings, "pings", 10, "number of latency samples")
+	flags.IntVar(&o.setups, "setups", 0, "also time this many fresh connections against kept-alive ones")
+	flags.BoolVar(&o.mtu, "mtu", false, "also find the path MTU from the server over its UDP echo")
+	flags.BoolVar(&o.bloat, "bufferbloat", false, "also measure latency under load, pinging during a 10 second download")
+	flags.BoolVar(&o.duplex, "duplex", false, "also download and upload at once for 10 seconds")
+	flags.BoolVar(&o.stack, "stack", false, "also ping and download over IPv4 and over IPv6, and compare them")
+	flags.BoolVar(&o.asym, "asym", false, "also load the upstream during downloads over /asym, to catch a downstream that collapses")
+	flags.BoolVar(&o.trace, "traceroute", false, "also trace the TCP path to the server, which needs root or CAP_NET_RAW, on Linux")
+	flags.StringVar(&dresses, "compare-as", "", "also download dressed up as each of these comma-separated types, e.g. video,download,web")
+	flags.IntVar(&o.streams, "streams", 1, "parallel download streams, sharing -bytes between them")
+	flags.DurationVar(&o.omit, "omit", 0, "leave this much of the start of the download and upload out of their throughput")
+	flags.StringVar(&o.dscp, "dscp", "", "mark the tests' traffic both ways with this DSCP, e.g. EF")
+	flags.BoolVar(&o.insecure, "insecure", false, "skip TLS certificate verification")
+	flags.StringVar(&o.token, "token", os.Getenv("GOST_TOKEN"), "bearer token for servers that require one (env GOST_TOKEN)")
+	flags.BoolVar(&o.json, "json", false, "print results as JSON")
+	flags.DurationVar(&o.timeout, "timeout", 2 * time.Minute, "give up on any one test after this long")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gost client [flags] URL")
+		flags.PrintDefaults()
+	}
+
+	err := flags.Parse(args)
+	if(err != nil) {
+		return o, err
+	}
+
+	if(flags.NArg() != 1) {
+		flags.Usage()
+		return o, errors.New("exactly one server URL is required")
+	}
+
+	o.server, err = url.Parse(flags.Arg(0))
+	if(err != nil) {
+		return o, err
+	}
+	if(o.server.Scheme != "http" && o.server.Scheme != "https") {
+		return o, fmt.Errorf("unsupported URL scheme %q", o.server.Scheme)
+	}
+	if(!strings.HasSuffix(o.server.Path, "/")) {
+		o.server.Path += "/"
+	}
+
+	o.bytes, err = parse_size(size)
+	if(err != nil) {
+		return o, err
+	}
+	if(o.pings < 2) {
+		return o, errors.New("at least two pings are needed")
+	}
+	if(o.setups < 0) {
+		return o, errors.New("setups must not be negative")
+	}
+	if(o.streams < 1 || o.streams > multi_max_streams) {
+		return o, fmt.Errorf("streams must be between 1 and %d", multi_max_streams)
+	}
+	if(o.omit < 0) {
+		return o, errors.New("omit must not be negative")
+	}
+	if(o.omit > 0 && o.streams > 1) {
+		return o, errors.New("omit can't be combined with streams")
+	}
+	if(o.dscp != "") {
+		_, err = parse_dscp(o.dscp)
+		if(err != nil) {
+			return o, err
+		}
+	}
+	for _, as := range strings.Split(dresses, ",") {
+		as = strings.TrimSpace(as)
+		if(as == "") {
+			continue
+		}
+		_, err = disguise_as(as)
+		if(err != nil) {
+			return o, err
+		}
+		o.dresses = append(o.dresses, as)
+	}
+
+	return o, nil
+}
+
+/*
+ * An HTTP client for talking to a gost server.  Compression is turned
+ * off so the transfer tests see the real payload.
+ */
+func new_test_client(o client_options) *http.Client {
+	return test_client_over(o, new_test_transport(o))
+}
+
+/*
+ * A test client that only connects over network, "tcp4" or "tcp6".
+ */
+func new_family_client(o client_options, network string) *http.Client {
+	transport := new_test_transport(o)
+	transport.DialContext = func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+		return o.dial(ctx, network, addr)
+	}
+	return test_client_over(o, transport)
+}
+
+func test_client_over(o client_options, transport *http.Transport) *http.Client {
+	var rt http.RoundTripper = transport
+	if(o.token != "") {
+		rt = bearer_transport{transport, o.token}
+	}
+	return &http.Client{Transport: rt, Timeout: o.timeout}
+}
+
+func new_test_transport(o client_options) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = true
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: o.insecure}
+	transport.DialContext = o.dial
+	return transport
+}
+
+/*
+ * Connect to the server, marking what we send with -dscp.
+ */
+func (o client_options) dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if(err != nil || o.dscp == "") {
+		return conn, err
+	}
+	mark, _ := parse_dscp(o.dscp)
+	err = set_dscp(conn, mark)
+	if(err != nil) {
+		conn.Close()
+		return nil, fmt.Errorf("dscp %s: %v", o.dscp, err)
+	}
+	return conn, nil
+}
+
+/*
+ * Adds a bearer token to every request.
+ */
+type bearer_transport struct {
+	next  http.RoundTripper
+	token string
+}
+
+func (b bearer_transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer " + b.token)
+	return b.next.RoundTrip(req)
+}
+
+/*
+ * Resolve a path against the server URL.
+ */
+func (o client_options) endpoint(path string) string {
+	return o.server.ResolveReference(&url.URL{Path: path}).String()
+}
+
+/*
+ * Time a run of pings over one keep-alive connection.
+ */
+func client_latency(client *http.Client, o client_options) (*latency_report, error) {
+	rtts := make([]float64, 0, o.pings)
+
+	for i := 0; i < o.pings; i++ {
+		start := time.Now()
+		res, err := client.Get(o.endpoint("ping"))
+		if(err != nil) {
+			return nil, err
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if(res.StatusCode != 200) {
+			return nil, fmt.Errorf("ping: %s", res.Status)
+		}
+		rtts = append(rtts, float64(time.Since(start)) / float64(time.Millisecond))
+	}
+
+	// The first ping pays for connection setup, so leave it out.
+	rtts = rtts[1:]
+
+	r := &latency_report{Samples: len(rtts), MinMs: math.Inf(1)}
+	for i, rtt := range rtts {
+		r.MinMs = math.Min(r.MinMs, rtt)
+		r.MaxMs = math.Max(r.MaxMs, rtt)
+		r.AvgMs += rtt
+		if(i > 0) {
+			r.JitterMs += math.Abs(rtt - rtts[i - 1])
+		}
+	}
+	r.AvgMs /= float64(len(rtts))
+	if(len(rtts) > 1) {
+		r.JitterMs /= float64(len(rtts) - 1)
+	}
+	return r, nil
+}
+
+/*
+ * Time requests to /connsetup, each over a fresh connection, phase by
+ * phase, and then over one kept-alive connection.
+ */
+func client_setup(client *http.Client, o client_options) (*setup_report, error) {
+	transport := new_test_transport(o)
+	transport.DisableKeepAlives = true
+	fresh := &http.Client{Transport: transport, Timeout: o.timeout}
+	defer transport.CloseIdleConnections()
+
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	var dns, connect, handshake, ttfb, total, reused, server, server_tls []float64
+
+	for i := 0; i < o.setups; i++ {
+		var dns_start, dns_done, connect_start, connect_done, tls_start, tls_done, wrote, first time.Time
+		trace := &httptrace.ClientTrace{
+			DNSStart:             func(httptrace.DNSStartInfo) { dns_start = time.Now() },
+			DNSDone:              func(httptrace.DNSDoneInfo) { dns_done = time.Now() },
+			ConnectStart:         func(string, string) { connect_start = time.Now() },
+			ConnectDone:          func(string, string, error) { connect_done = time.Now() },
+			TLSHandshakeStart:    func() { tls_start = time.Now() },
+			TLSHandshakeDone:     func(tls.ConnectionState, error) { tls_done = time.Now() },
+			WroteRequest:         func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+			GotFirstResponseByte: func() { first = time.Now() },
+		}
+		req, err := http.NewRequest("GET", o.endpoint("connsetup"), nil)
+		if(err != nil) {
+			return nil, err
+		}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+		start := time.Now()
+		res, err := fresh.Do(req)
+		if(err != nil) {
+			return nil, err
+		}
+		var reply connsetup_reply
+		err = json.NewDecoder(res.Body).Decode(&reply)
+		res.Body.Close()
+		if(res.StatusCode != 200) {
+			return nil, fmt.Errorf("connection setup: %s", res.Status)
+		}
+		if(err != nil) {
+			return nil, fmt.Errorf("connection setup: bad reply: %v", err)
+		}
+
+		dns = append(dns, ms(dns_done.Sub(dns_start)))
+		connect = append(connect, ms(connect_done.Sub(connect_start)))
+		handshake = append(handshake, ms(tls_done.Sub(tls_start)))
+		ttfb = append(ttfb, ms(first.Sub(wrote)))
+		total = append(total, ms(first.Sub(start)))
+		server = append(server, reply.SinceAcceptMs)
+		server_tls = append(server_tls, reply.HandshakeMs)
+	}
+
+	// One request to open the kept-alive connection, then the rest
+	// over it.
+	for i := 0; i <= o.setups; i++ {
+		start := time.Now()
+		res, err := client.Get(o.endpoint("connsetup"))
+		if(err != nil) {
+			return nil, err
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if(res.StatusCode != 200) {
+			return nil, fmt.Errorf("connection setup: %s", res.Status)
+		}
+		if(i > 0) {
+			reused = append(reused, ms(time.Since(start)))
+		}
+	}
+
+	return &setup_report{
+		Samples:     o.setups,
+		DNSMs:       percentile(dns, 0.5),
+		ConnectMs:   percentile(connect, 0.5),
+		TLSMs:       percentile(handshake, 0.5),
+		TTFBMs:      percentile(ttfb, 0.5),
+		TotalMs:     percentile(total, 0.5),
+		ReusedMs:    percentile(reused, 0.5),
+		ServerMs:    percentile(server, 0.5),
+		ServerTLSMs: percentile(server_tls, 0.5),
+	}, nil
+}
+
+/*
+ * Find the biggest UDP echo that makes it back from the server with
+ * don't-fragment set, by bisection between the smallest datagram any
+ * IPv4 path must carry and a jumbo frame's worth.
+ */
+func client_mtu(client *http.Client, o client_options) (*path_mtu_report, error) {
+	res, err := client.Post(o.endpoint("mtu"), "", nil)
+	if(err != nil) {
+		return nil, err
+	}
+	var probe mtu_report
+	err = json.NewDecoder(res.Body).Decode(&probe)
+	res.Body.Close()
+	if(res.StatusCode != 201) {
+		return nil, fmt.Errorf("mtu: %s", res.Status)
+	}
+	if(err != nil) {
+		return nil, fmt.Errorf("mtu: bad reply: %v", err)
+	}
+	id, err := hex.DecodeString(strings.ReplaceAll(probe.ID, "-", ""))
+	if(err != nil || len(id) != 16) {
+		return nil, fmt.Errorf("mtu: bad probe ID %q", probe.ID)
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(o.server.Hostname(), strconv.Itoa(probe.UDPPort)))
+	if(err != nil) {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// IP and UDP headers.
+	overhead := 48
+	remote, _ := conn.RemoteAddr().(*net.UDPAddr)
+	if(remote != nil && remote.IP.To4() != nil) {
+		overhead = 28
+	}
+
+	var seq uint64
+	reply := make([]byte, udp_max_datagram)
+	echoed := func(size int) (bool, error) {
+		for try := 0; try < 3; try++ {
+			seq++
+			packet := make([]byte, size)
+			copy(packet, udp_magic)
+			copy(packet[4:20], id)
+			binary.BigEndian.PutUint64(packet[20:28], seq)
+			binary.BigEndian.PutUint64(packet[28:36], uint64(monotonic_ns()))
+			_, err := conn.Write(packet)
+			if(errors.Is(err, syscall.EMSGSIZE)) {
+				return false, nil
+			}
+			if(err != nil) {
+				return false, err
+			}
+
+			conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			for {
+				n, err := conn.Read(reply)
+				if(err != nil) {
+					break
+				}
+				if(n == size && binary.BigEndian.Uint64(reply[20:28]) == seq) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+
+	low, high := 576 - 28, 9000 - overhead
+	ok, err := echoed(low)
+	if(err != nil) {
+		return nil, err
+	}
+	if(!ok) {
+		return nil, fmt.Errorf("mtu: no echo from UDP port %d", probe.UDPPort)
+	}
+	for low < high {
+		mid := (low + high + 1) / 2
+		ok, err := echoed(mid)
+		if(err != nil) {
+			return nil, err
+		}
+		if(ok) {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+
+	res, err = client.Get(o.endpoint("mtu/" + probe.ID))
+	if(err != nil) {
+		return nil, err
+	}
+	err = json.NewDecoder(res.Body).Decode(&probe)
+	res.Body.Close()
+	if(res.StatusCode != 200) {
+		return nil, fmt.Errorf("mtu: %s", res.Status)
+	}
+	if(err != nil) {
+		return nil, fmt.Errorf("mtu: bad reply: %v", err)
+	}
+
+	r := &path_mtu_report{MTU: low + overhead, LargestEcho: low, DontFragment: probe.DontFragment}
+	if(len(probe.Received) > 0) {
+		r.Received = probe.Received[len(probe.Received) - 1]
+	}
+	return r, nil
+}
+
+/*
+ * Ping over a connection of its own, first idle and then while a timed
+ * download fills the link, and fetch the server's verdict from the
+ * download's result.
+ */
+func client_bufferbloat(client *http.Client, o client_options) (*bufferbloat_report, error) {
+	pinger := new_test_client(o)
+	id := new_uuid()
+	ping := func() error {
+		res, err := pinger.Get(o.endpoint("ping") + "?test_id=" + id)
+		if(err != nil) {
+			return err
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if(res.StatusCode != 200) {
+			return fmt.Errorf("ping: %s", res.Status)
+		}
+		return nil
+	}
+
+	for i := 0; i <= o.pings; i++ {
+		err := ping()
+		if(err != nil) {
+			return nil, err
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		res, err := client.Get(o.endpoint("down") + "?seconds=" + strconv.Itoa(client_bufferbloat_seconds) + "&test_id=" + id)
+		if(err != nil) {
+			done <- err
+			return
+		}
+		_, err = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if(err == nil && res.StatusCode != 200) {
+			err = fmt.Errorf("download: %s", res.Status)
+		}
+		done <- err
+	}()
+	for loading := true; loading; {
+		select {
+		case err := <-done:
+			if(err != nil) {
+				return nil, err
+			}
+			loading = false
+		default:
+			err := ping()
+			if(err != nil) {
+				return nil, err
+			}
+		}
+	}
+
+	// The result comes as the one event /progress/ sends for a finished
+	// test.
+	res, err := client.Get(o.endpoint("progress/" + id))
+	if(err != nil) {
+		return nil, err
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if(res.StatusCode != 200) {
+		return nil, fmt.Errorf("bufferbloat: %s", res.Status)
+	}
+	if(err != nil) {
+		return nil, err
+	}
+	var result test_result
+	for _, line := range strings.Split(string(body), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if(ok) {
+			err = json.Unmarshal([]byte(data), &result)
+		}
+	}
+	if(err != nil) {
+		return nil, fmt.Errorf("bufferbloat: bad reply: %v", err)
+	}
+	if(result.Bufferbloat == nil) {
+		return nil, errors.New("bufferbloat: the server didn't see enough pings")
+	}
+	return result.Bufferbloat, nil
+}
+
+/*
+ * Download and upload at once through /duplex, each over a connection
+ * of its own, and fetch what the server made of it.
+ */
+func client_duplex(client *http.Client, o client_options) (*client_duplex_report, error) {
+	res, err := client.Post(o.endpoint("duplex") + "?seconds=" + strconv.Itoa(client_duplex_seconds), "", nil)
+	if(err != nil) {
+		return nil, err
+	}
+	var plan duplex_plan
+	err = json.NewDecoder(res.Body).Decode(&plan)
+	res.Body.Close()
+	if(res.StatusCode != 201) {
+		return nil, fmt.Errorf("duplex: %s", res.Status)
+	}
+	if(err != nil) {
+		return nil, fmt.Errorf("duplex: bad plan: %v", err)
+	}
+
+	done := make(chan error, 2)
+	go func() {
+		res, err := client.Get(o.endpoint(strings.TrimPrefix(plan.DownURL, "/")))
+		if(err != nil) {
+			done <- err
+			return
+		}
+		_, err = drain_body(res.Body)
+		res.Body.Close()
+		if(err == nil && res.StatusCode != 200) {
+			err = fmt.Errorf("duplex download: %s", res.Status)
+		}
+		done <- err
+	}()
+	go func() {
+		// More than the link can carry in the time; the server stops
+		// reading when it's up, and answers.
+		req, err := http.NewRequest("PUT", o.endpoint(strings.TrimPrefix(plan.UpURL, "/")), payload_reader(1 << 50))
+		if(err != nil) {
+			done <- err
+			return
+		}
+		res, err := client.Do(req)
+		if(err != nil) {
+			done <- err
+			return
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if(res.StatusCode != 200) {
+			err = fmt.Errorf("duplex upload: %s", res.Status)
+		}
+		done <- err
+	}()
+	for range 2 {
+		e := <-done
+		if(e != nil && err == nil) {
+			err = e
+		}
+	}
+	if(err != nil) {
+		return nil, err
+	}
+
+	res, err = client.Get(o.endpoint("duplex/" + plan.ID))
+	if(err != nil) {
+		return nil, err
+	}
+	var status duplex_status
+	err = json.NewDecoder(res.Body).Decode(&status)
+	res.Body.Close()
+	if(res.StatusCode != 200) {
+		return nil, fmt.Errorf("duplex: %s", res.Status)
+	}
+	if(err != nil) {
+		return nil, fmt.Errorf("duplex: bad reply: %v", err)
+	}
+	return &client_duplex_report{
+		DownMbps:       status.DownMbps,
+		UpMbps:         status.UpMbps,
+		Mbps:           status.Mbps,
+		OverlapSeconds: status.OverlapSeconds,
+	}, nil
+}
+
+/*
+ * Play the client's part in /asym: time and ack each burst sent down,
+ * send a burst up when asked, and flood the upstream once told to load
+ * it, until the report comes.
+ */
+func client_asym(o client_options) (*asym_report, error) {
+	ws, err := ws_dial(o, "asym")
+	if(err != nil) {
+		return nil, err
+	}
+	defer ws.conn.Close()
+	ws.max_message = asym_max_burst
+	ws.conn.SetDeadline(time.Now().Add(o.timeout))
+
+	flooding := make(chan struct{})
+	stop := sync.OnceFunc(func() { close(flooding) })
+	defer stop()
+
+	for {
+		opcode, message, err := ws.read_message()
+		if(err != nil) {
+			return nil, fmt.Errorf("asym: %v", err)
+		}
+		if(opcode != ws_op_text) {
+			return nil, errors.New("asym: unexpected binary message")
+		}
+		var control struct {
+			asym_control
+			Result *asym_report `json:"result"`
+		}
+		err = json.Unmarshal(message, &control)
+		if(err != nil) {
+			return nil, fmt.Errorf("asym: bad message: %v", err)
+		}
+
+		switch control.Phase {
+		case "down", "loaded":
+			start := time.Now()
+			opcode, message, err = ws.read_message()
+			if(err == nil && (opcode != ws_op_binary || int64(len(message)) != control.Bytes)) {
+				err = fmt.Errorf("got %d bytes, not %d", len(message), control.Bytes)
+			}
+			if(err == nil) {
+				ack, _ := json.Marshal(asym_ack{Round: control.Round, Ms: float64(time.Since(start).Microseconds()) / 1000})
+				err = ws.write_message(ws_op_text, ack)
+			}
+		case "up":
+			err = ws.write_message(ws_op_binary, make([]byte, control.Bytes))
+			if(err == nil) {
+				_, _, err = ws.read_message()
+			}
+		case "load":
+			go func() {
+				flood := make([]byte, asym_flood_message)
+				for {
+					select {
+					case <-flooding:
+						return
+					default:
+					}
+					if(ws.write_message(ws_op_binary, flood) != nil) {
+						return
+					}
+				}
+			}()
+		default:
+			if(control.Result != nil) {
+				stop()
+				ws.close(ws_close_normal, "")
+				return control.Result, nil
+			}
+			err = fmt.Errorf("unknown phase %q", control.Phase)
+		}
+		if(err != nil) {
+			return nil, fmt.Errorf("asym: %v", err)
+		}
+	}
+}
+
+/*
+ * The ?omit= and ?dscp= for a test, after its other parameters, if
+ * -omit and -dscp were given.
+ */
+func (o client_options) test_query() string {
+	query := ""
+	if(o.omit > 0) {
+		query += "&omit=" + o.omit.String()
+	}
+	if(o.dscp != "") {
+		query += "&dscp=" + url.QueryEscape(o.dscp)
+	}
+	return query
+}
+
+/*
+ * Fetch a payload from /down and time it.
+ */
+func client_download(client *http.Client, o client_options) (*transfer_report, error) {
+	id := client_start_test()
+	defer client_running_test.Store("")
+	return client_fetch(client, o.endpoint("down") + "?bytes=" + strconv.FormatInt(o.bytes, 10) + "&test_id=" + id + o.test_query())
+}
+
+/*
+ * Pick an ID for a test about to start, and note it's running.
+ */
+func client_start_test() string {
+	id := new_uuid()
+	client_running_test.Store(id)
+	return id
+}
+
+/*
+ * On Ctrl-C, cancel the test that's running, if any, on the server
+ * before exiting.
+ */
+func client_cancel_on_interrupt(o client_options) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	id, _ := client_running_test.Load().(string)
+	if(id != "") {
+		client := new_test_client(o)
+		client.Timeout = client_cancel_timeout
+		req, _ := http.NewRequest("DELETE", o.endpoint("tests/" + id), nil)
+		res, err := client.Do(req)
+		if(err == nil) {
+			res.Body.Close()
+			if(res.StatusCode != 200 && res.StatusCode != 202) {
+				err = fmt.Errorf("server said %s", res.Status)
+			}
+		}
+		if(err != nil) {
+			fmt.Fprintf(os.Stderr, "gost client: interrupted; couldn't cancel test %s: %v\n", id, err)
+		} else {
+			fmt.Fprintln(os.Stderr, "gost client: interrupted; cancelled test", id)
+		}
+	}
+	os.Exit(130)
+}
+
+/*
+ * Fetch and time one download.
+ */
+func client_fetch(client *http.Client, target string) (*transfer_report, error) {
+	start := time.Now()
+	res, err := client.Get(target)
+	if(err != nil) {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if(res.StatusCode != 200) {
+		return nil, fmt.Errorf("download: %s", res.Status)
+	}
+
+	n, err := drain_body(res.Body)
+	elapsed := time.Since(start)
+	if(err != nil) {
+		return nil, err
+	}
+
+	return &transfer_report{Bytes: n, Seconds: elapsed.Seconds(), Mbps: mbps(n, elapsed)}, nil
+}
+
+/*
+ * Fetch the payload again dressed up as each of -compare-as, to see
+ * whether the path treats it differently by its headers, compared with
+ * the plain download.
+ */
+func client_disguises(client *http.Client, o client_options, plain *transfer_report) ([]disguise_report, error) {
+	var reports []disguise_report
+	for _, as := range o.dresses {
+		r, err := client_fetch(client, o.endpoint("down") + "?bytes=" + strconv.FormatInt(o.bytes, 10) +
+			"&as=" + url.QueryEscape(as) + o.test_query())
+		if(err != nil) {
+			return reports, fmt.Errorf("download as %s: %v", as, err)
+		}
+		report := disguise_report{As: as, Mbps: r.Mbps}
+		if(plain.Mbps > 0) {
+			report.Difference = (r.Mbps - plain.Mbps) / plain.Mbps * 100
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+/*
+ * Ping and download over IPv4 and then IPv6, each with a client that
+ * can only use the one.  A family that doesn't work is reported, not
+ * fatal, since finding that out is the point.
+ */
+func client_stack(o client_options) *stack_compare_report {
+	r := &stack_compare_report{}
+	for _, family := range []struct {
+		network string
+		report  *family_report
+	}{{"tcp4", &r.IPv4}, {"tcp6", &r.IPv6}} {
+		client := new_family_client(o, family.network)
+		err := client_family(client, o, family.report)
+		if(err != nil) {
+			family.report.Error = err.Error()
+		}
+		client.CloseIdleConnections()
+	}
+	if(r.IPv4.Error == "" && r.IPv6.Error == "") {
+		r.LatencyDeltaMs = r.IPv6.LatencyMs - r.IPv4.LatencyMs
+		r.MbpsDelta = r.IPv6.Mbps - r.IPv4.Mbps
+	}
+	return r
+}
+
+/*
+ * Time the server's A and AAAA lookups with Go's own resolver, which
+ * keeps no cache of its own, so the repeats see the resolver's, and
+ * which says what it's talking to.  A lookup that fails doesn't stop the
+ * tests; the server's name will fail to connect if it matters.  Nil if the server's given as an
+ * address.
+ */
+func client_dns(o client_options) *dns_report {
+	host := o.server.Hostname()
+	if(net.ParseIP(host) != nil) {
+		return nil
+	}
+	r := &dns_report{Host: host}
+	var mu sync.Mutex
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, network, address)
+			if(err == nil) {
+				mu.Lock()
+				r.Resolver = address
+				mu.Unlock()
+			}
+			return conn, err
+		},
+	}
+
+	for _, family := range []struct {
+		network string
+		lookup  *dns_lookup
+	}{{"ip4", &r.A}, {"ip6", &r.AAAA}} {
+		var times []float64
+		for i := 0; i <= client_dns_repeats; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+			start := time.Now()
+			ips, err := resolver.LookupIP(ctx, family.network, host)
+			took := float64(time.Since(start).Microseconds()) / 1000
+			cancel()
+			if(err != nil) {
+				family.lookup.Error = err.Error()
+				break
+			}
+			if(i == 0) {
+				family.lookup.FirstMs = took
+				for _, ip := range ips {
+					family.lookup.Addresses = append(family.lookup.Addresses, ip.String())
+				}
+				continue
+			}
+			times = append(times, took)
+		}
+		if(len(times) > 0) {
+			family.lookup.CachedMs = percentile(times, 0.5)
+		}
+	}
+	// Names the hosts file has are answered without a query.
+	if(r.Resolver == "" && (r.A.Error == "" || r.AAAA.Error == "")) {
+		r.Resolver = "hosts file"
+	}
+	return r
+}
+
+func client_family(client *http.Client, o client_options, r *family_report) error {
+	res, err := client.Get(o.endpoint("stack"))
+	if(err != nil) {
+		return err
+	}
+	var stack stack_report
+	err = json.NewDecoder(res.Body).Decode(&stack)
+	res.Body.Close()
+	if(res.StatusCode != 200) {
+		return fmt.Errorf("stack: %s", res.Status)
+	}
+	if(err != nil) {
+		return fmt.Errorf("stack: bad reply: %v", err)
+	}
+	r.ServerIP = stack.ServerIP
+
+	latency, err := client_latency(client, o)
+	if(err != nil) {
+		return err
+	}
+	r.LatencyMs = latency.AvgMs
+
+	download, err := client_download(client, o)
+	if(err != nil) {
+		return err
+	}
+	r.Mbps = download.Mbps
+	return nil
+}
+
+/*
+ * Fetch a payload split across several parallel streams via
+ * /down/multi, and report the server's combined figures alongside our
+ * own.
+ */
+func client_download_multi(client *http.Client, o client_options) (*transfer_report, error) {
+	per := o.bytes / int64(o.streams)
+	res, err := client.Post(o.endpoint("down/multi") + "?streams=" + strconv.Itoa(o.streams) +
+		"&bytes=" + strconv.FormatInt(per, 10), "", nil)
+	if(err != nil) {
+		return nil, err
+	}
+
+	var plan multi_plan
+	err = json.NewDecoder(res.Body).Decode(&plan)
+	res.Body.Close()
+	if(res.StatusCode != 201) {
+		return nil, fmt.Errorf("download: %s", res.Status)
+	}
+	if(err != nil) {
+		return nil, fmt.Errorf("download: bad plan: %v", err)
+	}
+
+	type outcome struct {
+		n   int64
+		err error
+	}
+	done := make(chan outcome, len(plan.URLs))
+
+	start := time.Now()
+	for _, path := range plan.URLs {
+		go func(path string) {
+			res, err := client.Get(o.endpoint(strings.TrimPrefix(path, "/")))
+			if(err != nil) {
+				done <- outcome{0, err}
+				return
+			}
+			defer res.Body.Close()
+			if(res.StatusCode != 200) {
+				done <- outcome{0, fmt.Errorf("download: %s", res.Status)}
+				return
+			}
+			n, err := drain_body(res.Body)
+			done <- outcome{n, err}
+		}(path)
+	}
+
+	var total int64
+	for range plan.URLs {
+		r := <-done
+		total += r.n
+		if(r.err != nil && err == nil) {
+			err = r.err
+		}
+	}
+	elapsed := time.Since(start)
+	if(err != nil) {
+		return nil, err
+	}
+
+	report := &transfer_report{Bytes: total, Streams: plan.Streams, Seconds: elapsed.Seconds(), Mbps: mbps(total, elapsed)}
+
+	res, err = client.Get(o.endpoint("down/multi/" + plan.ID))
+	if(err == nil) {
+		var status multi_status
+		if(json.NewDecoder(res.Body).Decode(&status) == nil) {
+			report.ServerMbps = status.Mbps
+		}
+		res.Body.Close()
+	}
+	return report, nil
+}
+
+/*
+ * Push a payload to /up and time it.
+ */
+func client_upload(client *http.Client, o client_options) (*transfer_report, error) {
+	id := client_start_test()
+	defer client_running_test.Store("")
+	target := o.endpoint("up") + "?test_id=" + id + o.test_query()
+	req, err := http.NewRequest("PUT", target, payload_reader(o.bytes))
+	if(err != nil) {
+		return nil, err
+	}
+	req.ContentLength = o.bytes
+
+	start := time.Now()
+	res, err := client.Do(req)
+	if(err != nil) {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var summary upload_summary
+	err = json.NewDecoder(res.Body).Decode(&summary)
+	elapsed := time.Since(start)
+	if(res.StatusCode != 200) {
+		return nil, fmt.Errorf("upload: %s", res.Status)
+	}
+	if(err != nil) {
+		return nil, fmt.Errorf("upload: bad summary: %v", err)
+	}
+
+	return &transfer_report{
+		Bytes:      summary.Bytes,
+		Seconds:    elapsed.Seconds(),
+		Mbps:       mbps(summary.Bytes, elapsed),
+		ServerMbps: summary.Mbps,
+	}, nil
+}
+
+/*
+ * Print a report as an aligned table.
+ */
+func print_client_report(w io.Writer, r client_report) {
+	t := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(t, "Server\t%s\n", r.Server)
+	if(r.DNS != nil) {
+		for _, f := range []struct {
+			name   string
+			lookup dns_lookup
+		}{{"DNS A", r.DNS.A}, {"DNS AAAA", r.DNS.AAAA}} {
+			if(f.lookup.Error != "") {
+				fmt.Fprintf(t, "%s\t%s\n", f.name, f.lookup.Error)
+				continue
+			}
+			fmt.Fprintf(t, "%s\t%.2f ms first\t%.2f ms cached\tvia %s\t%s\n",
+				f.name, f.lookup.FirstMs, f.lookup.CachedMs, r.DNS.Resolver, strings.Join(f.lookup.Addresses, " "))
+		}
+	}
+	if(r.Setup != nil) {
+		fmt.Fprintf(t, "Setup\t%.2f ms DNS\t%.2f ms connect\t%.2f ms TLS\t%.2f ms TTFB\n",
+			r.Setup.DNSMs, r.Setup.ConnectMs, r.Setup.TLSMs, r.Setup.TTFBMs)
+		fmt.Fprintf(t, "\t%.2f ms fresh\t%.2f ms reused\t%.2f ms at server\t%.2f ms TLS at server\n",
+			r.Setup.TotalMs, r.Setup.ReusedMs, r.Setup.ServerMs, r.Setup.ServerTLSMs)
+	}
+	if(r.MTU != nil) {
+		fmt.Fprintf(t, "MTU\t%d bytes\t%d byte echo\t%d bytes at server", r.MTU.MTU, r.MTU.LargestEcho, r.MTU.Received)
+		if(!r.MTU.DontFragment) {
+			fmt.Fprintf(t, "\tserver can't set don't-fragment")
+		}
+		fmt.Fprintln(t)
+	}
+	fmt.Fprintf(t, "Latency\t%.2f ms min\t%.2f ms avg\t%.2f ms max\t%.2f ms jitter\n",
+		r.Latency.MinMs, r.Latency.AvgMs, r.Latency.MaxMs, r.Latency.JitterMs)
+	if(r.Bufferbloat != nil) {
+		fmt.Fprintf(t, "Bufferbloat\t%s\t%.2f ms idle\t%.2f ms loaded\t+%.2f ms\n",
+			r.Bufferbloat.Grade, r.Bufferbloat.IdleMs, r.Bufferbloat.LoadedMs, r.Bufferbloat.IncreaseMs)
+	}
+	fmt.Fprintf(t, "Download\t%.2f Mbps\t%d bytes\t%.3f s",
+		r.Download.Mbps, r.Download.Bytes, r.Download.Seconds)
+	if(r.Download.Streams > 1) {
+		fmt.Fprintf(t, "\t%.2f Mbps at server over %d streams", r.Download.ServerMbps, r.Download.Streams)
+	}
+	fmt.Fprintln(t)
+	fmt.Fprintf(t, "Upload\t%.2f Mbps\t%d bytes\t%.3f s\t%.2f Mbps at server\n",
+		r.Upload.Mbps, r.Upload.Bytes, r.Upload.Seconds, r.Upload.ServerMbps)
+	if(r.Duplex != nil) {
+		fmt.Fprintf(t, "Duplex\t%.2f Mbps\t%.2f Mbps down\t%.2f Mbps up\t%.3f s overlap\n",
+			r.Duplex.Mbps, r.Duplex.DownMbps, r.Duplex.UpMbps, r.Duplex.OverlapSeconds)
+	}
+	if(r.Stack != nil) {
+		for _, f := range []struct {
+			name   string
+			report family_report
+		}{{"IPv4", r.Stack.IPv4}, {"IPv6", r.Stack.IPv6}} {
+			if(f.report.Error != "") {
+				fmt.Fprintf(t, "%s\t%s\n", f.name, f.report.Error)
+				continue
+			}
+			fmt.Fprintf(t, "%s\t%.2f Mbps\t%.2f ms avg\t%s\n", f.name, f.report.Mbps, f.report.LatencyMs, f.report.ServerIP)
+		}
+		if(r.Stack.IPv4.Error == "" && r.Stack.IPv6.Error == "") {
+			fmt.Fprintf(t, "IPv6 - IPv4\t%+.2f Mbps\t%+.2f ms\n", r.Stack.MbpsDelta, r.Stack.LatencyDeltaMs)
+		}
+	}
+	if(r.Asym != nil) {
+		fmt.Fprintf(t, "Asymmetry\t%s\t%.2f Mbps down\t%.2f Mbps up\t%.2f Mbps loaded\t%.1f%% collapse\n",
+			r.Asym.Verdict, r.Asym.Down.Mbps, r.Asym.Up.Mbps, r.Asym.Loaded.Mbps, r.Asym.CollapsePct)
+		fmt.Fprintf(t, "\t%.2f ms skew\t%.2f ms loaded skew\t%.2f Mbps flood\n",
+			r.Asym.Down.SkewMs, r.Asym.Loaded.SkewMs, r.Asym.Loaded.FloodMbps)
+	}
+	for _, d := range r.Disguises {
+		fmt.Fprintf(t, "As %s\t%.2f Mbps\t%+.1f%% against plain\n", d.As, d.Mbps, d.Difference)
+	}
+	if(r.Traceroute != nil) {
+		fmt.Fprintf(t, "Traceroute\t%s", r.Traceroute.Target)
+		if(r.Traceroute.Error != "") {
+			fmt.Fprintf(t, "\t%s", r.Traceroute.Error)
+		} else if(!r.Traceroute.Reached) {
+			fmt.Fprintf(t, "\tnot reached")
+		}
+		fmt.Fprintln(t)
+		for _, hop := range r.Traceroute.Hops {
+			address := hop.Address
+			if(address == "") {
+				address = "*"
+			}
+			fmt.Fprintf(t, "%d\t%s", hop.TTL, address)
+			for _, rtt := range hop.RTTsMs {
+				fmt.Fprintf(t, "\t%.2f ms", rtt)
+			}
+			for range hop.Lost {
+				fmt.Fprintf(t, "\t*")
+			}
+			if(hop.Unreachable) {
+				fmt.Fprintf(t, "\tunreachable")
+			}
+			fmt.Fprintln(t)
+		}
+	}
+	t.Flush()
+}
+
+/*
+ * Run latency, download and upload tests against a gost server,
+ * stopping at the first that fails.
+ */
+func run_client_tests(client *http.Client, o client_options) (client_report, error) {
+	var err error
+	report := client_report{Server: o.server.String(), DNS: client_dns(o)}
+
+	if(o.setups > 0) {
+		report.Setup, err = client_setup(client, o)
+		if(err != nil) {
+			return report, err
+		}
+	}
+	if(o.mtu) {
+		report.MTU, err = client_mtu(client, o)
+		if(err != nil) {
+			return report, err
+		}
+	}
+	if(o.bloat) {
+		report.Bufferbloat, err = client_bufferbloat(client, o)
+		if(err != nil) {
+			return report, err
+		}
+	}
+	report.Latency, err = client_latency(client, o)
+	if(err == nil && o.streams > 1) {
+		report.Download, err = client_download_multi(client, o)
+	} else if(err == nil) {
+		report.Download, err = client_download(client, o)
+	}
+	if(err == nil && len(o.dresses) > 0) {
+		report.Disguises, err = client_disguises(client, o, report.Download)
+	}
+	if(err == nil) {
+		report.Upload, err = client_upload(client, o)
+	}
+	if(err == nil && o.duplex) {
+		report.Duplex, err = client_duplex(client, o)
+	}
+	if(err == nil && o.stack) {
+		report.Stack = client_stack(o)
+	}
+	if(err == nil && o.asym) {
+		report.Asym, err = client_asym(o)
+	}
+	if(err == nil && o.trace) {
+		report.Traceroute = client_traceroute(o)
+	}
+	return report, err
+}
+
+/*
+ * Run the tests and print what we found.  Returns the process exit status.
+ */
+func run_client(args []string) int {
+	o, err := parse_client_options(args)
+	if(err == flag.ErrHelp) {
+		return 0
+	}
+	if(err != nil) {
+		fmt.Fprintln(os.Stderr, "gost client:", err)
+		return 2
+	}
+
+	go client_cancel_on_interrupt(o)
+	report, err := run_client_tests(new_test_client(o), o)
+	if(err != nil) {
+		fmt.Fprintln(os.Stderr, "gost client:", err)
+		return 1
+	}
+
+	if(o.json) {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		print_client_report(os.Stdout, report)
+	}
+	return 0
+}
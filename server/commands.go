@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+ * gost is one binary with subcommands, so that client and admin tools
+ * can join the server without one big set of flags:
+ *
+ *	gost serve [flags]          run the server
+ *	gost client [flags] URL     test a gost server
+ *	gost check-config [flags]   check the configuration, then exit
+ *	gost healthcheck [flags]    ask this machine's gost whether it's ready
+ *	gost service ACTION         install or control the Windows service
+ *	gost version                print version and build information
+ *
+ * Each takes flags of its own after its name.  With no subcommand, or
+ * flags first, gost serves, as it always has.
+ */
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "run the server (the default)", run_serve},
+		{"client", "test a gost server and report", run_client},
+		{"check-config", "load and check the configuration, then exit", run_check_config},
+		{"healthcheck", "ask the local server whether it's ready, for container health checks", run_healthcheck},
+		{"service", "install, start, stop or remove the Windows service", run_service},
+		{"version", "print version and build information", run_version},
+		{"help", "list the commands", run_help},
+	}
+}
+
+/*
+ * The arguments the server was started with, less the subcommand, for
+ * reloads to read the flags from again.
+ */
+var server_args []string
+
+func find_command(name string) *command {
+	for i := range commands {
+		if(commands[i].name == name) {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+/*
+ * Run the subcommand args name, and return the exit status.
+ */
+func run_command(args []string) int {
+	if(len(args) == 0 || strings.HasPrefix(args[0], "-")) {
+		return run_serve(args)
+	}
+	cmd := find_command(args[0])
+	if(cmd == nil) {
+		fmt.Fprintf(os.Stderr, "gost: unknown command %q\n\n", args[0])
+		print_commands(os.Stderr)
+		return 2
+	}
+	return cmd.run(args[1:])
+}
+
+func print_commands(w io.Writer) {
+	fmt.Fprintln(w, "Usage: gost <command> [flags]")
+	fmt.Fprintln(w)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-14s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run gost <command> -h for a command's flags.")
+}
+
+func run_serve(args []string) int {
+	server_args = args
+	receive_configuration()
+	go_reload_on_hangup()
+	go_upgrade_on_signal()
+	start_rate_meter()
+	go_serve()
+	wait_for_death()
+	return 0
+}
+
+/*
+ * Where the configuration came from, for messages about it.
+ */
+func config_source(c configuration) string {
+	if(c.config_file == "") {
+		return "flags and environment"
+	}
+	return c.config_file
+}
+
+func run_version(args []string) int {
+	if(len(args) > 0) {
+		fmt.Fprintln(os.Stderr, "gost version: takes no arguments")
+		return 2
+	}
+	print_version()
+	return 0
+}
+
+func run_help(args []string) int {
+	if(len(args) > 0) {
+		cmd := find_command(args[0])
+		if(cmd != nil && cmd.name != "help") {
+			return cmd.run([]string{"-h"})
+		}
+	}
+	print_commands(os.Stdout)
+	return 0
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Compressible downloads, for finding out what a middlebox or CDN
+ * compresses.  The usual test payloads go out uncompressed with
+ * no-transform, so that nothing on the way should touch them;
+ * /down/compressible is the opposite.  It sends ?content=text, json,
+ * zero or random (the control, which doesn't compress), without
+ * no-transform, and gzips it itself if the request's Accept-Encoding
+ * allows.  X-Gost-Content-Bytes says how much content went out, so a
+ * client that got fewer bytes, or a Content-Encoding gost didn't send,
+ * knows something on the way compressed it.
+ */
+const compressible_path = "/down/compressible"
+
+/*
+ * Lines for the text and json content, repeated with a counter so that
+ * they compress well but not absurdly so.
+ */
+func compressible_block(format string) []byte {
+	b := make([]byte, 0, payload_block_size + 256)
+	for i := 0; len(b) < payload_block_size; i++ {
+		b = fmt.Appendf(b, format, i, i % 97, i * 31 % 1000)
+	}
+	return b[:payload_block_size]
+}
+
+var compressible_contents = map[string]struct {
+	content_type string
+	block        []byte
+}{
+	"text":   {"text/plain; charset=utf-8", compressible_block("%08d The quick brown fox jumps over the lazy dog, %d times out of %d.\n")},
+	"json":   {"application/json", compressible_block("{\"id\": %d, \"name\": \"gost\", \"shard\": %d, \"score\": %d, \"tags\": [\"speed\", \"test\"]},\n")},
+	"zero":   {"application/octet-stream", zero_block},
+	"random": {"application/octet-stream", random_block},
+}
+
+/*
+ * Whether the request's Accept-Encoding takes gzip.
+ */
+func accepts_gzip(req *http.Request) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if(!strings.EqualFold(strings.TrimSpace(coding), "gzip") && strings.TrimSpace(coding) != "*") {
+			continue
+		}
+		q, found := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		if(!found) {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
+
+/*
+ * GET: A download of compressible content, gzipped if the client
+ * accepts it.  The test's size is what went on the wire.
+ */
+func route_down_compressible(res http.ResponseWriter, req *http.Request) {
+	if(req.Method != "GET" && req.Method != "HEAD" && req.Method != "") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+
+	n, err := requested_bytes(req, down_default_bytes)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+	if(n > request_settings(req).max_test_bytes) {
+		res.WriteHeader(413) // Request Entity Too Large
+		io.WriteString(res, "Requested size exceeds the server limit")
+		return
+	}
+
+	name := req.URL.Query().Get("content")
+	if(name == "") {
+		name = "text"
+	}
+	content, ok := compressible_contents[name]
+	if(!ok) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, "content must be text, json, zero or random")
+		return
+	}
+
+	gzipped := accepts_gzip(req)
+	h := res.Header()
+	h.Set("Content-Type", content.content_type)
+	h.Set("Cache-Control", "no-store")
+	h.Set("Vary", "Accept-Encoding")
+	h.Set("X-Gost-Content-Bytes", strconv.FormatInt(n, 10))
+	h.Set("Trailer", measurement_headers)
+	if(gzipped) {
+		h.Set("Content-Encoding", "gzip")
+	} else {
+		h.Set("Content-Length", strconv.FormatInt(n, 10))
+	}
+	if(req.Method == "HEAD") {
+		return
+	}
+
+	t := begin_test(res, req, "down", n)
+	if(t == nil) {
+		return
+	}
+	t.content_bytes = n
+	t.encoding = "identity"
+
+	source := &payload_source{block: content.block}
+	out := t.writer(res)
+	if(gzipped) {
+		t.encoding = "gzip"
+		gz, _ := gzip.NewWriterLevel(out, gzip.BestSpeed)
+		_, err = write_source_until(source, gz, n, time.Time{})
+		if(err == nil) {
+			err = gz.Close()
+		}
+	} else {
+		_, err = write_source_until(source, out, n, time.Time{})
+	}
+	write_measurement_headers(res, t.end(t.moved.Load(), err))
+}
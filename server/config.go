@@ -0,0 +1,2042 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Log verbosity levels, from least to most chatty.
+ */
+const (
+	log_level_error = iota
+	log_level_info
+	log_level_debug
+)
+
+var log_level_names = map[string]int{
+	"error": log_level_error,
+	"info":  log_level_info,
+	"debug": log_level_debug,
+}
+
+/*
+ * Everything that can be tuned without recompiling.  The running
+ * instance is published through settings() so that a reload can swap
+ * it out from under handlers that are already in flight.
+ */
+type configuration struct {
+	config_file  string
+	bind_address string
+	http_port    int
+	https_port   int
+	cert_file    string
+	key_file     string
+	log_level    int
+	log_format   string
+
+	// Write the log, and the access log, to these files rather than
+	// stderr, rotating them past a size or age and keeping so many
+	// rotated copies, gzipped or not.
+	log_file     string
+	access_log   string
+	log_max_size int64
+	log_max_age  time.Duration
+	log_keep     int
+	log_compress bool
+
+	// Log to syslog instead: local, or udp://, tcp:// or tls:// and an
+	// address, with this facility and tag.
+	syslog_address  string
+	syslog_facility string
+	syslog_tag      string
+
+	// Largest payload a single test may move, and the longest a
+	// duration-based test may run.
+	max_test_bytes    int64
+	max_test_duration time.Duration
+
+	// At most this many tests at once, and new ones are refused while
+	// they're moving more than this many bits per second.  Zero means
+	// no limit.
+	max_active_tests  int
+	max_aggregate_bps int64
+
+	// Per client address: at most this many tests at once, and this
+	// many bytes in any ip_window.  Zero means no limit.
+	ip_max_active int
+	ip_max_bytes  int64
+	ip_window     time.Duration
+
+	// Defences against clients that hold connections open: the largest
+	// request header, how long a client has to send it, and how long an
+	// idle keep-alive connection is kept.
+	max_header_bytes    int64
+	read_header_timeout time.Duration
+	idle_timeout        time.Duration
+
+	// Most a single connection may upload across all its requests, zero
+	// for no limit beyond max_test_bytes each, and the rate below which
+	// an upload is cut off, judged over each min_rate_window.
+	max_conn_upload int64
+	min_upload_bps  int64
+	min_rate_window time.Duration
+
+	// Where to keep pre-generated files for /down?source=file, and the
+	// largest to generate.  An empty directory means none.
+	files_dir string
+	files_max int64
+
+	// What payloads are made of: random or zero.
+	payload_fill string
+
+	// Burst size for tests paced with ?limit=, unless they say.
+	throttle_burst int64
+
+	// How many test results /results remembers, for how long, and
+	// where they're kept across restarts.
+	results_kept    int
+	results_max_age time.Duration
+	results_file    string
+
+	// An SQLite database that keeps results too, up to this many rows,
+	// for history longer than the ring's.
+	results_db      string
+	results_db_rows int
+
+	// How far short of a rate asked for with ?expect= a test may fall
+	// and still pass, in percent.
+	expect_tolerance int
+
+	// How long shutdown waits for in-flight tests.
+	drain_timeout time.Duration
+
+	// Bearer tokens for the bandwidth endpoints.  Empty means open.
+	auth_tokens_file string
+
+	// Accept JWTs from this OIDC issuer, or signed by the keys at this
+	// JWKS URL, made out to this audience, on the admin API and, if
+	// jwt_tests, the test endpoints, as the grants allow.
+	jwt_issuer   string
+	jwt_jwks_url string
+	jwt_audience string
+	jwt_tests    bool
+	jwt_grants   []jwt_grant
+
+	// Comma-separated origins allowed to call the test endpoints from a
+	// browser, or "*" for any, with the methods and request headers they
+	// may use, and how long browsers may cache a preflight.  Empty means
+	// no CORS.
+	cors_origins string
+	cors_methods string
+	cors_headers string
+	cors_max_age time.Duration
+
+	// Proxies whose X-Forwarded-For is believed, and whether the HTTP
+	// listeners expect a PROXY protocol header on every connection.
+	trusted_proxies []netip.Prefix
+	proxy_protocol  bool
+
+	// MaxMind ASN and country databases for /ip and results.  Empty
+	// means none.
+	geoip_asn_db     string
+	geoip_country_db string
+
+	// Offer HTTP/2 over TLS, and cleartext HTTP/2 on the plain listener.
+	http2 bool
+	h2c   bool
+
+	// Get the TLS certificate for these comma-separated domains from an
+	// ACME CA rather than the cert and key files.  Empty means off.
+	acme_domain    string
+	acme_email     string
+	acme_directory string
+	acme_cache_dir string
+
+	// Write the self-signed certificate made up when the cert and key
+	// files are missing to those paths, rather than keeping it in memory.
+	self_signed_save bool
+
+	// TLS policy: the lowest version, as 1.0 to 1.3, and comma-separated
+	// TLS 1.2 cipher suites, curves and ALPN protocols, empty for Go's
+	// defaults.  With a client CA bundle, a client certificate it
+	// verifies stands in for a token.
+	tls_min_version string
+	tls_ciphers     string
+	tls_curves      string
+	tls_alpn        string
+	tls_client_ca   string
+
+	// Echo UDP datagrams on this port for loss and jitter tests.  Zero
+	// means off.
+	udp_port int
+
+	// Speak iperf3 on this port.  Zero means off.
+	iperf_port int
+
+	// Serve HTTP/3 over QUIC on this UDP port.  Zero means off.
+	h3_port int
+
+	// Other gost servers to test on a schedule, what this one is called
+	// among them, and another's /mesh to push results to, with a token
+	// for it.
+	peers         []peer_spec
+	node_name     string
+	mesh_push     string
+	mesh_token    string
+	mesh_insecure bool
+
+	// Where to POST finished results, and the file deliveries that
+	// never got through are appended to.
+	webhooks             []webhook_spec
+	webhook_dead_letters string
+
+	// When tests may start, and a file whose existence stops them.
+	test_windows     []test_window
+	maintenance_file string
+
+	// Rules on recent results that fire alerts.
+	alerts []alert_rule
+
+	// Tenants, with their own tokens, limits and results.
+	tenants []tenant_spec
+
+	// Virtual hosts, by Host and SNI, with their own certificates,
+	// limits and results.
+	vhosts []vhost_spec
+
+	// Send metrics to a StatsD agent at this address, with names under
+	// this prefix, and DogStatsD tags.  Empty means off.
+	statsd_address string
+	statsd_prefix  string
+	dogstatsd      bool
+
+	// Export trace spans of tests to the OpenTelemetry collector at this
+	// URL.  Empty means off.
+	otlp_endpoint string
+
+	// Serve the admin API on this address.  Empty means off.  Add
+	// pprof and trace endpoints to it, which need admin tokens or JWTs.
+	admin_address string
+	admin_pprof   bool
+
+	// Bearer tokens for the admin API, apart from the tests' own.
+	admin_tokens_file string
+
+	// Serve the gRPC service on this address.  Empty means off.
+	grpc_address string
+
+	// HTTP listeners listed in the config file.  Without any, there's a
+	// plain one on http_port, a TLS one on https_port, and a plain one
+	// on the unix socket if there is one.
+	listeners   []listener_spec
+	unix_socket string
+	unix_mode   os.FileMode
+
+	// The address family of the default HTTP listeners: "dual" for one
+	// socket taking both, or "ipv4" or "ipv6".
+	listen_family string
+
+	// Sockets, each with its own accept loop, that every TCP HTTP
+	// listener opens with SO_REUSEPORT.  1 is a plain listener.
+	acceptors int
+
+	// Socket tuning for the default HTTP listeners: send and receive
+	// buffer sizes, zero for the kernel's, and whether to turn Nagle's
+	// algorithm off, as Go does unless told otherwise.
+	tcp_sndbuf  int64
+	tcp_rcvbuf  int64
+	tcp_nodelay bool
+
+	// How much each write a download makes hands the connection.
+	write_size int64
+
+	// GOMAXPROCS.  Zero leaves it to Go.
+	gomaxprocs int
+
+	// TCP congestion control for connections each listener accepts.
+	// Empty means the system default.
+	http_congestion  string
+	https_congestion string
+	iperf_congestion string
+
+	// DSCP marks on what each listener sends.  Empty leaves it unmarked.
+	http_dscp  string
+	https_dscp string
+
+	// Print the version and exit.
+	show_version bool
+}
+
+var defaults = configuration{
+	bind_address: "",
+	http_port:    8000,
+	https_port:   8443,
+	cert_file:    "gost.crt",
+	key_file:     "gost.key",
+	log_level:    log_level_info,
+	log_format:   "text",
+	log_max_size: 100 * 1000 * 1000,
+	log_keep:     10,
+	log_compress: true,
+
+	syslog_facility: "daemon",
+	syslog_tag:      "gost",
+
+	max_test_bytes:    10 * 1000 * 1000 * 1000,
+	max_test_duration: time.Minute,
+	max_header_bytes:  64 * 1024,
+	throttle_burst:    64 * 1000,
+	files_max:         1000 * 1000 * 1000,
+	payload_fill:      "random",
+	cors_methods:      "GET, HEAD, POST, PUT",
+	cors_headers:      "Authorization, Content-Type",
+	cors_max_age:      10 * time.Minute,
+	results_kept:      1000,
+	results_db_rows:   1000000,
+	expect_tolerance:  10,
+	drain_timeout:     30 * time.Second,
+	http2:             true,
+	h2c:               false,
+	acme_directory:    acme_lets_encrypt,
+	acme_cache_dir:    "acme",
+	unix_mode:         0660,
+	listen_family:     "dual",
+	acceptors:         1,
+	tcp_nodelay:       true,
+	write_size:        down_chunk_size,
+	statsd_prefix:     "gost.",
+
+	read_header_timeout: 10 * time.Second,
+	idle_timeout:        2 * time.Minute,
+	min_rate_window:     10 * time.Second,
+	ip_window:           24 * time.Hour,
+}
+
+var live_config atomic.Pointer[configuration]
+
+/*
+ * The configuration currently in force.  Callers should fetch it once
+ * per request and hang on to it rather than calling this repeatedly.
+ */
+func settings() *configuration {
+	c := live_config.Load()
+	if(c == nil) {
+		return &defaults
+	}
+	return c
+}
+
+/*
+ * Put a new configuration into force.
+ */
+func apply_configuration(c configuration) {
+	live_config.Store(&c)
+	configure_logging(&c)
+	apply_gomaxprocs(&c)
+}
+
+/*
+ * The HTTP listeners to run: those from the config file, or else the
+ * usual plain and TLS pair.
+ */
+func (c *configuration) listener_specs() []listener_spec {
+	if(len(c.listeners) > 0) {
+		return c.listeners
+	}
+	specs := []listener_spec{
+		{
+			name:       "http",
+			address:    net.JoinHostPort(c.bind_address, strconv.Itoa(c.http_port)),
+			http2:      c.h2c,
+			congestion: c.http_congestion,
+			dscp:       c.http_dscp,
+			family:     c.listen_family,
+			sndbuf:     int(c.tcp_sndbuf),
+			rcvbuf:     int(c.tcp_rcvbuf),
+			nagle:      !c.tcp_nodelay,
+		},
+		{
+			name:       "https",
+			address:    net.JoinHostPort(c.bind_address, strconv.Itoa(c.https_port)),
+			tls:        true,
+			http2:      c.http2,
+			congestion: c.https_congestion,
+			dscp:       c.https_dscp,
+			family:     c.listen_family,
+			sndbuf:     int(c.tcp_sndbuf),
+			rcvbuf:     int(c.tcp_rcvbuf),
+			nagle:      !c.tcp_nodelay,
+		},
+	}
+	if(c.unix_socket != "") {
+		specs = append(specs, listener_spec{name: "unix", unix: c.unix_socket, mode: c.unix_mode})
+	}
+	return specs
+}
+
+/*
+ * Make sure the configuration is something we can actually run with.
+ */
+func (c *configuration) validate() error {
+	if(c.bind_address != "" && net.ParseIP(c.bind_address) == nil) {
+		_, err := net.LookupHost(c.bind_address)
+		if(err != nil) {
+			return fmt.Errorf("invalid bind address %q: %v", c.bind_address, err)
+		}
+	}
+
+	names := map[string]bool{"iperf": true, "udp": true, "admin": true, "grpc": true}
+	addresses := map[string]string{}
+	for _, spec := range c.listener_specs() {
+		err := spec.validate()
+		if(err != nil) {
+			return err
+		}
+		if(names[spec.name]) {
+			return fmt.Errorf("listener name %s is taken", spec.name)
+		}
+		for _, bind := range spec.binds() {
+			other, taken := addresses[bind]
+			if(taken) {
+				return fmt.Errorf("listeners %s and %s both want %s", other, spec.name, spec.where())
+			}
+			addresses[bind] = spec.name
+		}
+		names[spec.name] = true
+	}
+
+	if(c.tcp_sndbuf < 0 || c.tcp_sndbuf > math.MaxInt32 || c.tcp_rcvbuf < 0 || c.tcp_rcvbuf > math.MaxInt32) {
+		return fmt.Errorf("socket buffer sizes must be between 0 and %d", math.MaxInt32)
+	}
+	if(c.write_size < min_write_size || c.write_size > payload_block_size) {
+		return fmt.Errorf("write size must be between %d and %d bytes", min_write_size, payload_block_size)
+	}
+	if(c.gomaxprocs < 0) {
+		return errors.New("gomaxprocs must not be negative")
+	}
+
+	if(c.acceptors < 1 || c.acceptors > 1024) {
+		return fmt.Errorf("acceptors must be between 1 and 1024, not %d", c.acceptors)
+	}
+	if(c.acceptors > 1) {
+		err := check_reuseport()
+		if(err != nil) {
+			return fmt.Errorf("acceptors: %v", err)
+		}
+	}
+
+	if(c.udp_port < 0 || c.udp_port > 65535) {
+		return fmt.Errorf("invalid udp port %d", c.udp_port)
+	}
+
+	if(c.iperf_port < 0 || c.iperf_port > 65535) {
+		return fmt.Errorf("invalid iperf port %d", c.iperf_port)
+	}
+
+	if(c.h3_port < 0 || c.h3_port > 65535) {
+		return fmt.Errorf("invalid h3 port %d", c.h3_port)
+	}
+	if(c.h3_port != 0 && c.h3_port == c.udp_port) {
+		return fmt.Errorf("HTTP/3 and the UDP echo both want port %d", c.h3_port)
+	}
+	if(c.h3_port != 0 && !c.any_tls()) {
+		return errors.New("HTTP/3 needs a TLS listener for its certificate")
+	}
+
+	if(c.admin_address != "") {
+		err := c.admin_spec().validate()
+		if(err != nil) {
+			return err
+		}
+		for _, bind := range c.admin_spec().binds() {
+			other, taken := addresses[bind]
+			if(taken) {
+				return fmt.Errorf("listener %s and the admin API both want %s", other, c.admin_address)
+			}
+			addresses[bind] = "admin"
+		}
+	}
+
+	if(c.grpc_address != "") {
+		err := c.grpc_spec().validate()
+		if(err != nil) {
+			return err
+		}
+		for _, bind := range c.grpc_spec().binds() {
+			other, taken := addresses[bind]
+			if(taken) {
+				return fmt.Errorf("listener %s and the gRPC service both want %s", other, c.grpc_address)
+			}
+			addresses[bind] = "grpc"
+		}
+	}
+
+	if(c.iperf_port != 0) {
+		iperf := listener_spec{name: "iperf", address: net.JoinHostPort(c.bind_address, strconv.Itoa(c.iperf_port))}
+		for _, bind := range iperf.binds() {
+			other, taken := addresses[bind]
+			if(taken) {
+				return fmt.Errorf("listener %s and iperf3 both want %s", other, iperf.address)
+			}
+		}
+	}
+
+	webhook_names := map[string]bool{}
+	for _, w := range c.webhooks {
+		if(w.name == "" || webhook_names[w.name]) {
+			return fmt.Errorf("webhook %s needs a name of its own", w.url.Redacted())
+		}
+		webhook_names[w.name] = true
+		if(w.url.Scheme != "http" && w.url.Scheme != "https") {
+			return fmt.Errorf("webhook %s: unsupported URL scheme %q", w.name, w.url.Scheme)
+		}
+		if(w.below_bps < 0) {
+			return fmt.Errorf("webhook %s: below must not be negative", w.name)
+		}
+		if(w.direction != "" && w.direction != "down" && w.direction != "up" && w.direction != "duplex") {
+			return fmt.Errorf("webhook %s: unknown direction %q", w.name, w.direction)
+		}
+	}
+
+	alert_names := map[string]bool{}
+	for _, r := range c.alerts {
+		if(r.name == "" || alert_names[r.name]) {
+			return fmt.Errorf("alert %q needs a name of its own", r.name)
+		}
+		alert_names[r.name] = true
+		if(r.direction != "" && r.direction != "down" && r.direction != "up" && r.direction != "duplex") {
+			return fmt.Errorf("alert %s: unknown direction %q", r.name, r.direction)
+		}
+		if(!valid_alert_stat(r.stat)) {
+			return fmt.Errorf("alert %s: stat must be min, max, mean, median or p1 to p99, not %q", r.name, r.stat)
+		}
+		if(r.window <= 0) {
+			return fmt.Errorf("alert %s: over must be positive", r.name)
+		}
+		if(r.below_bps <= 0 && r.above_bps <= 0) {
+			return fmt.Errorf("alert %s: needs below or above", r.name)
+		}
+		if(r.min_tests < 1) {
+			return fmt.Errorf("alert %s: min_tests must be at least 1", r.name)
+		}
+	}
+
+	tenant_names := map[string]bool{}
+	tenant_tokens := map[string]string{}
+	for _, t := range c.tenants {
+		if(t.name == "" || tenant_names[t.name]) {
+			return fmt.Errorf("tenant %q needs a name of its own", t.name)
+		}
+		tenant_names[t.name] = true
+		if(len(t.tokens) == 0) {
+			return fmt.Errorf("tenant %s: needs at least one token", t.name)
+		}
+		for _, token := range t.tokens {
+			if(token == "") {
+				return fmt.Errorf("tenant %s: tokens must not be empty", t.name)
+			}
+			if(tenant_tokens[token] != "") {
+				return fmt.Errorf("tenant %s: shares a token with tenant %s", t.name, tenant_tokens[token])
+			}
+			tenant_tokens[token] = t.name
+		}
+		if(t.max_active < 0 || t.max_bytes < 0) {
+			return fmt.Errorf("tenant %s: limits must not be negative", t.name)
+		}
+		if(t.window <= 0) {
+			return fmt.Errorf("tenant %s: window must be positive", t.name)
+		}
+	}
+
+	vhost_hosts := map[string]string{}
+	for _, v := range c.vhosts {
+		if(len(v.hosts) == 0) {
+			return errors.New("each vhost needs at least one host")
+		}
+		for _, host := range v.hosts {
+			bare := strings.TrimPrefix(host, "*.")
+			if(bare == "" || strings.ContainsAny(bare, ":/* ") || host != strings.ToLower(host)) {
+				return fmt.Errorf("vhost %s: %q must be a lower-case host name, or *. and one", v.name, host)
+			}
+			if(vhost_hosts[host] != "") {
+				return fmt.Errorf("vhost %s: shares %s with vhost %s", v.name, host, vhost_hosts[host])
+			}
+			vhost_hosts[host] = v.name
+		}
+		if((v.cert_file == "") != (v.key_file == "")) {
+			return fmt.Errorf("vhost %s: needs both a cert and a key, or neither", v.name)
+		}
+		if(v.cert_file != "" && !c.any_tls()) {
+			return fmt.Errorf("vhost %s: has a certificate but there's no TLS listener", v.name)
+		}
+		if(v.max_test_bytes < 0 || v.max_test_duration < 0 || v.max_active < 0 || v.max_bytes < 0) {
+			return fmt.Errorf("vhost %s: limits must not be negative", v.name)
+		}
+		if(v.window <= 0) {
+			return fmt.Errorf("vhost %s: window must be positive", v.name)
+		}
+	}
+
+	peer_names := map[string]bool{}
+	for _, p := range c.peers {
+		if(p.name == "" || peer_names[p.name]) {
+			return fmt.Errorf("peer %s needs a name of its own", p.url)
+		}
+		peer_names[p.name] = true
+		if(p.url.Scheme != "http" && p.url.Scheme != "https") {
+			return fmt.Errorf("peer %s: unsupported URL scheme %q", p.name, p.url.Scheme)
+		}
+		if(p.jitter < 0 || p.bytes < 1) {
+			return fmt.Errorf("peer %s: jitter must not be negative and bytes must be positive", p.name)
+		}
+		if(p.schedule.next(time.Now()).IsZero()) {
+			return fmt.Errorf("peer %s: schedule %q never fires", p.name, p.schedule.text)
+		}
+	}
+
+	if(c.statsd_address != "") {
+		_, _, err := net.SplitHostPort(c.statsd_address)
+		if(err != nil) {
+			return fmt.Errorf("StatsD address %q: %v", c.statsd_address, err)
+		}
+	}
+	if(c.otlp_endpoint != "") {
+		u, err := url.Parse(c.otlp_endpoint)
+		if(err != nil || (u.Scheme != "http" && u.Scheme != "https")) {
+			return fmt.Errorf("OTLP endpoint %q must be http or https", c.otlp_endpoint)
+		}
+	}
+	if(!header_safe(c.statsd_prefix) || strings.ContainsAny(c.statsd_prefix, ":|@# ")) {
+		return fmt.Errorf("StatsD prefix %q may not contain spaces, :, |, @ or #", c.statsd_prefix)
+	}
+
+	if(c.mesh_push != "") {
+		u, err := url.Parse(c.mesh_push)
+		if(err != nil || (u.Scheme != "http" && u.Scheme != "https")) {
+			return fmt.Errorf("mesh push URL %q must be http or https", c.mesh_push)
+		}
+	}
+
+	if(c.admin_pprof && (c.admin_address == "" || (c.admin_tokens_file == "" && !c.jwt_enabled()))) {
+		return errors.New("pprof needs -admin, and -admin-tokens or -jwt-issuer")
+	}
+
+	for _, where := range []struct {
+		name  string
+		value string
+	}{{"issuer", c.jwt_issuer}, {"JWKS URL", c.jwt_jwks_url}} {
+		if(where.value == "") {
+			continue
+		}
+		u, err := url.Parse(where.value)
+		if(err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			return fmt.Errorf("JWT %s %q must be an http or https URL", where.name, where.value)
+		}
+	}
+	if(c.jwt_tests && !c.jwt_enabled()) {
+		return errors.New("jwt-tests needs -jwt-issuer or -jwt-jwks")
+	}
+	for i, g := range c.jwt_grants {
+		if(g.claim == "" && g.value != "") {
+			return fmt.Errorf("JWT grant %d: a value needs a claim", i + 1)
+		}
+		if(g.max_bytes < 0) {
+			return fmt.Errorf("JWT grant %d: max_test_bytes must not be negative", i + 1)
+		}
+	}
+
+	for _, spec := range c.listener_specs() {
+		_, port, _ := net.SplitHostPort(spec.address)
+		if(c.iperf_port != 0 && port == strconv.Itoa(c.iperf_port)) {
+			return fmt.Errorf("iperf port must differ from the %s listener's", spec.name)
+		}
+	}
+
+	err := check_congestion(c.iperf_congestion)
+	if(err != nil) {
+		return fmt.Errorf("congestion control %q: %v", c.iperf_congestion, err)
+	}
+
+	if(!log_formats[c.log_format]) {
+		return fmt.Errorf("unknown log format %q", c.log_format)
+	}
+	if(c.log_max_size < 0 || c.log_max_age < 0 || c.log_keep < 0) {
+		return errors.New("log rotation settings must not be negative")
+	}
+	if(c.syslog_address != "") {
+		_, _, err := parse_syslog_address(c.syslog_address)
+		if(err != nil) {
+			return err
+		}
+		if(c.log_file != "") {
+			return errors.New("log to -log-file or -syslog, not both")
+		}
+	}
+	_, ok := syslog_facilities[c.syslog_facility]
+	if(!ok) {
+		return fmt.Errorf("unknown syslog facility %q", c.syslog_facility)
+	}
+
+	if(c.max_test_bytes < 1) {
+		return errors.New("max test size must be positive")
+	}
+
+	if(c.max_test_duration <= 0) {
+		return errors.New("max test duration must be positive")
+	}
+
+	if(c.max_active_tests < 0 || c.max_aggregate_bps < 0) {
+		return errors.New("test limits must not be negative")
+	}
+
+	if(c.max_header_bytes < 1 || c.max_header_bytes > math.MaxInt32) {
+		return errors.New("max header size must be positive and under 2G")
+	}
+
+	if(c.read_header_timeout <= 0 || c.idle_timeout <= 0) {
+		return errors.New("header and idle timeouts must be positive")
+	}
+
+	if(c.ip_max_active < 0 || c.ip_max_bytes < 0) {
+		return errors.New("client quotas must not be negative")
+	}
+
+	if(c.ip_window < time.Minute) {
+		return errors.New("client quota window must be at least 1m")
+	}
+
+	if(c.max_conn_upload < 0 || c.min_upload_bps < 0) {
+		return errors.New("upload limits must not be negative")
+	}
+
+	if(c.min_rate_window < time.Second) {
+		return errors.New("min rate window must be at least 1s")
+	}
+
+	if(c.results_kept < 1) {
+		return errors.New("results kept must be positive")
+	}
+
+	if(c.results_max_age < 0) {
+		return errors.New("results max age must not be negative")
+	}
+
+	if(c.results_db_rows < 1) {
+		return errors.New("results database rows must be positive")
+	}
+
+	if(c.expect_tolerance < 0 || c.expect_tolerance > 100) {
+		return errors.New("expect tolerance must be between 0 and 100 percent")
+	}
+
+	if(!payload_fills[c.payload_fill]) {
+		return fmt.Errorf("unknown payload %q", c.payload_fill)
+	}
+
+	if(c.throttle_burst <= 0) {
+		return errors.New("burst must be positive")
+	}
+
+	if(c.cors_max_age < 0) {
+		return errors.New("CORS max age must not be negative")
+	}
+
+	if(c.drain_timeout < 0) {
+		return errors.New("drain timeout must not be negative")
+	}
+
+	err = c.validate_tls_policy()
+	if(err != nil) {
+		return err
+	}
+
+	if(c.acme_domain == "" && (c.cert_file == "" || c.key_file == "")) {
+		return errors.New("cert and key paths must not be empty")
+	}
+
+	if(c.acme_domain != "" && (c.acme_directory == "" || c.acme_cache_dir == "")) {
+		return errors.New("ACME directory and cache paths must not be empty")
+	}
+
+	return nil
+}
+
+/*
+ * Look up a GOST_* environment variable.
+ */
+func env_string(name string, fallback string) string {
+	value, ok := os.LookupEnv("GOST_" + name)
+	if(ok) {
+		return value
+	}
+	return fallback
+}
+
+/*
+ * Look up a numeric GOST_* environment variable.  If it isn't a
+ * number, fallback stands and *bad gets the error, unless it already
+ * holds an earlier one.
+ */
+func env_int(name string, fallback int, bad *error) int {
+	value, ok := os.LookupEnv("GOST_" + name)
+	if(!ok) {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if(err != nil) {
+		if(*bad == nil) {
+			*bad = fmt.Errorf("GOST_%s: not a number: %q", name, value)
+		}
+		return fallback
+	}
+	return n
+}
+
+/*
+ * Look up a boolean GOST_* environment variable, with errors as for
+ * env_int().
+ */
+func env_bool(name string, fallback bool, bad *error) bool {
+	value, ok := os.LookupEnv("GOST_" + name)
+	if(!ok) {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+	if(err != nil) {
+		if(*bad == nil) {
+			*bad = fmt.Errorf("GOST_%s: not a boolean: %q", name, value)
+		}
+		return fallback
+	}
+	return b
+}
+
+/*
+ * Map a log level name onto its constant.
+ */
+func parse_log_level(name string) (int, error) {
+	level, ok := log_level_names[strings.ToLower(name)]
+	if(!ok) {
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+	return level, nil
+}
+
+/*
+ * Parse octal file permissions such as 0660.
+ */
+func parse_mode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if(err != nil || mode > 0777) {
+		return 0, fmt.Errorf("invalid mode %q", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+/*
+ * Map a log level constant back onto its name.
+ */
+func log_level_name(level int) string {
+	for name, l := range log_level_names {
+		if(l == level) {
+			return name
+		}
+	}
+	return "info"
+}
+
+/*
+ * The on-disk layout of a -config file.  Everything is optional; a
+ * missing key leaves the default alone.
+ */
+type config_file_layout struct {
+	Listen *struct {
+		Bind      *string `json:"bind"`
+		HTTPPort  *int    `json:"http_port"`
+		HTTPSPort *int    `json:"https_port"`
+		UDPPort   *int    `json:"udp_port"`
+		IperfPort *int    `json:"iperf_port"`
+		H3Port    *int    `json:"h3_port"`
+		Unix      *string `json:"unix"`
+		UnixMode  *string `json:"unix_mode"`
+		Family    *string `json:"family"`
+		Acceptors *int    `json:"acceptors"`
+	} `json:"listen"`
+	Listeners []struct {
+		Name       string `json:"name"`
+		Address    string `json:"address"`
+		Unix       string `json:"unix"`
+		Mode       string `json:"mode"`
+		TLS        bool   `json:"tls"`
+		HTTP2      *bool  `json:"http2"`
+		Congestion string `json:"congestion"`
+		DSCP       string `json:"dscp"`
+		Family     string `json:"family"`
+		SndBuf     string `json:"sndbuf"`
+		RcvBuf     string `json:"rcvbuf"`
+		NoDelay    *bool  `json:"nodelay"`
+	} `json:"listeners"`
+	TLS *struct {
+		Cert *string `json:"cert"`
+		Key  *string `json:"key"`
+		Save *bool   `json:"save_generated"`
+
+		MinVersion *string `json:"min_version"`
+		Ciphers    *string `json:"ciphers"`
+		Curves     *string `json:"curves"`
+		ALPN       *string `json:"alpn"`
+		ClientCA   *string `json:"client_ca"`
+	} `json:"tls"`
+	ACME *struct {
+		Domain    *string `json:"domain"`
+		Email     *string `json:"email"`
+		Directory *string `json:"directory"`
+		CacheDir  *string `json:"cache_dir"`
+	} `json:"acme"`
+	Limits *struct {
+		MaxBytes   *string `json:"max_bytes"`
+		MaxSeconds *string `json:"max_seconds"`
+		MaxActive  *int    `json:"max_active"`
+		MaxRate    *string `json:"max_rate"`
+		Burst      *string `json:"burst"`
+
+		MaxHeaderBytes    *string `json:"max_header_bytes"`
+		ReadHeaderTimeout *string `json:"read_header_timeout"`
+		IdleTimeout       *string `json:"idle_timeout"`
+		ConnUpload        *string `json:"conn_upload"`
+		MinUploadRate     *string `json:"min_upload_rate"`
+		MinRateWindow     *string `json:"min_rate_window"`
+
+		IPActive *int    `json:"ip_active"`
+		IPBytes  *string `json:"ip_bytes"`
+		IPWindow *string `json:"ip_window"`
+	} `json:"limits"`
+	Tests *struct {
+		Windows         []string `json:"windows"`
+		MaintenanceFile *string  `json:"maintenance_file"`
+	} `json:"tests"`
+	Files *struct {
+		Dir *string `json:"dir"`
+		Max *string `json:"max"`
+	} `json:"files"`
+	Payload *struct {
+		Fill *string `json:"fill"`
+	} `json:"payload"`
+	Tuning *struct {
+		SndBuf     *string `json:"sndbuf"`
+		RcvBuf     *string `json:"rcvbuf"`
+		NoDelay    *bool   `json:"nodelay"`
+		WriteSize  *string `json:"write_size"`
+		GOMAXPROCS *int    `json:"gomaxprocs"`
+	} `json:"tuning"`
+	Auth *struct {
+		TokensFile *string `json:"tokens_file"`
+	} `json:"auth"`
+	JWT *struct {
+		Issuer   *string `json:"issuer"`
+		JWKS     *string `json:"jwks"`
+		Audience *string `json:"audience"`
+		Tests    *bool   `json:"tests"`
+		Grants   []struct {
+			Claim        string `json:"claim"`
+			Value        string `json:"value"`
+			Admin        bool   `json:"admin"`
+			MaxTestBytes string `json:"max_test_bytes"`
+		} `json:"grants"`
+	} `json:"jwt"`
+	Results *struct {
+		Kept   *int    `json:"kept"`
+		MaxAge *string `json:"max_age"`
+		File   *string `json:"file"`
+		DB     *string `json:"db"`
+		DBRows *int    `json:"db_rows"`
+
+		ExpectTolerance    *int    `json:"expect_tolerance"`
+		WebhookDeadLetters *string `json:"webhook_dead_letters"`
+	} `json:"results"`
+	Log *struct {
+		Level  *string `json:"level"`
+		Format *string `json:"format"`
+
+		File       *string `json:"file"`
+		AccessFile *string `json:"access_file"`
+		MaxSize    *string `json:"max_size"`
+		MaxAge     *string `json:"max_age"`
+		Keep       *int    `json:"keep"`
+		Compress   *bool   `json:"compress"`
+
+		Syslog         *string `json:"syslog"`
+		SyslogFacility *string `json:"syslog_facility"`
+		SyslogTag      *string `json:"syslog_tag"`
+	} `json:"log"`
+	Protocols *struct {
+		HTTP2 *bool `json:"http2"`
+		H2C   *bool `json:"h2c"`
+	} `json:"protocols"`
+	Congestion *struct {
+		HTTP  *string `json:"http"`
+		HTTPS *string `json:"https"`
+		Iperf *string `json:"iperf"`
+	} `json:"congestion"`
+	DSCP *struct {
+		HTTP  *string `json:"http"`
+		HTTPS *string `json:"https"`
+	} `json:"dscp"`
+	Proxy *struct {
+		Trusted  *string `json:"trusted"`
+		Protocol *bool   `json:"protocol"`
+	} `json:"proxy"`
+	GeoIP *struct {
+		ASN     *string `json:"asn"`
+		Country *string `json:"country"`
+	} `json:"geoip"`
+	CORS *struct {
+		Origins *string `json:"origins"`
+		Methods *string `json:"methods"`
+		Headers *string `json:"headers"`
+		MaxAge  *string `json:"max_age"`
+	} `json:"cors"`
+	Shutdown *struct {
+		DrainTimeout *string `json:"drain_timeout"`
+	} `json:"shutdown"`
+	Peers []struct {
+		Name     string `json:"name"`
+		URL      string `json:"url"`
+		Schedule string `json:"schedule"`
+		Jitter   string `json:"jitter"`
+		Enabled  *bool  `json:"enabled"`
+		Bytes    string `json:"bytes"`
+		Token    string `json:"token"`
+		Insecure bool   `json:"insecure"`
+	} `json:"peers"`
+	Webhooks []struct {
+		Name      string `json:"name"`
+		URL       string `json:"url"`
+		Secret    string `json:"secret"`
+		Below     string `json:"below"`
+		Direction string `json:"direction"`
+		Insecure  bool   `json:"insecure"`
+	} `json:"webhooks"`
+	Alerts []struct {
+		Name      string `json:"name"`
+		Direction string `json:"direction"`
+		Stat      string `json:"stat"`
+		Over      string `json:"over"`
+		Below     string `json:"below"`
+		Above     string `json:"above"`
+		MinTests  *int   `json:"min_tests"`
+	} `json:"alerts"`
+	Tenants []struct {
+		Name      string   `json:"name"`
+		Tokens    []string `json:"tokens"`
+		MaxActive int      `json:"max_active"`
+		MaxBytes  string   `json:"max_bytes"`
+		Window    string   `json:"window"`
+	} `json:"tenants"`
+	VHosts []struct {
+		Hosts           []string `json:"hosts"`
+		Cert            string   `json:"cert"`
+		Key             string   `json:"key"`
+		MaxTestBytes    string   `json:"max_test_bytes"`
+		MaxTestSeconds  string   `json:"max_test_seconds"`
+		MaxActive       int      `json:"max_active"`
+		MaxBytes        string   `json:"max_bytes"`
+		Window          string   `json:"window"`
+	} `json:"vhosts"`
+	Mesh *struct {
+		Name     *string `json:"name"`
+		Push     *string `json:"push"`
+		Token    *string `json:"token"`
+		Insecure *bool   `json:"insecure"`
+	} `json:"mesh"`
+	StatsD *struct {
+		Address   *string `json:"address"`
+		Prefix    *string `json:"prefix"`
+		DogStatsD *bool   `json:"dogstatsd"`
+	} `json:"statsd"`
+	Tracing *struct {
+		OTLP *string `json:"otlp"`
+	} `json:"tracing"`
+	Admin *struct {
+		Address    *string `json:"address"`
+		Pprof      *bool   `json:"pprof"`
+		TokensFile *string `json:"tokens_file"`
+	} `json:"admin"`
+	GRPC *struct {
+		Address *string `json:"address"`
+	} `json:"grpc"`
+}
+
+/*
+ * Read a JSON config file over the top of c.
+ */
+func read_config_file(path string, c *configuration) error {
+	data, err := os.ReadFile(path)
+	if(err != nil) {
+		return err
+	}
+
+	var f config_file_layout
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&f)
+	if(err != nil) {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return apply_config_layout(&f, c, path)
+}
+
+/*
+ * Copy whatever f provides over the top of c.  Errors name source and
+ * the key at fault.
+ */
+func apply_config_layout(f *config_file_layout, c *configuration, source string) error {
+	var err error
+
+	if(f.Listen != nil) {
+		set_if(&c.bind_address, f.Listen.Bind)
+		set_if(&c.http_port, f.Listen.HTTPPort)
+		set_if(&c.https_port, f.Listen.HTTPSPort)
+		set_if(&c.udp_port, f.Listen.UDPPort)
+		set_if(&c.iperf_port, f.Listen.IperfPort)
+		set_if(&c.h3_port, f.Listen.H3Port)
+		set_if(&c.unix_socket, f.Listen.Unix)
+		set_if(&c.listen_family, f.Listen.Family)
+		set_if(&c.acceptors, f.Listen.Acceptors)
+	}
+
+	if(f.Listen != nil && f.Listen.UnixMode != nil) {
+		c.unix_mode, err = parse_mode(*f.Listen.UnixMode)
+		if(err != nil) {
+			return fmt.Errorf("%s: listen.unix_mode: %v", source, err)
+		}
+	}
+
+	for _, l := range f.Listeners {
+		spec := listener_spec{name: l.Name, address: l.Address, unix: l.Unix, mode: defaults.unix_mode, tls: l.TLS, http2: l.TLS, congestion: l.Congestion, dscp: l.DSCP, family: l.Family}
+		set_if(&spec.http2, l.HTTP2)
+		if(l.Mode != "") {
+			spec.mode, err = parse_mode(l.Mode)
+			if(err != nil) {
+				return fmt.Errorf("%s: listeners: %s: %v", source, l.Name, err)
+			}
+		}
+		for _, size := range []struct {
+			text string
+			to   *int
+		}{{l.SndBuf, &spec.sndbuf}, {l.RcvBuf, &spec.rcvbuf}} {
+			if(size.text == "") {
+				continue
+			}
+			n, err := parse_size(size.text)
+			if(err != nil || n > math.MaxInt32) {
+				return fmt.Errorf("%s: listeners: %s: invalid buffer size %q", source, l.Name, size.text)
+			}
+			*size.to = int(n)
+		}
+		if(l.NoDelay != nil) {
+			spec.nagle = !*l.NoDelay
+		}
+		c.listeners = append(c.listeners, spec)
+	}
+
+	if(f.TLS != nil) {
+		set_if(&c.cert_file, f.TLS.Cert)
+		set_if(&c.key_file, f.TLS.Key)
+		set_if(&c.self_signed_save, f.TLS.Save)
+		set_if(&c.tls_min_version, f.TLS.MinVersion)
+		set_if(&c.tls_ciphers, f.TLS.Ciphers)
+		set_if(&c.tls_curves, f.TLS.Curves)
+		set_if(&c.tls_alpn, f.TLS.ALPN)
+		set_if(&c.tls_client_ca, f.TLS.ClientCA)
+	}
+
+	if(f.ACME != nil) {
+		set_if(&c.acme_domain, f.ACME.Domain)
+		set_if(&c.acme_email, f.ACME.Email)
+		set_if(&c.acme_directory, f.ACME.Directory)
+		set_if(&c.acme_cache_dir, f.ACME.CacheDir)
+	}
+
+	if(f.Protocols != nil) {
+		set_if(&c.http2, f.Protocols.HTTP2)
+		set_if(&c.h2c, f.Protocols.H2C)
+	}
+
+	if(f.Congestion != nil) {
+		set_if(&c.http_congestion, f.Congestion.HTTP)
+		set_if(&c.https_congestion, f.Congestion.HTTPS)
+		set_if(&c.iperf_congestion, f.Congestion.Iperf)
+	}
+
+	if(f.DSCP != nil) {
+		set_if(&c.http_dscp, f.DSCP.HTTP)
+		set_if(&c.https_dscp, f.DSCP.HTTPS)
+	}
+
+	if(f.Files != nil) {
+		set_if(&c.files_dir, f.Files.Dir)
+	}
+
+	if(f.Tuning != nil) {
+		set_if(&c.tcp_nodelay, f.Tuning.NoDelay)
+		set_if(&c.gomaxprocs, f.Tuning.GOMAXPROCS)
+		for _, size := range []struct {
+			key  string
+			text *string
+			to   *int64
+		}{{"sndbuf", f.Tuning.SndBuf, &c.tcp_sndbuf}, {"rcvbuf", f.Tuning.RcvBuf, &c.tcp_rcvbuf}, {"write_size", f.Tuning.WriteSize, &c.write_size}} {
+			if(size.text == nil) {
+				continue
+			}
+			*size.to, err = parse_size(*size.text)
+			if(err != nil) {
+				return fmt.Errorf("%s: tuning.%s: %v", source, size.key, err)
+			}
+		}
+	}
+
+	if(f.Payload != nil) {
+		set_if(&c.payload_fill, f.Payload.Fill)
+	}
+
+	if(f.Files != nil && f.Files.Max != nil) {
+		c.files_max, err = parse_size(*f.Files.Max)
+		if(err != nil) {
+			return fmt.Errorf("%s: files.max: %v", source, err)
+		}
+	}
+
+	if(f.Limits != nil && f.Limits.MaxBytes != nil) {
+		c.max_test_bytes, err = parse_size(*f.Limits.MaxBytes)
+		if(err != nil) {
+			return fmt.Errorf("%s: limits.max_bytes: %v", source, err)
+		}
+	}
+
+	if(f.Limits != nil && f.Limits.MaxSeconds != nil) {
+		c.max_test_duration, err = time.ParseDuration(*f.Limits.MaxSeconds)
+		if(err != nil) {
+			return fmt.Errorf("%s: limits.max_seconds: %v", source, err)
+		}
+	}
+
+	if(f.Limits != nil) {
+		set_if(&c.max_active_tests, f.Limits.MaxActive)
+	}
+
+	if(f.Limits != nil && f.Limits.Burst != nil) {
+		c.throttle_burst, err = parse_size(*f.Limits.Burst)
+		if(err != nil) {
+			return fmt.Errorf("%s: limits.burst: %v", source, err)
+		}
+	}
+
+	if(f.Limits != nil) {
+		set_if(&c.ip_max_active, f.Limits.IPActive)
+	}
+
+	if(f.Limits != nil && f.Limits.IPBytes != nil) {
+		c.ip_max_bytes, err = parse_size(*f.Limits.IPBytes)
+		if(err != nil) {
+			return fmt.Errorf("%s: limits.ip_bytes: %v", source, err)
+		}
+	}
+
+	if(f.Limits != nil && f.Limits.IPWindow != nil) {
+		c.ip_window, err = parse_span(*f.Limits.IPWindow)
+		if(err != nil) {
+			return fmt.Errorf("%s: limits.ip_window: %v", source, err)
+		}
+	}
+
+	if(f.Limits != nil && f.Limits.MaxHeaderBytes != nil) {
+		c.max_header_bytes, err = parse_size(*f.Limits.MaxHeaderBytes)
+		if(err != nil) {
+			return fmt.Errorf("%s: limits.max_header_bytes: %v", source, err)
+		}
+	}
+
+	if(f.Limits != nil && f.Limits.ReadHeaderTimeout != nil) {
+		c.read_header_timeout, err = time.ParseDuration(*f.Limits.ReadHeaderTimeout)
+		if(err != nil) {
+			return fmt.Errorf("%s: limits.read_header_timeout: %v", source, err)
+		}
+	}
+
+	if(f.Limits != nil && f.Limits.IdleTimeout != nil) {
+		c.idle_timeout, err = time.ParseDuration(*f.Limits.IdleTimeout)
+		if(err != nil) {
+			return fmt.Errorf("%s: limits.idle_timeout: %v", source, err)
+		}
+	}
+
+	if(f.Limits != nil && f.Limits.ConnUpload != nil) {
+		c.max_conn_upload, err = parse_size(*f.Limits.ConnUpload)
+		if(err != nil) {
+			return fmt.Errorf("%s: limits.conn_upload: %v", source, err)
+		}
+	}
+
+	if(f.Limits != nil && f.Limits.MinUploadRate != nil) {
+		c.min_upload_bps, err = parse_rate(*f.Limits.MinUploadRate)
+		if(err != nil) {
+			return fmt.Errorf("%s: limits.min_upload_rate: %v", source, err)
+		}
+	}
+
+	if(f.Limits != nil && f.Limits.MinRateWindow != nil) {
+		c.min_rate_window, err = time.ParseDuration(*f.Limits.MinRateWindow)
+		if(err != nil) {
+			return fmt.Errorf("%s: limits.min_rate_window: %v", source, err)
+		}
+	}
+
+	if(f.Limits != nil && f.Limits.MaxRate != nil) {
+		c.max_aggregate_bps, err = parse_rate(*f.Limits.MaxRate)
+		if(err != nil) {
+			return fmt.Errorf("%s: limits.max_rate: %v", source, err)
+		}
+	}
+
+	if(f.Auth != nil) {
+		set_if(&c.auth_tokens_file, f.Auth.TokensFile)
+	}
+
+	if(f.JWT != nil) {
+		set_if(&c.jwt_issuer, f.JWT.Issuer)
+		set_if(&c.jwt_jwks_url, f.JWT.JWKS)
+		set_if(&c.jwt_audience, f.JWT.Audience)
+		set_if(&c.jwt_tests, f.JWT.Tests)
+		if(f.JWT.Grants != nil) {
+			c.jwt_grants = nil
+		}
+		for i, g := range f.JWT.Grants {
+			grant := jwt_grant{claim: g.Claim, value: g.Value, admin: g.Admin}
+			if(g.MaxTestBytes != "") {
+				grant.max_bytes, err = parse_size(g.MaxTestBytes)
+				if(err != nil) {
+					return fmt.Errorf("%s: jwt: grants: %d: max_test_bytes: %v", source, i + 1, err)
+				}
+			}
+			c.jwt_grants = append(c.jwt_grants, grant)
+		}
+	}
+
+	if(f.Results != nil) {
+		set_if(&c.results_kept, f.Results.Kept)
+		set_if(&c.results_file, f.Results.File)
+		set_if(&c.results_db, f.Results.DB)
+		set_if(&c.results_db_rows, f.Results.DBRows)
+		set_if(&c.expect_tolerance, f.Results.ExpectTolerance)
+		set_if(&c.webhook_dead_letters, f.Results.WebhookDeadLetters)
+	}
+
+	if(f.Results != nil && f.Results.MaxAge != nil) {
+		c.results_max_age, err = time.ParseDuration(*f.Results.MaxAge)
+		if(err != nil) {
+			return fmt.Errorf("%s: results.max_age: %v", source, err)
+		}
+	}
+
+	if(f.Log != nil && f.Log.Level != nil) {
+		c.log_level, err = parse_log_level(*f.Log.Level)
+		if(err != nil) {
+			return fmt.Errorf("%s: log.level: %v", source, err)
+		}
+	}
+
+	if(f.Log != nil) {
+		set_if(&c.log_format, f.Log.Format)
+		set_if(&c.log_file, f.Log.File)
+		set_if(&c.access_log, f.Log.AccessFile)
+		set_if(&c.log_keep, f.Log.Keep)
+		set_if(&c.log_compress, f.Log.Compress)
+		set_if(&c.syslog_address, f.Log.Syslog)
+		set_if(&c.syslog_facility, f.Log.SyslogFacility)
+		set_if(&c.syslog_tag, f.Log.SyslogTag)
+	}
+
+	if(f.Tests != nil && f.Tests.Windows != nil) {
+		c.test_windows, err = parse_test_windows(strings.Join(f.Tests.Windows, ";"))
+		if(err != nil) {
+			return fmt.Errorf("%s: tests.windows: %v", source, err)
+		}
+	}
+
+	if(f.Tests != nil) {
+		set_if(&c.maintenance_file, f.Tests.MaintenanceFile)
+	}
+
+	if(f.Log != nil && f.Log.MaxSize != nil) {
+		c.log_max_size, err = parse_size(*f.Log.MaxSize)
+		if(err != nil) {
+			return fmt.Errorf("%s: log.max_size: %v", source, err)
+		}
+	}
+
+	if(f.Log != nil && f.Log.MaxAge != nil) {
+		c.log_max_age, err = parse_span(*f.Log.MaxAge)
+		if(err != nil) {
+			return fmt.Errorf("%s: log.max_age: %v", source, err)
+		}
+	}
+
+	if(f.Proxy != nil && f.Proxy.Trusted != nil) {
+		c.trusted_proxies, err = parse_prefixes(*f.Proxy.Trusted)
+		if(err != nil) {
+			return fmt.Errorf("%s: proxy.trusted: %v", source, err)
+		}
+	}
+
+	if(f.Proxy != nil) {
+		set_if(&c.proxy_protocol, f.Proxy.Protocol)
+	}
+
+	if(f.GeoIP != nil) {
+		set_if(&c.geoip_asn_db, f.GeoIP.ASN)
+		set_if(&c.geoip_country_db, f.GeoIP.Country)
+	}
+
+	if(f.CORS != nil) {
+		set_if(&c.cors_origins, f.CORS.Origins)
+		set_if(&c.cors_methods, f.CORS.Methods)
+		set_if(&c.cors_headers, f.CORS.Headers)
+	}
+
+	if(f.CORS != nil && f.CORS.MaxAge != nil) {
+		c.cors_max_age, err = time.ParseDuration(*f.CORS.MaxAge)
+		if(err != nil) {
+			return fmt.Errorf("%s: cors.max_age: %v", source, err)
+		}
+	}
+
+	if(f.Peers != nil) {
+		c.peers = nil
+	}
+	for _, p := range f.Peers {
+		peer := peer_spec{name: p.Name, enabled: true, bytes: peer_default_bytes, token: p.Token, insecure: p.Insecure}
+		set_if(&peer.enabled, p.Enabled)
+		peer.url, err = url.Parse(p.URL)
+		if(err != nil) {
+			return fmt.Errorf("%s: peers: %s: %v", source, p.Name, err)
+		}
+		if(!strings.HasSuffix(peer.url.Path, "/")) {
+			peer.url.Path += "/"
+		}
+		schedule := p.Schedule
+		if(schedule == "") {
+			schedule = peer_default_schedule
+		}
+		peer.schedule, err = parse_schedule(schedule)
+		if(err != nil) {
+			return fmt.Errorf("%s: peers: %s: %v", source, p.Name, err)
+		}
+		if(p.Jitter != "") {
+			peer.jitter, err = time.ParseDuration(p.Jitter)
+			if(err != nil) {
+				return fmt.Errorf("%s: peers: %s: jitter: %v", source, p.Name, err)
+			}
+		}
+		if(p.Bytes != "") {
+			peer.bytes, err = parse_size(p.Bytes)
+			if(err != nil) {
+				return fmt.Errorf("%s: peers: %s: %v", source, p.Name, err)
+			}
+		}
+		c.peers = append(c.peers, peer)
+	}
+
+	if(f.Webhooks != nil) {
+		c.webhooks = nil
+	}
+	for _, w := range f.Webhooks {
+		hook := webhook_spec{name: w.Name, secret: w.Secret, direction: w.Direction, insecure: w.Insecure}
+		hook.url, err = url.Parse(w.URL)
+		if(err != nil) {
+			return fmt.Errorf("%s: webhooks: %s: %v", source, w.Name, err)
+		}
+		if(w.Below != "") {
+			hook.below_bps, err = parse_rate(w.Below)
+			if(err != nil) {
+				return fmt.Errorf("%s: webhooks: %s: below: %v", source, w.Name, err)
+			}
+		}
+		c.webhooks = append(c.webhooks, hook)
+	}
+
+	if(f.Alerts != nil) {
+		c.alerts = nil
+	}
+	for _, a := range f.Alerts {
+		rule := alert_rule{name: a.Name, direction: a.Direction, stat: strings.ToLower(a.Stat), min_tests: 1}
+		if(rule.stat == "") {
+			rule.stat = "median"
+		}
+		rule.window, err = time.ParseDuration(a.Over)
+		if(err != nil) {
+			return fmt.Errorf("%s: alerts: %s: over: %v", source, a.Name, err)
+		}
+		if(a.Below != "") {
+			rule.below_bps, err = parse_rate(a.Below)
+			if(err != nil) {
+				return fmt.Errorf("%s: alerts: %s: below: %v", source, a.Name, err)
+			}
+		}
+		if(a.Above != "") {
+			rule.above_bps, err = parse_rate(a.Above)
+			if(err != nil) {
+				return fmt.Errorf("%s: alerts: %s: above: %v", source, a.Name, err)
+			}
+		}
+		if(a.MinTests != nil) {
+			rule.min_tests = *a.MinTests
+		}
+		c.alerts = append(c.alerts, rule)
+	}
+
+	if(f.Tenants != nil) {
+		c.tenants = nil
+	}
+	for _, t := range f.Tenants {
+		tenant := tenant_spec{name: t.Name, tokens: t.Tokens, max_active: t.MaxActive, window: tenant_default_window}
+		if(t.MaxBytes != "") {
+			tenant.max_bytes, err = parse_size(t.MaxBytes)
+			if(err != nil) {
+				return fmt.Errorf("%s: tenants: %s: max_bytes: %v", source, t.Name, err)
+			}
+		}
+		if(t.Window != "") {
+			tenant.window, err = parse_span(t.Window)
+			if(err != nil) {
+				return fmt.Errorf("%s: tenants: %s: window: %v", source, t.Name, err)
+			}
+		}
+		c.tenants = append(c.tenants, tenant)
+	}
+
+	if(f.VHosts != nil) {
+		c.vhosts = nil
+	}
+	for i, v := range f.VHosts {
+		vhost := vhost_spec{hosts: v.Hosts, cert_file: v.Cert, key_file: v.Key, max_active: v.MaxActive, window: tenant_default_window}
+		vhost.name = fmt.Sprint(i + 1)
+		if(len(v.Hosts) > 0) {
+			vhost.name = v.Hosts[0]
+		}
+		for _, size := range []struct {
+			name  string
+			value string
+			into  *int64
+		}{{"max_test_bytes", v.MaxTestBytes, &vhost.max_test_bytes}, {"max_bytes", v.MaxBytes, &vhost.max_bytes}} {
+			if(size.value == "") {
+				continue
+			}
+			*size.into, err = parse_size(size.value)
+			if(err != nil) {
+				return fmt.Errorf("%s: vhosts: %s: %s: %v", source, vhost.name, size.name, err)
+			}
+		}
+		if(v.MaxTestSeconds != "") {
+			vhost.max_test_duration, err = time.ParseDuration(v.MaxTestSeconds)
+			if(err != nil) {
+				return fmt.Errorf("%s: vhosts: %s: max_test_seconds: %v", source, vhost.name, err)
+			}
+		}
+		if(v.Window != "") {
+			vhost.window, err = parse_span(v.Window)
+			if(err != nil) {
+				return fmt.Errorf("%s: vhosts: %s: window: %v", source, vhost.name, err)
+			}
+		}
+		c.vhosts = append(c.vhosts, vhost)
+	}
+
+	if(f.Mesh != nil) {
+		set_if(&c.node_name, f.Mesh.Name)
+		set_if(&c.mesh_push, f.Mesh.Push)
+		set_if(&c.mesh_token, f.Mesh.Token)
+		set_if(&c.mesh_insecure, f.Mesh.Insecure)
+	}
+
+	if(f.StatsD != nil) {
+		set_if(&c.statsd_address, f.StatsD.Address)
+		set_if(&c.statsd_prefix, f.StatsD.Prefix)
+		set_if(&c.dogstatsd, f.StatsD.DogStatsD)
+	}
+
+	if(f.Tracing != nil) {
+		set_if(&c.otlp_endpoint, f.Tracing.OTLP)
+	}
+
+	if(f.Admin != nil) {
+		set_if(&c.admin_address, f.Admin.Address)
+		set_if(&c.admin_pprof, f.Admin.Pprof)
+		set_if(&c.admin_tokens_file, f.Admin.TokensFile)
+	}
+
+	if(f.GRPC != nil) {
+		set_if(&c.grpc_address, f.GRPC.Address)
+	}
+
+	if(f.Shutdown != nil && f.Shutdown.DrainTimeout != nil) {
+		c.drain_timeout, err = time.ParseDuration(*f.Shutdown.DrainTimeout)
+		if(err != nil) {
+			return fmt.Errorf("%s: shutdown.drain_timeout: %v", source, err)
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Copy *src into *dst when the config file provided it.
+ */
+func set_if[T any](dst *T, src *T) {
+	if(src != nil) {
+		*dst = *src
+	}
+}
+
+/*
+ * Find the -config argument without parsing anything else, since the
+ * file has to be read before the other flags get their defaults.
+ */
+func find_config_path(args []string) string {
+	path := env_string("CONFIG", "")
+
+	for i, arg := range args {
+		if(arg == "--") {
+			break
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		if(name == arg) {
+			continue
+		}
+
+		if(name == "config" && i + 1 < len(args)) {
+			path = args[i + 1]
+		} else if(strings.HasPrefix(name, "config=")) {
+			path = strings.TrimPrefix(name, "config=")
+		}
+	}
+
+	return path
+}
+
+/*
+ * Build the configuration from defaults, then the -config file, then
+ * GOST_* environment variables, then command line flags, in increasing
+ * precedence.
+ */
+func load_configuration(args []string) (configuration, error) {
+	c := defaults
+
+	c.config_file = find_config_path(args)
+	if(c.config_file != "") {
+		err := read_config_file(c.config_file, &c)
+		if(err != nil) {
+			return c, err
+		}
+	}
+
+	level_name := env_string("LOG_LEVEL", log_level_name(c.log_level))
+	log_max_size := env_string("LOG_MAX_SIZE", strconv.FormatInt(c.log_max_size, 10))
+	log_max_age := env_string("LOG_MAX_AGE", c.log_max_age.String())
+	test_windows := env_string("TEST_WINDOWS", format_test_windows(c.test_windows))
+	max_bytes := env_string("MAX_BYTES", strconv.FormatInt(c.max_test_bytes, 10))
+	drain := env_string("DRAIN_TIMEOUT", c.drain_timeout.String())
+	max_seconds := env_string("MAX_SECONDS", c.max_test_duration.String())
+	max_rate := env_string("MAX_RATE", strconv.FormatInt(c.max_aggregate_bps, 10))
+	burst := env_string("BURST", strconv.FormatInt(c.throttle_burst, 10))
+	ip_bytes := env_string("IP_MAX_BYTES", strconv.FormatInt(c.ip_max_bytes, 10))
+	ip_window := env_string("IP_WINDOW", c.ip_window.String())
+	max_header := env_string("MAX_HEADER_BYTES", strconv.FormatInt(c.max_header_bytes, 10))
+	header_timeout := env_string("READ_HEADER_TIMEOUT", c.read_header_timeout.String())
+	idle_timeout := env_string("IDLE_TIMEOUT", c.idle_timeout.String())
+	conn_upload := env_string("MAX_CONN_UPLOAD", strconv.FormatInt(c.max_conn_upload, 10))
+	min_rate := env_string("MIN_UPLOAD_RATE", strconv.FormatInt(c.min_upload_bps, 10))
+	min_rate_window := env_string("MIN_RATE_WINDOW", c.min_rate_window.String())
+	sndbuf := env_string("SNDBUF", strconv.FormatInt(c.tcp_sndbuf, 10))
+	rcvbuf := env_string("RCVBUF", strconv.FormatInt(c.tcp_rcvbuf, 10))
+	write_size := env_string("WRITE_SIZE", strconv.FormatInt(c.write_size, 10))
+	files_max := env_string("FILES_MAX", strconv.FormatInt(c.files_max, 10))
+	max_age := env_string("RESULTS_MAX_AGE", c.results_max_age.String())
+	cors_max_age := env_string("CORS_MAX_AGE", c.cors_max_age.String())
+	trusted := env_string("TRUSTED_PROXIES", format_prefixes(c.trusted_proxies))
+	unix_mode := env_string("UNIX_MODE", fmt.Sprintf("%04o", c.unix_mode))
+	var env_err error
+
+	flags := flag.NewFlagSet("gost", flag.ContinueOnError)
+	flags.BoolVar(&c.show_version, "version", false, "print version and build information, then exit")
+	flags.StringVar(&c.config_file, "config", c.config_file, "JSON config file, re-read on SIGHUP (env GOST_CONFIG)")
+	flags.StringVar(&c.bind_address, "bind", env_string("BIND", c.bind_address), "address to bind listeners to (env GOST_BIND)")
+	flags.StringVar(&c.listen_family, "family", env_string("FAMILY", c.listen_family), "address family for the listeners: dual, ipv4 or ipv6 (env GOST_FAMILY)")
+	flags.IntVar(&c.acceptors, "acceptors", env_int("ACCEPTORS", c.acceptors, &env_err), "sockets per listener, shared with SO_REUSEPORT, each accepting on its own (env GOST_ACCEPTORS)")
+	flags.IntVar(&c.http_port, "http-port", env_int("HTTP_PORT", c.http_port, &env_err), "plain HTTP port (env GOST_HTTP_PORT)")
+	flags.IntVar(&c.https_port, "https-port", env_int("HTTPS_PORT", c.https_port, &env_err), "TLS port (env GOST_HTTPS_PORT)")
+	flags.StringVar(&c.unix_socket, "unix", env_string("UNIX", c.unix_socket), "also serve plain HTTP on this unix socket (env GOST_UNIX)")
+	flags.StringVar(&unix_mode, "unix-mode", unix_mode, "permissions for the unix socket (env GOST_UNIX_MODE)")
+	flags.IntVar(&c.udp_port, "udp-port", env_int("UDP_PORT", c.udp_port, &env_err), "UDP echo port for loss and jitter tests, 0 for off (env GOST_UDP_PORT)")
+	flags.IntVar(&c.iperf_port, "iperf-port", env_int("IPERF_PORT", c.iperf_port, &env_err), "iperf3 server port, usually 5201, 0 for off (env GOST_IPERF_PORT)")
+	flags.IntVar(&c.h3_port, "h3-port", env_int("H3_PORT", c.h3_port, &env_err), "UDP port for HTTP/3 over QUIC, usually the TLS port, 0 for off (env GOST_H3_PORT)")
+	flags.StringVar(&c.http_congestion, "http-congestion", env_string("HTTP_CONGESTION", c.http_congestion), "TCP congestion control on the plain listener, e.g. bbr (env GOST_HTTP_CONGESTION)")
+	flags.StringVar(&c.https_congestion, "https-congestion", env_string("HTTPS_CONGESTION", c.https_congestion), "TCP congestion control on the TLS listener (env GOST_HTTPS_CONGESTION)")
+	flags.StringVar(&c.iperf_congestion, "iperf-congestion", env_string("IPERF_CONGESTION", c.iperf_congestion), "TCP congestion control for iperf3 tests that don't ask for one (env GOST_IPERF_CONGESTION)")
+	flags.StringVar(&c.http_dscp, "http-dscp", env_string("HTTP_DSCP", c.http_dscp), "DSCP mark on what the plain listener sends, e.g. EF (env GOST_HTTP_DSCP)")
+	flags.StringVar(&c.https_dscp, "https-dscp", env_string("HTTPS_DSCP", c.https_dscp), "DSCP mark on what the TLS listener sends (env GOST_HTTPS_DSCP)")
+	flags.StringVar(&c.cert_file, "cert", env_string("CERT", c.cert_file), "TLS certificate path (env GOST_CERT)")
+	flags.StringVar(&c.key_file, "key", env_string("KEY", c.key_file), "TLS key path (env GOST_KEY)")
+	flags.BoolVar(&c.self_signed_save, "save-cert", env_bool("SAVE_CERT", c.self_signed_save, &env_err), "write the self-signed certificate made when -cert and -key are missing to those paths (env GOST_SAVE_CERT)")
+	flags.StringVar(&c.tls_min_version, "tls-min-version", env_string("TLS_MIN_VERSION", c.tls_min_version), "lowest TLS version to accept: 1.0, 1.1, 1.2 or 1.3 (env GOST_TLS_MIN_VERSION)")
+	flags.StringVar(&c.tls_ciphers, "tls-ciphers", env_string("TLS_CIPHERS", c.tls_ciphers), "comma-separated TLS 1.2 cipher suites, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 (env GOST_TLS_CIPHERS)")
+	flags.StringVar(&c.tls_curves, "tls-curves", env_string("TLS_CURVES", c.tls_curves), "comma-separated key exchange curves, most preferred first, e.g. X25519,P-256 (env GOST_TLS_CURVES)")
+	flags.StringVar(&c.tls_alpn, "tls-alpn", env_string("TLS_ALPN", c.tls_alpn), "comma-separated ALPN protocols, most preferred first: h2, http/1.1 (env GOST_TLS_ALPN)")
+	flags.StringVar(&c.tls_client_ca, "tls-client-ca", env_string("TLS_CLIENT_CA", c.tls_client_ca), "PEM bundle of CAs whose client certificates may run tests without a token (env GOST_TLS_CLIENT_CA)")
+	flags.StringVar(&c.acme_domain, "acme-domain", env_string("ACME_DOMAIN", c.acme_domain), "get the TLS certificate for these comma-separated domains via ACME (env GOST_ACME_DOMAIN)")
+	flags.StringVar(&c.acme_email, "acme-email", env_string("ACME_EMAIL", c.acme_email), "contact address for the ACME account (env GOST_ACME_EMAIL)")
+	flags.StringVar(&c.acme_directory, "acme-directory", env_string("ACME_DIRECTORY", c.acme_directory), "ACME directory URL (env GOST_ACME_DIRECTORY)")
+	flags.StringVar(&c.acme_cache_dir, "acme-cache", env_string("ACME_CACHE", c.acme_cache_dir), "directory for ACME keys and certificates (env GOST_ACME_CACHE)")
+	flags.StringVar(&level_name, "log-level", level_name, "error, info, or debug (env GOST_LOG_LEVEL)")
+	flags.StringVar(&c.log_format, "log-format", env_string("LOG_FORMAT", c.log_format), "text or json (env GOST_LOG_FORMAT)")
+	flags.StringVar(&test_windows, "test-windows", test_windows, "when tests may start, in local time, e.g. \"mon-fri 08:00-20:00; sat 10:00-14:00\" (env GOST_TEST_WINDOWS)")
+	flags.StringVar(&c.maintenance_file, "maintenance-file", env_string("MAINTENANCE_FILE", c.maintenance_file), "refuse tests while this file exists (env GOST_MAINTENANCE_FILE)")
+	flags.StringVar(&c.log_file, "log-file", env_string("LOG_FILE", c.log_file), "write the log to this file rather than stderr (env GOST_LOG_FILE)")
+	flags.StringVar(&c.access_log, "access-log", env_string("ACCESS_LOG", c.access_log), "write the access log to this file, apart from the rest (env GOST_ACCESS_LOG)")
+	flags.StringVar(&log_max_size, "log-max-size", log_max_size, "rotate log files before they grow past this, e.g. 100M; 0 for never (env GOST_LOG_MAX_SIZE)")
+	flags.StringVar(&log_max_age, "log-max-age", log_max_age, "rotate log files after this long, e.g. 24h or 7d; 0 for never (env GOST_LOG_MAX_AGE)")
+	flags.IntVar(&c.log_keep, "log-keep", env_int("LOG_KEEP", c.log_keep, &env_err), "rotated log files to keep (env GOST_LOG_KEEP)")
+	flags.StringVar(&c.syslog_address, "syslog", env_string("SYSLOG", c.syslog_address), "log to syslog: local, or udp://, tcp:// or tls:// and host:port (env GOST_SYSLOG)")
+	flags.StringVar(&c.syslog_facility, "syslog-facility", env_string("SYSLOG_FACILITY", c.syslog_facility), "syslog facility, e.g. daemon or local0 (env GOST_SYSLOG_FACILITY)")
+	flags.StringVar(&c.syslog_tag, "syslog-tag", env_string("SYSLOG_TAG", c.syslog_tag), "syslog app name (env GOST_SYSLOG_TAG)")
+	flags.BoolVar(&c.log_compress, "log-compress", env_bool("LOG_COMPRESS", c.log_compress, &env_err), "gzip rotated log files (env GOST_LOG_COMPRESS)")
+	flags.StringVar(&max_bytes, "max-bytes", max_bytes, "largest test payload, e.g. 500M or 10G (env GOST_MAX_BYTES)")
+	flags.StringVar(&max_seconds, "max-seconds", max_seconds, "longest duration-based test (env GOST_MAX_SECONDS)")
+	flags.IntVar(&c.max_active_tests, "max-active", env_int("MAX_ACTIVE", c.max_active_tests, &env_err), "most tests running at once, 0 for no limit (env GOST_MAX_ACTIVE)")
+	flags.StringVar(&max_rate, "max-rate", max_rate, "refuse new tests above this aggregate rate, e.g. 2Gbps, 0 for no limit (env GOST_MAX_RATE)")
+	flags.StringVar(&burst, "burst", burst, "token bucket size for tests paced with ?limit=, e.g. 64K (env GOST_BURST)")
+	flags.IntVar(&c.ip_max_active, "ip-max-active", env_int("IP_MAX_ACTIVE", c.ip_max_active, &env_err), "most tests one client address may run at once, 0 for no limit (env GOST_IP_MAX_ACTIVE)")
+	flags.StringVar(&ip_bytes, "ip-max-bytes", ip_bytes, "most one client address may move in each -ip-window, e.g. 50G, 0 for no limit (env GOST_IP_MAX_BYTES)")
+	flags.StringVar(&ip_window, "ip-window", ip_window, "sliding window for -ip-max-bytes, e.g. 24h or 7d (env GOST_IP_WINDOW)")
+	flags.StringVar(&max_header, "max-header-bytes", max_header, "largest request header (env GOST_MAX_HEADER_BYTES)")
+	flags.StringVar(&header_timeout, "read-header-timeout", header_timeout, "how long a client has to send its request header (env GOST_READ_HEADER_TIMEOUT)")
+	flags.StringVar(&idle_timeout, "idle-timeout", idle_timeout, "close keep-alive connections idle this long (env GOST_IDLE_TIMEOUT)")
+	flags.StringVar(&conn_upload, "max-conn-upload", conn_upload, "most one connection may upload in all, e.g. 50G, 0 for no limit (env GOST_MAX_CONN_UPLOAD)")
+	flags.StringVar(&min_rate, "min-upload-rate", min_rate, "cut off uploads slower than this, e.g. 64Kbps, 0 for no limit (env GOST_MIN_UPLOAD_RATE)")
+	flags.StringVar(&min_rate_window, "min-rate-window", min_rate_window, "period over which -min-upload-rate is judged (env GOST_MIN_RATE_WINDOW)")
+	flags.StringVar(&c.payload_fill, "payload", env_string("PAYLOAD", c.payload_fill), "random or zero (env GOST_PAYLOAD)")
+	flags.StringVar(&sndbuf, "sndbuf", sndbuf, "socket send buffer on the listeners, e.g. 4M, 0 for the kernel's (env GOST_SNDBUF)")
+	flags.StringVar(&rcvbuf, "rcvbuf", rcvbuf, "socket receive buffer on the listeners, 0 for the kernel's (env GOST_RCVBUF)")
+	flags.BoolVar(&c.tcp_nodelay, "nodelay", env_bool("NODELAY", c.tcp_nodelay, &env_err), "turn Nagle's algorithm off on the listeners (env GOST_NODELAY)")
+	flags.StringVar(&write_size, "write-size", write_size, "how much each download write hands the connection, e.g. 256K (env GOST_WRITE_SIZE)")
+	flags.IntVar(&c.gomaxprocs, "gomaxprocs", env_int("GOMAXPROCS", c.gomaxprocs, &env_err), "OS threads running Go code at once, 0 for Go's choice (env GOST_GOMAXPROCS)")
+	flags.StringVar(&c.files_dir, "files-dir", env_string("FILES_DIR", c.files_dir), "directory of pre-generated files for /down?source=file (env GOST_FILES_DIR)")
+	flags.StringVar(&files_max, "files-max", files_max, "largest test file to generate, e.g. 10G (env GOST_FILES_MAX)")
+	flags.BoolVar(&c.http2, "http2", env_bool("HTTP2", c.http2, &env_err), "offer HTTP/2 on the TLS listener (env GOST_HTTP2)")
+	flags.BoolVar(&c.h2c, "h2c", env_bool("H2C", c.h2c, &env_err), "accept cleartext HTTP/2 on the plain listener (env GOST_H2C)")
+	flags.StringVar(&c.jwt_issuer, "jwt-issuer", env_string("JWT_ISSUER", c.jwt_issuer), "accept JWTs from this OpenID Connect issuer on the admin API (env GOST_JWT_ISSUER)")
+	flags.StringVar(&c.jwt_jwks_url, "jwt-jwks", env_string("JWT_JWKS", c.jwt_jwks_url), "JWKS URL of the keys JWTs are signed with, rather than the issuer's own (env GOST_JWT_JWKS)")
+	flags.StringVar(&c.jwt_audience, "jwt-audience", env_string("JWT_AUDIENCE", c.jwt_audience), "audience JWTs must be made out to (env GOST_JWT_AUDIENCE)")
+	flags.BoolVar(&c.jwt_tests, "jwt-tests", env_bool("JWT_TESTS", c.jwt_tests, &env_err), "accept and require JWTs on the test endpoints too (env GOST_JWT_TESTS)")
+	flags.StringVar(&c.auth_tokens_file, "tokens", env_string("TOKENS", c.auth_tokens_file), "file of bearer tokens required for tests, re-read when it changes (env GOST_TOKENS)")
+	flags.IntVar(&c.results_kept, "results-kept", env_int("RESULTS_KEPT", c.results_kept, &env_err), "number of test results /results remembers (env GOST_RESULTS_KEPT)")
+	flags.StringVar(&max_age, "results-max-age", max_age, "forget results older than this, 0 to keep them all (env GOST_RESULTS_MAX_AGE)")
+	flags.IntVar(&c.expect_tolerance, "expect-tolerance", env_int("EXPECT_TOLERANCE", c.expect_tolerance, &env_err), "percent a test may fall short of its ?expect= rate and still pass (env GOST_EXPECT_TOLERANCE)")
+	flags.StringVar(&c.webhook_dead_letters, "webhook-dead-letters", env_string("WEBHOOK_DEAD_LETTERS", c.webhook_dead_letters), "append webhook deliveries that never got through to this file (env GOST_WEBHOOK_DEAD_LETTERS)")
+	flags.StringVar(&c.results_file, "results-file", env_string("RESULTS_FILE", c.results_file), "keep results in this file across restarts (env GOST_RESULTS_FILE)")
+	flags.StringVar(&c.results_db, "results-db", env_string("RESULTS_DB", c.results_db), "keep results in this SQLite database too, for longer history (env GOST_RESULTS_DB)")
+	flags.IntVar(&c.results_db_rows, "results-db-rows", env_int("RESULTS_DB_ROWS", c.results_db_rows, &env_err), "most results the database keeps (env GOST_RESULTS_DB_ROWS)")
+	flags.StringVar(&c.cors_origins, "cors-origins", env_string("CORS_ORIGINS", c.cors_origins), "comma-separated origins allowed to run tests from a browser, or * (env GOST_CORS_ORIGINS)")
+	flags.StringVar(&c.cors_methods, "cors-methods", env_string("CORS_METHODS", c.cors_methods), "methods allowed cross-origin (env GOST_CORS_METHODS)")
+	flags.StringVar(&c.cors_headers, "cors-headers", env_string("CORS_HEADERS", c.cors_headers), "request headers allowed cross-origin (env GOST_CORS_HEADERS)")
+	flags.StringVar(&cors_max_age, "cors-max-age", cors_max_age, "how long browsers may cache a CORS preflight (env GOST_CORS_MAX_AGE)")
+	flags.StringVar(&trusted, "trusted-proxies", trusted, "comma-separated proxy addresses or CIDRs whose X-Forwarded-For is believed (env GOST_TRUSTED_PROXIES)")
+	flags.BoolVar(&c.proxy_protocol, "proxy-protocol", env_bool("PROXY_PROTOCOL", c.proxy_protocol, &env_err), "expect a PROXY protocol v1 or v2 header on every HTTP connection (env GOST_PROXY_PROTOCOL)")
+	flags.StringVar(&c.geoip_asn_db, "geoip-asn", env_string("GEOIP_ASN", c.geoip_asn_db), "MaxMind ASN database, e.g. GeoLite2-ASN.mmdb, for /ip and results (env GOST_GEOIP_ASN)")
+	flags.StringVar(&c.geoip_country_db, "geoip-country", env_string("GEOIP_COUNTRY", c.geoip_country_db), "MaxMind country database, e.g. GeoLite2-Country.mmdb, for /ip and results (env GOST_GEOIP_COUNTRY)")
+	flags.StringVar(&c.node_name, "node-name", env_string("NODE_NAME", c.node_name), "this server's name in the mesh, by default the host name (env GOST_NODE_NAME)")
+	flags.StringVar(&c.mesh_push, "mesh-push", env_string("MESH_PUSH", c.mesh_push), "push peer test results to the gost server at this URL (env GOST_MESH_PUSH)")
+	flags.StringVar(&c.mesh_token, "mesh-token", env_string("MESH_TOKEN", c.mesh_token), "bearer token for -mesh-push (env GOST_MESH_TOKEN)")
+	flags.StringVar(&c.statsd_address, "statsd", env_string("STATSD", c.statsd_address), "send test metrics to the StatsD agent at this host:port, e.g. 127.0.0.1:8125 (env GOST_STATSD)")
+	flags.StringVar(&c.statsd_prefix, "statsd-prefix", env_string("STATSD_PREFIX", c.statsd_prefix), "prefix for StatsD metric names (env GOST_STATSD_PREFIX)")
+	flags.BoolVar(&c.dogstatsd, "dogstatsd", env_bool("DOGSTATSD", c.dogstatsd, &env_err), "send StatsD metrics with DogStatsD tags and histograms (env GOST_DOGSTATSD)")
+	flags.StringVar(&c.otlp_endpoint, "otlp", env_string("OTLP", c.otlp_endpoint), "export trace spans of tests to the OpenTelemetry collector at this URL, e.g. http://127.0.0.1:4318 (env GOST_OTLP)")
+	flags.StringVar(&c.admin_address, "admin", env_string("ADMIN", c.admin_address), "serve the admin API on this address, e.g. 127.0.0.1:9000 (env GOST_ADMIN)")
+	flags.StringVar(&c.admin_tokens_file, "admin-tokens", env_string("ADMIN_TOKENS", c.admin_tokens_file), "file of bearer tokens for the admin API, re-read when it changes (env GOST_ADMIN_TOKENS)")
+	flags.StringVar(&c.grpc_address, "grpc", env_string("GRPC", c.grpc_address), "serve the gRPC service on this address, e.g. :9090 (env GOST_GRPC)")
+	flags.BoolVar(&c.admin_pprof, "pprof", env_bool("PPROF", c.admin_pprof, &env_err), "serve pprof and trace on the admin listener; needs -admin-tokens or -jwt-issuer (env GOST_PPROF)")
+	flags.StringVar(&drain, "drain-timeout", drain, "how long shutdown waits for running tests (env GOST_DRAIN_TIMEOUT)")
+
+	err := flags.Parse(args)
+	if(err != nil || c.show_version) {
+		return c, err
+	}
+	if(env_err != nil) {
+		return c, env_err
+	}
+
+	c.max_test_bytes, err = parse_size(max_bytes)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.max_test_duration, err = time.ParseDuration(max_seconds)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.max_aggregate_bps, err = parse_rate(max_rate)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.throttle_burst, err = parse_size(burst)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.ip_max_bytes, err = parse_size(ip_bytes)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.ip_window, err = parse_span(ip_window)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.max_header_bytes, err = parse_size(max_header)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.tcp_sndbuf, err = parse_size(sndbuf)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.tcp_rcvbuf, err = parse_size(rcvbuf)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.write_size, err = parse_size(write_size)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.read_header_timeout, err = time.ParseDuration(header_timeout)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.idle_timeout, err = time.ParseDuration(idle_timeout)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.max_conn_upload, err = parse_size(conn_upload)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.min_upload_bps, err = parse_rate(min_rate)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.min_rate_window, err = time.ParseDuration(min_rate_window)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.files_max, err = parse_size(files_max)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.drain_timeout, err = time.ParseDuration(drain)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.results_max_age, err = time.ParseDuration(max_age)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.cors_max_age, err = time.ParseDuration(cors_max_age)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.trusted_proxies, err = parse_prefixes(trusted)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.unix_mode, err = parse_mode(unix_mode)
+	if(err != nil) {
+		return c, err
+	}
+
+	level, err := parse_log_level(level_name)
+	if(err != nil) {
+		return c, err
+	}
+	c.log_level = level
+
+	c.log_max_size, err = parse_size(log_max_size)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.log_max_age, err = parse_span(log_max_age)
+	if(err != nil) {
+		return c, err
+	}
+
+	c.test_windows, err = parse_test_windows(test_windows)
+	if(err != nil) {
+		return c, err
+	}
+
+	if(c.node_name == "") {
+		c.node_name, _ = os.Hostname()
+	}
+
+	return c, c.validate()
+}
+
+/*
+ * Re-read the configuration and put into force whatever can change
+ * without restarting.  Listener and TLS settings need a restart, so
+ * changes to them are reported and otherwise ignored.
+ */
+func reload_configuration() error {
+	current := settings()
+
+	c, err := load_configuration(server_args)
+	if(err != nil) {
+		return err
+	}
+
+	if(c.needs_restart(current)) {
+		log_at(log_level_error, "Listener, TLS and results file changes take effect on restart")
+	}
+
+	next := *current
+	next.log_level = c.log_level
+	next.log_format = c.log_format
+	next.log_file = c.log_file
+	next.access_log = c.access_log
+	next.log_max_size = c.log_max_size
+	next.log_max_age = c.log_max_age
+	next.log_keep = c.log_keep
+	next.log_compress = c.log_compress
+	next.syslog_address = c.syslog_address
+	next.syslog_facility = c.syslog_facility
+	next.syslog_tag = c.syslog_tag
+	next.test_windows = c.test_windows
+	next.maintenance_file = c.maintenance_file
+	next.max_test_bytes = c.max_test_bytes
+	next.max_test_duration = c.max_test_duration
+	next.max_active_tests = c.max_active_tests
+	next.max_aggregate_bps = c.max_aggregate_bps
+	next.throttle_burst = c.throttle_burst
+	next.ip_max_active = c.ip_max_active
+	next.ip_max_bytes = c.ip_max_bytes
+	next.ip_window = c.ip_window
+	next.max_conn_upload = c.max_conn_upload
+	next.min_upload_bps = c.min_upload_bps
+	next.min_rate_window = c.min_rate_window
+	next.payload_fill = c.payload_fill
+	next.write_size = c.write_size
+	next.gomaxprocs = c.gomaxprocs
+	next.drain_timeout = c.drain_timeout
+	next.results_kept = c.results_kept
+	next.results_max_age = c.results_max_age
+	next.results_db_rows = c.results_db_rows
+	next.expect_tolerance = c.expect_tolerance
+	next.auth_tokens_file = c.auth_tokens_file
+	next.jwt_issuer = c.jwt_issuer
+	next.jwt_jwks_url = c.jwt_jwks_url
+	next.jwt_audience = c.jwt_audience
+	next.jwt_tests = c.jwt_tests
+	next.jwt_grants = c.jwt_grants
+	next.trusted_proxies = c.trusted_proxies
+	next.cors_origins = c.cors_origins
+	next.cors_methods = c.cors_methods
+	next.cors_headers = c.cors_headers
+	next.cors_max_age = c.cors_max_age
+	next.admin_pprof = c.admin_pprof
+	next.admin_tokens_file = c.admin_tokens_file
+	next.peers = c.peers
+	next.webhooks = c.webhooks
+	next.webhook_dead_letters = c.webhook_dead_letters
+	next.alerts = c.alerts
+	next.tenants = c.tenants
+	next.vhosts = c.vhosts
+	next.node_name = c.node_name
+	next.mesh_push = c.mesh_push
+	next.mesh_token = c.mesh_token
+	next.mesh_insecure = c.mesh_insecure
+	next.statsd_address = c.statsd_address
+	next.statsd_prefix = c.statsd_prefix
+	next.dogstatsd = c.dogstatsd
+	next.otlp_endpoint = c.otlp_endpoint
+
+	err = open_log_files(&next)
+	if(err != nil) {
+		return err
+	}
+	err = load_vhost_certificates(&next)
+	if(err != nil) {
+		return err
+	}
+	apply_configuration(next)
+
+	return nil
+}
+
+/*
+ * Whether going from current to c changes anything that only takes
+ * effect on restart.
+ */
+func (c *configuration) needs_restart(current *configuration) bool {
+	return !slices.Equal(c.listener_specs(), current.listener_specs()) ||
+		c.udp_port != current.udp_port || c.iperf_port != current.iperf_port ||
+		c.h3_port != current.h3_port ||
+		c.acceptors != current.acceptors ||
+		c.iperf_congestion != current.iperf_congestion ||
+		c.files_dir != current.files_dir || c.files_max != current.files_max ||
+		c.geoip_asn_db != current.geoip_asn_db || c.geoip_country_db != current.geoip_country_db ||
+		c.proxy_protocol != current.proxy_protocol ||
+		c.admin_address != current.admin_address || c.grpc_address != current.grpc_address ||
+		c.max_header_bytes != current.max_header_bytes || c.read_header_timeout != current.read_header_timeout ||
+		c.idle_timeout != current.idle_timeout ||
+		c.cert_file != current.cert_file || c.key_file != current.key_file ||
+		c.tls_min_version != current.tls_min_version || c.tls_ciphers != current.tls_ciphers ||
+		c.tls_curves != current.tls_curves || c.tls_alpn != current.tls_alpn ||
+		c.tls_client_ca != current.tls_client_ca ||
+		c.acme_domain != current.acme_domain || c.acme_directory != current.acme_directory ||
+		c.acme_email != current.acme_email || c.acme_cache_dir != current.acme_cache_dir ||
+		c.results_file != current.results_file || c.results_db != current.results_db
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"net"
+)
+
+/*
+ * TCP congestion control can be chosen per listener, and per test with
+ * ?congestion=, so that bbr and cubic can be compared against the same
+ * server.  Only Linux lets us choose.
+ */
+
+/*
+ * Wrap a ConnContext hook so that every connection the listener
+ * accepts uses algorithm, if one is set.
+ */
+func with_congestion(listener string, algorithm string, next func(context.Context, net.Conn) context.Context) func(context.Context, net.Conn) context.Context {
+	return func(ctx context.Context, conn net.Conn) context.Context {
+		if(algorithm != "") {
+			err := set_congestion(conn, algorithm)
+			if(err != nil) {
+				log_at(log_level_error, "Can't use %s congestion control on the %s listener: %v", algorithm, listener, err)
+			}
+		}
+		return next(ctx, conn)
+	}
+}
+
+/*
+ * Check that algorithm can be set, by trying it on a throwaway
+ * socket.
+ */
+func check_congestion(algorithm string) error {
+	if(algorithm == "") {
+		return nil
+	}
+	return on_throwaway_conn(func(conn net.Conn) error {
+		return set_congestion(conn, algorithm)
+	})
+}
+
+/*
+ * Try f on a TCP connection over loopback that's closed after.
+ */
+func on_throwaway_conn(f func(net.Conn) error) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if(err != nil) {
+		return err
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if(err != nil) {
+		return err
+	}
+	defer conn.Close()
+
+	return f(conn)
+}
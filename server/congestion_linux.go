@@ -0,0 +1,69 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+/*
+ * Switch conn to the named congestion control algorithm.  The kernel
+ * only allows the ones in net.ipv4.tcp_allowed_congestion_control
+ * unless we're privileged.
+ */
+func set_congestion(conn net.Conn, algorithm string) error {
+	tcp := tcp_conn_of(conn)
+	if(tcp == nil) {
+		return errors.New("not a TCP connection")
+	}
+	raw, err := tcp.SyscallConn()
+	if(err != nil) {
+		return err
+	}
+
+	var set_err error
+	err = raw.Control(func(fd uintptr) {
+		set_err = syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, algorithm)
+	})
+	if(err != nil) {
+		return err
+	}
+	return set_err
+}
+
+/*
+ * The congestion control algorithm conn is using, or "" if we can't
+ * tell.
+ */
+func congestion_of(conn net.Conn) string {
+	tcp := tcp_conn_of(conn)
+	if(tcp == nil) {
+		return ""
+	}
+	raw, err := tcp.SyscallConn()
+	if(err != nil) {
+		return ""
+	}
+
+	// TCP_CA_NAME_MAX in the kernel.
+	var buf [16]byte
+	size := uint32(len(buf))
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if(err != nil || errno != 0) {
+		return ""
+	}
+
+	name := buf[:size]
+	for i, b := range name {
+		if(b == 0) {
+			name = name[:i]
+			break
+		}
+	}
+	return string(name)
+}
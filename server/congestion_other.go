@@ -0,0 +1,16 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+func set_congestion(conn net.Conn, algorithm string) error {
+	return errors.New("choosing congestion control is only supported on Linux")
+}
+
+func congestion_of(conn net.Conn) string {
+	return ""
+}
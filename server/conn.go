@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * State hung off each accepted connection, so handlers can tell when
+ * several requests arrive over the same keep-alive connection.
+ */
+type conn_info struct {
+	id       uint64
+	accepted time.Time
+	conn     net.Conn
+
+	// Requests that have arrived over the connection, and upload bytes
+	// taken over it so far, for -max-conn-upload.
+	requests atomic.Int64
+	uploaded atomic.Int64
+
+	mu           sync.Mutex
+	ping         ping_series
+	handshake    time.Duration
+	handshake_at time.Time
+}
+
+type conn_info_key struct{}
+
+var next_conn_id atomic.Uint64
+
+/*
+ * An http.Server ConnContext hook that attaches a fresh conn_info.
+ */
+func attach_conn_info(ctx context.Context, conn net.Conn) context.Context {
+	info := &conn_info{id: next_conn_id.Add(1), accepted: time.Now(), conn: conn}
+	return context.WithValue(ctx, conn_info_key{}, info)
+}
+
+/*
+ * Find the conn_info for the connection a request arrived on.  Never
+ * returns nil, so handlers don't need to care whether the server was
+ * set up with attach_conn_info.
+ */
+func connection_of(req *http.Request) *conn_info {
+	info, ok := req.Context().Value(conn_info_key{}).(*conn_info)
+	if(!ok) {
+		return &conn_info{accepted: time.Now()}
+	}
+	return info
+}
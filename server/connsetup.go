@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"time"
+)
+
+/*
+ * Connection setup, measured apart from transfers.  A client that
+ * opens a fresh connection for every request pays for DNS, the TCP
+ * handshake and the TLS handshake each time, which can matter more
+ * than bandwidth for small fetches.  /connsetup answers at once with
+ * what the server saw of the connection: how many requests it has
+ * carried, how long after being accepted this one arrived, which for a
+ * new connection covers the TLS handshake, and how long the handshake
+ * itself took and what it settled on.
+ * gost client -setups N times fresh and reused connections against it.
+ */
+type connsetup_reply struct {
+	Connection    uint64  `json:"connection"`
+	Requests      int64   `json:"requests"`
+	Reused        bool    `json:"reused"`
+	SinceAcceptMs float64 `json:"since_accept_ms"`
+	Protocol      string  `json:"protocol"`
+	TLSVersion    string  `json:"tls_version,omitempty"`
+	TLSResumed    bool    `json:"tls_resumed,omitempty"`
+	ALPN          string  `json:"alpn,omitempty"`
+	Cipher        string  `json:"cipher,omitempty"`
+	KeyExchange   string  `json:"key_exchange,omitempty"`
+	HandshakeMs   float64 `json:"handshake_ms,omitempty"`
+}
+
+/*
+ * GET: What the server knows about the connection this request came
+ * over.
+ */
+func route_connsetup(res http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	if(req.Method != "GET" && req.Method != "HEAD" && req.Method != "") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+
+	conn := connection_of(req)
+	requests := conn.requests.Load()
+	reply := connsetup_reply{
+		Connection:    conn.id,
+		Requests:      requests,
+		Reused:        requests > 1,
+		SinceAcceptMs: float64(now.Sub(conn.accepted).Microseconds()) / 1000,
+		Protocol:      req.Proto,
+	}
+	if(req.TLS != nil) {
+		reply.TLSVersion = tls.VersionName(req.TLS.Version)
+		reply.TLSResumed = req.TLS.DidResume
+		reply.ALPN = req.TLS.NegotiatedProtocol
+		reply.Cipher = tls.CipherSuiteName(req.TLS.CipherSuite)
+		if(req.TLS.CurveID != 0) {
+			reply.KeyExchange = req.TLS.CurveID.String()
+		}
+	}
+	conn.mu.Lock()
+	reply.HandshakeMs = float64(conn.handshake.Microseconds()) / 1000
+	conn.mu.Unlock()
+
+	res.Header().Set("Cache-Control", "no-store")
+	write_json(res, 200, reply)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * CORS on the test endpoints, so a speed-test page hosted elsewhere
+ * can call gost directly.  -cors-origins lists the origins allowed, or
+ * "*" for any; with none, browsers keep cross-origin pages out as
+ * usual.  Preflight answers are cached by the browser for
+ * -cors-max-age.
+ */
+
+/*
+ * Response headers a cross-origin page may read.  Without these the
+ * browser hides the server's own measurements.
+ */
+const cors_exposed_headers = "X-Request-Id, X-Gost-Test-Id, X-Gost-Protocol, X-Gost-Recv-Ns, X-Gost-Send-Ns, " + measurement_headers + ", " + checksum_header + ", X-Gost-Content-Bytes"
+
+/*
+ * Whether origin may call gost under c.
+ */
+func cors_allowed(c *configuration, origin string) bool {
+	for _, allowed := range strings.Split(c.cors_origins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if(allowed == "*" || strings.EqualFold(allowed, origin)) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Wrap a handler to answer CORS preflights itself and mark its other
+ * responses as readable by allowed origins.  Preflights carry no
+ * credentials, so this must sit outside require_auth.
+ */
+func with_cors(handler http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		c := settings()
+		if(c.cors_origins == "") {
+			handler(res, req)
+			return
+		}
+
+		h := res.Header()
+		h.Add("Vary", "Origin")
+		origin := req.Header.Get("Origin")
+		if(origin == "" || !cors_allowed(c, origin)) {
+			handler(res, req)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Origin", origin)
+		if(req.Method != "OPTIONS" || req.Header.Get("Access-Control-Request-Method") == "") {
+			h.Set("Access-Control-Expose-Headers", cors_exposed_headers)
+			handler(res, req)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Methods", c.cors_methods)
+		h.Set("Access-Control-Allow-Headers", c.cors_headers)
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.cors_max_age.Seconds())))
+		res.WriteHeader(204) // No Content
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+/*
+ * Downloads dressed up as something else, for finding ISPs that shape
+ * traffic by what it looks like, such as throttling video or
+ * prioritising web pages.  /down?as= takes video, audio, image,
+ * download or web, or any MIME type, for the Content-Type; ?cache=
+ * replaces the usual "no-store, no-transform" Cache-Control, to look
+ * cacheable; and ?filename= adds a Content-Disposition for a download.
+ * The payload is the same whatever it's dressed as, so comparing the
+ * throughput of each shows up shaping that goes by the headers.
+ */
+type disguise struct {
+	content_type  string
+	cache_control string
+	filename      string
+}
+
+var disguise_presets = map[string]disguise{
+	"video":    {content_type: "video/mp4"},
+	"audio":    {content_type: "audio/mpeg"},
+	"image":    {content_type: "image/jpeg"},
+	"download": {content_type: "application/octet-stream", filename: "download.bin"},
+	"web":      {content_type: "text/html; charset=utf-8"},
+}
+
+/*
+ * Whether s is safe to put in a header: printable ASCII, no controls.
+ */
+func header_safe(s string) bool {
+	for _, r := range s {
+		if(r < ' ' || r > '~') {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * The Content-Type for an ?as= of a preset name or a MIME type.
+ */
+func disguise_as(as string) (disguise, error) {
+	preset, ok := disguise_presets[strings.ToLower(as)]
+	if(ok) {
+		return preset, nil
+	}
+	_, _, err := mime.ParseMediaType(as)
+	if(err != nil || !strings.Contains(as, "/") || !header_safe(as)) {
+		return disguise{}, fmt.Errorf("as must be video, audio, image, download, web or a MIME type, not %q", as)
+	}
+	return disguise{content_type: as}, nil
+}
+
+/*
+ * The disguise asked for with ?as=, ?cache= and ?filename=, or nil for
+ * none.
+ */
+func requested_disguise(req *http.Request) (*disguise, error) {
+	query := req.URL.Query()
+	as, cache, filename := query.Get("as"), query.Get("cache"), query.Get("filename")
+	if(as == "" && cache == "" && filename == "") {
+		return nil, nil
+	}
+
+	d := disguise{}
+	if(as != "") {
+		var err error
+		d, err = disguise_as(as)
+		if(err != nil) {
+			return nil, err
+		}
+	}
+	if(cache != "") {
+		if(!header_safe(cache)) {
+			return nil, fmt.Errorf("invalid cache %q", cache)
+		}
+		d.cache_control = cache
+	}
+	if(filename != "") {
+		if(path.Base(filename) != filename || !header_safe(filename) || strings.ContainsAny(filename, "\"\\")) {
+			return nil, fmt.Errorf("invalid filename %q", filename)
+		}
+		d.filename = filename
+	}
+	return &d, nil
+}
+
+/*
+ * Put the disguise's headers over the usual ones.
+ */
+func (d *disguise) apply(res http.ResponseWriter) {
+	if(d == nil) {
+		return
+	}
+	h := res.Header()
+	if(d.content_type != "") {
+		h.Set("Content-Type", d.content_type)
+	}
+	if(d.cache_control != "") {
+		h.Set("Cache-Control", d.cache_control)
+	}
+	if(d.filename != "") {
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": d.filename}))
+	}
+}
+
+/*
+ * How the result records it.
+ */
+func (d *disguise) String() string {
+	if(d == nil) {
+		return ""
+	}
+	return d.content_type
+}
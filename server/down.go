@@ -0,0 +1,325 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Size of each write in a download stream, unless -write-size says
+ * otherwise, and the largest a client may ask for with ?chunk=.
+ */
+const down_chunk_size = 64 * 1024
+
+/*
+ * Payload size used when the client doesn't ask for one.
+ */
+const down_default_bytes = 10 * 1000 * 1000
+
+/*
+ * Buffers are reused across requests so that a stream of many
+ * gigabytes doesn't churn the allocator.
+ */
+var down_buffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, down_chunk_size)
+		return &buf
+	},
+}
+
+/*
+ * Stream n bytes of payload to w.  Returns the number of bytes actually
+ * written.
+ */
+func write_payload(w io.Writer, n int64) (int64, error) {
+	return write_payload_until(w, n, time.Time{})
+}
+
+/*
+ * Like write_payload, but also stop cleanly once deadline passes,
+ * unless deadline is zero.
+ */
+func write_payload_until(w io.Writer, n int64, deadline time.Time) (int64, error) {
+	return write_source_until(new_payload_source(), w, n, deadline)
+}
+
+/*
+ * Stream n bytes of payload to w, from offset bytes into it.
+ */
+func write_payload_range(w io.Writer, offset int64, n int64) (int64, error) {
+	source := new_payload_source()
+	source.seek(offset)
+	return write_source_until(source, w, n, time.Time{})
+}
+
+func write_source_until(source *payload_source, w io.Writer, n int64, deadline time.Time) (int64, error) {
+	size := settings().write_size
+	written := int64(0)
+	for written < n {
+		if(!deadline.IsZero() && !time.Now().Before(deadline)) {
+			break
+		}
+
+		chunk := source.next(int(min(n - written, size)))
+		m, err := w.Write(chunk)
+		written += int64(m)
+		if(err != nil) {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+/*
+ * Smallest write a client may ask for with ?chunk=.
+ */
+const down_min_chunk = 64
+
+/*
+ * Splits writes into chunks of a fixed size, flushing after each one
+ * if asked to.  Small flushed writes show up the per-syscall and
+ * per-packet costs that big buffered ones hide.
+ */
+type chunked_writer struct {
+	w     io.Writer
+	rc    *http.ResponseController
+	size  int
+	flush bool
+}
+
+func (c chunked_writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), c.size)
+		m, err := c.w.Write(p[:n])
+		written += m
+		if(err == nil && c.flush) {
+			err = c.rc.Flush()
+		}
+		if(err != nil) {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+/*
+ * The write pattern a client asked for with ?chunk= and ?flush=.
+ */
+type chunking struct {
+	size  int
+	flush bool
+}
+
+func requested_chunking(req *http.Request) (chunking, error) {
+	query := req.URL.Query()
+	c := chunking{size: down_chunk_size}
+	if(query.Get("chunk") != "") {
+		n, err := strconv.Atoi(query.Get("chunk"))
+		if(err != nil || n < down_min_chunk || n > down_chunk_size) {
+			return c, fmt.Errorf("chunk must be between %d and %d bytes", down_min_chunk, down_chunk_size)
+		}
+		c.size = n
+	}
+
+	if(query.Get("flush") != "") {
+		var err error
+		c.flush, err = strconv.ParseBool(query.Get("flush"))
+		if(err != nil) {
+			return c, fmt.Errorf("invalid flush %q", query.Get("flush"))
+		}
+	}
+	return c, nil
+}
+
+/*
+ * Wrap w, which ends up at res, to write in this pattern.
+ */
+func (c chunking) wrap(w io.Writer, res http.ResponseWriter) io.Writer {
+	if(c.size == down_chunk_size && !c.flush) {
+		return w
+	}
+	return chunked_writer{w, http.NewResponseController(res), c.size, c.flush}
+}
+
+/*
+ * Work out how many bytes the client wants from the ?bytes= parameter.
+ */
+func requested_bytes(req *http.Request, fallback int64) (int64, error) {
+	value := req.URL.Query().Get("bytes")
+	if(value == "") {
+		return fallback, nil
+	}
+	return parse_size(value)
+}
+
+/*
+ * Work out how long the client wants a test to run from ?seconds=,
+ * which takes either a plain number of seconds or a duration like 10s.
+ * Returns zero when the test is size-based instead.
+ */
+func requested_seconds(req *http.Request) (time.Duration, error) {
+	value := req.URL.Query().Get("seconds")
+	if(value == "") {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if(err != nil) {
+		var f float64
+		f, err = strconv.ParseFloat(value, 64)
+		d = time.Duration(f * float64(time.Second))
+	}
+	if(err != nil || d <= 0) {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	if(d > request_settings(req).max_test_duration) {
+		return 0, fmt.Errorf("duration %v exceeds the server limit of %v", d, request_settings(req).max_test_duration)
+	}
+	return d, nil
+}
+
+/*
+ * How much of the start of a test ?omit= leaves out of its throughput,
+ * given like ?seconds=.  A timed test must run for longer.
+ */
+func requested_omit(req *http.Request) (time.Duration, error) {
+	value := req.URL.Query().Get("omit")
+	if(value == "") {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if(err != nil) {
+		var f float64
+		f, err = strconv.ParseFloat(value, 64)
+		d = time.Duration(f * float64(time.Second))
+	}
+	if(err != nil || d < 0) {
+		return 0, fmt.Errorf("invalid omit %q", value)
+	}
+	if(d >= request_settings(req).max_test_duration) {
+		return 0, fmt.Errorf("omit %v must be shorter than the server limit of %v", d, request_settings(req).max_test_duration)
+	}
+	duration, err := requested_seconds(req)
+	if(err == nil && duration > 0 && d >= duration) {
+		return 0, fmt.Errorf("omit %v must be shorter than the test", d)
+	}
+	return d, nil
+}
+
+/*
+ * The rate in bits per second a test is expected to reach, if it gave
+ * one with ?expect=.
+ */
+func requested_expect(req *http.Request) (int64, error) {
+	value := req.URL.Query().Get("expect")
+	if(value == "") {
+		return 0, nil
+	}
+
+	rate, err := parse_rate(value)
+	if(err != nil || rate <= 0) {
+		return 0, fmt.Errorf("invalid expect %q", value)
+	}
+	return rate, nil
+}
+
+/*
+ * The part of an n byte download a Range header asks for, as an offset
+ * and a length.  Without a Range, or with one for several ranges or
+ * with an If-Range that no longer matches, it's the whole thing.  An
+ * error means the range can't be satisfied.
+ */
+func requested_range(req *http.Request, n int64) (int64, int64, bool, error) {
+	value := req.Header.Get("Range")
+	if(value == "" || strings.Contains(value, ",")) {
+		return 0, n, false, nil
+	}
+	if_range := req.Header.Get("If-Range")
+	if(if_range != "" && if_range != payload_etag(n)) {
+		return 0, n, false, nil
+	}
+
+	spec, ok := strings.CutPrefix(value, "bytes=")
+	first, last, dash := strings.Cut(spec, "-")
+	if(!ok || !dash) {
+		return 0, n, false, fmt.Errorf("invalid range %q", value)
+	}
+
+	if(first == "") {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if(err != nil || suffix <= 0) {
+			return 0, n, false, fmt.Errorf("invalid range %q", value)
+		}
+		suffix = min(suffix, n)
+		return n - suffix, suffix, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if(err != nil || start < 0 || start >= n) {
+		return 0, n, false, fmt.Errorf("range %q is outside the %d byte payload", value, n)
+	}
+	end := n - 1
+	if(last != "") {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if(err != nil || end < start) {
+			return 0, n, false, fmt.Errorf("invalid range %q", value)
+		}
+		end = min(end, n - 1)
+	}
+	return start, end - start + 1, true, nil
+}
+
+/*
+ * The server's own figures for a test.  Comparing them with what the
+ * client measured shows up buffering middleboxes and asymmetric paths.
+ * X-Gost-Seconds and X-Gost-Mbps carry the same numbers in other units
+ * and are kept for older clients.
+ */
+const measurement_headers = "X-Gost-Bytes, X-Gost-Duration-Ms, X-Gost-Throughput-Mbps, X-Gost-Seconds, X-Gost-Mbps, X-Gost-Verdict"
+
+/*
+ * Set the measurement headers, or trailers if the body has already
+ * gone out and they were promised in the Trailer header.
+ */
+func write_measurement_headers(res http.ResponseWriter, result test_result) {
+	h := res.Header()
+	h.Set("X-Gost-Bytes", strconv.FormatInt(result.Bytes, 10))
+	h.Set("X-Gost-Duration-Ms", strconv.FormatFloat(result.Seconds * 1000, 'f', 3, 64))
+	h.Set("X-Gost-Throughput-Mbps", strconv.FormatFloat(result.Mbps, 'f', 3, 64))
+	h.Set("X-Gost-Seconds", strconv.FormatFloat(result.Seconds, 'f', 6, 64))
+	h.Set("X-Gost-Mbps", strconv.FormatFloat(result.Mbps, 'f', 3, 64))
+	if(result.Verdict != "") {
+		h.Set("X-Gost-Verdict", result.Verdict)
+	}
+}
+
+/*
+ * Send the headers for a duration-based download.  The length isn't
+ * known up front, so the response is chunked and the server's figures
+ * follow in trailers.
+ */
+func write_timed_payload_headers(res http.ResponseWriter) {
+	h := res.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Cache-Control", "no-store, no-transform")
+	h.Set("Trailer", measurement_headers)
+}
+
+/*
+ * Send the download test headers.  The payload is random and must reach
+ * the client byte-for-byte, so compression and caching are ruled out.
+ */
+func write_payload_headers(res http.ResponseWriter, n int64) {
+	h := res.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.FormatInt(n, 10))
+	h.Set("Cache-Control", "no-store, no-transform")
+}
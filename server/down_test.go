@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestedRange(t *testing.T) {
+	const n = 1000
+
+	tests := []struct {
+		name     string
+		header   string
+		if_range string
+		offset   int64
+		length   int64
+		partial  bool
+		fails    bool
+	}{
+		{"no range", "", "", 0, n, false, false},
+		{"first bytes", "bytes=0-99", "", 0, 100, true, false},
+		{"middle", "bytes=100-199", "", 100, 100, true, false},
+		{"one byte", "bytes=5-5", "", 5, 1, true, false},
+		{"open ended", "bytes=900-", "", 900, 100, true, false},
+		{"last byte open ended", "bytes=999-", "", 999, 1, true, false},
+		{"end past the payload", "bytes=900-5000", "", 900, 100, true, false},
+		{"suffix", "bytes=-100", "", 900, 100, true, false},
+		{"suffix longer than the payload", "bytes=-5000", "", 0, n, true, false},
+		{"several ranges", "bytes=0-1,5-6", "", 0, n, false, false},
+		{"If-Range that matches", "bytes=0-99", payload_etag(n), 0, 100, true, false},
+		{"If-Range for another payload", "bytes=0-99", payload_etag(n + 1), 0, n, false, false},
+
+		{"start at the end", "bytes=1000-", "", 0, n, false, true},
+		{"start past the end", "bytes=2000-3000", "", 0, n, false, true},
+		{"end before start", "bytes=200-100", "", 0, n, false, true},
+		{"empty suffix", "bytes=-0", "", 0, n, false, true},
+		{"no dash", "bytes=100", "", 0, n, false, true},
+		{"no numbers", "bytes=-", "", 0, n, false, true},
+		{"another unit", "items=0-99", "", 0, n, false, true},
+		{"negative start", "bytes=-5-10", "", 0, n, false, true},
+		{"not a number", "bytes=a-b", "", 0, n, false, true},
+		{"overflowing", "bytes=0-99999999999999999999", "", 0, n, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/down?bytes=1000", nil)
+			if(test.header != "") {
+				req.Header.Set("Range", test.header)
+			}
+			if(test.if_range != "") {
+				req.Header.Set("If-Range", test.if_range)
+			}
+
+			offset, length, partial, err := requested_range(req, n)
+			if(test.fails) {
+				if(err == nil) {
+					t.Fatalf("got %d+%d, want an error", offset, length)
+				}
+				return
+			}
+			if(err != nil) {
+				t.Fatalf("rejected: %v", err)
+			}
+			if(offset != test.offset || length != test.length || partial != test.partial) {
+				t.Fatalf("got %d+%d partial %v, want %d+%d partial %v", offset, length, partial, test.offset, test.length, test.partial)
+			}
+		})
+	}
+}
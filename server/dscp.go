@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+ * DSCP marks on test traffic, per listener and per test with ?dscp=,
+ * so a QoS policy can be checked end to end: mark a download EF and
+ * see whether it gets through a congested link any better.  The mark
+ * goes in the IP header's TOS or traffic class byte of what gost sends,
+ * and only Linux lets us set it.  Marks are given by name (EF, AF41,
+ * CS6) or as a number from 0 to 63.
+ */
+var dscp_names = map[string]int{
+	"DF": 0, "BE": 0, "LE": 1, "EF": 46, "VA": 44,
+	"AF11": 10, "AF12": 12, "AF13": 14,
+	"AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30,
+	"AF41": 34, "AF42": 36, "AF43": 38,
+	"CS0": 0, "CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+}
+
+/*
+ * The codepoint for a DSCP name or number.
+ */
+func parse_dscp(s string) (int, error) {
+	mark, ok := dscp_names[strings.ToUpper(s)]
+	if(ok) {
+		return mark, nil
+	}
+	mark, err := strconv.Atoi(s)
+	if(err != nil || mark < 0 || mark > 63) {
+		return 0, fmt.Errorf("dscp must be a name such as EF or AF41, or a number from 0 to 63, not %q", s)
+	}
+	return mark, nil
+}
+
+/*
+ * A codepoint's usual name, or its number if it hasn't one.  DF wins
+ * over CS0 and BE for 0.
+ */
+func dscp_name(mark int) string {
+	if(mark == 0) {
+		return "DF"
+	}
+	for name, n := range dscp_names {
+		if(n == mark && name != "BE" && name != "CS0") {
+			return name
+		}
+	}
+	return strconv.Itoa(mark)
+}
+
+/*
+ * Wrap a ConnContext hook so that every connection the listener
+ * accepts is marked with dscp, if it's set.
+ */
+func with_dscp(listener string, dscp string, next func(context.Context, net.Conn) context.Context) func(context.Context, net.Conn) context.Context {
+	mark, err := parse_dscp(dscp)
+	return func(ctx context.Context, conn net.Conn) context.Context {
+		if(dscp != "" && err == nil) {
+			err := set_dscp(conn, mark)
+			if(err != nil) {
+				log_at(log_level_error, "Can't mark connections on the %s listener with DSCP %s: %v", listener, dscp, err)
+			}
+		}
+		return next(ctx, conn)
+	}
+}
+
+/*
+ * Check that dscp is a mark we can set, by trying it on a throwaway
+ * socket.
+ */
+func check_dscp(dscp string) error {
+	if(dscp == "") {
+		return nil
+	}
+	mark, err := parse_dscp(dscp)
+	if(err != nil) {
+		return err
+	}
+	return on_throwaway_conn(func(conn net.Conn) error {
+		return set_dscp(conn, mark)
+	})
+}
+
+/*
+ * How a result records the mark on its connection: its name, or empty
+ * for unmarked traffic or when we can't tell.
+ */
+func dscp_report(conn net.Conn) string {
+	mark := dscp_of(conn)
+	if(mark <= 0) {
+		return ""
+	}
+	return dscp_name(mark)
+}
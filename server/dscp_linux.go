@@ -0,0 +1,71 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+/*
+ * Whether conn's socket is IPv6, and so takes IPV6_TCLASS rather than
+ * IP_TOS.  IPv4 over a dual-stack socket still goes out with IP_TOS.
+ */
+func tclass_socket(tcp *net.TCPConn) bool {
+	local, ok := tcp.LocalAddr().(*net.TCPAddr)
+	return ok && local.IP.To4() == nil
+}
+
+/*
+ * Mark what conn sends with a DSCP codepoint, leaving the ECN bits
+ * alone.
+ */
+func set_dscp(conn net.Conn, mark int) error {
+	tcp := tcp_conn_of(conn)
+	if(tcp == nil) {
+		return errors.New("not a TCP connection")
+	}
+	raw, err := tcp.SyscallConn()
+	if(err != nil) {
+		return err
+	}
+
+	level, option := syscall.IPPROTO_IP, syscall.IP_TOS
+	if(tclass_socket(tcp)) {
+		level, option = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	var set_err error
+	err = raw.Control(func(fd uintptr) {
+		set_err = syscall.SetsockoptInt(int(fd), level, option, mark << 2)
+	})
+	if(err != nil) {
+		return err
+	}
+	return set_err
+}
+
+/*
+ * The DSCP codepoint conn is marking with, or -1 if we can't tell.
+ */
+func dscp_of(conn net.Conn) int {
+	tcp := tcp_conn_of(conn)
+	if(tcp == nil) {
+		return -1
+	}
+	raw, err := tcp.SyscallConn()
+	if(err != nil) {
+		return -1
+	}
+
+	level, option := syscall.IPPROTO_IP, syscall.IP_TOS
+	if(tclass_socket(tcp)) {
+		level, option = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	value, get_err := -1, error(nil)
+	err = raw.Control(func(fd uintptr) {
+		value, get_err = syscall.GetsockoptInt(int(fd), level, option)
+	})
+	if(err != nil || get_err != nil) {
+		return -1
+	}
+	return value >> 2
+}
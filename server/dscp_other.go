@@ -0,0 +1,16 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+func set_dscp(conn net.Conn, mark int) error {
+	return errors.New("DSCP marking is only supported on Linux")
+}
+
+func dscp_of(conn net.Conn) int {
+	return -1
+}
@@ -0,0 +1,466 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Duplex tests, downloading and uploading at once over two
+ * connections, to measure full-duplex capacity.  A link that's really
+ * half-duplex, or a policer that counts both directions together,
+ * shows up as each direction doing worse than it does alone.
+ *
+ *	POST /duplex?seconds=10        creates the test
+ *	GET  /duplex/{id}/down         runs the download half
+ *	PUT  /duplex/{id}/up           runs the upload half
+ *	GET  /duplex/{id}              reports the combined result
+ *
+ * Both halves stop when the test's time is up, counted from whichever
+ * starts first.  The result is recorded with direction "duplex": the
+ * bytes and throughput of both halves together, and each half under
+ * duplex, with how long they overlapped.  DELETE /tests/{id} cancels
+ * both halves.
+ */
+const duplex_prefix = "/duplex"
+const duplex_default_seconds = 10
+
+/*
+ * A test whose halves haven't both finished by then is recorded as
+ * aborted with whatever was moved.
+ */
+const duplex_expiry = 10 * time.Minute
+
+type duplex_half struct {
+	grouped_part
+	state   string
+	bytes   int64
+	started time.Time
+	ended   time.Time
+}
+
+type duplex_test struct {
+	mu         sync.Mutex
+	id         string
+	request_id string
+	tenant     string
+	vhost      string
+	client_ip  string
+	duration   time.Duration
+	deadline   time.Time
+	down       duplex_half
+	up         duplex_half
+	finished   int
+	failed     error
+	result     *test_result
+	expiry     *time.Timer
+	protocol   string
+
+	// The most bytes the client's JWT lets both halves move together,
+	// or zero, and what they have.
+	jwt_limit int64
+	moved     atomic.Int64
+
+	// Set once the test's cancelled, which stops both halves.
+	cancelled bool
+	stop      atomic.Bool
+	done      chan struct{}
+}
+
+var duplex_tests = struct {
+	sync.Mutex
+	byid map[string]*duplex_test
+}{byid: map[string]*duplex_test{}}
+
+/*
+ * What POST /duplex hands back.
+ */
+type duplex_plan struct {
+	ID      string  `json:"id"`
+	Seconds float64 `json:"seconds"`
+	DownURL string  `json:"down_url"`
+	UpURL   string  `json:"up_url"`
+}
+
+/*
+ * Each half of a duplex test, in its result and in GET /duplex/{id}.
+ */
+type duplex_report struct {
+	DownBytes      int64   `json:"down_bytes"`
+	DownMbps       float64 `json:"down_mbps"`
+	UpBytes        int64   `json:"up_bytes"`
+	UpMbps         float64 `json:"up_mbps"`
+	OverlapSeconds float64 `json:"overlap_seconds"`
+}
+
+type duplex_status struct {
+	ID    string  `json:"id"`
+	State string  `json:"state"`
+	Mbps  float64 `json:"mbps"`
+	duplex_report
+}
+
+/*
+ * The half's throughput so far.
+ */
+func (h *duplex_half) mbps(now time.Time) float64 {
+	if(h.started.IsZero()) {
+		return 0
+	}
+	end := h.ended
+	if(end.IsZero()) {
+		end = now
+	}
+	return mbps(h.bytes, end.Sub(h.started))
+}
+
+/*
+ * Both halves so far.  Called with mu held.
+ */
+func (d *duplex_test) report(now time.Time) duplex_report {
+	r := duplex_report{
+		DownBytes: d.down.bytes,
+		DownMbps:  d.down.mbps(now),
+		UpBytes:   d.up.bytes,
+		UpMbps:    d.up.mbps(now),
+	}
+	if(!d.down.started.IsZero() && !d.up.started.IsZero()) {
+		start := d.down.started
+		if(d.up.started.After(start)) {
+			start = d.up.started
+		}
+		end := now
+		if(!d.down.ended.IsZero() && d.down.ended.Before(end)) {
+			end = d.down.ended
+		}
+		if(!d.up.ended.IsZero() && d.up.ended.Before(end)) {
+			end = d.up.ended
+		}
+		r.OverlapSeconds = max(end.Sub(start), 0).Seconds()
+	}
+	return r
+}
+
+/*
+ * Record the combined result.  Called with mu held, once.
+ */
+func (d *duplex_test) conclude(protocol string) {
+	d.expiry.Stop()
+
+	now := time.Now()
+	first, last := now, time.Time{}
+	for _, h := range []*duplex_half{&d.down, &d.up} {
+		if(!h.started.IsZero() && h.started.Before(first)) {
+			first = h.started
+		}
+		if(h.ended.After(last)) {
+			last = h.ended
+		}
+	}
+	span := max(last.Sub(first), 0)
+
+	report := d.report(now)
+	result := test_result{
+		ID:        d.id,
+		RequestID: d.request_id,
+		Direction: "duplex",
+		Started:   first,
+		Bytes:     d.down.bytes + d.up.bytes,
+		Seconds:   span.Seconds(),
+		Mbps:      report.DownMbps + report.UpMbps,
+		ClientIP:  d.client_ip,
+		Tenant:    d.tenant,
+		Vhost:     d.vhost,
+		Protocol:  protocol,
+		Outcome:   "completed",
+		Duplex:    &report,
+	}
+	if(d.failed != nil) {
+		result.Outcome = "aborted"
+		result.Error = d.failed.Error()
+	}
+
+	result.locate()
+	d.result = &result
+	metric_test_duration.observe("duplex", span.Seconds())
+	finish_result(result)
+	close(d.done)
+	grouped_tests.Delete(d.id)
+}
+
+func (d *duplex_test) status() duplex_status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	report := d.report(time.Now())
+	out := duplex_status{ID: d.id, State: "running", Mbps: report.DownMbps + report.UpMbps, duplex_report: report}
+	if(d.down.started.IsZero() && d.up.started.IsZero()) {
+		out.State = "pending"
+	}
+	if(d.result != nil) {
+		out.State = d.result.Outcome
+	}
+	return out
+}
+
+func (d *duplex_test) owned_by(client string, tenant string) bool {
+	return d.client_ip == client && d.tenant == tenant
+}
+
+/*
+ * Cancel the test: interrupt the halves running, and conclude it now
+ * if neither is.
+ */
+func (d *duplex_test) cancel() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if(d.result != nil || d.cancelled) {
+		return
+	}
+	d.cancelled = true
+	d.stop.Store(true)
+	if(d.failed == nil) {
+		d.failed = test_cancelled
+	}
+	for _, h := range []*duplex_half{&d.down, &d.up} {
+		switch h.state {
+		case "running":
+			h.grouped_part.cancel(d.client_ip, d.tenant, d.vhost)
+		case "pending":
+			h.state = "cancelled"
+			d.finished++
+		}
+	}
+	if(d.finished == 2) {
+		d.conclude(d.protocol)
+	}
+}
+
+func (d *duplex_test) concluded() <-chan struct{} {
+	return d.done
+}
+
+func (d *duplex_test) final() *test_result {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.result
+}
+
+func (d *duplex_test) so_far() any {
+	return d.status()
+}
+
+/*
+ * Look up a duplex test by ID.
+ */
+func find_duplex_test(id string) *duplex_test {
+	duplex_tests.Lock()
+	defer duplex_tests.Unlock()
+	return duplex_tests.byid[id]
+}
+
+/*
+ * Dispatch /duplex and everything beneath it.
+ */
+func route_duplex(res http.ResponseWriter, req *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(req.URL.Path, duplex_prefix), "/")
+	parts := strings.Split(rest, "/")
+
+	switch {
+	case rest == "" && req.Method == "POST":
+		duplex_create(res, req)
+	case rest != "" && len(parts) == 1 && req.Method == "GET":
+		duplex_status_of(res, req, parts[0])
+	case len(parts) == 2 && parts[1] == "down" && req.Method == "GET":
+		duplex_serve(res, req, parts[0], "down")
+	case len(parts) == 2 && parts[1] == "up" && (req.Method == "PUT" || req.Method == "POST"):
+		duplex_serve(res, req, parts[0], "up")
+	case rest == "" || (len(parts) == 2 && (parts[1] == "down" || parts[1] == "up")) || len(parts) == 1:
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+	default:
+		res.WriteHeader(404)
+		io.WriteString(res, "Not Found")
+	}
+}
+
+/*
+ * POST /duplex: set up a test and tell the client where to run each
+ * half.
+ */
+func duplex_create(res http.ResponseWriter, req *http.Request) {
+	duration, err := requested_seconds(req)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+	if(duration == 0) {
+		duration = min(duplex_default_seconds * time.Second, request_settings(req).max_test_duration)
+	}
+
+	d := &duplex_test{
+		id:         new_uuid(),
+		request_id: request_id(req),
+		client_ip:  client_ip(req),
+		tenant:     request_tenant(req),
+		vhost:      request_vhost(req),
+		duration:   duration,
+		protocol:   req.Proto,
+		jwt_limit:  jwt_test_limit(req),
+		done:       make(chan struct{}),
+	}
+	d.down.state = "pending"
+	d.up.state = "pending"
+
+	d.expiry = time.AfterFunc(duplex_expiry, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if(d.result == nil) {
+			d.failed = errors.New("not both halves finished in time")
+			d.conclude(d.protocol)
+		}
+	})
+
+	duplex_tests.Lock()
+	duplex_tests.byid[d.id] = d
+	duplex_tests.Unlock()
+	grouped_tests.Store(d.id, d)
+
+	// Forget finished tests after a while; their results live on in
+	// /results.
+	time.AfterFunc(2 * duplex_expiry, func() {
+		duplex_tests.Lock()
+		delete(duplex_tests.byid, d.id)
+		duplex_tests.Unlock()
+	})
+
+	res.Header().Set("X-Gost-Test-Id", d.id)
+	write_json(res, 201, duplex_plan{
+		ID:      d.id,
+		Seconds: duration.Seconds(),
+		DownURL: mount_prefix + duplex_prefix + "/" + d.id + "/down",
+		UpURL:   mount_prefix + duplex_prefix + "/" + d.id + "/up",
+	})
+}
+
+/*
+ * GET /duplex/{id}: the combined result so far.  Like the halves, only
+ * for the client that set the test up.
+ */
+func duplex_status_of(res http.ResponseWriter, req *http.Request, id string) {
+	d := find_duplex_test(id)
+	if(d == nil || !d.owned_by(client_ip(req), request_tenant(req))) {
+		res.WriteHeader(404)
+		io.WriteString(res, "No such test")
+		return
+	}
+	write_json(res, 200, d.status())
+}
+
+/*
+ * GET /duplex/{id}/down or PUT /duplex/{id}/up: one half of the test,
+ * which may be run once, by the client that set the test up, from the
+ * same address and as the same tenant.
+ */
+func duplex_serve(res http.ResponseWriter, req *http.Request, id string, direction string) {
+	d := find_duplex_test(id)
+	if(d == nil || !d.owned_by(client_ip(req), request_tenant(req))) {
+		res.WriteHeader(404)
+		io.WriteString(res, "No such test")
+		return
+	}
+
+	d.mu.Lock()
+	h := &d.down
+	if(direction == "up") {
+		h = &d.up
+	}
+	if(d.cancelled) {
+		d.mu.Unlock()
+		res.WriteHeader(409) // Conflict
+		io.WriteString(res, "Test cancelled")
+		return
+	}
+	if(h.state != "pending" || d.result != nil) {
+		d.mu.Unlock()
+		res.WriteHeader(409) // Conflict
+		io.WriteString(res, "Already run")
+		return
+	}
+	if(!admit_test(res, d.client_ip, d.tenant, d.vhost)) {
+		d.mu.Unlock()
+		return
+	}
+	h.state = "running"
+	h.started = time.Now()
+	h.begin(res, req)
+	if(d.deadline.IsZero()) {
+		d.deadline = h.started.Add(d.duration)
+	}
+	deadline := d.deadline
+	d.mu.Unlock()
+
+	res.Header().Set("X-Gost-Test-Id", d.id)
+	var n int64
+	var err error
+	if(direction == "down") {
+		write_timed_payload_headers(res)
+		w := jwt_limit_writer(res, &d.moved, d.jwt_limit)
+		n, err = write_payload_until(progress_writer{w, &h.moved, &d.stop}, request_settings(req).max_test_bytes, deadline)
+	} else {
+		slow := watch_upload_rate(res, &h.moved)
+		r := jwt_limit_reader(upload_body(res, req), &d.moved, d.jwt_limit)
+		n, err = drain_body_until(res, progress_reader{r, &h.moved, &d.stop}, deadline)
+		if(slow()) {
+			err = upload_too_slow
+		}
+		connection_of(req).uploaded.Add(n)
+	}
+	metric_test_bytes.add(direction, n)
+
+	d.mu.Lock()
+	if(err != nil && d.cancelled) {
+		err = test_cancelled
+	}
+	h.end(d.client_ip, d.tenant, d.vhost, n, err)
+	h.bytes = n
+	h.ended = time.Now()
+	h.state = "completed"
+	if(err != nil) {
+		h.state = "aborted"
+		if(d.failed == nil) {
+			d.failed = err
+		}
+	}
+	elapsed := h.ended.Sub(h.started)
+	d.finished++
+	if(d.finished == 2 && d.result == nil) {
+		d.conclude(req.Proto)
+	}
+	d.mu.Unlock()
+
+	if(direction == "down") {
+		return
+	}
+	_, too_big := err.(*http.MaxBytesError)
+	switch {
+	case too_big:
+		res.WriteHeader(413) // Request Entity Too Large
+		io.WriteString(res, "Upload exceeds the server limit")
+	case err == upload_too_slow:
+		res.WriteHeader(408) // Request Timeout
+		io.WriteString(res, "Upload too slow")
+	case err == jwt_err_limit:
+		set_error_code(res, "token_limit")
+		res.WriteHeader(403) // Forbidden
+		io.WriteString(res, "Upload is larger than the token allows")
+	case err == nil:
+		write_json(res, 200, upload_summary{ID: d.id, Bytes: n, Seconds: elapsed.Seconds(), Mbps: mbps(n, elapsed)})
+	}
+}
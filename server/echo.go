@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+/*
+ * How long a WebSocket echo session may sit idle.
+ */
+const echo_idle_timeout = 60 * time.Second
+
+/*
+ * The reply to each message on /ws.  Data is whatever the client sent,
+ * returned verbatim so it can carry the client's own timestamps.
+ */
+type echo_frame struct {
+	Seq    uint64          `json:"seq"`
+	RecvNs int64           `json:"recv_ns"`
+	SendNs int64           `json:"send_ns"`
+	Data   json.RawMessage `json:"data"`
+}
+
+/*
+ * GET: Upgrade to a WebSocket and echo every text message back wrapped
+ * in an echo_frame.  A browser can fire off many small samples this
+ * way without paying for a request each time, which is what jitter
+ * measurements need.
+ */
+func route_ws(res http.ResponseWriter, req *http.Request) {
+	ws, err := ws_upgrade(res, req, nil)
+	if(err != nil) {
+		log_request(req, log_level_debug, "websocket upgrade failed", "remote", req.RemoteAddr, "error", err)
+		return
+	}
+	defer ws.conn.Close()
+	ws.max_message = 64 * 1024
+
+	seq := uint64(0)
+	for {
+		ws.conn.SetReadDeadline(time.Now().Add(echo_idle_timeout))
+		opcode, message, err := ws.read_message()
+		recv := monotonic_ns()
+		if(err != nil) {
+			log_request(req, log_level_debug, "websocket echo ended", "remote", req.RemoteAddr, "messages", seq, "error", err)
+			return
+		}
+
+		if(opcode != ws_op_text) {
+			ws.close(ws_close_unsupported, "text frames only")
+			return
+		}
+
+		seq++
+		frame := echo_frame{Seq: seq, RecvNs: recv, Data: message}
+		if(!json.Valid(message)) {
+			frame.Data, _ = json.Marshal(string(message))
+		}
+		frame.SendNs = monotonic_ns()
+
+		reply, _ := json.Marshal(frame)
+		err = ws.write_message(ws_op_text, reply)
+		if(err != nil) {
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+ * gost can run inside another program as well as on its own:
+ *
+ *	s, err := server.New(server.Config{Prefix: "/speedtest"})
+ *	mux.Handle("/speedtest/", s.Handler())
+ *
+ * serves the test routes from the host program's own listener, and
+ * s.Run(ctx) starts gost's listeners too, if it's to have them.  Its
+ * state is the process's, as the binary's is, so there's one per
+ * process.
+ */
+type Config struct {
+	Args   []string // flags, as gost serve takes them
+	Prefix string   // the path Handler is mounted under, if any
+}
+
+type Server struct {
+	prefix     string
+	tls_config *tls.Config
+}
+
+/*
+ * The path the test routes are mounted under, for the URLs they hand
+ * out.  Empty when gost is serving on its own.
+ */
+var mount_prefix string
+
+var created atomic.Bool
+
+/*
+ * Load the configuration from config's flags, the environment and any
+ * configuration file, as gost serve would, and get ready to serve.
+ * Errors are returned rather than exiting.
+ */
+func New(config Config) (*Server, error) {
+	prefix := strings.TrimSuffix(config.Prefix, "/")
+	if(prefix != "" && !strings.HasPrefix(prefix, "/")) {
+		return nil, errors.New("gost: Prefix must start with /")
+	}
+	if(!created.CompareAndSwap(false, true)) {
+		return nil, errors.New("gost: only one server per process")
+	}
+
+	server_args = config.Args
+	c, err := load_configuration(server_args)
+	if(err != nil) {
+		return nil, err
+	}
+	err = put_in_force(c)
+	if(err != nil) {
+		return nil, err
+	}
+	mount_prefix = prefix
+
+	start_rate_meter()
+	tls_config, err := prepare_serving()
+	if(err != nil) {
+		return nil, err
+	}
+	return &Server{prefix: prefix, tls_config: tls_config}, nil
+}
+
+/*
+ * The test routes, for mounting under the configured prefix.
+ */
+func (s *Server) Handler() http.Handler {
+	if(s.prefix == "") {
+		return http_listeners.mux
+	}
+	return http.StripPrefix(s.prefix, http_listeners.mux)
+}
+
+/*
+ * Start the listeners the configuration asks for, admin and gRPC among
+ * them, and serve until ctx is done, then drain as a signal would.
+ */
+func (s *Server) Run(ctx context.Context) error {
+	err := start_serving(settings(), s.tls_config)
+	if(err != nil) {
+		return err
+	}
+
+	<-ctx.Done()
+	drain("Stopped")
+	return nil
+}
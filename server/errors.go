@@ -0,0 +1,165 @@
+package server
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Errors as JSON for clients that ask for it.  Handlers answer errors
+ * in plain text, which is what curl users want to see; a request whose
+ * Accept prefers application/json to text gets the API's envelope
+ * instead, so a client can tell why it was turned away without
+ * scraping the text:
+ *
+ *	{"error":{"code":"client_quota","message":"..."},"request_id":"..."}
+ *
+ * The code is the HTTP status's name, not_found or method_not_allowed,
+ * unless the handler gave a more particular one with set_error_code(),
+ * as refusals do with their reason.  The message is the text the
+ * handler wrote.  Headers such as Retry-After and Allow are kept, and
+ * responses that are already JSON pass through untouched.
+ */
+const error_message_max = 4096
+
+/*
+ * Does req prefer JSON to text?  Wildcards don't count, so curl, and
+ * browsers, which list text/html first, get text.
+ */
+func wants_json_errors(req *http.Request) bool {
+	var json, text float64
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+		media, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if(err != nil) {
+			continue
+		}
+		q := 1.0
+		if(params["q"] != "") {
+			q, err = strconv.ParseFloat(params["q"], 64)
+			if(err != nil) {
+				continue
+			}
+		}
+		switch {
+		case media == "application/json" || strings.HasSuffix(media, "+json"):
+			json = max(json, q)
+		case strings.HasPrefix(media, "text/"):
+			text = max(text, q)
+		}
+	}
+	return json > 0 && json > text
+}
+
+/*
+ * Holds back an error response until the handler's done with it, then
+ * writes it as JSON.  Anything else goes straight through.
+ */
+type error_writer struct {
+	http.ResponseWriter
+	req     *http.Request
+	status  int
+	code    string
+	message strings.Builder
+	passed  bool
+}
+
+/*
+ * Give the error res is answering with a more particular code than its
+ * status's, for clients that get it as JSON.
+ */
+func set_error_code(res http.ResponseWriter, code string) {
+	for res != nil {
+		e, ok := res.(*error_writer)
+		if(ok) {
+			e.code = code
+			return
+		}
+		inner, ok := res.(interface{ Unwrap() http.ResponseWriter })
+		if(!ok) {
+			return
+		}
+		res = inner.Unwrap()
+	}
+}
+
+func (e *error_writer) WriteHeader(code int) {
+	if(e.status != 0) {
+		return
+	}
+	if(!e.passed && code >= 400 && !strings.HasPrefix(e.Header().Get("Content-Type"), "application/json")) {
+		e.status = code
+		return
+	}
+	if(code >= 200) {
+		e.passed = true
+	}
+	e.ResponseWriter.WriteHeader(code)
+}
+
+func (e *error_writer) Write(p []byte) (int, error) {
+	if(e.status != 0) {
+		if(e.message.Len() < error_message_max) {
+			e.message.Write(p[:min(len(p), error_message_max - e.message.Len())])
+		}
+		return len(p), nil
+	}
+	e.passed = true
+	return e.ResponseWriter.Write(p)
+}
+
+func (e *error_writer) ReadFrom(src io.Reader) (int64, error) {
+	if(e.status != 0) {
+		return io.Copy(struct{ io.Writer }{e}, src)
+	}
+	e.passed = true
+	rf, ok := e.ResponseWriter.(io.ReaderFrom)
+	if(!ok) {
+		return io.Copy(struct{ io.Writer }{e.ResponseWriter}, src)
+	}
+	return rf.ReadFrom(src)
+}
+
+func (e *error_writer) FlushError() error {
+	if(e.status != 0) {
+		return nil
+	}
+	e.passed = true
+	return http.NewResponseController(e.ResponseWriter).Flush()
+}
+
+func (e *error_writer) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+/*
+ * Write the error the handler held back, if it did.
+ */
+func (e *error_writer) finish() {
+	if(e.status == 0) {
+		return
+	}
+	code := e.code
+	if(code == "") {
+		code = strings.ReplaceAll(strings.ToLower(http.StatusText(e.status)), " ", "_")
+	}
+	if(code == "") {
+		code = "error"
+	}
+	message := strings.TrimSpace(e.message.String())
+	if(message == "") {
+		message = http.StatusText(e.status)
+	}
+
+	h := e.Header()
+	h.Del("Content-Length")
+	h.Del("X-Content-Type-Options")
+	if(e.req.Method == "HEAD") {
+		h.Set("Content-Type", "application/json")
+		e.ResponseWriter.WriteHeader(e.status)
+		return
+	}
+	write_api_error(e.ResponseWriter, e.req, e.status, code, message)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+ * Everything the server is doing, as Server-Sent Events, for
+ * dashboards.  /events sends a "start" event as each test begins, a
+ * "progress" event for each running test every ?interval=, and a
+ * "finish" event carrying each result.  A subscriber that falls behind
+ * misses events rather than holding up the tests.
+ */
+const events_default_interval = time.Second
+const events_buffer = 64
+
+type lifecycle_event struct {
+	name string
+	data any
+}
+
+var event_subscribers = struct {
+	sync.Mutex
+	set map[chan lifecycle_event]bool
+}{set: map[chan lifecycle_event]bool{}}
+
+/*
+ * Send an event to everyone listening on /events.
+ */
+func publish_event(name string, data any) {
+	event_subscribers.Lock()
+	defer event_subscribers.Unlock()
+
+	for ch := range event_subscribers.set {
+		select {
+		case ch <- lifecycle_event{name, data}:
+		default:
+		}
+	}
+}
+
+func subscribe_events() chan lifecycle_event {
+	ch := make(chan lifecycle_event, events_buffer)
+	event_subscribers.Lock()
+	event_subscribers.set[ch] = true
+	event_subscribers.Unlock()
+	return ch
+}
+
+func unsubscribe_events(ch chan lifecycle_event) {
+	event_subscribers.Lock()
+	delete(event_subscribers.set, ch)
+	event_subscribers.Unlock()
+}
+
+/*
+ * GET: Stream test activity until the client goes away.
+ */
+func route_events(res http.ResponseWriter, req *http.Request) {
+	interval := events_default_interval
+	value := req.URL.Query().Get("interval")
+	if(value != "") {
+		d, err := time.ParseDuration(value)
+		if(err != nil || d < progress_min_interval) {
+			res.WriteHeader(400) // Bad Request
+			io.WriteString(res, "interval must be a duration of at least " + progress_min_interval.String())
+			return
+		}
+		interval = d
+	}
+
+	ch := subscribe_events()
+	defer unsubscribe_events(ch)
+
+	write_event_headers(res)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	type sample struct {
+		bytes int64
+		at    time.Time
+	}
+	last := map[string]sample{}
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case e := <-ch:
+			err := write_event(res, e.name, e.data)
+			if(err != nil) {
+				return
+			}
+		case now := <-ticker.C:
+			seen := map[string]sample{}
+			var err error
+			active_runs.Range(func(_, v any) bool {
+				t := v.(*test_run)
+				bytes := t.moved.Load()
+				prev, ok := last[t.id]
+				if(!ok) {
+					prev = sample{0, t.start}
+				}
+				seen[t.id] = sample{bytes, now}
+				err = write_event(res, "progress", progress_event{
+					ID:      t.id,
+					Bytes:   bytes,
+					Seconds: now.Sub(t.start).Seconds(),
+					Mbps:    mbps(bytes - prev.bytes, now.Sub(prev.at)),
+					AvgMbps: mbps(bytes, now.Sub(t.start)),
+				})
+				return err == nil
+			})
+			if(err != nil) {
+				return
+			}
+			last = seen
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * /down?source=file serves a pre-generated file from -files-dir rather
+ * than generating the payload as it goes.  Over plain HTTP/1.1 that
+ * lets the kernel sendfile() it straight from the page cache, which is
+ * the thing to compare against when copying data through userspace
+ * starts to cost at 10GbE and up.  TLS and HTTP/2 still copy.
+ *
+ * Files come in the sizes below, up to -files-max, and are written in
+ * the background at startup if they aren't there already.
+ */
+var test_file_sizes = []int64{
+	1000 * 1000,
+	10 * 1000 * 1000,
+	100 * 1000 * 1000,
+	1000 * 1000 * 1000,
+	10 * 1000 * 1000 * 1000,
+}
+
+/*
+ * How much a counted_response hands to sendfile at a time, so that
+ * progress reports still move.
+ */
+const sendfile_step = 4 * 1024 * 1024
+
+var test_files = struct {
+	sync.RWMutex
+	ready map[int64]string
+}{ready: map[int64]string{}}
+
+func test_file_name(size int64) string {
+	return "gost-" + strconv.FormatInt(size, 10) + ".bin"
+}
+
+/*
+ * Write any missing test files, smallest first so the common sizes are
+ * ready soonest.
+ */
+func go_prepare_test_files(c *configuration) {
+	if(c.files_dir == "") {
+		return
+	}
+
+	go func() {
+		err := os.MkdirAll(c.files_dir, 0755)
+		if(err != nil) {
+			log_at(log_level_error, "Can't create %s: %v", c.files_dir, err)
+			return
+		}
+
+		for _, size := range test_file_sizes {
+			if(size > c.files_max) {
+				break
+			}
+
+			path := filepath.Join(c.files_dir, test_file_name(size))
+			info, err := os.Stat(path)
+			if(err != nil || info.Size() != size) {
+				start := time.Now()
+				err = write_test_file(path, size)
+				if(err != nil) {
+					log_at(log_level_error, "Can't write test file %s: %v", path, err)
+					return
+				}
+				log_at(log_level_info, "Wrote test file %s in %v", path, time.Since(start).Round(time.Millisecond))
+			}
+
+			test_files.Lock()
+			test_files.ready[size] = path
+			test_files.Unlock()
+		}
+	}()
+}
+
+/*
+ * Write size bytes of payload to path, via a temporary file so that a
+ * half-written one is never served.
+ */
+func write_test_file(path string, size int64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path) + ".*")
+	if(err != nil) {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriterSize(tmp, down_chunk_size)
+	_, err = write_payload(w, size)
+	if(err == nil) {
+		err = w.Flush()
+	}
+	if(err == nil) {
+		err = tmp.Chmod(0644)
+	}
+	if(err == nil) {
+		err = tmp.Close()
+	}
+	if(err != nil) {
+		tmp.Close()
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+/*
+ * Counts what goes out through a ResponseWriter towards a test.  It
+ * passes ReadFrom through, so a file still goes out by sendfile(), in
+ * steps of sendfile_step.
+ */
+type counted_response struct {
+	http.ResponseWriter
+	test *test_run
+	err  error
+}
+
+func (c *counted_response) Write(p []byte) (int, error) {
+	n, err := c.test.writer(c.ResponseWriter).Write(p)
+	if(err != nil) {
+		c.err = err
+	}
+	return n, err
+}
+
+func (c *counted_response) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := c.ResponseWriter.(io.ReaderFrom)
+	if(!ok) {
+		return io.Copy(struct{ io.Writer }{c}, src)
+	}
+
+	// Unwrap a LimitedReader so that each step is only one deep, as
+	// sendfile() needs.
+	remain := int64(-1)
+	lr, limited := src.(*io.LimitedReader)
+	if(limited) {
+		src, remain = lr.R, lr.N
+	}
+
+	total := int64(0)
+	for remain != 0 {
+		if(c.test.cancelled.Load()) {
+			c.err = test_cancelled
+			return total, c.err
+		}
+		step := int64(sendfile_step)
+		if(remain > 0 && remain < step) {
+			step = remain
+		}
+		n, err := rf.ReadFrom(&io.LimitedReader{R: src, N: step})
+		total += n
+		c.test.moved.Add(n)
+		payload_bytes_moved.Add(n)
+		if(remain > 0) {
+			remain -= n
+		}
+		if(limited) {
+			lr.N -= n
+		}
+		if(err != nil) {
+			c.err = err
+			return total, err
+		}
+		if(n < step) {
+			break
+		}
+	}
+	return total, nil
+}
+
+/*
+ * Serve a download test from a test file of exactly n bytes.
+ */
+func serve_test_file(res http.ResponseWriter, req *http.Request, n int64, dress *disguise) {
+	if(settings().files_dir == "") {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, "No test files are configured")
+		return
+	}
+
+	test_files.RLock()
+	path, ok := test_files.ready[n]
+	test_files.RUnlock()
+	if(!ok) {
+		res.Header().Set("Retry-After", "60")
+		res.WriteHeader(503) // Service Unavailable
+		io.WriteString(res, fmt.Sprintf("No test file of %d bytes is ready; sizes are 1M, 10M, 100M, 1G and 10G", n))
+		return
+	}
+
+	f, err := os.Open(path)
+	if(err != nil) {
+		res.WriteHeader(500) // Internal Server Error
+		io.WriteString(res, "Can't open test file")
+		log_request(req, log_level_error, "can't open test file", "error", err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if(err != nil) {
+		res.WriteHeader(500) // Internal Server Error
+		io.WriteString(res, "Can't open test file")
+		return
+	}
+
+	h := res.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Cache-Control", "no-store, no-transform")
+	dress.apply(res)
+	if(req.Method == "HEAD") {
+		http.ServeContent(res, req, "", info.ModTime(), f)
+		return
+	}
+
+	test := begin_test(res, req, "down", n)
+	if(test == nil) {
+		return
+	}
+	out := &counted_response{ResponseWriter: res, test: test}
+	test.as = dress.String()
+	http.ServeContent(out, req, "", info.ModTime(), f)
+	test.end(test.moved.Load(), out.err)
+}
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+/*
+ * A reader for MaxMind DB files, such as the free GeoLite2 databases,
+ * enough to look addresses up in them.  The whole file is read into
+ * memory.  The format is a binary search tree over address bits whose
+ * leaves point into a data section of self-describing values; see
+ * https://maxmind.github.io/MaxMind-DB/.
+ */
+type geoip_db struct {
+	path        string
+	data        []byte
+	node_count  uint
+	record_size uint
+	ip_version  uint
+	tree_size   uint
+	ipv4_start  uint
+	kind        string
+}
+
+var geoip_metadata_marker = []byte("\xab\xcd\xefMaxMind.com")
+
+/*
+ * The data types a value in the data section can have.
+ */
+const (
+	mmdb_extended = iota
+	mmdb_pointer
+	mmdb_string
+	mmdb_double
+	mmdb_bytes
+	mmdb_uint16
+	mmdb_uint32
+	mmdb_map
+	mmdb_int32
+	mmdb_uint64
+	mmdb_uint128
+	mmdb_array
+	mmdb_container
+	mmdb_end
+	mmdb_bool
+	mmdb_float
+)
+
+/*
+ * Load the database at path.
+ */
+func open_geoip(path string) (*geoip_db, error) {
+	data, err := os.ReadFile(path)
+	if(err != nil) {
+		return nil, err
+	}
+
+	at := bytes.LastIndex(data, geoip_metadata_marker)
+	if(at < 0) {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+	metadata := data[at + len(geoip_metadata_marker):]
+	decoded, _, err := mmdb_decode(metadata, 0)
+	if(err != nil) {
+		return nil, fmt.Errorf("%s: metadata: %v", path, err)
+	}
+	meta, ok := decoded.(map[string]any)
+	if(!ok) {
+		return nil, fmt.Errorf("%s: metadata isn't a map", path)
+	}
+
+	db := &geoip_db{path: path, data: data}
+	db.node_count = mmdb_uint(meta["node_count"])
+	db.record_size = mmdb_uint(meta["record_size"])
+	db.ip_version = mmdb_uint(meta["ip_version"])
+	db.kind, _ = meta["database_type"].(string)
+	if(db.record_size != 24 && db.record_size != 28 && db.record_size != 32) {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, db.record_size)
+	}
+
+	db.tree_size = db.record_size * 2 / 8 * db.node_count
+	if(db.tree_size + 16 > uint(at)) {
+		return nil, fmt.Errorf("%s: search tree runs past the data", path)
+	}
+
+	// IPv4 addresses live under ::/96 in an IPv6 tree.
+	if(db.ip_version == 6) {
+		for i := 0; i < 96 && db.ipv4_start < db.node_count; i++ {
+			db.ipv4_start = db.record(db.ipv4_start, 0)
+		}
+	}
+	return db, nil
+}
+
+/*
+ * One of a node's two records: 0 for the left, 1 for the right.
+ */
+func (db *geoip_db) record(node uint, side uint) uint {
+	switch db.record_size {
+	case 24:
+		b := db.data[node * 6 + side * 3:]
+		return uint(b[0]) << 16 | uint(b[1]) << 8 | uint(b[2])
+	case 28:
+		b := db.data[node * 7:]
+		if(side == 0) {
+			return uint(b[3] & 0xf0) << 20 | uint(b[0]) << 16 | uint(b[1]) << 8 | uint(b[2])
+		}
+		return uint(b[3] & 0x0f) << 24 | uint(b[4]) << 16 | uint(b[5]) << 8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(db.data[node * 8 + side * 4:]))
+}
+
+/*
+ * Find what the database knows about addr, or nil if nothing.
+ */
+func (db *geoip_db) lookup(addr netip.Addr) (map[string]any, error) {
+	addr = addr.Unmap()
+	bits := addr.AsSlice()
+	node := uint(0)
+	if(addr.Is4() && db.ip_version == 6) {
+		node = db.ipv4_start
+	} else if(addr.Is6() && db.ip_version == 4) {
+		return nil, nil
+	}
+
+	for i := 0; i < len(bits) * 8 && node < db.node_count; i++ {
+		bit := uint(bits[i / 8] >> (7 - i % 8)) & 1
+		node = db.record(node, bit)
+	}
+	if(node == db.node_count) {
+		return nil, nil
+	}
+	if(node < db.node_count) {
+		return nil, errors.New("address runs off the search tree")
+	}
+
+	section := db.data[db.tree_size + 16:]
+	offset := node - db.node_count - 16
+	if(offset >= uint(len(section))) {
+		return nil, errors.New("record points past the data section")
+	}
+	value, _, err := mmdb_decode(section, offset)
+	if(err != nil) {
+		return nil, err
+	}
+	m, _ := value.(map[string]any)
+	return m, nil
+}
+
+/*
+ * Decode the value at offset in a data section, returning it and the
+ * offset just past it.  Maps come back as map[string]any, arrays as
+ * []any, and every unsigned integer as a uint64.
+ */
+func mmdb_decode(section []byte, offset uint) (any, uint, error) {
+	if(offset >= uint(len(section))) {
+		return nil, 0, errors.New("truncated data")
+	}
+	control := section[offset]
+	offset++
+
+	kind := uint(control >> 5)
+	if(kind == mmdb_pointer) {
+		target, next, err := mmdb_pointer_at(section, control, offset)
+		if(err != nil) {
+			return nil, 0, err
+		}
+		value, _, err := mmdb_decode(section, target)
+		return value, next, err
+	}
+
+	if(kind == mmdb_extended) {
+		if(offset >= uint(len(section))) {
+			return nil, 0, errors.New("truncated data")
+		}
+		kind = 7 + uint(section[offset])
+		offset++
+	}
+
+	size := uint(control & 0x1f)
+	if(size >= 29) {
+		extra := size - 28
+		if(offset + extra > uint(len(section))) {
+			return nil, 0, errors.New("truncated data")
+		}
+		n := mmdb_uint_bytes(section[offset:offset + extra])
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + n
+		case 2:
+			size = 285 + n
+		default:
+			size = 65821 + n
+		}
+	}
+
+	switch kind {
+	case mmdb_map:
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := mmdb_decode(section, offset)
+			if(err != nil) {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if(!ok) {
+				return nil, 0, errors.New("map key isn't a string")
+			}
+			m[name], offset, err = mmdb_decode(section, next)
+			if(err != nil) {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+
+	case mmdb_array:
+		a := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value any
+			var err error
+			value, offset, err = mmdb_decode(section, offset)
+			if(err != nil) {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+
+	case mmdb_bool:
+		return size != 0, offset, nil
+
+	case mmdb_end, mmdb_container:
+		return nil, offset, nil
+	}
+
+	if(offset + size > uint(len(section))) {
+		return nil, 0, errors.New("truncated data")
+	}
+	b := section[offset:offset + size]
+	offset += size
+
+	switch kind {
+	case mmdb_string:
+		return string(b), offset, nil
+	case mmdb_bytes:
+		return append([]byte(nil), b...), offset, nil
+	case mmdb_double:
+		if(size != 8) {
+			return nil, 0, errors.New("bad double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdb_float:
+		if(size != 4) {
+			return nil, 0, errors.New("bad float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdb_int32:
+		return int64(int32(mmdb_uint_bytes(b))), offset, nil
+	case mmdb_uint16, mmdb_uint32, mmdb_uint64:
+		return uint64(mmdb_uint_bytes(b)), offset, nil
+	case mmdb_uint128:
+		// Nothing gost looks at is this wide; keep the raw bytes.
+		return append([]byte(nil), b...), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", kind)
+}
+
+/*
+ * Decode a pointer, returning the offset it points at and the offset
+ * just past it.
+ */
+func mmdb_pointer_at(section []byte, control byte, offset uint) (uint, uint, error) {
+	size := uint(control >> 3) & 3
+	n := size + 1
+	if(offset + n > uint(len(section))) {
+		return 0, 0, errors.New("truncated pointer")
+	}
+	b := section[offset:offset + n]
+
+	target := uint(0)
+	switch size {
+	case 0:
+		target = uint(control & 7) << 8 | mmdb_uint_bytes(b)
+	case 1:
+		target = (uint(control & 7) << 16 | mmdb_uint_bytes(b)) + 2048
+	case 2:
+		target = (uint(control & 7) << 24 | mmdb_uint_bytes(b)) + 526336
+	default:
+		target = mmdb_uint_bytes(b)
+	}
+	return target, offset + n, nil
+}
+
+func mmdb_uint_bytes(b []byte) uint {
+	n := uint(0)
+	for _, v := range b {
+		n = n << 8 | uint(v)
+	}
+	return n
+}
+
+/*
+ * A decoded unsigned value as a uint, or 0 if it isn't one.
+ */
+func mmdb_uint(v any) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
+
+/*
+ * Walk a path of map keys down a decoded value.
+ */
+func mmdb_path(v any, keys ...string) any {
+	for _, key := range keys {
+		m, ok := v.(map[string]any)
+		if(!ok) {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
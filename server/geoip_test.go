@@ -0,0 +1,335 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/*
+ * A value as a data section holds it, with the control byte for kind
+ * and size, extended for the kinds that need it.
+ */
+func mmdb_control(kind uint, size int) []byte {
+	var out []byte
+	first := byte(kind << 5)
+	if(kind > 7) {
+		first = 0
+	}
+	switch {
+	case size < 29:
+		out = []byte{first | byte(size)}
+	case size < 285:
+		out = []byte{first | 29, byte(size - 29)}
+	case size < 65821:
+		out = []byte{first | 30, byte((size - 285) >> 8), byte(size - 285)}
+	default:
+		n := size - 65821
+		out = []byte{first | 31, byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	if(kind > 7) {
+		// The extended type goes after the control byte, before the size.
+		out = append([]byte{out[0], byte(kind - 7)}, out[1:]...)
+	}
+	return out
+}
+
+func mmdb_encode(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(mmdb_control(mmdb_string, len(v)), v...)
+	case uint32:
+		b := binary.BigEndian.AppendUint32(nil, v)
+		return append(mmdb_control(mmdb_uint32, 4), b...)
+	case float64:
+		b := binary.BigEndian.AppendUint64(nil, math.Float64bits(v))
+		return append(mmdb_control(mmdb_double, 8), b...)
+	case bool:
+		size := 0
+		if(v) {
+			size = 1
+		}
+		return mmdb_control(mmdb_bool, size)
+	case []any:
+		out := mmdb_control(mmdb_array, len(v))
+		for _, e := range v {
+			out = append(out, mmdb_encode(e)...)
+		}
+		return out
+	case map[string]any:
+		out := mmdb_control(mmdb_map, len(v))
+		for key, e := range v {
+			out = append(out, mmdb_encode(key)...)
+			out = append(out, mmdb_encode(e)...)
+		}
+		return out
+	}
+	panic("can't encode that")
+}
+
+/*
+ * Write a database with record_size records over an ip_version tree,
+ * holding the value given for each network, and open it.
+ */
+func mmdb_file(t *testing.T, record_size uint, ip_version uint, networks map[string]map[string]any) *geoip_db {
+	// Nodes' records: a node's index, or -1 for nothing, or -2 - i for
+	// the ith value.
+	nodes := [][2]int{{-1, -1}}
+	var data []byte
+	var offsets []int
+	for network, value := range networks {
+		prefix := netip.MustParsePrefix(network)
+		bits := prefix.Addr().AsSlice()
+		length := prefix.Bits()
+		if(ip_version == 6 && prefix.Addr().Is4()) {
+			bits = append(make([]byte, 12), bits...)
+			length += 96
+		}
+		node := 0
+		for i := 0; i < length; i++ {
+			bit := bits[i / 8] >> (7 - i % 8) & 1
+			if(i == length - 1) {
+				nodes[node][bit] = -2 - len(offsets)
+				break
+			}
+			if(nodes[node][bit] < 0) {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		offsets = append(offsets, len(data))
+		data = append(data, mmdb_encode(value)...)
+	}
+
+	count := uint(len(nodes))
+	var file []byte
+	for _, node := range nodes {
+		var records [2]uint
+		for side, r := range node {
+			switch {
+			case r == -1:
+				records[side] = count
+			case r < 0:
+				records[side] = count + 16 + uint(offsets[-2 - r])
+			default:
+				records[side] = uint(r)
+			}
+		}
+		left, right := records[0], records[1]
+		switch record_size {
+		case 24:
+			file = append(file, byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right))
+		case 28:
+			file = append(file, byte(left >> 16), byte(left >> 8), byte(left), byte(left >> 24 << 4) | byte(right >> 24 & 0x0f), byte(right >> 16), byte(right >> 8), byte(right))
+		case 32:
+			file = binary.BigEndian.AppendUint32(file, uint32(left))
+			file = binary.BigEndian.AppendUint32(file, uint32(right))
+		}
+	}
+	file = append(file, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, geoip_metadata_marker...)
+	file = append(file, mmdb_encode(map[string]any{
+		"node_count":    uint32(count),
+		"record_size":   uint32(record_size),
+		"ip_version":    uint32(ip_version),
+		"database_type": "Test-City",
+	})...)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	err := os.WriteFile(path, file, 0600)
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	db, err := open_geoip(path)
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMMDBDecode(t *testing.T) {
+	long := strings.Repeat("x", 300)
+
+	tests := []struct {
+		name    string
+		section []byte
+		offset  uint
+		want    any
+		next    uint
+		fails   bool
+	}{
+		{"string", []byte{0x43, 'a', 'b', 'c'}, 0, "abc", 4, false},
+		{"empty string", []byte{0x40}, 0, "", 1, false},
+		{"string of 29 bytes", mmdb_encode(long[:29]), 0, long[:29], 31, false},
+		{"string of 300 bytes", mmdb_encode(long), 0, long, 303, false},
+		{"uint16", []byte{0xa2, 0x01, 0x00}, 0, uint64(256), 3, false},
+		{"uint32", []byte{0xc1, 0x05}, 0, uint64(5), 2, false},
+		{"uint32 of no bytes", []byte{0xc0}, 0, uint64(0), 1, false},
+		{"uint64", []byte{0x02, 0x02, 0x01, 0x00}, 0, uint64(256), 4, false},
+		{"int32", []byte{0x04, 0x01, 0xff, 0xff, 0xff, 0xff}, 0, int64(-1), 6, false},
+		{"double", mmdb_encode(2.5), 0, 2.5, 9, false},
+		{"float", []byte{0x04, 0x08, 0x3f, 0xc0, 0x00, 0x00}, 0, 1.5, 6, false},
+		{"true", []byte{0x01, 0x07}, 0, true, 2, false},
+		{"false", []byte{0x00, 0x07}, 0, false, 2, false},
+		{"array", []byte{0x02, 0x04, 0x41, 'a', 0x41, 'b'}, 0, []any{"a", "b"}, 6, false},
+		{"map", []byte{0xe1, 0x41, 'k', 0x41, 'v'}, 0, map[string]any{"k": "v"}, 5, false},
+		{"nested", mmdb_encode(map[string]any{"country": map[string]any{"iso_code": "NL"}}), 0, map[string]any{"country": map[string]any{"iso_code": "NL"}}, 22, false},
+		{"pointer", []byte{0x41, 'x', 0x20, 0x00}, 2, "x", 4, false},
+		{"pointer in a map", []byte{0x41, 'x', 0xe1, 0x41, 'k', 0x20, 0x00}, 2, map[string]any{"k": "x"}, 7, false},
+		{"two-byte pointer", append(append(make([]byte, 2048), 0x41, 'y'), 0x28, 0x00, 0x00), 2050, "y", 2053, false},
+		{"bytes", []byte{0x82, 0x01, 0x02}, 0, []byte{1, 2}, 3, false},
+
+		{"nothing", nil, 0, nil, 0, true},
+		{"past the end", []byte{0x40}, 1, nil, 0, true},
+		{"truncated string", []byte{0x43, 'a'}, 0, nil, 0, true},
+		{"truncated size", []byte{0x5e, 0x01}, 0, nil, 0, true},
+		{"truncated extended type", []byte{0x01}, 0, nil, 0, true},
+		{"truncated pointer", []byte{0x28, 0x00}, 0, nil, 0, true},
+		{"pointer past the end", []byte{0x27, 0xff}, 0, nil, 0, true},
+		{"map key that isn't a string", []byte{0xe1, 0xc1, 0x05, 0x41, 'v'}, 0, nil, 0, true},
+		{"map missing a value", []byte{0xe1, 0x41, 'k'}, 0, nil, 0, true},
+		{"double of 4 bytes", []byte{0x64, 0, 0, 0, 0}, 0, nil, 0, true},
+		{"float of 8 bytes", []byte{0x08, 0x08, 0, 0, 0, 0, 0, 0, 0, 0}, 0, nil, 0, true},
+		{"unknown type", []byte{0x00, 0x09}, 0, nil, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, next, err := mmdb_decode(test.section, test.offset)
+			if(test.fails) {
+				if(err == nil) {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if(err != nil) {
+				t.Fatalf("failed: %v", err)
+			}
+			if(!reflect.DeepEqual(got, test.want) || next != test.next) {
+				t.Fatalf("got %#v ending at %d, want %#v ending at %d", got, next, test.want, test.next)
+			}
+		})
+	}
+}
+
+func TestGeoIPRecord(t *testing.T) {
+	tests := []struct {
+		name        string
+		record_size uint
+		node        []byte
+		left        uint
+		right       uint
+	}{
+		{"24 bits", 24, []byte{0x12, 0x34, 0x56, 0xab, 0xcd, 0xef}, 0x123456, 0xabcdef},
+		{"28 bits", 28, []byte{0x12, 0x34, 0x56, 0x7a, 0xbc, 0xde, 0xf0}, 0x7123456, 0xabcdef0},
+		{"28 bits, top nibbles clear", 28, []byte{0x12, 0x34, 0x56, 0x00, 0xbc, 0xde, 0xf0}, 0x123456, 0xbcdef0},
+		{"32 bits", 32, []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}, 0x12345678, 0x9abcdef0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The node is the second, so offsets are checked too.
+			db := &geoip_db{record_size: test.record_size, data: append(make([]byte, len(test.node)), test.node...)}
+			left, right := db.record(1, 0), db.record(1, 1)
+			if(left != test.left || right != test.right) {
+				t.Fatalf("got %#x and %#x, want %#x and %#x", left, right, test.left, test.right)
+			}
+		})
+	}
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	networks := map[string]map[string]any{
+		"192.0.2.0/24":      {"country": map[string]any{"iso_code": "NL"}},
+		"198.51.100.128/25": {"country": map[string]any{"iso_code": "DE"}},
+		"2001:db8::/32":     {"country": map[string]any{"iso_code": "FR"}},
+	}
+
+	tests := []struct {
+		addr string
+		v6   string
+		v4   string
+	}{
+		{"192.0.2.1", "NL", "NL"},
+		{"192.0.2.255", "NL", "NL"},
+		{"::ffff:192.0.2.7", "NL", "NL"},
+		{"192.0.3.1", "", ""},
+		{"198.51.100.200", "DE", "DE"},
+		{"198.51.100.1", "", ""},
+		{"2001:db8::1", "FR", ""},
+		{"2001:db8:ffff::1", "FR", ""},
+		{"2001:db9::1", "", ""},
+		{"::1", "", ""},
+	}
+
+	for _, record_size := range []uint{24, 28, 32} {
+		for _, ip_version := range []uint{6, 4} {
+			v4_networks := map[string]map[string]any{}
+			for network, value := range networks {
+				if(ip_version == 6 || netip.MustParsePrefix(network).Addr().Is4()) {
+					v4_networks[network] = value
+				}
+			}
+			db := mmdb_file(t, record_size, ip_version, v4_networks)
+			if(db.kind != "Test-City") {
+				t.Fatalf("database type %q", db.kind)
+			}
+
+			for _, test := range tests {
+				want := test.v6
+				if(ip_version == 4) {
+					want = test.v4
+				}
+				t.Run(fmt.Sprintf("%s in IPv%d with %d-bit records", test.addr, ip_version, record_size), func(t *testing.T) {
+					found, err := db.lookup(netip.MustParseAddr(test.addr))
+					if(err != nil) {
+						t.Fatal(err)
+					}
+					got, _ := mmdb_path(found, "country", "iso_code").(string)
+					if(got != want) {
+						t.Fatalf("got %q, want %q", got, want)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestOpenGeoIP(t *testing.T) {
+	meta := func(fields map[string]any) []byte {
+		return append(append([]byte(nil), geoip_metadata_marker...), mmdb_encode(fields)...)
+	}
+
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"no metadata", []byte("not a database")},
+		{"metadata that isn't a map", append(append([]byte(nil), geoip_metadata_marker...), mmdb_encode("x")...)},
+		{"broken metadata", append(append([]byte(nil), geoip_metadata_marker...), 0x43, 'a')},
+		{"unsupported record size", meta(map[string]any{"node_count": uint32(0), "record_size": uint32(20), "ip_version": uint32(6)})},
+		{"tree past the data", meta(map[string]any{"node_count": uint32(100), "record_size": uint32(24), "ip_version": uint32(6)})},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.mmdb")
+			err := os.WriteFile(path, test.file, 0600)
+			if(err != nil) {
+				t.Fatal(err)
+			}
+			_, err = open_geoip(path)
+			if(err == nil || !strings.Contains(err.Error(), path)) {
+				t.Fatalf("got %v, want an error naming the file", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,682 @@
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+/*
+ * Configure anything that needs configuring.  Bad configuration is
+ * fatal; there's no point limping along with half of it.
+ */
+func receive_configuration() {
+	c, err := load_configuration(server_args)
+	if(err == flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if(err != nil) {
+		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		os.Exit(2)
+	}
+	if(c.show_version) {
+		print_version()
+		os.Exit(0)
+	}
+	err = put_in_force(c)
+	if(err != nil) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+/*
+ * Open what the loaded configuration c names and make it the one in
+ * force.
+ */
+func put_in_force(c configuration) error {
+	err := open_log_files(&c)
+	if(err != nil) {
+		return fmt.Errorf("Can't open log file: %w", err)
+	}
+	apply_configuration(c)
+
+	// The database loads the rings before the file is rewritten from
+	// them.
+	err = open_results_db(&c)
+	if(err != nil) {
+		return fmt.Errorf("Can't open results database: %w", err)
+	}
+
+	err = open_results_file(&c)
+	if(err != nil) {
+		return fmt.Errorf("Can't open results file: %w", err)
+	}
+
+	err = go_watch_tokens()
+	if(err != nil) {
+		return fmt.Errorf("Can't load tokens: %w", err)
+	}
+	return nil
+}
+
+/*
+ * Write v as a JSON response.
+ */
+func write_json(res http.ResponseWriter, status int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(v)
+}
+
+/*
+ * Spawn off goroutines to handle incoming requests.
+ */
+func go_serve() {
+	tls_config, err := prepare_serving()
+	if(err == nil) {
+		err = start_serving(settings(), tls_config)
+	}
+	if(err != nil) {
+		log.Fatal(err)
+	}
+	go_notify_systemd()
+	go_report_upgraded()
+}
+
+/*
+ * Register the routes, open the GeoIP databases, start the background
+ * work that doesn't need a listener, and work out the TLS configuration
+ * the listeners will use.
+ */
+func prepare_serving() (*tls.Config, error) {
+	register_routes(http_listeners.mux)
+	register_admin_routes(admin_listeners.mux)
+	register_grpc_routes(grpc_listeners.mux)
+
+	c := settings()
+	var err error
+	if(c.geoip_asn_db != "") {
+		geoip_asn, err = open_geoip(c.geoip_asn_db)
+		if(err != nil) {
+			return nil, err
+		}
+	}
+	if(c.geoip_country_db != "") {
+		geoip_country, err = open_geoip(c.geoip_country_db)
+		if(err != nil) {
+			return nil, err
+		}
+	}
+
+	go_prepare_test_files(c)
+	go_schedule_peers()
+	go_evaluate_alerts()
+	go_send_statsd()
+	go_export_traces()
+
+	var tls_config *tls.Config
+	acme = new_acme_manager(c)
+	if(acme != nil) {
+		if(!certificate_files_missing(c)) {
+			err := go_watch_certificate(c)
+			if(err != nil) {
+				return nil, err
+			}
+			acme.fallback = get_served_certificate
+		}
+		err := acme.go_renew()
+		if(err != nil) {
+			return nil, err
+		}
+		tls_config = &tls.Config{GetCertificate: acme.get_certificate}
+	} else if(c.any_tls() && certificate_files_missing(c)) {
+		cert, err := self_signed_certificate(c)
+		if(err != nil) {
+			return nil, err
+		}
+		if(c.self_signed_save) {
+			log_at(log_level_info, "No certificate found; wrote a self-signed one to %s and %s", c.cert_file, c.key_file)
+		} else {
+			log_at(log_level_info, "No certificate found at %s; using a self-signed one for this run", c.cert_file)
+		}
+		tls_config = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	} else if(c.any_tls()) {
+		err := go_watch_certificate(c)
+		if(err != nil) {
+			return nil, err
+		}
+		tls_config = &tls.Config{GetCertificate: get_served_certificate}
+	}
+	if(tls_config != nil) {
+		err := apply_tls_policy(tls_config, c)
+		if(err == nil) {
+			err = load_vhost_certificates(c)
+		}
+		if(err != nil) {
+			return nil, err
+		}
+		with_vhost_certificates(tls_config)
+	}
+	return tls_config, nil
+}
+
+/*
+ * Bind and serve every configured listener.
+ */
+func start_serving(c *configuration, tls_config *tls.Config) error {
+	collect_systemd_sockets(c)
+	err := http_listeners.start(c, c.listener_specs(), tls_config)
+	if(err == nil) {
+		err = go_serve_admin(c)
+	}
+	if(err == nil) {
+		err = go_serve_grpc(c)
+	}
+	if(err == nil) {
+		err = go_serve_udp(c)
+	}
+	if(err == nil) {
+		err = go_serve_iperf(c)
+	}
+	if(err == nil) {
+		err = go_serve_h3(c, tls_config)
+	}
+	if(err != nil) {
+		return err
+	}
+	go_probe_listeners()
+	return nil
+}
+
+/*
+ * Re-read the configuration whenever we get a SIGHUP.
+ */
+func go_reload_on_hangup() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	go func() {
+		for range sig {
+			sd_notify("RELOADING=1")
+			err := reload_configuration()
+			sd_notify("READY=1")
+			if(err != nil) {
+				log_at(log_level_error, "Reload failed, keeping the old configuration: %v", err)
+				continue
+			}
+			err = refresh_tokens()
+			if(err != nil) {
+				log_at(log_level_error, "Can't reload tokens, keeping the old ones: %v", err)
+			}
+			log_at(log_level_info, "Configuration reloaded.")
+		}
+	}()
+}
+
+/*
+ * Where the signals that stop the server arrive, and where the Windows
+ * service manager's stop requests are sent as SIGTERM.
+ */
+var death = make(chan os.Signal, 1)
+
+/*
+ * Wait for an interrupt or termination signal, or for an upgrade to
+ * have handed over, then drain and exit.
+ */
+func wait_for_death() {
+	signal.Notify(death, os.Interrupt, syscall.SIGTERM)
+	s := <-death
+	signal.Stop(death)
+	upgraded := s == upgrade_signal
+	if(!upgraded) {
+		sd_notify("STOPPING=1")
+	}
+
+	timeout := settings().drain_timeout
+	if(upgraded) {
+		log_at(log_level_info, "Upgraded, draining for up to %v.", timeout)
+	} else {
+		log_at(log_level_info, "Got %v, draining for up to %v.", s, timeout)
+	}
+
+	word := "Killed"
+	if(upgraded) {
+		word = "Handed over"
+	}
+	drain(word)
+	service_stopped()
+	os.Exit(0)
+}
+
+/*
+ * Stop accepting new connections and give in-flight tests until the
+ * drain timeout to finish before cutting them off, then log how they
+ * fared after word.
+ */
+func drain(word string) {
+	ctx, cancel := context.WithTimeout(context.Background(), settings().drain_timeout)
+	defer cancel()
+
+	close_standalone_sockets()
+	http_listeners.shutdown(ctx)
+	admin_listeners.shutdown(ctx)
+	grpc_listeners.shutdown(ctx)
+	shutdown_h3(ctx)
+
+	// Tests that aren't HTTP requests, like iperf3's, get what's left;
+	// closed connections make any other stragglers fail fast.
+	deadline, _ := ctx.Deadline()
+	wait_for_tests(max(time.Until(deadline), time.Second))
+	if(acme != nil) {
+		acme.shutdown()
+	}
+	if(results_db != nil) {
+		results_db.flush()
+	}
+
+	log_at(log_level_error, "%s. %d tests completed, %d aborted, %d still running.", word,
+		test_tracker.completed.Load(), test_tracker.aborted.Load(), test_tracker.active.Load())
+}
+
+/*
+ * A default all-matching route to allow the app's response behavior to
+ * be fully defined.
+ */
+func route_default(res http.ResponseWriter, req *http.Request) {
+	if(req.URL.Path != "/") {
+		res.WriteHeader(404)
+		io.WriteString(res, "Not Found")
+		return
+	}
+
+	io.WriteString(res, "")
+}
+
+/*
+ * The body of a /status response.
+ */
+type status_report struct {
+	Status        string                     `json:"status"`
+	Protocol      string                     `json:"protocol"`
+	Family        string                     `json:"family"`
+	Build         build_info                 `json:"build"`
+	UptimeSeconds int64                      `json:"uptime_seconds"`
+	ActiveTests   int64                      `json:"active_tests"`
+	Listeners     map[string]listener_report `json:"listeners"`
+	Runtime       runtime_stats              `json:"runtime"`
+}
+
+/*
+ * Name the protocols a listener speaks.
+ */
+func protocol_names(p *http.Protocols, tls bool) []string {
+	names := []string{}
+	if(p.HTTP1()) {
+		names = append(names, "http/1.1")
+	}
+	if(tls && p.HTTP2()) {
+		names = append(names, "h2")
+	}
+	if(!tls && p.UnencryptedHTTP2()) {
+		names = append(names, "h2c")
+	}
+	return names
+}
+
+/*
+ * The obligatory status endpoint that's used to determine service
+ * health externally.
+ */
+func route_status(res http.ResponseWriter, req *http.Request) {
+	report := current_status(req)
+	if(report.Status != "healthy") {
+		write_json(res, 503, report) // Service Unavailable
+		return
+	}
+
+	write_json(res, 200, report)
+}
+
+/*
+ * How the server stands, as seen by req.
+ */
+func current_status(req *http.Request) status_report {
+	report := status_report{
+		Status:        "healthy",
+		Protocol:      req.Proto,
+		Family:        request_family(req),
+		Build:         current_build(),
+		UptimeSeconds: uptime_seconds(),
+		ActiveTests:   test_tracker.active.Load(),
+		Listeners:     http_listeners.report(),
+		Runtime: current_runtime(),
+	}
+
+	for _, l := range report.Listeners {
+		if(!l.Healthy) {
+			report.Status = "unhealthy"
+		}
+	}
+	return report
+}
+
+/*
+ * GET: Perform a downstream bandwidth test.  The size of the payload
+ * comes from ?bytes=, e.g. /down?bytes=100M.  With ?seconds= the test
+ * runs for that long instead, still capped by the size limit, and the
+ * server's figures arrive in trailers.  ?limit= paces it, ?delay=
+ * and ?jitter= slow it down, and ?chunk= and ?flush= shape its writes.
+ * ?profile= replays a stored profile instead.
+ */
+func route_down(res http.ResponseWriter, req *http.Request) {
+	if(req.Method != "GET" && req.Method != "HEAD" && req.Method != "") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+
+	n, err := requested_bytes(req, down_default_bytes)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	if(n > request_settings(req).max_test_bytes) {
+		res.WriteHeader(413) // Request Entity Too Large
+		io.WriteString(res, "Requested size exceeds the server limit")
+		return
+	}
+
+	duration, err := requested_seconds(req)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	bucket, err := requested_limit(req)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	impair, err := requested_impairment(req)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	chunks, err := requested_chunking(req)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	checksum, err := requested_checksum(req)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	dress, err := requested_disguise(req)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	profile, err := requested_profile(req)
+	if(err == nil && profile != nil && (duration > 0 || bucket != nil || impair != nil || checksum ||
+		chunks != (chunking{size: down_chunk_size}) || req.URL.Query().Has("bytes") ||
+		req.URL.Query().Has("source") || req.Header.Get("Range") != "")) {
+		err = errors.New("profile can't be combined with bytes, seconds, limit, delay, chunk, flush, checksum, source or a range")
+	}
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+	if(profile != nil) {
+		serve_profile(res, req, profile, dress)
+		return
+	}
+
+	switch req.URL.Query().Get("source") {
+	case "", "generated":
+	case "file":
+		if(duration > 0 || bucket != nil || impair != nil || checksum || chunks != (chunking{size: down_chunk_size})) {
+			res.WriteHeader(400) // Bad Request
+			io.WriteString(res, "source=file can't be combined with seconds, limit, delay, chunk, flush or checksum")
+			return
+		}
+		serve_test_file(res, req, n, dress)
+		return
+	default:
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, "source must be generated or file")
+		return
+	}
+
+	// Sized downloads are the same bytes every time, so they can be
+	// fetched in parts.
+	offset, length, partial := int64(0), n, false
+	if(duration == 0) {
+		res.Header().Set("Accept-Ranges", "bytes")
+		res.Header().Set("ETag", payload_etag(n))
+		offset, length, partial, err = requested_range(req, n)
+		if(err != nil) {
+			res.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", n))
+			res.WriteHeader(416) // Range Not Satisfiable
+			io.WriteString(res, err.Error())
+			return
+		}
+		if(partial) {
+			res.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset + length - 1, n))
+		}
+	}
+
+	if(req.Method == "HEAD") {
+		if(duration > 0) {
+			write_timed_payload_headers(res)
+		} else {
+			write_payload_headers(res, length)
+		}
+		dress.apply(res)
+		if(partial) {
+			res.WriteHeader(206) // Partial Content
+		}
+		return
+	}
+
+	// Injected delays come before the test starts, so they don't eat
+	// into a timed test's duration.
+	impair.before_first()
+
+	// The digest, if any, is of what reached the ResponseWriter.
+	var sent io.Writer = res
+	var hashed *hash_writer
+	if(checksum) {
+		hashed = new_hash_writer(res)
+		sent = hashed
+	}
+
+	var written int64
+	var test *test_run
+	if(duration > 0) {
+		test = begin_test(res, req, "down", 0)
+		if(test == nil) {
+			return
+		}
+		write_timed_payload_headers(res)
+		dress.apply(res)
+		if(checksum) {
+			res.Header().Add("Trailer", checksum_header)
+		}
+		out := impair_writer(chunks.wrap(throttle_writer(test.writer(sent), bucket), res), impair)
+		written, err = write_payload_until(out, request_settings(req).max_test_bytes, test.start.Add(duration))
+	} else {
+		test = begin_test(res, req, "down", length)
+		if(test == nil) {
+			return
+		}
+		// A response with a Content-Length can only carry trailers
+		// over HTTP/2; HTTP/1.1 clients won't see these.  Checksummed
+		// responses are chunked so that they can.
+		if(checksum) {
+			write_timed_payload_headers(res)
+			res.Header().Add("Trailer", checksum_header)
+		} else {
+			write_payload_headers(res, length)
+			res.Header().Set("Trailer", measurement_headers)
+		}
+		dress.apply(res)
+		if(partial) {
+			res.WriteHeader(206) // Partial Content
+		}
+		out := impair_writer(chunks.wrap(throttle_writer(test.writer(sent), bucket), res), impair)
+		written, err = write_payload_range(out, offset, length)
+	}
+	if(hashed != nil) {
+		test.checksum = hashed.sum()
+		res.Header().Set(checksum_header, test.checksum)
+	}
+	test.as = dress.String()
+	write_measurement_headers(res, test.end(written, err))
+	if(err != nil) {
+		log_at(log_level_debug, "Download to %s aborted after %d bytes: %v", req.RemoteAddr, written, err)
+	}
+}
+
+/*
+ * PUT: Perform an upstream bandwidth test.  The body is discarded and
+ * the client gets back a JSON summary of what arrived.  With ?seconds=
+ * the server stops reading after that long and replies with what it
+ * got so far; the client just keeps sending until then.
+ */
+func route_up(res http.ResponseWriter, req *http.Request) {
+	if(req.Method != "PUT" && req.Method != "") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+
+	duration, err := requested_seconds(req)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	bucket, err := requested_limit(req)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	impair, err := requested_impairment(req)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	checksum, expected, err := requested_upload_checksum(req)
+	if(err == nil && expected != "" && duration > 0) {
+		err = errors.New("a timed upload stops early, so it can't be checked against a digest")
+	}
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	impair.before_first()
+	test := begin_test(res, req, "up", req.ContentLength)
+	if(test == nil) {
+		return
+	}
+	var received io.Reader = upload_body(res, req)
+	var hashed *hash_reader
+	if(checksum) {
+		hashed = new_hash_reader(received)
+		received = hashed
+	}
+	body := impair_reader(throttle_reader(test.reader(received), bucket), impair)
+	slow := watch_upload_rate(res, &test.moved)
+	var n int64
+	if(duration > 0) {
+		n, err = drain_body_until(res, body, test.start.Add(duration))
+	} else {
+		n, err = drain_body(body)
+	}
+	if(slow()) {
+		err = upload_too_slow
+	}
+	connection_of(req).uploaded.Add(n)
+	if(hashed != nil) {
+		test.checksum = hashed.sum()
+		res.Header().Set(checksum_header, test.checksum)
+	}
+	if(expected != "") {
+		match := test.checksum == expected
+		test.checksum_match = &match
+	}
+	result := test.end(n, err)
+
+	if(err != nil) {
+		log_at(log_level_debug, "Upload from %s aborted after %d bytes: %v", req.RemoteAddr, n, err)
+		_, too_big := err.(*http.MaxBytesError)
+		if(too_big) {
+			res.WriteHeader(413) // Request Entity Too Large
+			io.WriteString(res, "Upload exceeds the server limit")
+		}
+		if(err == upload_too_slow) {
+			res.WriteHeader(408) // Request Timeout
+			io.WriteString(res, "Upload too slow")
+		}
+		if(err == jwt_err_limit) {
+			set_error_code(res, "token_limit")
+			res.WriteHeader(403) // Forbidden
+			io.WriteString(res, "Upload is larger than the token allows")
+		}
+		return
+	}
+
+	write_measurement_headers(res, result)
+	write_json(res, 200, upload_summary{
+		ID:          result.ID,
+		Bytes:       result.Bytes,
+		Seconds:     result.Seconds,
+		Mbps:        result.Mbps,
+		SHA256:      result.SHA256,
+		SHA256Match: result.Match,
+		Verdict:     result.Verdict,
+	})
+}
+
+/*
+ * Main entry point and short synopsis of execution flow: run the
+ * subcommand in args and return the exit status.
+ */
+func Main(args []string) int {
+	return run_command(args)
+}
+
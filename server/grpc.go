@@ -0,0 +1,470 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * A gRPC service for orchestrating tests, on a listener of its own
+ * given with -grpc, for tooling built against protobuf contracts.
+ * gost.proto has the contract:
+ *
+ *	StartTest       plans a test: its ID, and the request that runs it
+ *	StreamProgress  progress while the test runs, then its result
+ *	GetResult       a finished test's result
+ *
+ * gRPC is HTTP/2 with length-prefixed protobuf messages and a status
+ * in the trailers, which the standard library's HTTP/2 server can
+ * carry, so gost speaks it itself and encodes the messages by hand.
+ * The listener is cleartext, taking HTTP/2 with prior knowledge, and
+ * the service has no message compression or reflection.  With -tokens
+ * set, calls need the usual token, as "authorization: Bearer <token>"
+ * metadata.
+ */
+const grpc_service_prefix = "/gost.v1.Gost/"
+
+// The largest request message accepted.
+const grpc_max_message = 64 * 1024
+
+// How long StreamProgress waits for a test that hasn't started yet.
+const grpc_start_wait = 30 * time.Second
+
+var grpc_listeners = &listener_manager{mux: http.NewServeMux()}
+
+/*
+ * gRPC status codes.
+ */
+const (
+	grpc_ok                = 0
+	grpc_invalid_argument  = 3
+	grpc_deadline_exceeded = 4
+	grpc_not_found         = 5
+	grpc_unimplemented     = 12
+	grpc_internal          = 13
+)
+
+/*
+ * A gRPC call ending other than with OK.
+ */
+type grpc_error struct {
+	code    int
+	message string
+}
+
+func (e *grpc_error) Error() string {
+	return e.message
+}
+
+func grpc_errorf(code int, format string, args ...any) error {
+	return &grpc_error{code, fmt.Sprintf(format, args...)}
+}
+
+/*
+ * The gRPC listener, if there is one: cleartext, with HTTP/2.
+ */
+func (c *configuration) grpc_spec() listener_spec {
+	return listener_spec{name: "grpc", address: c.grpc_address, http2: true}
+}
+
+func go_serve_grpc(c *configuration) error {
+	if(c.grpc_address == "") {
+		return nil
+	}
+	return grpc_listeners.start(c, []listener_spec{c.grpc_spec()}, nil)
+}
+
+/*
+ * A protobuf message being encoded.  Fields at their zero value are
+ * left out, as proto3 does.
+ */
+type pb_message []byte
+
+func (m *pb_message) tag(field int, wire int) {
+	*m = binary.AppendUvarint(*m, uint64(field << 3 | wire))
+}
+
+func (m *pb_message) string(field int, s string) {
+	if(s == "") {
+		return
+	}
+	m.tag(field, 2)
+	*m = binary.AppendUvarint(*m, uint64(len(s)))
+	*m = append(*m, s...)
+}
+
+func (m *pb_message) message(field int, sub pb_message) {
+	m.tag(field, 2)
+	*m = binary.AppendUvarint(*m, uint64(len(sub)))
+	*m = append(*m, sub...)
+}
+
+func (m *pb_message) int64(field int, v int64) {
+	if(v == 0) {
+		return
+	}
+	m.tag(field, 0)
+	*m = binary.AppendUvarint(*m, uint64(v))
+}
+
+func (m *pb_message) double(field int, v float64) {
+	if(v == 0) {
+		return
+	}
+	m.tag(field, 1)
+	*m = binary.LittleEndian.AppendUint64(*m, math.Float64bits(v))
+}
+
+/*
+ * A decoded protobuf message: the last value of each numeric field, as
+ * raw bits, and of each length-delimited one.
+ */
+type pb_fields struct {
+	numbers map[int]uint64
+	bytes   map[int][]byte
+}
+
+func parse_pb(b []byte) (pb_fields, error) {
+	f := pb_fields{numbers: map[int]uint64{}, bytes: map[int][]byte{}}
+	bad := errors.New("malformed message")
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if(n <= 0) {
+			return f, bad
+		}
+		b = b[n:]
+		field := int(key >> 3)
+
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if(n <= 0) {
+				return f, bad
+			}
+			f.numbers[field] = v
+			b = b[n:]
+		case 1:
+			if(len(b) < 8) {
+				return f, bad
+			}
+			f.numbers[field] = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if(n <= 0 || size > uint64(len(b) - n)) {
+				return f, bad
+			}
+			f.bytes[field] = b[n : n + int(size)]
+			b = b[n + int(size):]
+		case 5:
+			if(len(b) < 4) {
+				return f, bad
+			}
+			f.numbers[field] = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return f, bad
+		}
+	}
+	return f, nil
+}
+
+func (f pb_fields) string(field int) string {
+	return string(f.bytes[field])
+}
+
+func (f pb_fields) int64(field int) int64 {
+	return int64(f.numbers[field])
+}
+
+func (f pb_fields) double(field int) float64 {
+	return math.Float64frombits(f.numbers[field])
+}
+
+/*
+ * Result, as gost.proto lays it out.
+ */
+func pb_result(r test_result) pb_message {
+	var m pb_message
+	m.string(1, r.ID)
+	m.string(2, r.RequestID)
+	m.string(3, r.Direction)
+	m.string(4, r.Started.Format(time.RFC3339Nano))
+	m.int64(5, r.Bytes)
+	m.double(6, r.Seconds)
+	m.double(7, r.Mbps)
+	m.string(8, r.ClientIP)
+	m.string(9, r.Protocol)
+	m.string(10, r.Outcome)
+	m.string(11, r.Error)
+	m.double(12, r.ExpectMbps)
+	m.string(13, r.Verdict)
+	return m
+}
+
+/*
+ * ProgressEvent: how a running test stands, or with result set, how it
+ * ended.
+ */
+func pb_progress(e progress_event, result *test_result) pb_message {
+	var m pb_message
+	m.string(1, e.ID)
+	m.int64(2, e.Bytes)
+	m.double(3, e.Seconds)
+	m.double(4, e.Mbps)
+	m.double(5, e.AvgMbps)
+	if(result != nil) {
+		m.message(6, pb_result(*result))
+	}
+	return m
+}
+
+/*
+ * Read the single request message of a call.
+ */
+func read_grpc_message(req *http.Request) (pb_fields, error) {
+	var prefix [5]byte
+	_, err := io.ReadFull(req.Body, prefix[:])
+	if(err != nil) {
+		return pb_fields{}, grpc_errorf(grpc_invalid_argument, "no request message")
+	}
+	if(prefix[0] != 0) {
+		return pb_fields{}, grpc_errorf(grpc_unimplemented, "compressed messages aren't supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if(size > grpc_max_message) {
+		return pb_fields{}, grpc_errorf(grpc_invalid_argument, "request message of %d bytes is too big", size)
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(req.Body, b)
+	if(err != nil) {
+		return pb_fields{}, grpc_errorf(grpc_invalid_argument, "truncated request message")
+	}
+	f, err := parse_pb(b)
+	if(err != nil) {
+		return f, grpc_errorf(grpc_invalid_argument, "%v", err)
+	}
+	return f, nil
+}
+
+/*
+ * Send a response message, and push it out so that streamed ones
+ * arrive as they're sent.
+ */
+func write_grpc_message(res http.ResponseWriter, m pb_message) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(m)))
+	_, err := res.Write(append(prefix[:], m...))
+	if(err != nil) {
+		return err
+	}
+	return http.NewResponseController(res).Flush()
+}
+
+/*
+ * Dispatch a gRPC call, and end it with its status.
+ */
+func route_grpc(res http.ResponseWriter, req *http.Request) {
+	if(req.Method != "POST") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+	if(!strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")) {
+		res.WriteHeader(415) // Unsupported Media Type
+		io.WriteString(res, "Expected application/grpc")
+		return
+	}
+
+	h := res.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Trailer", "Grpc-Status, Grpc-Message")
+	res.WriteHeader(200)
+
+	var err error
+	switch strings.TrimPrefix(req.URL.Path, grpc_service_prefix) {
+	case "StartTest":
+		err = grpc_start_test(res, req)
+	case "StreamProgress":
+		err = grpc_stream_progress(res, req)
+	case "GetResult":
+		err = grpc_get_result(res, req)
+	default:
+		err = grpc_errorf(grpc_unimplemented, "unknown method %s", req.URL.Path)
+	}
+
+	code, message := grpc_ok, ""
+	if(err != nil) {
+		code, message = grpc_internal, err.Error()
+		var e *grpc_error
+		if(errors.As(err, &e)) {
+			code = e.code
+		}
+		log_request(req, log_level_debug, "grpc call failed", "method", req.URL.Path, "code", code, "error", message)
+	}
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	if(message != "") {
+		h.Set("Grpc-Message", url.PathEscape(message))
+	}
+}
+
+/*
+ * StartTest: plan a test, despite the name.  Nothing starts here: it
+ * picks an ID and says what request will run the test over HTTP, and
+ * the test starts when the client makes it.  Fields that request
+ * couldn't honour are INVALID_ARGUMENT rather than quietly dropped, so
+ * the plan is always the test asked for.
+ */
+func grpc_start_test(res http.ResponseWriter, req *http.Request) error {
+	f, err := read_grpc_message(req)
+	if(err != nil) {
+		return err
+	}
+
+	direction := f.string(1)
+	bytes := f.int64(2)
+	seconds := f.double(3)
+	expect := f.string(4)
+	if(direction != "down" && direction != "up") {
+		return grpc_errorf(grpc_invalid_argument, "direction must be down or up")
+	}
+	if(bytes < 0 || seconds < 0 || math.IsNaN(seconds)) {
+		return grpc_errorf(grpc_invalid_argument, "bytes and seconds must not be negative")
+	}
+	if(bytes > 0 && seconds > 0) {
+		return grpc_errorf(grpc_invalid_argument, "give bytes or seconds, not both")
+	}
+	if(bytes > 0 && direction == "up") {
+		return grpc_errorf(grpc_invalid_argument, "bytes is for downloads; an upload is as big as what's sent")
+	}
+	if(seconds > 0 && time.Duration(seconds * float64(time.Second)) <= 0) {
+		return grpc_errorf(grpc_invalid_argument, "seconds is too short")
+	}
+	if(expect != "") {
+		rate, err := parse_rate(expect)
+		if(err != nil || rate <= 0) {
+			return grpc_errorf(grpc_invalid_argument, "invalid expect %q", expect)
+		}
+	}
+	if(seconds > settings().max_test_duration.Seconds()) {
+		return grpc_errorf(grpc_invalid_argument, "duration exceeds the server limit of %v", settings().max_test_duration)
+	}
+	if(bytes > settings().max_test_bytes) {
+		return grpc_errorf(grpc_invalid_argument, "size exceeds the server limit")
+	}
+
+	id := new_uuid()
+	query := url.Values{"test_id": {id}}
+	if(bytes > 0) {
+		query.Set("bytes", strconv.FormatInt(bytes, 10))
+	}
+	if(seconds > 0) {
+		query.Set("seconds", strconv.FormatFloat(seconds, 'f', -1, 64))
+	}
+	if(expect != "") {
+		query.Set("expect", expect)
+	}
+	method := "GET"
+	if(direction == "up") {
+		method = "PUT"
+	}
+
+	var m pb_message
+	m.string(1, id)
+	m.string(2, method)
+	m.string(3, "/" + direction + "?" + query.Encode())
+	return write_grpc_message(res, m)
+}
+
+/*
+ * StreamProgress: an event every interval while the test runs, and a
+ * last one with its result.  A test that hasn't started yet is waited
+ * for.
+ */
+func grpc_stream_progress(res http.ResponseWriter, req *http.Request) error {
+	f, err := read_grpc_message(req)
+	if(err != nil) {
+		return err
+	}
+	id := f.string(1)
+	interval := progress_default_interval
+	if(f.int64(2) != 0) {
+		interval = time.Duration(f.int64(2)) * time.Millisecond
+		if(interval < progress_min_interval) {
+			return grpc_errorf(grpc_invalid_argument, "interval must be at least %v", progress_min_interval)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	waited := time.Now()
+	var t *test_run
+	for t == nil {
+		v, running := active_runs.Load(id)
+		if(running) {
+			t = v.(*test_run)
+			break
+		}
+		result, ok := find_result(req, id)
+		if(ok) {
+			return write_grpc_message(res, pb_progress(progress_event{ID: id, Bytes: result.Bytes, Seconds: result.Seconds, Mbps: result.Mbps, AvgMbps: result.Mbps}, &result))
+		}
+		if(time.Since(waited) > grpc_start_wait) {
+			return grpc_errorf(grpc_not_found, "no such test")
+		}
+		select {
+		case <-req.Context().Done():
+			return grpc_errorf(grpc_deadline_exceeded, "cancelled")
+		case <-ticker.C:
+		}
+	}
+
+	last_bytes := int64(0)
+	last_time := t.start
+	for {
+		select {
+		case <-req.Context().Done():
+			return grpc_errorf(grpc_deadline_exceeded, "cancelled")
+		case <-t.done:
+			r := t.result
+			return write_grpc_message(res, pb_progress(progress_event{ID: r.ID, Bytes: r.Bytes, Seconds: r.Seconds, Mbps: r.Mbps, AvgMbps: r.Mbps}, &r))
+		case now := <-ticker.C:
+			bytes := t.moved.Load()
+			event := progress_event{
+				ID:      t.id,
+				Bytes:   bytes,
+				Seconds: now.Sub(t.start).Seconds(),
+				Mbps:    mbps(bytes - last_bytes, now.Sub(last_time)),
+				AvgMbps: mbps(bytes, now.Sub(t.start)),
+			}
+			last_bytes, last_time = bytes, now
+			err := write_grpc_message(res, pb_progress(event, nil))
+			if(err != nil) {
+				return err
+			}
+		}
+	}
+}
+
+/*
+ * GetResult: a finished test's result.
+ */
+func grpc_get_result(res http.ResponseWriter, req *http.Request) error {
+	f, err := read_grpc_message(req)
+	if(err != nil) {
+		return err
+	}
+	result, ok := find_result(req, f.string(1))
+	if(!ok) {
+		return grpc_errorf(grpc_not_found, "no such result")
+	}
+	return write_grpc_message(res, pb_result(result))
+}
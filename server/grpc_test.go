@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+/*
+ * The service as grpc-go sees it: a client connected to route_grpc over
+ * cleartext HTTP/2, and the messages of gost.proto, compiled from the
+ * file itself so the contract is what's checked.
+ */
+type grpc_client struct {
+	conn  *grpc.ClientConn
+	types protoreflect.FileDescriptor
+}
+
+func new_grpc_client(t *testing.T) *grpc_client {
+	files, err := (&protocompile.Compiler{
+		Resolver: &protocompile.SourceResolver{ImportPaths: []string{".."}},
+	}).Compile(context.Background(), "gost.proto")
+	if(err != nil) {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	s := &http.Server{Handler: http.HandlerFunc(route_grpc), Protocols: protocols}
+	go s.Serve(l)
+
+	conn, err := grpc.NewClient("passthrough:///" + l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		s.Close()
+	})
+	return &grpc_client{conn: conn, types: files[0]}
+}
+
+/*
+ * A message of the named type with fields set, as name and value.
+ */
+func (g *grpc_client) message(name string, fields map[string]any) *dynamicpb.Message {
+	m := dynamicpb.NewMessage(g.types.Messages().ByName(protoreflect.Name(name)))
+	for field, value := range fields {
+		m.Set(m.Descriptor().Fields().ByName(protoreflect.Name(field)), protoreflect.ValueOf(value))
+	}
+	return m
+}
+
+func (g *grpc_client) call(method string, in *dynamicpb.Message, out string) (*dynamicpb.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	reply := g.message(out, nil)
+	err := g.conn.Invoke(ctx, grpc_service_prefix + method, in, reply)
+	return reply, err
+}
+
+func field(m *dynamicpb.Message, name string) protoreflect.Value {
+	return m.Get(m.Descriptor().Fields().ByName(protoreflect.Name(name)))
+}
+
+func TestGRPCStartTest(t *testing.T) {
+	g := new_grpc_client(t)
+
+	tests := []struct {
+		name    string
+		request map[string]any
+		method  string
+		path    []string
+		fails   codes.Code
+	}{
+		{"download by size", map[string]any{"direction": "down", "bytes": int64(25000000)}, "GET", []string{"/down?", "bytes=25000000"}, codes.OK},
+		{"download by time", map[string]any{"direction": "down", "seconds": 2.5}, "GET", []string{"/down?", "seconds=2.5"}, codes.OK},
+		{"download with expect", map[string]any{"direction": "down", "expect": "300Mbps"}, "GET", []string{"/down?", "expect=300Mbps"}, codes.OK},
+		{"upload by time", map[string]any{"direction": "up", "seconds": float64(5)}, "PUT", []string{"/up?", "seconds=5"}, codes.OK},
+		{"upload", map[string]any{"direction": "up"}, "PUT", []string{"/up?"}, codes.OK},
+
+		{"upload by size", map[string]any{"direction": "up", "bytes": int64(1000)}, "", nil, codes.InvalidArgument},
+		{"no direction", map[string]any{}, "", nil, codes.InvalidArgument},
+		{"sideways", map[string]any{"direction": "sideways"}, "", nil, codes.InvalidArgument},
+		{"size and time", map[string]any{"direction": "down", "bytes": int64(1000), "seconds": float64(1)}, "", nil, codes.InvalidArgument},
+		{"negative size", map[string]any{"direction": "down", "bytes": int64(-1)}, "", nil, codes.InvalidArgument},
+		{"NaN seconds", map[string]any{"direction": "down", "seconds": math.NaN()}, "", nil, codes.InvalidArgument},
+		{"a picosecond", map[string]any{"direction": "down", "seconds": 1e-12}, "", nil, codes.InvalidArgument},
+		{"longer than allowed", map[string]any{"direction": "down", "seconds": float64(3600)}, "", nil, codes.InvalidArgument},
+		{"bigger than allowed", map[string]any{"direction": "down", "bytes": int64(1) << 50}, "", nil, codes.InvalidArgument},
+		{"expect that isn't a rate", map[string]any{"direction": "down", "expect": "fast"}, "", nil, codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reply, err := g.call("StartTest", g.message("StartTestRequest", test.request), "StartTestResponse")
+			if(status.Code(err) != test.fails) {
+				t.Fatalf("got %v, want %v", err, test.fails)
+			}
+			if(test.fails != codes.OK) {
+				return
+			}
+			id := field(reply, "id").String()
+			path := field(reply, "path").String()
+			if(field(reply, "method").String() != test.method) {
+				t.Fatalf("method %q, want %q", field(reply, "method").String(), test.method)
+			}
+			for _, part := range append(test.path, "test_id=" + id) {
+				if(!strings.Contains(path, part)) {
+					t.Fatalf("path %q, want it to have %q", path, part)
+				}
+			}
+		})
+	}
+}
+
+func TestGRPCResults(t *testing.T) {
+	g := new_grpc_client(t)
+	started := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	recent_results.add(test_result{
+		ID:         "grpc-test-result",
+		RequestID:  "request-1",
+		Direction:  "down",
+		Started:    started,
+		Bytes:      25000000,
+		Seconds:    2.5,
+		Mbps:       80,
+		ClientIP:   "192.0.2.1",
+		Protocol:   "HTTP/2.0",
+		Outcome:    "completed",
+		ExpectMbps: 100,
+		Verdict:    "fail",
+	}, settings().results_kept)
+
+	t.Run("GetResult", func(t *testing.T) {
+		reply, err := g.call("GetResult", g.message("ResultRequest", map[string]any{"id": "grpc-test-result"}), "Result")
+		if(err != nil) {
+			t.Fatal(err)
+		}
+		want := map[string]any{
+			"id":          "grpc-test-result",
+			"request_id":  "request-1",
+			"direction":   "down",
+			"started":     started.Format(time.RFC3339Nano),
+			"bytes":       int64(25000000),
+			"seconds":     2.5,
+			"mbps":        float64(80),
+			"client_ip":   "192.0.2.1",
+			"protocol":    "HTTP/2.0",
+			"outcome":     "completed",
+			"error":       "",
+			"expect_mbps": float64(100),
+			"verdict":     "fail",
+		}
+		for name, value := range want {
+			if(field(reply, name).Interface() != value) {
+				t.Fatalf("%s is %v, want %v", name, field(reply, name).Interface(), value)
+			}
+		}
+	})
+
+	t.Run("GetResult of no such test", func(t *testing.T) {
+		_, err := g.call("GetResult", g.message("ResultRequest", map[string]any{"id": "nobody"}), "Result")
+		if(status.Code(err) != codes.NotFound || status.Convert(err).Message() != "no such result") {
+			t.Fatalf("got %v, want NotFound and its message", err)
+		}
+	})
+
+	t.Run("StreamProgress of a finished test", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		defer cancel()
+		stream, err := g.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, grpc_service_prefix + "StreamProgress")
+		if(err == nil) {
+			err = stream.SendMsg(g.message("ProgressRequest", map[string]any{"id": "grpc-test-result"}))
+		}
+		if(err == nil) {
+			err = stream.CloseSend()
+		}
+		if(err != nil) {
+			t.Fatal(err)
+		}
+
+		event := g.message("ProgressEvent", nil)
+		err = stream.RecvMsg(event)
+		if(err != nil) {
+			t.Fatal(err)
+		}
+		if(field(event, "bytes").Int() != 25000000 || field(event, "avg_mbps").Float() != 80) {
+			t.Fatalf("event %v", event)
+		}
+		result := field(event, "result").Message()
+		if(!result.IsValid() || result.Get(result.Descriptor().Fields().ByName("verdict")).String() != "fail") {
+			t.Fatalf("last event's result %v", result)
+		}
+		err = stream.RecvMsg(g.message("ProgressEvent", nil))
+		if(err != io.EOF) {
+			t.Fatalf("after the last event got %v, want the end", err)
+		}
+	})
+
+	t.Run("StreamProgress too often", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		defer cancel()
+		stream, err := g.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, grpc_service_prefix + "StreamProgress")
+		if(err == nil) {
+			err = stream.SendMsg(g.message("ProgressRequest", map[string]any{"id": "grpc-test-result", "interval_ms": int64(1)}))
+		}
+		if(err == nil) {
+			err = stream.RecvMsg(g.message("ProgressEvent", nil))
+		}
+		if(status.Code(err) != codes.InvalidArgument) {
+			t.Fatalf("got %v, want InvalidArgument", err)
+		}
+	})
+
+	t.Run("unknown method", func(t *testing.T) {
+		_, err := g.call("Nothing", g.message("ResultRequest", nil), "Result")
+		if(status.Code(err) != codes.Unimplemented) {
+			t.Fatalf("got %v, want Unimplemented", err)
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+/*
+ * The HTTP/3 listener, if there is one: the same routes as the others,
+ * over QUIC on a UDP port, so a test over TCP and one over QUIC can be
+ * compared on the same box.  Its results say HTTP/3.0 for protocol.
+ */
+var h3_server *http3.Server
+var h3_conn net.PacketConn
+
+/*
+ * HTTP/3 requests being served, for draining.  Unlike http.Server's,
+ * a QUIC server's shutdown waits for every connection to go, clients
+ * that vanished without closing theirs too, so for drains it's enough
+ * that the requests are done.
+ */
+var h3_requests atomic.Int64
+
+/*
+ * The port HTTP/3 is served on, for Alt-Svc, or zero.
+ */
+var h3_port int
+
+func go_serve_h3(c *configuration, tls_config *tls.Config) error {
+	if(c.h3_port == 0 && !systemd_socket("h3")) {
+		return nil
+	}
+	if(tls_config == nil) {
+		return errors.New("HTTP/3 needs a TLS listener for its certificate")
+	}
+
+	addr := net.JoinHostPort(c.bind_address, strconv.Itoa(c.h3_port))
+	conn, err := listen_udp("h3", addr)
+	if(err != nil) {
+		return err
+	}
+	log_at(log_level_info, "Serving HTTP/3 on %s", conn.LocalAddr())
+	h3_port = port_of(conn.LocalAddr())
+	share_socket("h3", conn, false)
+	h3_conn = conn
+
+	h3_server = &http3.Server{
+		Handler:        http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			h3_requests.Add(1)
+			defer h3_requests.Add(-1)
+			http_listeners.mux.ServeHTTP(res, req)
+		}),
+		TLSConfig:      http3.ConfigureTLSConfig(tls_config.Clone()),
+		MaxHeaderBytes: int(c.max_header_bytes),
+		IdleTimeout:    c.idle_timeout,
+		ConnContext: func(ctx context.Context, conn *quic.Conn) context.Context {
+			info := &conn_info{id: next_conn_id.Add(1), accepted: time.Now()}
+			return context.WithValue(ctx, conn_info_key{}, info)
+		},
+	}
+	go func() {
+		err := h3_server.Serve(conn)
+		if(err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed)) {
+			log_at(log_level_error, "HTTP/3 stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+/*
+ * Let running HTTP/3 requests finish until ctx is done.
+ */
+func shutdown_h3(ctx context.Context) {
+	if(h3_server == nil) {
+		return
+	}
+	go h3_server.Shutdown(ctx)
+	for h3_requests.Load() > 0 && ctx.Err() == nil {
+		time.Sleep(50 * time.Millisecond)
+	}
+	h3_server.Close()
+	h3_conn.Close()
+}
+
+/*
+ * Tell clients of the TLS listeners that HTTP/3 is on offer, so they
+ * can move over to it.
+ */
+func with_alt_svc(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if(h3_port != 0 && req.ProtoMajor < 3) {
+			res.Header().Set("Alt-Svc", "h3=\":" + strconv.Itoa(h3_port) + "\"; ma=86400")
+		}
+		handler.ServeHTTP(res, req)
+	})
+}
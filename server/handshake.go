@@ -0,0 +1,63 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+/*
+ * TLS handshakes, timed.  Each handshake is timed from the server
+ * getting the ClientHello to its verifying the connection, the last
+ * step before the handshake finishes, and counted in
+ * gost_tls_handshake_seconds by TLS version.  The time is kept with the
+ * connection, for /connsetup to report alongside what the handshake
+ * settled on.  A handshake that's much slower on TLS 1.2 than 1.3 is
+ * the extra round trip showing.
+ */
+
+/*
+ * A TLS config for a listener speaking protocols, which times each
+ * handshake.  The config handed to each handshake is base with its
+ * own VerifyConnection, so ALPN is worked out here, since
+ * http.Server's own additions to NextProtos don't reach it.  h2 is
+ * only offered where the listener speaks it.
+ */
+func timed_tls_config(base *tls.Config, protocols *http.Protocols) *tls.Config {
+	wanted := base.NextProtos
+	if(len(wanted) == 0) {
+		wanted = []string{"h2", "http/1.1"}
+	}
+	var next_protos []string
+	for _, proto := range wanted {
+		if(proto != "h2" || protocols.HTTP2()) {
+			next_protos = append(next_protos, proto)
+		}
+	}
+
+	outer := base.Clone()
+	outer.NextProtos = next_protos
+	outer.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		start := time.Now()
+		info, ok := hello.Context().Value(conn_info_key{}).(*conn_info)
+
+		inner := base.Clone()
+		inner.NextProtos = next_protos
+		inner.VerifyConnection = func(state tls.ConnectionState) error {
+			elapsed := time.Since(start)
+			metric_tls_handshake.observe(tls.VersionName(state.Version), elapsed.Seconds())
+			if(ok) {
+				info.mu.Lock()
+				info.handshake = elapsed
+				info.handshake_at = start
+				info.mu.Unlock()
+			}
+			if(base.VerifyConnection != nil) {
+				return base.VerifyConnection(state)
+			}
+			return nil
+		}
+		return inner, nil
+	}
+	return outer
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+ * Each listener is probed over loopback every so often.  A listener is
+ * healthy if its goroutine is still serving and its last probe
+ * succeeded recently; a wedged accept loop or an expired certificate
+ * shows up here even though nothing has exited.
+ */
+const health_probe_path = "/status/probe"
+const health_probe_interval = 5 * time.Second
+const health_probe_timeout = 2 * time.Second
+const health_stale_after = 3 * health_probe_interval
+
+type listener_health struct {
+	name      string
+	scheme    string
+	address   net.Addr
+	ipv6_only bool
+	client    *http.Client
+
+	mu           sync.Mutex
+	serving      bool
+	last_success time.Time
+	last_error   string
+	failures     int
+}
+
+/*
+ * How one listener looks in /status.
+ */
+type listener_report struct {
+	Protocols   []string   `json:"protocols"`
+	Healthy     bool       `json:"healthy"`
+	Serving     bool       `json:"serving"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Failures    int        `json:"failures"`
+	Error       string     `json:"error,omitempty"`
+	Family      string     `json:"family,omitempty"`
+	Acceptors   int        `json:"acceptors,omitempty"`
+}
+
+/*
+ * Every listener being tracked, by name.  Listeners can come and go
+ * while gost runs, so take a snapshot rather than ranging over byname.
+ */
+var health_listeners = struct {
+	sync.Mutex
+	byname map[string]*listener_health
+}{byname: map[string]*listener_health{}}
+
+/*
+ * Start tracking a listener bound to address, which doesn't take IPv4
+ * if ipv6_only.  Call before its goroutine starts.
+ */
+func track_listener(name string, scheme string, address net.Addr, ipv6_only bool) *listener_health {
+	h := &listener_health{name: name, scheme: scheme, address: address, ipv6_only: ipv6_only, client: health_client}
+	if(address.Network() == "unix") {
+		h.client = unix_client(address.String(), health_probe_timeout)
+	}
+	health_listeners.Lock()
+	health_listeners.byname[name] = h
+	health_listeners.Unlock()
+	return h
+}
+
+/*
+ * Stop tracking a listener, once it's closed for good.
+ */
+func untrack_listener(name string) {
+	health_listeners.Lock()
+	delete(health_listeners.byname, name)
+	health_listeners.Unlock()
+}
+
+func tracked_listeners() map[string]*listener_health {
+	health_listeners.Lock()
+	defer health_listeners.Unlock()
+
+	tracked := make(map[string]*listener_health, len(health_listeners.byname))
+	for name, h := range health_listeners.byname {
+		tracked[name] = h
+	}
+	return tracked
+}
+
+/*
+ * Bracket a listener goroutine's Serve call with these.
+ */
+func (h *listener_health) set_serving(serving bool) {
+	h.mu.Lock()
+	h.serving = serving
+	h.mu.Unlock()
+}
+
+/*
+ * Where to reach a listener from here.  Wildcard binds are probed over
+ * loopback, IPv6's if that's all they take, and unix sockets with a
+ * made-up host.
+ */
+func (h *listener_health) probe_url() string {
+	if(h.address.Network() == "unix") {
+		return h.scheme + "://unix" + health_probe_path
+	}
+
+	host, port, _ := net.SplitHostPort(h.address.String())
+	ip := net.ParseIP(host)
+	if(host == "" || (ip != nil && ip.IsUnspecified())) {
+		host = "127.0.0.1"
+		if(h.ipv6_only) {
+			host = "::1"
+		}
+	}
+	return h.scheme + "://" + net.JoinHostPort(host, port) + health_probe_path
+}
+
+/*
+ * The probe client.  We're checking that we answer, not who we are, so
+ * certificates aren't verified.
+ */
+var health_client = &http.Client{
+	Timeout: health_probe_timeout,
+	Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+		DialContext:       proxy_dial,
+	},
+}
+
+/*
+ * A client whose every request goes to the unix socket at path.
+ */
+func unix_client(path string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				return proxy_dial(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+/*
+ * Probe one listener and record how it went.
+ */
+func (h *listener_health) probe() {
+	res, err := h.client.Get(h.probe_url())
+	if(err == nil) {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if(res.StatusCode != 200) {
+			err = fmt.Errorf("probe returned %d", res.StatusCode)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if(err != nil) {
+		if(h.failures == 0) {
+			log_at(log_level_error, "Health probe of %s listener failed: %v", h.name, err)
+		}
+		h.failures++
+		h.last_error = err.Error()
+		return
+	}
+
+	if(h.failures > 0) {
+		log_at(log_level_info, "Health probe of %s listener recovered after %d failures", h.name, h.failures)
+	}
+	h.failures = 0
+	h.last_error = ""
+	h.last_success = time.Now()
+}
+
+/*
+ * Probe every listener now, then every health_probe_interval.
+ */
+func go_probe_listeners() {
+	go func() {
+		// Give the listeners a moment to bind.
+		time.Sleep(250 * time.Millisecond)
+
+		for {
+			var wg sync.WaitGroup
+			for _, h := range tracked_listeners() {
+				wg.Add(1)
+				go func(h *listener_health) {
+					defer wg.Done()
+					h.probe()
+				}(h)
+			}
+			wg.Wait()
+			time.Sleep(health_probe_interval)
+		}
+	}()
+}
+
+/*
+ * Is this listener serving and answering?
+ */
+func (h *listener_health) report(protocols []string) listener_report {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := listener_report{
+		Protocols: protocols,
+		Serving:   h.serving,
+		Failures:  h.failures,
+		Error:     h.last_error,
+	}
+	if(!h.last_success.IsZero()) {
+		when := h.last_success
+		r.LastSuccess = &when
+	}
+	r.Healthy = h.serving && h.failures == 0 && time.Since(h.last_success) < health_stale_after
+	return r
+}
+
+/*
+ * GET: What the health probe hits.  Deliberately does nothing, and
+ * isn't logged, since it arrives every few seconds.
+ */
+func route_probe(res http.ResponseWriter, req *http.Request) {
+	io.WriteString(res, "ok")
+}
+
+/*
+ * GET: Liveness.  If this answers at all, the process is alive; restart
+ * it if it doesn't.
+ */
+func route_healthz(res http.ResponseWriter, req *http.Request) {
+	io.WriteString(res, "ok")
+}
+
+/*
+ * The body of a /readyz response: each check, and "ok" or what's wrong.
+ */
+type readiness_report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+/*
+ * Run every readiness check.
+ */
+func readiness_checks() map[string]string {
+	checks := map[string]string{}
+	record := func(name string, err error) {
+		if(err != nil) {
+			checks[name] = err.Error()
+		} else {
+			checks[name] = "ok"
+		}
+	}
+
+	for name, h := range tracked_listeners() {
+		var err error
+		r := h.report(nil)
+		if(!r.Healthy) {
+			err = fmt.Errorf("not answering: %s", r.Error)
+			if(!r.Serving) {
+				err = errors.New("not serving")
+			}
+		}
+		record("listener_" + name, err)
+	}
+
+	record("config", settings().validate())
+
+	if(results_log != nil) {
+		record("results_file", results_log.writable())
+	}
+	if(results_db != nil) {
+		record("results_db", results_db.db.Ping())
+	}
+
+	// Having a certificate is enough; renewing one doesn't make us unready.
+	if(acme != nil) {
+		var err error
+		if(!acme.has_certificate()) {
+			err = errors.New("no certificate yet")
+		}
+		record("acme", err)
+	}
+
+	return checks
+}
+
+/*
+ * Whether every readiness check passes.
+ */
+func ready() bool {
+	for _, result := range readiness_checks() {
+		if(result != "ok") {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Whether every listener is serving and answering its probes.
+ */
+func listeners_healthy() bool {
+	for _, h := range tracked_listeners() {
+		if(!h.report(nil).Healthy) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * GET: Readiness.  Send traffic here only once every listener answers,
+ * the configuration is valid, results can be written, and there's a
+ * certificate to serve.
+ */
+func route_readyz(res http.ResponseWriter, req *http.Request) {
+	report := readiness_report{Status: "ready", Checks: readiness_checks()}
+	for _, result := range report.Checks {
+		if(result != "ok") {
+			report.Status = "unready"
+		}
+	}
+
+	if(report.Status != "ready") {
+		write_json(res, 503, report) // Service Unavailable
+		return
+	}
+	write_json(res, 200, report)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+/*
+ * gost healthcheck asks the gost on this machine whether it's ready,
+ * for a container's HEALTHCHECK without curl in the image.  It takes
+ * the server's flags and environment, so it finds the same listeners:
+ * a unix socket if there is one, otherwise the first plain listener,
+ * otherwise a TLS one, without checking its certificate.  A wildcard
+ * address is reached over loopback.  It GETs /readyz there and exits 0
+ * if that's 200, 1 if not.
+ */
+const healthcheck_timeout = 5 * time.Second
+
+func run_healthcheck(args []string) int {
+	c, err := load_configuration(args)
+	if(err != nil) {
+		fmt.Fprintf(os.Stderr, "gost healthcheck: %v\n", err)
+		return 1
+	}
+
+	spec, ok := healthcheck_listener(c.listener_specs())
+	if(!ok) {
+		fmt.Fprintln(os.Stderr, "gost healthcheck: no listener to check")
+		return 1
+	}
+	client, url := healthcheck_client(spec)
+
+	res, err := client.Get(url)
+	if(err != nil) {
+		fmt.Fprintf(os.Stderr, "gost healthcheck: %v\n", err)
+		return 1
+	}
+	defer res.Body.Close()
+
+	var report readiness_report
+	json.NewDecoder(io.LimitReader(res.Body, 64 * 1024)).Decode(&report)
+	if(res.StatusCode != 200) {
+		fmt.Fprintf(os.Stderr, "gost healthcheck: %s says %s\n", url, res.Status)
+		for _, name := range sorted_keys(report.Checks) {
+			if(report.Checks[name] != "ok") {
+				fmt.Fprintf(os.Stderr, "  %s: %s\n", name, report.Checks[name])
+			}
+		}
+		return 1
+	}
+	fmt.Printf("%s: %s\n", url, report.Status)
+	return 0
+}
+
+/*
+ * The listener to ask: a unix socket, then plain HTTP, then TLS.
+ */
+func healthcheck_listener(specs []listener_spec) (listener_spec, bool) {
+	for _, want := range []func(listener_spec) bool{
+		func(s listener_spec) bool { return s.unix != "" },
+		func(s listener_spec) bool { return !s.tls },
+		func(s listener_spec) bool { return true },
+	} {
+		for _, spec := range specs {
+			if(want(spec)) {
+				return spec, true
+			}
+		}
+	}
+	return listener_spec{}, false
+}
+
+/*
+ * A client for the listener, and the URL of its /readyz.
+ */
+func healthcheck_client(spec listener_spec) (*http.Client, string) {
+	transport := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}
+	client := &http.Client{Transport: transport, Timeout: healthcheck_timeout}
+
+	if(spec.unix != "") {
+		transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", spec.unix)
+		}
+		return client, "http://localhost/readyz"
+	}
+
+	host, port, _ := net.SplitHostPort(spec.address)
+	ip := net.ParseIP(host)
+	if(host == "" || (ip != nil && ip.IsUnspecified())) {
+		host = "127.0.0.1"
+		if(spec.family == "ipv6") {
+			host = "::1"
+		}
+	}
+	scheme := "http"
+	if(spec.tls) {
+		scheme = "https"
+	}
+	return client, scheme + "://" + net.JoinHostPort(host, port) + "/readyz"
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+/*
+ * Latency injection, so QA can see how clients cope with a slow server
+ * without reaching for tc or netem.  ?delay=200ms holds back the first
+ * byte of /down, the first read of /up, or a /ping reply; ?jitter=50ms
+ * spreads each delay evenly over delay ± jitter.  With ?delay_on=chunk
+ * every 64K chunk of a transfer is delayed instead.
+ */
+const impair_max_delay = 10 * time.Second
+
+type impairment struct {
+	delay     time.Duration
+	jitter    time.Duration
+	per_chunk bool
+}
+
+/*
+ * Work out the impairment a client asked for, or nil if none.
+ */
+func requested_impairment(req *http.Request) (*impairment, error) {
+	query := req.URL.Query()
+	if(query.Get("delay") == "" && query.Get("jitter") == "") {
+		return nil, nil
+	}
+
+	m := &impairment{}
+	for _, p := range []struct {
+		name  string
+		value *time.Duration
+	}{{"delay", &m.delay}, {"jitter", &m.jitter}} {
+		s := query.Get(p.name)
+		if(s == "") {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if(err != nil || d < 0 || d > impair_max_delay) {
+			return nil, fmt.Errorf("%s must be a duration up to %v", p.name, impair_max_delay)
+		}
+		*p.value = d
+	}
+
+	switch query.Get("delay_on") {
+	case "", "first":
+	case "chunk":
+		m.per_chunk = true
+	default:
+		return nil, fmt.Errorf("delay_on must be first or chunk")
+	}
+	return m, nil
+}
+
+/*
+ * Sleep for one delay.  Safe to call on a nil impairment.
+ */
+func (m *impairment) pause() {
+	if(m == nil) {
+		return
+	}
+	d := m.delay
+	if(m.jitter > 0) {
+		d += time.Duration(rand.Int64N(int64(2 * m.jitter) + 1)) - m.jitter
+	}
+	if(d > 0) {
+		time.Sleep(d)
+	}
+}
+
+/*
+ * Pause before the first byte, unless the pauses belong to each chunk.
+ */
+func (m *impairment) before_first() {
+	if(m != nil && !m.per_chunk) {
+		m.pause()
+	}
+}
+
+type delayed_writer struct {
+	w io.Writer
+	m *impairment
+}
+
+func (d delayed_writer) Write(p []byte) (int, error) {
+	d.m.pause()
+	return d.w.Write(p)
+}
+
+type delayed_reader struct {
+	r io.Reader
+	m *impairment
+}
+
+func (d delayed_reader) Read(p []byte) (int, error) {
+	d.m.pause()
+	return d.r.Read(p)
+}
+
+/*
+ * Delay each write to w, if asked to.
+ */
+func impair_writer(w io.Writer, m *impairment) io.Writer {
+	if(m == nil || !m.per_chunk) {
+		return w
+	}
+	return delayed_writer{w, m}
+}
+
+/*
+ * Delay each read from r, if asked to.
+ */
+func impair_reader(r io.Reader, m *impairment) io.Reader {
+	if(m == nil || !m.per_chunk) {
+		return r
+	}
+	return delayed_reader{r, m}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+/*
+ * Who's calling.  Behind a reverse proxy RemoteAddr is the proxy, so
+ * when it's one of -trusted-proxies gost believes X-Forwarded-For
+ * instead, reading it from the right and skipping any other trusted
+ * hops, so that a client can't claim an address by sending the header
+ * itself.  Whatever is on the other end of a unix socket is local, and
+ * so trusted too.
+ */
+const ip_lookup_timeout = time.Second
+
+/*
+ * The ASN and country databases given with -geoip-asn and
+ * -geoip-country, if any.
+ */
+var geoip_asn *geoip_db
+var geoip_country *geoip_db
+
+/*
+ * Where addr is: its country's ISO code and its autonomous system, as
+ * far as the databases we have say.
+ */
+func locate(addr netip.Addr) (string, uint, string) {
+	var country string
+	var asn uint
+	var org string
+	if(!addr.IsValid()) {
+		return country, asn, org
+	}
+
+	if(geoip_country != nil) {
+		record, err := geoip_country.lookup(addr)
+		if(err != nil) {
+			log_at(log_level_error, "Can't look %s up in %s: %v", addr, geoip_country.path, err)
+		}
+		country, _ = mmdb_path(record, "country", "iso_code").(string)
+	}
+	if(geoip_asn != nil) {
+		record, err := geoip_asn.lookup(addr)
+		if(err != nil) {
+			log_at(log_level_error, "Can't look %s up in %s: %v", addr, geoip_asn.path, err)
+		}
+		asn = mmdb_uint(mmdb_path(record, "autonomous_system_number"))
+		org, _ = mmdb_path(record, "autonomous_system_organization").(string)
+	}
+	return country, asn, org
+}
+
+/*
+ * Whether addr is a proxy whose X-Forwarded-For can be believed.
+ */
+func trusted_proxy(c *configuration, addr netip.Addr) bool {
+	for _, prefix := range c.trusted_proxies {
+		if(prefix.Contains(addr.Unmap())) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * The caller's address and port as far as gost can tell, and whether
+ * that came from a proxy.  The port is zero when a proxy answered for
+ * the client, since X-Forwarded-For doesn't carry one.
+ */
+func client_address(req *http.Request) (netip.Addr, int, bool) {
+	c := settings()
+	peer, err := netip.ParseAddrPort(req.RemoteAddr)
+	addr := peer.Addr().Unmap()
+	if(err == nil && !trusted_proxy(c, addr)) {
+		return addr, int(peer.Port()), false
+	}
+
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if(err != nil) {
+			break
+		}
+		addr = hop.Unmap()
+		if(!trusted_proxy(c, addr)) {
+			break
+		}
+	}
+	if(addr == peer.Addr().Unmap()) {
+		return addr, int(peer.Port()), false
+	}
+	return addr, 0, true
+}
+
+/*
+ * The caller's IP address, without the port, or "unix" for a local
+ * caller over a unix socket.
+ */
+func client_ip(req *http.Request) string {
+	addr, _, _ := client_address(req)
+	if(!addr.IsValid()) {
+		if(req.RemoteAddr == "@" || req.RemoteAddr == "") {
+			return "unix"
+		}
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if(err != nil) {
+			return req.RemoteAddr
+		}
+		return host
+	}
+	return addr.String()
+}
+
+/*
+ * What GET /ip returns.
+ */
+type ip_report struct {
+	IP         string `json:"ip"`
+	Port       int    `json:"port,omitempty"`
+	Forwarded  bool   `json:"forwarded"`
+	ReverseDNS string `json:"reverse_dns,omitempty"`
+	Country    string `json:"country,omitempty"`
+	ASN        uint   `json:"asn,omitempty"`
+	ASOrg      string `json:"as_org,omitempty"`
+}
+
+/*
+ * GET: The caller's address, its reverse DNS, and with -geoip-country
+ * and -geoip-asn its country and autonomous system.  ?format=text gives
+ * just the address.
+ */
+func route_ip(res http.ResponseWriter, req *http.Request) {
+	if(req.URL.Query().Get("format") == "text") {
+		res.Header().Set("Content-Type", "text/plain")
+		io.WriteString(res, client_ip(req))
+		return
+	}
+
+	addr, port, forwarded := client_address(req)
+	report := ip_report{IP: client_ip(req), Port: port, Forwarded: forwarded}
+
+	ctx, cancel := context.WithTimeout(req.Context(), ip_lookup_timeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, report.IP)
+	if(err == nil && len(names) > 0) {
+		report.ReverseDNS = strings.TrimSuffix(names[0], ".")
+	}
+
+	report.Country, report.ASN, report.ASOrg = locate(addr)
+	write_json(res, 200, report)
+}
+
+/*
+ * Parse a comma-separated list of addresses and CIDR prefixes.
+ */
+func parse_prefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if(item == "") {
+			continue
+		}
+		if(!strings.Contains(item, "/")) {
+			addr, err := netip.ParseAddr(item)
+			if(err != nil) {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if(err != nil) {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func format_prefixes(prefixes []netip.Prefix) string {
+	items := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		items[i] = prefix.String()
+	}
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,464 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Enough of the iperf3 protocol that a stock `iperf3 -c` can test
+ * against gost over TCP, in either direction (-R) and with parallel
+ * streams (-P).  UDP, SCTP, --bidir and iperf3's own authentication
+ * aren't supported, and the client is told the server is busy.
+ *
+ * A test is a control connection, on which a state byte at a time
+ * moves things along, plus one data connection per stream.  Every
+ * connection opens with the client's 37-byte cookie, which is how the
+ * data connections find their test:
+ *
+ *	server: PARAM_EXCHANGE     client: JSON parameters
+ *	server: CREATE_STREAMS     client: opens the data connections
+ *	server: TEST_START, TEST_RUNNING, and data flows
+ *	client: TEST_END
+ *	server: EXCHANGE_RESULTS   client: its JSON results, then ours
+ *	server: DISPLAY_RESULTS    client: IPERF_DONE
+ *
+ * JSON goes as a 4-byte big-endian length and the text.
+ */
+const (
+	iperf_test_start       = 1
+	iperf_test_running     = 2
+	iperf_test_end         = 4
+	iperf_param_exchange   = 9
+	iperf_create_streams   = 10
+	iperf_server_terminate = 11
+	iperf_client_terminate = 12
+	iperf_exchange_results = 13
+	iperf_display_results  = 14
+	iperf_done             = 16
+	iperf_access_denied    = -1
+)
+
+const iperf_cookie_size = 37
+const iperf_max_json = 64 * 1024
+const iperf_max_streams = 128
+
+/*
+ * How long the client gets for each step of the handshake, and how far
+ * past the agreed duration a test may run before it's cut off.
+ */
+const iperf_step_timeout = 10 * time.Second
+const iperf_overrun = 10 * time.Second
+
+/*
+ * The client's parameters we care about.  Times are in seconds, and
+ * Bytes is the -n limit, if any.
+ */
+type iperf_params struct {
+	TCP           bool   `json:"tcp"`
+	UDP           bool   `json:"udp"`
+	SCTP          bool   `json:"sctp"`
+	Omit          int    `json:"omit"`
+	Time          int    `json:"time"`
+	Bytes         int64  `json:"num"`
+	Parallel      int    `json:"parallel"`
+	Reverse       bool   `json:"reverse"`
+	Bidirectional bool   `json:"bidirectional"`
+	Congestion    string `json:"congestion"`
+	AuthToken     string `json:"authtoken"`
+}
+
+type iperf_stream_result struct {
+	ID          int     `json:"id"`
+	Bytes       int64   `json:"bytes"`
+	Retransmits int     `json:"retransmits"`
+	Jitter      float64 `json:"jitter"`
+	Errors      int64   `json:"errors"`
+	Packets     int64   `json:"packets"`
+	StartTime   float64 `json:"start_time"`
+	EndTime     float64 `json:"end_time"`
+}
+
+type iperf_results struct {
+	CPUTotal             float64               `json:"cpu_util_total"`
+	CPUUser              float64               `json:"cpu_util_user"`
+	CPUSystem            float64               `json:"cpu_util_system"`
+	SenderHasRetransmits int                   `json:"sender_has_retransmits"`
+	CongestionUsed       string                `json:"congestion_used,omitempty"`
+	Streams              []iperf_stream_result `json:"streams"`
+}
+
+type iperf_stream struct {
+	conn  net.Conn
+	bytes atomic.Int64
+}
+
+/*
+ * Tests waiting for their data connections, by cookie.
+ */
+var iperf_pending = struct {
+	sync.Mutex
+	bycookie map[string]chan net.Conn
+}{bycookie: map[string]chan net.Conn{}}
+
+/*
+ * Counts bytes through one stream, alongside the test's own count.
+ */
+type tally_reader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (t tally_reader) Read(b []byte) (int, error) {
+	n, err := t.r.Read(b)
+	t.n.Add(int64(n))
+	return n, err
+}
+
+type tally_writer struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (t tally_writer) Write(b []byte) (int, error) {
+	n, err := t.w.Write(b)
+	t.n.Add(int64(n))
+	return n, err
+}
+
+func iperf_send_state(conn net.Conn, state int8) error {
+	_, err := conn.Write([]byte{byte(state)})
+	return err
+}
+
+func iperf_read_state(conn net.Conn) (int8, error) {
+	var b [1]byte
+	_, err := io.ReadFull(conn, b[:])
+	return int8(b[0]), err
+}
+
+func iperf_write_json(conn net.Conn, v interface{}) error {
+	data, err := json.Marshal(v)
+	if(err != nil) {
+		return err
+	}
+	frame := make([]byte, 4, 4 + len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	_, err = conn.Write(append(frame, data...))
+	return err
+}
+
+func iperf_read_json(conn net.Conn, v interface{}) error {
+	var size [4]byte
+	_, err := io.ReadFull(conn, size[:])
+	if(err != nil) {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if(n > iperf_max_json) {
+		return fmt.Errorf("iperf3 JSON of %d bytes is too big", n)
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(conn, data)
+	if(err != nil) {
+		return err
+	}
+	if(v == nil) {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+/*
+ * Sort a new connection into a data stream for a waiting test or the
+ * control connection of a new one.
+ */
+func iperf_accept(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(iperf_step_timeout))
+	cookie := make([]byte, iperf_cookie_size)
+	_, err := io.ReadFull(conn, cookie)
+	if(err != nil) {
+		conn.Close()
+		return
+	}
+
+	iperf_pending.Lock()
+	streams, ok := iperf_pending.bycookie[string(cookie)]
+	iperf_pending.Unlock()
+
+	if(ok) {
+		select {
+		case streams <- conn:
+		default:
+			conn.Close()
+		}
+		return
+	}
+
+	defer conn.Close()
+	err = iperf_control(conn, string(cookie))
+	if(err != nil) {
+		log_at(log_level_debug, "iperf3 test from %s failed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+/*
+ * Why a test can't be run, or "" if it can.
+ */
+func (p *iperf_params) refusal() string {
+	if(p.UDP || p.SCTP) {
+		return "only TCP tests are supported"
+	}
+	if(p.Bidirectional) {
+		return "bidirectional tests aren't supported"
+	}
+	if(p.AuthToken != "") {
+		return "iperf3 authentication isn't supported"
+	}
+	if(p.Parallel < 1 || p.Parallel > iperf_max_streams) {
+		return fmt.Sprintf("%d streams is out of range", p.Parallel)
+	}
+	return ""
+}
+
+/*
+ * Run one test over its control connection.
+ */
+func iperf_control(conn net.Conn, cookie string) error {
+	err := iperf_send_state(conn, iperf_param_exchange)
+	if(err != nil) {
+		return err
+	}
+
+	var params iperf_params
+	err = iperf_read_json(conn, &params)
+	if(err != nil) {
+		return err
+	}
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	refusal := params.refusal()
+	if(refusal == "") {
+		refusal, _ = reserve_test(host, "", "")
+	}
+	if(refusal != "") {
+		iperf_send_state(conn, iperf_access_denied)
+		return errors.New(refusal)
+	}
+
+	c := settings()
+	direction := "up"
+	if(params.Reverse) {
+		direction = "down"
+	}
+	test := new_test_run(context.Background(), "", "", direction, host, "iperf3", params.Bytes)
+
+	streams, err := iperf_gather_streams(conn, cookie, params.Parallel)
+	defer func() {
+		for _, s := range streams {
+			s.conn.Close()
+		}
+	}()
+	if(err != nil) {
+		test.end(0, err)
+		return err
+	}
+	test.conn = streams[0].conn
+
+	// iperf3 -C picks the algorithm; otherwise the listener's default.
+	algorithm := params.Congestion
+	if(algorithm == "") {
+		algorithm = c.iperf_congestion
+	}
+	if(algorithm != "") {
+		for _, s := range streams {
+			err = set_congestion(s.conn, algorithm)
+			if(err != nil) {
+				break
+			}
+		}
+	}
+	if(err != nil) {
+		iperf_send_state(conn, iperf_access_denied)
+		test.end(0, err)
+		return err
+	}
+
+	err = iperf_send_state(conn, iperf_test_start)
+	if(err == nil) {
+		err = iperf_send_state(conn, iperf_test_running)
+	}
+	if(err != nil) {
+		test.end(0, err)
+		return err
+	}
+	running := time.Now()
+
+	limit := c.max_test_bytes
+	if(params.Bytes > 0 && params.Bytes < limit) {
+		limit = params.Bytes
+	}
+	for _, s := range streams {
+		go iperf_move(test, s, params.Reverse, limit / int64(len(streams)))
+	}
+
+	// The client says when it's done; don't wait forever for it.
+	duration := time.Duration(params.Time + params.Omit) * time.Second
+	if(duration <= 0 || duration > c.max_test_duration) {
+		duration = c.max_test_duration
+	}
+	conn.SetReadDeadline(running.Add(duration + iperf_overrun))
+
+	state, err := iperf_read_state(conn)
+	if(err == nil && state != iperf_test_end) {
+		err = fmt.Errorf("client sent state %d while the test ran", state)
+	}
+	elapsed := time.Since(running)
+
+	// Stop writing, and stop counting what's still in flight.
+	var total int64
+	results := iperf_results{SenderHasRetransmits: -1, CongestionUsed: congestion_of(streams[0].conn)}
+	for i, s := range streams {
+		s.conn.SetWriteDeadline(time.Now())
+		n := s.bytes.Load()
+		total += n
+		stream := iperf_stream_result{
+			ID:          iperf_stream_id(i),
+			Bytes:       n,
+			Retransmits: -1,
+			EndTime:     elapsed.Seconds(),
+		}
+
+		// As the sender we can say how many segments went again.
+		stats := read_tcp_info(s.conn)
+		if(params.Reverse && stats != nil) {
+			results.SenderHasRetransmits = 1
+			stream.Retransmits = int(stats.Retransmits)
+		}
+		results.Streams = append(results.Streams, stream)
+	}
+	if(err != nil) {
+		iperf_send_state(conn, iperf_server_terminate)
+		test.end(total, err)
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(iperf_step_timeout))
+	err = iperf_send_state(conn, iperf_exchange_results)
+	if(err == nil) {
+		err = iperf_read_json(conn, nil)
+	}
+	if(err == nil) {
+		err = iperf_write_json(conn, results)
+	}
+	if(err == nil) {
+		err = iperf_send_state(conn, iperf_display_results)
+	}
+	if(err == nil) {
+		state, err = iperf_read_state(conn)
+		if(err == nil && state != iperf_done && state != iperf_client_terminate) {
+			err = fmt.Errorf("client sent state %d instead of IPERF_DONE", state)
+		}
+	}
+
+	result := test.end(total, err)
+	log_at(log_level_debug, "iperf3 test %s from %s: %d streams, %.1f Mbps", result.ID, host, len(streams), result.Mbps)
+	return err
+}
+
+/*
+ * iperf3 numbers streams 1, 3, 4, 5...; the client checks that our
+ * results use the same IDs.
+ */
+func iperf_stream_id(i int) int {
+	if(i == 0) {
+		return 1
+	}
+	return i + 2
+}
+
+/*
+ * Ask for the data connections and wait for them all to arrive.
+ */
+func iperf_gather_streams(conn net.Conn, cookie string, n int) ([]*iperf_stream, error) {
+	arrivals := make(chan net.Conn, n)
+	iperf_pending.Lock()
+	iperf_pending.bycookie[cookie] = arrivals
+	iperf_pending.Unlock()
+	defer func() {
+		iperf_pending.Lock()
+		delete(iperf_pending.bycookie, cookie)
+		iperf_pending.Unlock()
+	}()
+
+	err := iperf_send_state(conn, iperf_create_streams)
+	if(err != nil) {
+		return nil, err
+	}
+
+	streams := []*iperf_stream{}
+	timeout := time.After(iperf_step_timeout)
+	for len(streams) < n {
+		select {
+		case c := <-arrivals:
+			c.SetReadDeadline(time.Time{})
+			streams = append(streams, &iperf_stream{conn: c})
+		case <-timeout:
+			return streams, fmt.Errorf("only %d of %d streams connected", len(streams), n)
+		}
+	}
+	return streams, nil
+}
+
+/*
+ * Move a stream's data: send up to limit bytes if the client asked for
+ * -R, otherwise take whatever it sends.
+ */
+func iperf_move(test *test_run, s *iperf_stream, reverse bool, limit int64) {
+	if(reverse) {
+		write_payload(test.writer(tally_writer{s.conn, &s.bytes}), limit)
+		return
+	}
+	drain_body(test.reader(tally_reader{s.conn, &s.bytes}))
+}
+
+/*
+ * Start the iperf3 listener, if it's configured.
+ */
+func go_serve_iperf(c *configuration) error {
+	if(c.iperf_port == 0 && !systemd_socket("iperf")) {
+		return nil
+	}
+
+	addr := net.JoinHostPort(c.bind_address, strconv.Itoa(c.iperf_port))
+	listener, err := listen_tcp("iperf", "tcp", addr)
+	if(err != nil) {
+		return err
+	}
+	log_at(log_level_info, "Serving iperf3 on %s", listener.Addr())
+	share_socket("iperf", listener, true)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if(errors.Is(err, net.ErrClosed)) {
+				return
+			}
+			if(err != nil) {
+				log_at(log_level_error, "iperf3 listener stopped: %v", err)
+				return
+			}
+			go iperf_accept(conn)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * The client end of an iperf3 test, stepping through the control
+ * protocol against a listener and failing at the first thing the
+ * server says out of turn.
+ */
+type iperf_client struct {
+	t      *testing.T
+	addr   string
+	cookie []byte
+	conn   net.Conn
+}
+
+func (c *iperf_client) dial() net.Conn {
+	conn, err := net.Dial("tcp", c.addr)
+	if(err != nil) {
+		c.t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c.t.Cleanup(func() {
+		conn.Close()
+	})
+	_, err = conn.Write(c.cookie)
+	if(err != nil) {
+		c.t.Fatal(err)
+	}
+	return conn
+}
+
+func (c *iperf_client) expect(state int8) {
+	got, err := iperf_read_state(c.conn)
+	if(err != nil) {
+		c.t.Fatalf("waiting for state %d: %v", state, err)
+	}
+	if(got != state) {
+		c.t.Fatalf("server sent state %d, want %d", got, state)
+	}
+}
+
+func (c *iperf_client) send(state int8) {
+	err := iperf_send_state(c.conn, state)
+	if(err != nil) {
+		c.t.Fatal(err)
+	}
+}
+
+/*
+ * Wait for the test from this client to have taken n bytes, so that
+ * none are still in flight when it's told the test is over.
+ */
+func iperf_wait_for(t *testing.T, n int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var moved int64
+		active_runs.Range(func(_, v any) bool {
+			run := v.(*test_run)
+			if(run.protocol == "iperf3") {
+				moved = run.moved.Load()
+			}
+			return true
+		})
+		if(moved >= n) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("the server never took all %d bytes", n)
+}
+
+func results_so_far() []test_result {
+	recent_results.mu.Lock()
+	defer recent_results.mu.Unlock()
+	return recent_results.newest_first()
+}
+
+func TestIperfControl(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if(err != nil) {
+				return
+			}
+			go iperf_accept(conn)
+		}
+	}()
+
+	tests := []struct {
+		name    string
+		params  iperf_params
+		per     int64
+		end     int8
+		refused bool
+		outcome string
+	}{
+		{"upload", iperf_params{TCP: true, Time: 1, Parallel: 1}, 100000, iperf_test_end, false, "completed"},
+		{"upload over streams", iperf_params{TCP: true, Time: 1, Parallel: 3}, 100000, iperf_test_end, false, "completed"},
+		{"download", iperf_params{TCP: true, Time: 1, Parallel: 1, Reverse: true, Bytes: 300000}, 300000, iperf_test_end, false, "completed"},
+		{"download over streams", iperf_params{TCP: true, Time: 1, Parallel: 3, Reverse: true, Bytes: 300000}, 100000, iperf_test_end, false, "completed"},
+		{"client out of turn", iperf_params{TCP: true, Time: 1, Parallel: 1}, 1000, iperf_param_exchange, false, "aborted"},
+
+		{"UDP", iperf_params{UDP: true, Parallel: 1}, 0, 0, true, ""},
+		{"SCTP", iperf_params{SCTP: true, Parallel: 1}, 0, 0, true, ""},
+		{"bidirectional", iperf_params{TCP: true, Bidirectional: true, Parallel: 1}, 0, 0, true, ""},
+		{"iperf3 authentication", iperf_params{TCP: true, AuthToken: "secret", Parallel: 1}, 0, 0, true, ""},
+		{"no streams", iperf_params{TCP: true, Parallel: 0}, 0, 0, true, ""},
+		{"too many streams", iperf_params{TCP: true, Parallel: iperf_max_streams + 1}, 0, 0, true, ""},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			admitting(t, defaults, 0)
+			before := len(results_so_far())
+			c := &iperf_client{t: t, addr: l.Addr().String(), cookie: []byte(fmt.Sprintf("%-36d\x00", i))}
+			c.conn = c.dial()
+
+			c.expect(iperf_param_exchange)
+			err := iperf_write_json(c.conn, test.params)
+			if(err != nil) {
+				t.Fatal(err)
+			}
+			if(test.refused) {
+				c.expect(iperf_access_denied)
+				return
+			}
+
+			c.expect(iperf_create_streams)
+			streams := []net.Conn{}
+			for range test.params.Parallel {
+				streams = append(streams, c.dial())
+			}
+			c.expect(iperf_test_start)
+			c.expect(iperf_test_running)
+
+			for _, s := range streams {
+				if(test.params.Reverse) {
+					_, err = io.ReadFull(s, make([]byte, test.per))
+				} else {
+					_, err = s.Write(make([]byte, test.per))
+				}
+				if(err != nil) {
+					t.Fatal(err)
+				}
+			}
+			total := test.per * int64(len(streams))
+			iperf_wait_for(t, total)
+
+			c.send(test.end)
+			if(test.end != iperf_test_end) {
+				c.expect(iperf_server_terminate)
+			} else {
+				c.expect(iperf_exchange_results)
+				err = iperf_write_json(c.conn, iperf_results{})
+				if(err != nil) {
+					t.Fatal(err)
+				}
+				var results iperf_results
+				err = iperf_read_json(c.conn, &results)
+				if(err != nil) {
+					t.Fatal(err)
+				}
+				if(len(results.Streams) != len(streams)) {
+					t.Fatalf("results for %d streams, want %d", len(results.Streams), len(streams))
+				}
+				for k, s := range results.Streams {
+					if(s.ID != iperf_stream_id(k) || s.Bytes != test.per) {
+						t.Fatalf("stream %d is %d with %d bytes, want %d with %d", k, s.ID, s.Bytes, iperf_stream_id(k), test.per)
+					}
+				}
+				c.expect(iperf_display_results)
+				c.send(iperf_done)
+			}
+
+			// The server hangs up once it has recorded the test.
+			_, err = c.conn.Read(make([]byte, 1))
+			if(err != io.EOF) {
+				t.Fatalf("after the test got %v, want the server to hang up", err)
+			}
+			all := results_so_far()
+			if(len(all) != before + 1) {
+				t.Fatalf("%d results recorded, want 1", len(all) - before)
+			}
+			result := all[0]
+			if(result.Protocol != "iperf3" || result.Outcome != test.outcome || result.Bytes != total) {
+				t.Fatalf("recorded %s %s with %d bytes, want iperf3 %s with %d", result.Protocol, result.Outcome, result.Bytes, test.outcome, total)
+			}
+			if(test_tracker.active.Load() != 0) {
+				t.Fatalf("%d tests still hold slots", test_tracker.active.Load())
+			}
+		})
+	}
+}
+
+func TestIperfReadJSON(t *testing.T) {
+	frame := func(n uint32, text string) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, n), text...)
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  int
+		fails bool
+	}{
+		{"parameters", frame(14, `{"parallel":4}`), 4, false},
+		{"empty object", frame(2, `{}`), 0, false},
+		{"as big as allowed", frame(iperf_max_json, `{"parallel":2}` + strings.Repeat(" ", iperf_max_json - 14)), 2, false},
+		{"too big", frame(iperf_max_json + 1, ""), 0, true},
+		{"short", frame(20, `{"parallel":4}`), 0, true},
+		{"no length", []byte{0, 0}, 0, true},
+		{"not JSON", frame(3, "abc"), 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ours, theirs := net.Pipe()
+			defer ours.Close()
+			go func() {
+				theirs.Write(test.input)
+				theirs.Close()
+			}()
+			var params iperf_params
+			err := iperf_read_json(ours, &params)
+			if(test.fails) {
+				if(err == nil) {
+					t.Fatalf("got %+v, want an error", params)
+				}
+				return
+			}
+			if(err != nil) {
+				t.Fatal(err)
+			}
+			if(params.Parallel != test.want) {
+				t.Fatalf("parallel %d, want %d", params.Parallel, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,545 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * JSON Web Tokens from an OpenID Connect provider, as well as or
+ * instead of static tokens, so that access to gost can be handed out
+ * and taken away where the rest of an organisation's access is.  With
+ * -jwt-issuer, gost finds the issuer's signing keys through its
+ * discovery document, or takes them from -jwt-jwks, and a bearer token
+ * that's a JWT signed by one of them, unexpired, from that issuer and,
+ * with -jwt-audience, for that audience, is accepted on the admin API,
+ * and with -jwt-tests on the test endpoints too.  RSA and ECDSA
+ * signatures are checked; HMAC and unsigned tokens never are.
+ *
+ * The config file's "jwt" "grants" decide what a token's claims allow.
+ * Each grant matches a claim, by a dotted path into the token's claims
+ * such as "realm_access.roles", having a value, or being in a list of
+ * them; a grant without a claim matches every token.  A token may use
+ * the admin API if a grant it matches says "admin", and may run tests
+ * up to the largest "max_test_bytes" of its grants, or any size if one
+ * of them has none.  With grants configured, a token that matches none
+ * of them gets nowhere; without any, a valid token may do anything.
+ */
+const (
+	jwt_leeway         = time.Minute
+	jwks_refresh       = time.Hour
+	jwks_min_refresh   = time.Minute
+	jwks_fetch_timeout = 10 * time.Second
+)
+
+type jwt_grant struct {
+	claim     string
+	value     string
+	admin     bool
+	max_bytes int64
+}
+
+/*
+ * The issuer's keys by ID, where they came from, and when.  fetching
+ * is closed once the fetch under way, if any, is done.
+ */
+var jwks_cache = struct {
+	sync.Mutex
+	source   string
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	tried    time.Time
+	fetching chan struct{}
+}{}
+
+type jwt_header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (c *configuration) jwt_enabled() bool {
+	return c.jwt_issuer != "" || c.jwt_jwks_url != ""
+}
+
+/*
+ * Decode one of a JWT's base64url parts.
+ */
+func jwt_segment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+/*
+ * Turn a JWK into a public key.
+ */
+func (k jwk) public_key() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := jwt_segment(k.N)
+		if(err != nil) {
+			return nil, err
+		}
+		e, err := jwt_segment(k.E)
+		if(err != nil || len(e) == 0 || len(e) > 4) {
+			return nil, errors.New("bad RSA exponent")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent << 8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+	case "EC":
+		curve := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+		if(curve == nil) {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := jwt_segment(k.X)
+		if(err != nil) {
+			return nil, err
+		}
+		y, err := jwt_segment(k.Y)
+		if(err != nil) {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if(!curve.IsOnCurve(key.X, key.Y)) {
+			return nil, errors.New("EC key isn't on its curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+/*
+ * GET a JSON document.
+ */
+func fetch_json(target string, into any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), jwks_fetch_timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if(err != nil) {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if(err != nil) {
+		return err
+	}
+	defer res.Body.Close()
+	if(res.StatusCode != 200) {
+		return fmt.Errorf("%s: %s", target, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1 << 20)).Decode(into)
+}
+
+/*
+ * Fetch the signing keys: from the JWKS URL if there is one, otherwise
+ * from wherever the issuer's discovery document says they are.
+ */
+func fetch_jwks(c *configuration) (map[string]crypto.PublicKey, error) {
+	source := c.jwt_jwks_url
+	if(source == "") {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		err := fetch_json(strings.TrimSuffix(c.jwt_issuer, "/") + "/.well-known/openid-configuration", &discovery)
+		if(err != nil) {
+			return nil, err
+		}
+		if(discovery.JWKSURI == "") {
+			return nil, errors.New("the issuer's discovery document has no jwks_uri")
+		}
+		source = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err := fetch_json(source, &set)
+	if(err != nil) {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if(k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := k.public_key()
+		if(err != nil) {
+			log_at(log_level_debug, "Skipping JWK %q from %s: %v", k.Kid, source, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if(len(keys) == 0) {
+		return nil, fmt.Errorf("%s has no signing keys gost can use", source)
+	}
+	return keys, nil
+}
+
+/*
+ * The key with ID kid, fetching the key set if it's stale or doesn't
+ * have it, though not more than once every jwks_min_refresh.  One
+ * fetch runs at a time, outside the lock: while it does, a key we
+ * already have is used as it is, and only a request for one we don't
+ * waits for it.  A fetch that fails keeps the keys we had.
+ */
+func jwks_key(c *configuration, kid string) (crypto.PublicKey, error) {
+	source := c.jwt_issuer + " " + c.jwt_jwks_url
+	jwks_cache.Lock()
+	now := time.Now()
+	if(jwks_cache.source != source) {
+		jwks_cache.source, jwks_cache.keys = source, nil
+		jwks_cache.fetched, jwks_cache.tried = time.Time{}, time.Time{}
+		jwks_cache.fetching = nil
+	}
+	key, found := jwks_cache.keys[kid]
+	stale := now.Sub(jwks_cache.fetched) > jwks_refresh
+	if((!found || stale) && jwks_cache.fetching == nil && now.Sub(jwks_cache.tried) >= jwks_min_refresh) {
+		jwks_cache.tried = now
+		jwks_cache.fetching = make(chan struct{})
+		go refresh_jwks(c, source, jwks_cache.fetching)
+	}
+	fetching := jwks_cache.fetching
+	jwks_cache.Unlock()
+
+	if(!found && fetching != nil) {
+		<-fetching
+		jwks_cache.Lock()
+		key, found = jwks_cache.keys[kid]
+		jwks_cache.Unlock()
+	}
+	if(!found) {
+		return nil, fmt.Errorf("no signing key %q", kid)
+	}
+	return key, nil
+}
+
+/*
+ * Fetch the key set from source into the cache, unless the issuer has
+ * changed meanwhile, and close done.
+ */
+func refresh_jwks(c *configuration, source string, done chan struct{}) {
+	keys, err := fetch_jwks(c)
+	jwks_cache.Lock()
+	if(jwks_cache.source == source) {
+		if(err != nil) {
+			log_at(log_level_error, "Can't fetch the JWT signing keys: %v", err)
+		} else {
+			jwks_cache.keys, jwks_cache.fetched = keys, time.Now()
+		}
+	}
+	if(jwks_cache.fetching == done) {
+		jwks_cache.fetching = nil
+	}
+	jwks_cache.Unlock()
+	close(done)
+}
+
+/*
+ * Check a JWT's signature and its registered claims, and return its
+ * claims.
+ */
+func verify_jwt(c *configuration, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if(len(parts) != 3) {
+		return nil, errors.New("not a JWT")
+	}
+	head, err := jwt_segment(parts[0])
+	if(err != nil) {
+		return nil, errors.New("bad JWT header")
+	}
+	var header jwt_header
+	err = json.Unmarshal(head, &header)
+	if(err != nil) {
+		return nil, errors.New("bad JWT header")
+	}
+	signature, err := jwt_segment(parts[2])
+	if(err != nil) {
+		return nil, errors.New("bad JWT signature")
+	}
+
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[strings.TrimLeft(header.Alg, "RSPE")]
+	family := strings.TrimRight(header.Alg, "0123456789")
+	if(hash == 0 || (family != "RS" && family != "PS" && family != "ES")) {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", header.Alg)
+	}
+	key, err := jwks_key(c, header.Kid)
+	if(err != nil) {
+		return nil, err
+	}
+	h := hash.New()
+	io.WriteString(h, parts[0] + "." + parts[1])
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if(family == "RS") {
+			err = rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		} else if(family == "PS") {
+			err = rsa.VerifyPSS(k, hash, digest, signature, nil)
+		} else {
+			err = errors.New("an ECDSA algorithm with an RSA key")
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if(family != "ES" || len(signature) != 2 * size) {
+			err = errors.New("bad ECDSA signature")
+		} else if(!ecdsa.Verify(k, digest, new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:]))) {
+			err = errors.New("bad signature")
+		}
+	default:
+		err = errors.New("unusable key")
+	}
+	if(err != nil) {
+		return nil, fmt.Errorf("JWT signature: %v", err)
+	}
+
+	body, err := jwt_segment(parts[1])
+	if(err != nil) {
+		return nil, errors.New("bad JWT claims")
+	}
+	var claims map[string]any
+	err = json.Unmarshal(body, &claims)
+	if(err != nil) {
+		return nil, errors.New("bad JWT claims")
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if(!ok || now.After(time.Unix(int64(exp), 0).Add(jwt_leeway))) {
+		return nil, errors.New("JWT expired")
+	}
+	nbf, ok := claims["nbf"].(float64)
+	if(ok && now.Add(jwt_leeway).Before(time.Unix(int64(nbf), 0))) {
+		return nil, errors.New("JWT not valid yet")
+	}
+	if(c.jwt_issuer != "" && strings.TrimSuffix(fmt.Sprint(claims["iss"]), "/") != strings.TrimSuffix(c.jwt_issuer, "/")) {
+		return nil, errors.New("JWT from another issuer")
+	}
+	if(c.jwt_audience != "" && !claim_has(claims["aud"], c.jwt_audience)) {
+		return nil, errors.New("JWT for another audience")
+	}
+	return claims, nil
+}
+
+/*
+ * Is want the claim's value, or one of its values?
+ */
+func claim_has(claim any, want string) bool {
+	switch v := claim.(type) {
+	case []any:
+		for _, item := range v {
+			if(claim_has(item, want)) {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	case string:
+		return v == want
+	}
+	return fmt.Sprint(claim) == want
+}
+
+/*
+ * The claim at a dotted path, or nil.
+ */
+func claim_at(claims map[string]any, path string) any {
+	var v any = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if(!ok) {
+			return nil
+		}
+		v = m[name]
+	}
+	return v
+}
+
+/*
+ * What a token's claims allow: whether it matched anything at all, the
+ * admin API, and the largest test, zero for any.
+ */
+type jwt_access struct {
+	any       bool
+	admin     bool
+	max_bytes int64
+}
+
+func (c *configuration) jwt_access(claims map[string]any) jwt_access {
+	if(len(c.jwt_grants) == 0) {
+		return jwt_access{any: true, admin: true}
+	}
+	var a jwt_access
+	unlimited := false
+	for _, g := range c.jwt_grants {
+		if(g.claim != "" && !claim_has(claim_at(claims, g.claim), g.value)) {
+			continue
+		}
+		a.any = true
+		a.admin = a.admin || g.admin
+		if(g.max_bytes == 0) {
+			unlimited = true
+		}
+		a.max_bytes = max(a.max_bytes, g.max_bytes)
+	}
+	if(unlimited) {
+		a.max_bytes = 0
+	}
+	return a
+}
+
+/*
+ * A request's JWT as checked once, so the handlers after require_auth()
+ * and require_admin() don't check it again.
+ */
+type jwt_checked struct {
+	claims map[string]any
+	err    error
+}
+
+type jwt_checked_key struct{}
+
+/*
+ * Check req's JWT, if JWTs are on, and hang what came of it on req.
+ */
+func with_request_jwt(req *http.Request) *http.Request {
+	if(!settings().jwt_enabled() || req.Context().Value(jwt_checked_key{}) != nil) {
+		return req
+	}
+	claims, err := check_request_jwt(req)
+	return req.WithContext(context.WithValue(req.Context(), jwt_checked_key{}, &jwt_checked{claims, err}))
+}
+
+/*
+ * The verified claims of the request's bearer token, nil if JWTs are
+ * off or the token isn't one, or why it's no good.
+ */
+func request_jwt(req *http.Request) (map[string]any, error) {
+	checked, ok := req.Context().Value(jwt_checked_key{}).(*jwt_checked)
+	if(ok) {
+		return checked.claims, checked.err
+	}
+	return check_request_jwt(req)
+}
+
+func check_request_jwt(req *http.Request) (map[string]any, error) {
+	c := settings()
+	header := req.Header.Get("Authorization")
+	if(!c.jwt_enabled() || len(header) < 7 || !strings.EqualFold(header[:7], "bearer ")) {
+		return nil, nil
+	}
+	token := strings.TrimSpace(header[7:])
+	if(strings.Count(token, ".") != 2) {
+		return nil, nil
+	}
+	return verify_jwt(c, token)
+}
+
+/*
+ * The most bytes the request's JWT lets one of its tests move, zero
+ * for no limit beyond the server's.
+ */
+func jwt_test_limit(req *http.Request) int64 {
+	claims, _ := request_jwt(req)
+	if(claims == nil) {
+		return 0
+	}
+	return settings().jwt_access(claims).max_bytes
+}
+
+/*
+ * Fails reads or writes once a test has moved as much as its token
+ * allows.
+ */
+var jwt_err_limit = errors.New("test is larger than the token allows")
+
+type jwt_limited struct {
+	moved *atomic.Int64
+	limit int64
+}
+
+func (l jwt_limited) room(n int) (int, error) {
+	left := l.limit - l.moved.Load()
+	if(left <= 0) {
+		return 0, jwt_err_limit
+	}
+	return int(min(int64(n), left)), nil
+}
+
+type jwt_limited_writer struct {
+	w io.Writer
+	jwt_limited
+}
+
+func (l jwt_limited_writer) Write(b []byte) (int, error) {
+	n, err := l.room(len(b))
+	if(err != nil) {
+		return 0, err
+	}
+	m, err := l.w.Write(b[:n])
+	if(err == nil && n < len(b)) {
+		err = jwt_err_limit
+	}
+	return m, err
+}
+
+/*
+ * Wrap w so that it stops at limit, counting what it writes into
+ * moved: for tests of several transfers that share one allowance.  A
+ * limit of zero leaves w be.
+ */
+func jwt_limit_writer(w io.Writer, moved *atomic.Int64, limit int64) io.Writer {
+	if(limit <= 0) {
+		return w
+	}
+	return tally_writer{jwt_limited_writer{w, jwt_limited{moved, limit}}, moved}
+}
+
+func jwt_limit_reader(r io.Reader, moved *atomic.Int64, limit int64) io.Reader {
+	if(limit <= 0) {
+		return r
+	}
+	return tally_reader{jwt_limited_reader{r, jwt_limited{moved, limit}}, moved}
+}
+
+type jwt_limited_reader struct {
+	r io.Reader
+	jwt_limited
+}
+
+func (l jwt_limited_reader) Read(b []byte) (int, error) {
+	n, err := l.room(len(b))
+	if(err != nil) {
+		return 0, err
+	}
+	return l.r.Read(b[:n])
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+ * A JWT with header and claims, signed with key by SHA-256 as the
+ * header's alg says, or not at all if key is nil.
+ */
+func sign_jwt(t *testing.T, header map[string]any, claims map[string]any, key crypto.Signer) string {
+	head, _ := json.Marshal(header)
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(head) + "." + base64.RawURLEncoding.EncodeToString(body)
+	if(key == nil) {
+		return signed + "."
+	}
+
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+	sum := digest.Sum(nil)
+
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if(header["alg"] == "PS256") {
+			signature, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, sum, nil)
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, e := ecdsa.Sign(rand.Reader, k, sum)
+		err = e
+		if(err == nil) {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyJWT(t *testing.T) {
+	rsa_key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	other_key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	ec_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if(err != nil) {
+		t.Fatal(err)
+	}
+
+	c := &configuration{jwt_issuer: "https://issuer.example/", jwt_audience: "gost"}
+	jwks_cache.Lock()
+	jwks_cache.source = c.jwt_issuer + " " + c.jwt_jwks_url
+	jwks_cache.keys = map[string]crypto.PublicKey{"rsa": &rsa_key.PublicKey, "ec": &ec_key.PublicKey}
+	jwks_cache.fetched = time.Now()
+	jwks_cache.tried = time.Now()
+	jwks_cache.Unlock()
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]any) map[string]any {
+		claims := map[string]any{"iss": "https://issuer.example", "aud": "gost", "exp": now + 3600, "sub": "someone"}
+		for name, value := range changes {
+			if(value == nil) {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+	rs256 := map[string]any{"alg": "RS256", "kid": "rsa"}
+
+	tests := []struct {
+		name  string
+		token string
+		fails string
+	}{
+		{"RS256", sign_jwt(t, rs256, claims(nil), rsa_key), ""},
+		{"PS256", sign_jwt(t, map[string]any{"alg": "PS256", "kid": "rsa"}, claims(nil), rsa_key), ""},
+		{"ES256", sign_jwt(t, map[string]any{"alg": "ES256", "kid": "ec"}, claims(nil), ec_key), ""},
+		{"audience in a list", sign_jwt(t, rs256, claims(map[string]any{"aud": []string{"other", "gost"}}), rsa_key), ""},
+		{"expired within the leeway", sign_jwt(t, rs256, claims(map[string]any{"exp": now - 30}), rsa_key), ""},
+
+		{"alg none", sign_jwt(t, map[string]any{"alg": "none", "kid": "rsa"}, claims(nil), nil), "unsupported JWT algorithm"},
+		{"alg HS256", sign_jwt(t, map[string]any{"alg": "HS256", "kid": "rsa"}, claims(nil), rsa_key), "unsupported JWT algorithm"},
+		{"alg missing", sign_jwt(t, map[string]any{"kid": "rsa"}, claims(nil), rsa_key), "unsupported JWT algorithm"},
+		{"ES256 with an RSA key", sign_jwt(t, map[string]any{"alg": "ES256", "kid": "rsa"}, claims(nil), ec_key), "ECDSA algorithm with an RSA key"},
+		{"RS256 with an EC key", sign_jwt(t, map[string]any{"alg": "RS256", "kid": "ec"}, claims(nil), rsa_key), "bad ECDSA signature"},
+		{"signed by another key", sign_jwt(t, rs256, claims(nil), other_key), "JWT signature"},
+		{"unknown key", sign_jwt(t, map[string]any{"alg": "RS256", "kid": "nobody"}, claims(nil), rsa_key), "no signing key"},
+
+		{"expired", sign_jwt(t, rs256, claims(map[string]any{"exp": now - 3600}), rsa_key), "JWT expired"},
+		{"no expiry", sign_jwt(t, rs256, claims(map[string]any{"exp": nil}), rsa_key), "JWT expired"},
+		{"not valid yet", sign_jwt(t, rs256, claims(map[string]any{"nbf": now + 3600}), rsa_key), "not valid yet"},
+		{"another issuer", sign_jwt(t, rs256, claims(map[string]any{"iss": "https://evil.example"}), rsa_key), "another issuer"},
+		{"another audience", sign_jwt(t, rs256, claims(map[string]any{"aud": "someone-else"}), rsa_key), "another audience"},
+		{"no audience", sign_jwt(t, rs256, claims(map[string]any{"aud": nil}), rsa_key), "another audience"},
+
+		{"two parts", "eyJhbGciOiJSUzI1NiJ9.e30", "not a JWT"},
+		{"bad header", "!!!.e30.AAAA", "bad JWT header"},
+		{"bad signature encoding", strings.TrimSuffix(sign_jwt(t, rs256, claims(nil), nil), ".") + ".!!!", "bad JWT signature"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := verify_jwt(c, test.token)
+			if(test.fails == "") {
+				if(err != nil) {
+					t.Fatalf("rejected: %v", err)
+				}
+				return
+			}
+			if(err == nil) {
+				t.Fatalf("accepted, want an error about %q", test.fails)
+			}
+			if(!strings.Contains(err.Error(), test.fails)) {
+				t.Fatalf("error %q, want one about %q", err, test.fails)
+			}
+		})
+	}
+}
+
+/*
+ * A key we have is used while the key set is refetched, and however
+ * many ask for one we don't, only one fetch goes out.
+ */
+func TestJWKSKeyFetchesOnce(t *testing.T) {
+	old_key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	new_key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if(err != nil) {
+		t.Fatal(err)
+	}
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fetches.Add(1)
+		<-release
+		json.NewEncoder(res).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "new",
+			"n":   base64.RawURLEncoding.EncodeToString(new_key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(new_key.E)).Bytes()),
+		}}})
+	}))
+	defer srv.Close()
+
+	c := &configuration{jwt_issuer: "https://issuer.example/", jwt_jwks_url: srv.URL}
+	jwks_cache.Lock()
+	jwks_cache.source = c.jwt_issuer + " " + c.jwt_jwks_url
+	jwks_cache.keys = map[string]crypto.PublicKey{"old": &old_key.PublicKey}
+	jwks_cache.fetched = time.Now().Add(-2 * jwks_refresh)
+	jwks_cache.tried = time.Time{}
+	jwks_cache.fetching = nil
+	jwks_cache.Unlock()
+
+	// Stale, so this starts a fetch, but doesn't wait for it.
+	key, err := jwks_key(c, "old")
+	if(err != nil || key != &old_key.PublicKey) {
+		t.Fatalf("got %v, %v; want the old key", key, err)
+	}
+
+	var wg sync.WaitGroup
+	got := make([]crypto.PublicKey, 10)
+	for i := range got {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got[i], _ = jwks_key(c, "new")
+		}()
+	}
+	for fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	key, err = jwks_key(c, "old")
+	if(err != nil || key != &old_key.PublicKey) {
+		t.Fatalf("during the fetch got %v, %v; want the old key", key, err)
+	}
+
+	close(release)
+	wg.Wait()
+	for i, key := range got {
+		k, ok := key.(*rsa.PublicKey)
+		if(!ok || !k.Equal(&new_key.PublicKey)) {
+			t.Fatalf("waiter %d got %v, want the new key", i, key)
+		}
+	}
+	if(fetches.Load() != 1) {
+		t.Fatalf("%d fetches, want 1", fetches.Load())
+	}
+}
+
+/*
+ * Once require_auth() or require_admin() has checked a JWT, the
+ * handlers after them get its claims without checking it again.
+ */
+func TestRequestJWTCheckedOnce(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	c := defaults
+	c.jwt_issuer = "https://issuer.example/"
+	c.jwt_audience = "gost"
+	live_config.Store(&c)
+	defer live_config.Store(nil)
+
+	jwks_cache.Lock()
+	jwks_cache.source = c.jwt_issuer + " " + c.jwt_jwks_url
+	jwks_cache.keys = map[string]crypto.PublicKey{"rsa": &key.PublicKey}
+	jwks_cache.fetched = time.Now()
+	jwks_cache.tried = time.Now()
+	jwks_cache.fetching = nil
+	jwks_cache.Unlock()
+
+	token := sign_jwt(t, map[string]any{"alg": "RS256", "kid": "rsa"},
+		map[string]any{"iss": c.jwt_issuer, "aud": "gost", "exp": time.Now().Unix() + 3600, "sub": "someone"}, key)
+	req := httptest.NewRequest("GET", "/down", nil)
+	req.Header.Set("Authorization", "Bearer " + token)
+	req = with_request_jwt(req)
+
+	// With the key gone, checking again would fail.
+	jwks_cache.Lock()
+	jwks_cache.keys = nil
+	jwks_cache.Unlock()
+
+	claims, err := request_jwt(req)
+	if(err != nil || claims["sub"] != "someone") {
+		t.Fatalf("got %v, %v; want the claims checked before", claims, err)
+	}
+}
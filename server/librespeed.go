@@ -0,0 +1,134 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * The LibreSpeed backend protocol, so its stock web client and CLI can
+ * use gost as a server.  LibreSpeed measures download in chunks of one
+ * mebibyte and asks for ckSize of them.
+ */
+const librespeed_prefix = "/librespeed/"
+const librespeed_chunk = 1024 * 1024
+const librespeed_default_chunks = 4
+const librespeed_max_chunks = 1024
+
+/*
+ * Headers every LibreSpeed backend response carries.  The client asks
+ * for cross-origin access by adding ?cors to the URL.
+ */
+func librespeed_headers(res http.ResponseWriter, req *http.Request) {
+	h := res.Header()
+	h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0, s-maxage=0")
+	h.Set("Pragma", "no-cache")
+
+	_, cors := req.URL.Query()["cors"]
+	if(cors) {
+		h.Set("Access-Control-Allow-Origin", "*")
+		h.Set("Access-Control-Allow-Methods", "GET, POST")
+		h.Set("Access-Control-Allow-Headers", "Content-Encoding, Content-Type")
+	}
+}
+
+/*
+ * Dispatch /librespeed/* requests.
+ */
+func route_librespeed(res http.ResponseWriter, req *http.Request) {
+	librespeed_headers(res, req)
+
+	if(req.Method == "OPTIONS") {
+		return
+	}
+
+	switch strings.TrimPrefix(req.URL.Path, librespeed_prefix) {
+	case "garbage.php":
+		librespeed_garbage(res, req)
+	case "empty.php":
+		librespeed_empty(res, req)
+	case "getIP.php":
+		librespeed_get_ip(res, req)
+	default:
+		res.WriteHeader(404)
+		io.WriteString(res, "Not Found")
+	}
+}
+
+/*
+ * Download: ckSize mebibytes of random data.
+ */
+func librespeed_garbage(res http.ResponseWriter, req *http.Request) {
+	chunks := int64(librespeed_default_chunks)
+	value := req.URL.Query().Get("ckSize")
+	if(value != "") {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if(err != nil || n < 1) {
+			res.WriteHeader(400) // Bad Request
+			io.WriteString(res, "Bad ckSize")
+			return
+		}
+		chunks = min(n, librespeed_max_chunks)
+	}
+
+	n := min(chunks * librespeed_chunk, request_settings(req).max_test_bytes)
+
+	test := begin_test(res, req, "down", n)
+	if(test == nil) {
+		return
+	}
+
+	write_payload_headers(res, n)
+	h := res.Header()
+	h.Set("Content-Description", "File Transfer")
+	h.Set("Content-Disposition", "attachment; filename=random.dat")
+	h.Set("Content-Transfer-Encoding", "binary")
+
+	written, err := write_payload(test.writer(res), n)
+	test.end(written, err)
+}
+
+/*
+ * Upload sink, and ping target when fetched with GET.
+ */
+func librespeed_empty(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Connection", "keep-alive")
+
+	if(req.Method != "POST") {
+		return
+	}
+
+	test := begin_test(res, req, "up", req.ContentLength)
+	if(test == nil) {
+		return
+	}
+	slow := watch_upload_rate(res, &test.moved)
+	n, err := drain_body(test.reader(upload_body(res, req)))
+	if(slow()) {
+		err = upload_too_slow
+	}
+	connection_of(req).uploaded.Add(n)
+	test.end(n, err)
+}
+
+/*
+ * The client's address, as JSON when ISP details are requested and as
+ * plain text otherwise.  gost has no ISP database, so rawIspInfo is
+ * always empty.
+ */
+func librespeed_get_ip(res http.ResponseWriter, req *http.Request) {
+	ip := client_ip(req)
+
+	if(req.URL.Query().Get("isp") == "") {
+		res.Header().Set("Content-Type", "text/plain")
+		io.WriteString(res, ip)
+		return
+	}
+
+	write_json(res, 200, map[string]string{
+		"processedString": ip,
+		"rawIspInfo":      "",
+	})
+}
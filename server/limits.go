@@ -0,0 +1,147 @@
+package server
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Admission control for bandwidth tests.  A handful of clients can
+ * otherwise saturate the box and starve the health checks, so new
+ * tests are turned away with 429 when too many are already running or
+ * when the aggregate rate across all of them is over the limit.
+ */
+
+/*
+ * Every payload byte moved by any test, for the aggregate rate meter.
+ */
+var payload_bytes_moved atomic.Int64
+
+/*
+ * The aggregate rate is sampled every rate_sample and averaged over
+ * the last rate_window.
+ */
+const rate_sample = 250 * time.Millisecond
+const rate_window = 4
+
+var rate_meter struct {
+	once    sync.Once
+	bits    atomic.Uint64 // float64 bits per second
+	samples [rate_window]int64
+	next    int
+}
+
+/*
+ * Start sampling the aggregate rate, if we haven't already.
+ */
+func start_rate_meter() {
+	rate_meter.once.Do(func() {
+		go func() {
+			ticker := time.NewTicker(rate_sample)
+			for range ticker.C {
+				now := payload_bytes_moved.Load()
+				oldest := rate_meter.samples[rate_meter.next]
+				rate_meter.samples[rate_meter.next] = now
+				rate_meter.next = (rate_meter.next + 1) % rate_window
+
+				span := rate_sample * rate_window
+				bps := float64(now - oldest) * 8 / span.Seconds()
+				rate_meter.bits.Store(math.Float64bits(bps))
+			}
+		}()
+	})
+}
+
+/*
+ * Aggregate test throughput over the last second, in bits per second.
+ */
+func aggregate_rate() float64 {
+	return math.Float64frombits(rate_meter.bits.Load())
+}
+
+/*
+ * Turn a test away: with 503 when tests are closed for maintenance or
+ * outside their windows, or else with 429.
+ */
+func refuse_test(res http.ResponseWriter, retry_after time.Duration, reason string) {
+	res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry_after.Seconds()))))
+	set_error_code(res, strings.ReplaceAll(reason, " ", "_"))
+	if(reason == "maintenance" || reason == "test_window") {
+		res.WriteHeader(503) // Service Unavailable
+		io.WriteString(res, "Service Unavailable: " + reason)
+		return
+	}
+	res.WriteHeader(429) // Too Many Requests
+	io.WriteString(res, "Too Many Requests: " + reason)
+}
+
+/*
+ * Reserve a slot for a test from client, for tenant if it's one's, on
+ * virtual host vhost if it's one's, or write a 429 and report false.  A
+ * slot that's granted must be given back with track_end().
+ */
+func admit_test(res http.ResponseWriter, client string, tenant string, vhost string) bool {
+	reason, retry_after := reserve_test(client, tenant, vhost)
+	if(reason != "") {
+		refuse_test(res, retry_after, reason)
+		return false
+	}
+	return true
+}
+
+/*
+ * Reserve a slot for a test from client, or say why not and when to
+ * try again.  admit_test() is the HTTP flavour of this.
+ */
+func reserve_test(client string, tenant string, vhost string) (string, time.Duration) {
+	c := settings()
+
+	closed, retry_after := tests_closed(time.Now())
+	if(closed != "") {
+		metric_tests_refused.add(closed, 1)
+		return closed, retry_after
+	}
+
+	if(c.max_aggregate_bps > 0 && aggregate_rate() >= float64(c.max_aggregate_bps)) {
+		metric_tests_refused.add("bandwidth", 1)
+		return "bandwidth", time.Second
+	}
+
+	reason, retry_after := reserve_client(client)
+	if(reason != "") {
+		return reason, retry_after
+	}
+	reason, retry_after = reserve_tenant(tenant)
+	if(reason != "") {
+		release_client(client, 0)
+		return reason, retry_after
+	}
+	reason, retry_after = reserve_vhost(vhost)
+	if(reason != "") {
+		release_client(client, 0)
+		release_tenant(tenant, 0)
+		return reason, retry_after
+	}
+
+	for {
+		active := test_tracker.active.Load()
+		if(c.max_active_tests > 0 && active >= int64(c.max_active_tests)) {
+			release_client(client, 0)
+			release_tenant(tenant, 0)
+			release_vhost(vhost, 0)
+			metric_tests_refused.add("concurrency", 1)
+			return "concurrency", 5 * time.Second
+		}
+		if(test_tracker.active.CompareAndSwap(active, active + 1)) {
+			break
+		}
+	}
+	test_tracker.running.Add(1)
+	return "", 0
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"math"
+	"testing"
+)
+
+/*
+ * A step in a run of admissions: reserve a test for client, expecting
+ * want as the reason it's refused, give one back having moved bytes,
+ * or charge bytes moved after it was given back.
+ */
+type admission struct {
+	op     string
+	client string
+	bytes  int64
+	want   string
+}
+
+/*
+ * Put c in force for admitting tests, with nothing running, no client
+ * having used anything and the aggregate rate at bps, and put things
+ * back afterwards.
+ */
+func admitting(t *testing.T, c configuration, bps float64) {
+	live_config.Store(&c)
+	test_tracker.active.Store(0)
+	rate_meter.bits.Store(math.Float64bits(bps))
+	client_quotas.Lock()
+	client_quotas.byip = map[string]*client_usage{}
+	client_quotas.Unlock()
+	t.Cleanup(func() {
+		live_config.Store(nil)
+		test_tracker.active.Store(0)
+		rate_meter.bits.Store(0)
+	})
+}
+
+/*
+ * Take the steps in order, failing at the first that doesn't go as it
+ * should.
+ */
+func run_admissions(t *testing.T, steps []admission) {
+	for i, step := range steps {
+		switch step.op {
+		case "reserve":
+			reason, retry_after := reserve_test(step.client, "", "")
+			if(reason != step.want) {
+				t.Fatalf("step %d: reserving for %s got %q, want %q", i + 1, step.client, reason, step.want)
+			}
+			if(reason != "" && retry_after <= 0) {
+				t.Fatalf("step %d: refused with no retry time", i + 1)
+			}
+			if(reason == "") {
+				test_tracker.running.Done()
+			}
+		case "release":
+			release_test(step.client, "", "", step.bytes)
+		case "charge":
+			charge_test(step.client, "", "", step.bytes)
+		}
+	}
+}
+
+func TestReserveTest(t *testing.T) {
+	reserve := func(client string, want string) admission {
+		return admission{op: "reserve", client: client, want: want}
+	}
+	release := func(client string) admission {
+		return admission{op: "release", client: client}
+	}
+
+	tests := []struct {
+		name       string
+		max_active int
+		ip_active  int
+		max_rate   int64
+		rate       float64
+		steps      []admission
+	}{
+		{"no limits", 0, 0, 0, 0, []admission{
+			reserve("192.0.2.1", ""), reserve("192.0.2.1", ""), reserve("192.0.2.2", ""),
+		}},
+		{"up to the limit", 2, 0, 0, 0, []admission{
+			reserve("192.0.2.1", ""), reserve("192.0.2.2", ""),
+		}},
+		{"over the limit", 2, 0, 0, 0, []admission{
+			reserve("192.0.2.1", ""), reserve("192.0.2.2", ""), reserve("192.0.2.3", "concurrency"),
+		}},
+		{"a slot given back", 1, 0, 0, 0, []admission{
+			reserve("192.0.2.1", ""), reserve("192.0.2.2", "concurrency"), release("192.0.2.1"), reserve("192.0.2.2", ""),
+		}},
+		{"a refusal gives back the client's slot", 1, 1, 0, 0, []admission{
+			reserve("192.0.2.1", ""), reserve("192.0.2.2", "concurrency"), release("192.0.2.1"),
+			reserve("192.0.2.2", ""),
+		}},
+		{"under the aggregate rate", 0, 0, 1000000, 999999, []admission{
+			reserve("192.0.2.1", ""),
+		}},
+		{"at the aggregate rate", 0, 0, 1000000, 1000000, []admission{
+			reserve("192.0.2.1", "bandwidth"),
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := defaults
+			c.max_active_tests = test.max_active
+			c.ip_max_active = test.ip_active
+			c.max_aggregate_bps = test.max_rate
+			admitting(t, c, test.rate)
+			run_admissions(t, test.steps)
+		})
+	}
+}
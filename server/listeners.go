@@ -0,0 +1,390 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+/*
+ * One HTTP listener: where it binds, whether it speaks TLS, and the
+ * rest of what can differ between listeners.  HTTP/2 means h2 over TLS
+ * and h2c without it.  A listener binds either a TCP address or a unix
+ * socket, created with the given mode.  DSCP marks what it sends, as
+ * parse_dscp() takes it, and sndbuf and rcvbuf size its sockets'
+ * buffers, zero leaving them to the kernel.  Nagle turns Nagle's
+ * algorithm back on.  Family is "dual", or empty,
+ * for one socket taking IPv4 and IPv6 on a wildcard address, or "ipv4"
+ * or "ipv6" for just the one.
+ */
+type listener_spec struct {
+	name       string
+	address    string
+	unix       string
+	mode       os.FileMode
+	tls        bool
+	http2      bool
+	congestion string
+	dscp       string
+	family     string
+	sndbuf     int
+	rcvbuf     int
+	nagle      bool
+}
+
+/*
+ * The address families a listener can bind, and the network each
+ * takes.  An IPv6 socket for "ipv6" is IPv6 only, so an IPv4 listener
+ * can share its port.
+ */
+var listen_families = map[string]string{
+	"":     "tcp",
+	"dual": "tcp",
+	"ipv4": "tcp4",
+	"ipv6": "tcp6",
+}
+
+/*
+ * Where the listener binds, for messages and to tell listeners apart.
+ */
+func (s listener_spec) where() string {
+	if(s.unix != "") {
+		return "unix:" + s.unix
+	}
+	return s.address
+}
+
+/*
+ * What the listener takes up, to find two that clash: its address for
+ * each family it binds, so that an IPv4 and an IPv6 listener can share
+ * a port but neither can share one with a dual-stack listener.
+ */
+func (s listener_spec) binds() []string {
+	switch {
+	case s.unix != "":
+		return []string{s.where()}
+	case s.family == "ipv4" || s.family == "ipv6":
+		return []string{s.address + " " + s.family}
+	}
+	return []string{s.address + " ipv4", s.address + " ipv6"}
+}
+
+func (s listener_spec) scheme() string {
+	if(s.tls) {
+		return "https"
+	}
+	return "http"
+}
+
+/*
+ * Protocols the listener speaks, offered via ALPN over TLS.
+ */
+func (s listener_spec) protocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	if(s.tls) {
+		p.SetHTTP2(s.http2)
+	} else {
+		p.SetUnencryptedHTTP2(s.http2)
+	}
+	return p
+}
+
+/*
+ * Make sure a listener is something we can start.
+ */
+func (s listener_spec) validate() error {
+	if(s.name == "") {
+		return fmt.Errorf("listener on %s needs a name", s.where())
+	}
+
+	if(s.unix != "") {
+		if(s.address != "") {
+			return fmt.Errorf("listener %s can't have both an address and a unix socket", s.name)
+		}
+		if(s.congestion != "") {
+			return fmt.Errorf("listener %s: unix sockets have no congestion control", s.name)
+		}
+		if(s.dscp != "") {
+			return fmt.Errorf("listener %s: unix sockets have no DSCP", s.name)
+		}
+		if(s.sndbuf != 0 || s.rcvbuf != 0 || s.nagle) {
+			return fmt.Errorf("listener %s: unix sockets aren't tuned", s.name)
+		}
+		if(s.family != "") {
+			return fmt.Errorf("listener %s: unix sockets have no address family", s.name)
+		}
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(s.address)
+	if(err != nil) {
+		return fmt.Errorf("listener %s: %v", s.name, err)
+	}
+	_, known := listen_families[s.family]
+	if(!known) {
+		return fmt.Errorf("listener %s: family must be dual, ipv4 or ipv6, not %q", s.name, s.family)
+	}
+	ip := net.ParseIP(host)
+	if(ip != nil && s.family == "ipv4" && ip.To4() == nil) {
+		return fmt.Errorf("listener %s: %s is not an IPv4 address", s.name, host)
+	}
+	if(ip != nil && s.family == "ipv6" && ip.To4() != nil) {
+		return fmt.Errorf("listener %s: %s is not an IPv6 address", s.name, host)
+	}
+	n, err := strconv.Atoi(port)
+	if(err != nil || n < 1 || n > 65535) {
+		return fmt.Errorf("invalid %s port %q", s.name, port)
+	}
+
+	err = check_congestion(s.congestion)
+	if(err != nil) {
+		return fmt.Errorf("listener %s: congestion control %q: %v", s.name, s.congestion, err)
+	}
+	err = check_dscp(s.dscp)
+	if(err != nil) {
+		return fmt.Errorf("listener %s: %v", s.name, err)
+	}
+	if(s.sndbuf < 0 || s.rcvbuf < 0) {
+		return fmt.Errorf("listener %s: buffer sizes must not be negative", s.name)
+	}
+	return nil
+}
+
+/*
+ * A listener that's bound, and the server answering on it.  Under
+ * -acceptors, extra holds the sockets sharing its address.
+ */
+type managed_listener struct {
+	spec     listener_spec
+	server   *http.Server
+	listener net.Listener
+	extra    []net.Listener
+	health   *listener_health
+	proxied  bool
+}
+
+/*
+ * A set of HTTP listeners, started together and stopped together, and
+ * the routes they all serve.  Connections to proxied ones start with a
+ * PROXY header under -proxy-protocol.
+ */
+type listener_manager struct {
+	mu        sync.Mutex
+	mux       *http.ServeMux
+	proxied   bool
+	listeners []*managed_listener
+}
+
+var http_listeners = &listener_manager{mux: http.NewServeMux(), proxied: true}
+
+/*
+ * Bind a listener and get its server ready, without serving yet.
+ * TLS listeners use tls_config.
+ */
+func (m *listener_manager) add(spec listener_spec, tls_config *tls.Config) (*managed_listener, error) {
+	c := settings()
+	var listener net.Listener
+	var extra []net.Listener
+	var err error
+	switch {
+	case spec.unix != "" && !systemd_socket(spec.name):
+		listener, err = listen_unix(spec.unix, spec.mode)
+	case spec.unix == "" && c.acceptors > 1 && !systemd_socket(spec.name):
+		var listeners []net.Listener
+		listeners, err = listen_acceptors(listen_families[spec.family], spec.address, c.acceptors)
+		if(err == nil) {
+			listener, extra = listeners[0], listeners[1:]
+		}
+	default:
+		listener, err = listen_tcp(spec.name, listen_families[spec.family], spec.address)
+		if(err == nil) {
+			extra, err = listen_tcp_extra(spec.name)
+		}
+	}
+	if(err != nil) {
+		return nil, err
+	}
+	for _, socket := range append([]net.Listener{listener}, extra...) {
+		share_socket(spec.name, socket, false)
+	}
+
+	l := &managed_listener{
+		spec:     spec,
+		listener: listener,
+		extra:    extra,
+		server: &http.Server{
+			Addr:              spec.address,
+			Handler:           m.handler(spec),
+			Protocols:         spec.protocols(),
+			ConnState:         track_connections(spec.name),
+			ConnContext:       with_congestion(spec.name, spec.congestion, with_dscp(spec.name, spec.dscp, with_socket_tuning(spec, attach_conn_info))),
+			MaxHeaderBytes:    int(c.max_header_bytes),
+			ReadHeaderTimeout: c.read_header_timeout,
+			IdleTimeout:       c.idle_timeout,
+		},
+		health:  track_listener(spec.name, spec.scheme(), listener.Addr(), spec.family == "ipv6"),
+		proxied: m.proxied,
+	}
+	if(spec.tls) {
+		l.server.TLSConfig = timed_tls_config(tls_config, spec.protocols())
+	}
+
+	m.mu.Lock()
+	m.listeners = append(m.listeners, l)
+	m.mu.Unlock()
+	return l, nil
+}
+
+/*
+ * What serves spec's requests: the manager's routes, with the TLS ones
+ * pointing clients at HTTP/3 when it's on.
+ */
+func (m *listener_manager) handler(spec listener_spec) http.Handler {
+	if(spec.tls && m == http_listeners) {
+		return with_alt_svc(m.mux)
+	}
+	return m.mux
+}
+
+/*
+ * Serve on the listener, with an accept loop for each of its sockets,
+ * until it's shut down.  Anything else stopping it is fatal.
+ */
+func (l *managed_listener) go_serve(c *configuration) {
+	l.health.set_serving(true)
+	if(len(l.extra) > 0) {
+		log_at(log_level_info, "Listening on %s (%s) with %d acceptors", l.listener.Addr(), l.spec.name, len(l.extra) + 1)
+	} else {
+		log_at(log_level_info, "Listening on %s (%s)", l.listener.Addr(), l.spec.name)
+	}
+
+	for _, listener := range append([]net.Listener{l.listener}, l.extra...) {
+		go func() {
+			if(l.proxied) {
+				listener = proxy_listen(listener, c)
+			}
+			var err error
+			if(!l.spec.tls) {
+				err = l.server.Serve(listener)
+			} else {
+				err = l.server.ServeTLS(listener, "", "")
+			}
+
+			l.health.set_serving(false)
+			if(err != http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+}
+
+/*
+ * Start listeners for specs, all bound before any serves.
+ */
+func (m *listener_manager) start(c *configuration, specs []listener_spec, tls_config *tls.Config) error {
+	var started []*managed_listener
+	for _, spec := range specs {
+		l, err := m.add(spec, tls_config)
+		if(err != nil) {
+			return err
+		}
+		started = append(started, l)
+	}
+	for _, l := range started {
+		l.go_serve(c)
+	}
+	return nil
+}
+
+func (m *listener_manager) snapshot() []*managed_listener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*managed_listener(nil), m.listeners...)
+}
+
+/*
+ * Stop accepting connections everywhere and wait, until ctx runs out,
+ * for requests in flight.  Those still going then are cut off.
+ */
+func (m *listener_manager) shutdown(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, l := range m.snapshot() {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			err := server.Shutdown(ctx)
+			if(err != nil) {
+				server.Close()
+			}
+		}(l.server)
+	}
+	wg.Wait()
+}
+
+/*
+ * How each listener looks in /status.
+ */
+func (m *listener_manager) report() map[string]listener_report {
+	reports := map[string]listener_report{}
+	for _, l := range m.snapshot() {
+		report := l.health.report(protocol_names(l.server.Protocols, l.spec.tls))
+		if(len(l.extra) > 0) {
+			report.Acceptors = len(l.extra) + 1
+		}
+		if(l.spec.unix == "") {
+			report.Family = l.spec.family
+			if(report.Family == "") {
+				report.Family = "dual"
+			}
+		}
+		reports[l.spec.name] = report
+	}
+	return reports
+}
+
+/*
+ * Listen on a unix socket at path, replacing a stale one left by an
+ * earlier run, and give it mode.  The socket goes away again when the
+ * listener closes.
+ */
+func listen_unix(path string, mode os.FileMode) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	if(err == nil && info.Mode() & os.ModeSocket != 0) {
+		conn, err := net.Dial("unix", path)
+		if(err == nil) {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if(err != nil) {
+		return nil, err
+	}
+	err = os.Chmod(path, mode)
+	if(err != nil) {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+/*
+ * Whether any listener speaks TLS, and so needs a certificate.
+ */
+func (c *configuration) any_tls() bool {
+	for _, spec := range c.listener_specs() {
+		if(spec.tls) {
+			return true
+		}
+	}
+	return false
+}
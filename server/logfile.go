@@ -0,0 +1,193 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Log files that rotate themselves, for appliances with nothing to
+ * collect stderr.  -log-file takes the application log, and the access
+ * log too unless -access-log gives it a file of its own.  A file is
+ * rotated once it would grow past -log-max-size, or has been written
+ * to for -log-max-age: it's renamed with the time, as
+ * gost.log.20261014T160500.000Z, and, with -log-compress, gzipped in
+ * the background.  Only the newest -log-keep rotated files are kept.
+ */
+const log_rotated_layout = "20060102T150405.000Z"
+
+type rotating_file struct {
+	path string
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	opened   time.Time
+	max_size int64
+	max_age  time.Duration
+	keep     int
+	compress bool
+}
+
+/*
+ * Open log files, by path, so that reloads keep writing to the same
+ * ones.
+ */
+var log_files = struct {
+	sync.Mutex
+	bypath map[string]*rotating_file
+}{bypath: map[string]*rotating_file{}}
+
+/*
+ * Open the log files c names, or take up the ones already open with
+ * c's rotation settings.
+ */
+func open_log_files(c *configuration) error {
+	for _, path := range []string{c.log_file, c.access_log} {
+		if(path == "") {
+			continue
+		}
+		_, err := log_file(path, c)
+		if(err != nil) {
+			return err
+		}
+	}
+	return nil
+}
+
+func log_file(path string, c *configuration) (*rotating_file, error) {
+	log_files.Lock()
+	defer log_files.Unlock()
+
+	f, ok := log_files.bypath[path]
+	if(!ok) {
+		f = &rotating_file{path: path}
+		err := f.open()
+		if(err != nil) {
+			return nil, err
+		}
+		log_files.bypath[path] = f
+	}
+	f.mu.Lock()
+	f.max_size, f.max_age, f.keep, f.compress = c.log_max_size, c.log_max_age, c.log_keep, c.log_compress
+	f.mu.Unlock()
+	return f, nil
+}
+
+func (f *rotating_file) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0640)
+	if(err != nil) {
+		return err
+	}
+	info, err := file.Stat()
+	if(err != nil) {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotating_file) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	full := f.max_size > 0 && f.size > 0 && f.size + int64(len(p)) > f.max_size
+	old := f.max_age > 0 && f.size > 0 && time.Since(f.opened) >= f.max_age
+	if(full || old) {
+		err := f.rotate()
+		if(err != nil) {
+			// Keep writing to the old file rather than lose the line.
+			os.Stderr.WriteString("Can't rotate " + f.path + ": " + err.Error() + "\n")
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+/*
+ * Move the current file aside and start a new one.  Called with mu
+ * held.
+ */
+func (f *rotating_file) rotate() error {
+	rotated := f.path + "." + time.Now().UTC().Format(log_rotated_layout)
+	err := os.Rename(f.path, rotated)
+	if(err != nil) {
+		return err
+	}
+	f.file.Close()
+	err = f.open()
+	if(err != nil) {
+		// The old file's gone; there's nowhere else to write.
+		f.file, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		return err
+	}
+
+	compress, keep := f.compress, f.keep
+	go func() {
+		if(compress) {
+			gzip_file(rotated)
+		}
+		prune_rotated(f.path, keep)
+	}()
+	return nil
+}
+
+/*
+ * Replace path with path.gz.
+ */
+func gzip_file(path string) error {
+	in, err := os.Open(path)
+	if(err != nil) {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path + ".gz", os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0640)
+	if(err != nil) {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if(err == nil) {
+		err = gz.Close()
+	}
+	if(err == nil) {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if(err != nil) {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+/*
+ * Remove all but the newest keep rotated copies of path.
+ */
+func prune_rotated(path string, keep int) {
+	matches, _ := filepath.Glob(path + ".*")
+	var rotated []string
+	for _, match := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(match, path + "."), ".gz")
+		_, err := time.Parse(log_rotated_layout, stamp)
+		if(err == nil) {
+			rotated = append(rotated, match)
+		}
+	}
+	// The time stamps sort in order, oldest first.
+	slices.Sort(rotated)
+	for len(rotated) > keep {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+}
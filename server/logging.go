@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Logging goes through log/slog so that it can come out either as
+ * key=value text or as JSON for machine consumption.  The level lives
+ * in a LevelVar, so a reload can change it without replacing loggers
+ * that are already in use.
+ */
+var log_level_var slog.LevelVar
+
+/*
+ * Where the access log goes, when -access-log splits it off.  Nil means
+ * with everything else.
+ */
+var access_logger atomic.Pointer[slog.Logger]
+
+var log_formats = map[string]bool{"text": true, "json": true}
+
+/*
+ * Map one of our log levels onto slog's.
+ */
+func slog_level(level int) slog.Level {
+	switch level {
+	case log_level_error:
+		return slog.LevelError
+	case log_level_debug:
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+/*
+ * Point the default logger at stderr, -log-file or -syslog, in the
+ * configured format, and the access log at -access-log if it has a
+ * file of its own.  The standard log package is routed through the
+ * default too.
+ */
+func configure_logging(c *configuration) {
+	log_level_var.Set(slog_level(c.log_level))
+	if(c.syslog_address != "") {
+		slog.SetDefault(slog.New(syslog_log_handler(c)))
+	} else {
+		slog.SetDefault(slog.New(log_handler(c, c.log_file)))
+	}
+
+	access_logger.Store(nil)
+	if(c.access_log != "") {
+		access_logger.Store(slog.New(log_handler(c, c.access_log)))
+	}
+}
+
+/*
+ * A handler in the configured format writing to path, or to stderr for
+ * none or if it won't open.
+ */
+func log_handler(c *configuration, path string) slog.Handler {
+	var w io.Writer = os.Stderr
+	if(path != "") {
+		f, err := log_file(path, c)
+		if(err != nil) {
+			fmt.Fprintf(os.Stderr, "Can't open log file, logging to stderr: %v\n", err)
+		} else {
+			w = f
+		}
+	}
+
+	return format_handler(c, w, short_source)
+}
+
+/*
+ * A handler sending records to -syslog, or to stderr if that's no
+ * good.
+ */
+func syslog_log_handler(c *configuration) slog.Handler {
+	sink, err := syslog_sink_for(c)
+	if(err != nil) {
+		fmt.Fprintf(os.Stderr, "Can't log to syslog, logging to stderr: %v\n", err)
+		return format_handler(c, os.Stderr, short_source)
+	}
+	return &syslog_handler{format_handler(c, sink, syslog_replace), sink}
+}
+
+func format_handler(c *configuration, w io.Writer, replace func([]string, slog.Attr) slog.Attr) slog.Handler {
+	options := &slog.HandlerOptions{AddSource: true, Level: &log_level_var, ReplaceAttr: replace}
+	if(c.log_format == "json") {
+		return slog.NewJSONHandler(w, options)
+	}
+	return slog.NewTextHandler(w, options)
+}
+
+/*
+ * Trim the source attribute down to file:line, like log.Lshortfile.
+ */
+func short_source(groups []string, a slog.Attr) slog.Attr {
+	if(a.Key != slog.SourceKey) {
+		return a
+	}
+
+	source, ok := a.Value.Any().(*slog.Source)
+	if(!ok) {
+		return a
+	}
+	return slog.String(slog.SourceKey, fmt.Sprintf("%s:%d", filepath.Base(source.File), source.Line))
+}
+
+/*
+ * Emit a record attributed to the caller skip frames above this one.
+ */
+func log_record(level int, skip int, msg string, attrs ...any) {
+	log_record_to(slog.Default(), level, skip + 1, msg, attrs...)
+}
+
+func log_record_to(logger *slog.Logger, level int, skip int, msg string, attrs ...any) {
+	if(!logger.Enabled(context.Background(), slog_level(level))) {
+		return
+	}
+
+	var pcs [1]uintptr
+	runtime.Callers(skip + 2, pcs[:])
+	record := slog.NewRecord(time.Now(), slog_level(level), msg, pcs[0])
+	record.Add(attrs...)
+	logger.Handler().Handle(context.Background(), record)
+}
+
+/*
+ * Log a formatted message, only when the configured verbosity allows it.
+ */
+func log_at(level int, format string, v ...interface{}) {
+	log_record(level, 1, fmt.Sprintf(format, v...))
+}
+
+/*
+ * Log a message with structured fields, given as alternating keys and
+ * values in the manner of slog.
+ */
+func log_fields(level int, msg string, attrs ...any) {
+	log_record(level, 1, msg, attrs...)
+}
+
+/*
+ * Log a message about a request, tagged with the request's ID.
+ */
+func log_request(req *http.Request, level int, msg string, attrs ...any) {
+	log_record(level, 1, msg, append([]any{"request_id", request_id(req)}, attrs...)...)
+}
+
+/*
+ * Every request gets an ID, so that a client's report of a bad test
+ * can be matched with the server's own record of it.  The ID goes back
+ * in X-Request-Id, into every log line about the request, and into the
+ * result of any test it runs.  A client or proxy in front that sends
+ * its own X-Request-Id has that one used instead, as long as it's a
+ * sane length and made of safe characters.
+ */
+const request_id_header = "X-Request-Id"
+const request_id_max = 128
+
+type request_id_key struct{}
+
+func valid_request_id(s string) bool {
+	if(s == "" || len(s) > request_id_max) {
+		return false
+	}
+	for _, r := range s {
+		if(!(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r))) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Give req an ID, the client's if it sent a usable one, and tell the
+ * client what it is.
+ */
+func with_request_id(res http.ResponseWriter, req *http.Request) *http.Request {
+	id := req.Header.Get(request_id_header)
+	if(!valid_request_id(id)) {
+		id = new_uuid()
+	}
+	res.Header().Set(request_id_header, id)
+	return req.WithContext(context.WithValue(req.Context(), request_id_key{}, id))
+}
+
+/*
+ * The ID with_request_id() gave req, or "" for none.
+ */
+func request_id(req *http.Request) string {
+	id, _ := req.Context().Value(request_id_key{}).(string)
+	return id
+}
+
+/*
+ * Stands in for a handler's ResponseWriter to note the status and how
+ * much went out, for the access log.  Flushing and the like reach the
+ * real one through Unwrap, and a file still goes out by sendfile()
+ * through ReadFrom.
+ */
+type response_recorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	first  time.Time
+}
+
+func (r *response_recorder) WriteHeader(code int) {
+	if(r.status == 0 && code >= 200) {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *response_recorder) Write(p []byte) (int, error) {
+	if(r.status == 0) {
+		r.status = 200
+	}
+	if(r.first.IsZero()) {
+		r.first = time.Now()
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *response_recorder) ReadFrom(src io.Reader) (int64, error) {
+	if(r.status == 0) {
+		r.status = 200
+	}
+	if(r.first.IsZero()) {
+		r.first = time.Now()
+	}
+	rf, ok := r.ResponseWriter.(io.ReaderFrom)
+	if(!ok) {
+		return io.Copy(struct{ io.Writer }{r}, src)
+	}
+	n, err := rf.ReadFrom(src)
+	r.bytes += n
+	return n, err
+}
+
+func (r *response_recorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if(err == nil) {
+		r.status = 101
+	}
+	return conn, rw, err
+}
+
+func (r *response_recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+/*
+ * Log a request once it's been answered.  Routes that are polled all
+ * day only show up at debug level.
+ */
+func log_access(req *http.Request, r *response_recorder, elapsed time.Duration, quiet bool) {
+	level := log_level_info
+	if(quiet) {
+		level = log_level_debug
+	}
+	logger := access_logger.Load()
+	if(logger == nil) {
+		logger = slog.Default()
+	}
+	log_record_to(logger, level, 1, "request",
+		"request_id", request_id(req),
+		"method", req.Method,
+		"path", req.URL.Path,
+		"query", req.URL.RawQuery,
+		"remote", req.RemoteAddr,
+		"proto", req.Proto,
+		"status", r.status,
+		"bytes", r.bytes,
+		"duration_ms", float64(elapsed.Microseconds()) / 1000)
+}
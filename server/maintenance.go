@@ -0,0 +1,290 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Times tests aren't welcome, such as overnight while backups run.
+ * -test-windows lists when tests may start, in local time, as
+ * "mon-fri 08:00-20:00; sat,sun 10:00-16:00"; a window may run past
+ * midnight, as "22:00-06:00", and one without days is every day.
+ * Maintenance mode stops tests whenever it's on: while the
+ * -maintenance-file exists, or after POST /admin/maintenance, until
+ * DELETE or the time it was given is up.  New tests then get 503 with
+ * Retry-After saying when to come back, but /status/ stays healthy, as
+ * the server is fine; tests already running carry on.
+ */
+const maintenance_retry = time.Minute
+
+type test_window struct {
+	text  string
+	days  uint8
+	start int
+	end   int
+}
+
+var weekday_names = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+/*
+ * Minutes into the day of a time such as 08:30, up to 24:00.
+ */
+func parse_clock(s string) (int, error) {
+	hours, minutes, ok := strings.Cut(s, ":")
+	h, err1 := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if(!ok || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h * 60 + m > 24 * 60) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h * 60 + m, nil
+}
+
+/*
+ * Days such as mon-fri or sat,sun as a bit for each, Sunday first.
+ */
+func parse_weekdays(s string) (uint8, error) {
+	var days uint8
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		first, last, is_range := strings.Cut(part, "-")
+		from, ok1 := weekday_names[first]
+		to, ok2 := weekday_names[last]
+		if(!is_range) {
+			to, ok2 = from, ok1
+		}
+		if(!ok1 || !ok2) {
+			return 0, fmt.Errorf("invalid days %q", s)
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			days |= 1 << d
+			if(d == to) {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parse_test_window(text string) (test_window, error) {
+	w := test_window{text: text, days: 0x7f}
+	fields := strings.Fields(text)
+	if(len(fields) == 2) {
+		var err error
+		w.days, err = parse_weekdays(fields[0])
+		if(err != nil) {
+			return w, err
+		}
+		fields = fields[1:]
+	}
+	if(len(fields) != 1) {
+		return w, fmt.Errorf("test window %q should be days and a time range, as mon-fri 08:00-20:00", text)
+	}
+	from, to, ok := strings.Cut(fields[0], "-")
+	if(!ok) {
+		return w, fmt.Errorf("test window %q needs a time range, as 08:00-20:00", text)
+	}
+	var err error
+	w.start, err = parse_clock(from)
+	if(err == nil) {
+		w.end, err = parse_clock(to)
+	}
+	if(err != nil) {
+		return w, err
+	}
+	if(w.start == w.end) {
+		return w, fmt.Errorf("test window %q is empty", text)
+	}
+	return w, nil
+}
+
+/*
+ * Windows separated by semicolons.
+ */
+func parse_test_windows(s string) ([]test_window, error) {
+	var windows []test_window
+	for _, text := range strings.Split(s, ";") {
+		text = strings.TrimSpace(text)
+		if(text == "") {
+			continue
+		}
+		w, err := parse_test_window(text)
+		if(err != nil) {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func test_window_texts(windows []test_window) []string {
+	texts := []string{}
+	for _, w := range windows {
+		texts = append(texts, w.text)
+	}
+	return texts
+}
+
+func format_test_windows(windows []test_window) string {
+	return strings.Join(test_window_texts(windows), "; ")
+}
+
+/*
+ * Whether t falls in the window.  A window past midnight belongs to
+ * the day it starts on.
+ */
+func (w test_window) contains(t time.Time) bool {
+	minute := t.Hour() * 60 + t.Minute()
+	today := w.days & (1 << t.Weekday()) != 0
+	if(w.start < w.end) {
+		return today && minute >= w.start && minute < w.end
+	}
+	yesterday := w.days & (1 << ((t.Weekday() + 6) % 7)) != 0
+	return (today && minute >= w.start) || (yesterday && minute < w.end)
+}
+
+func in_test_window(windows []test_window, t time.Time) bool {
+	if(len(windows) == 0) {
+		return true
+	}
+	for _, w := range windows {
+		if(w.contains(t)) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * When a window next opens after t, looking up to a week ahead.
+ */
+func next_test_window(windows []test_window, t time.Time) time.Time {
+	next := t.Truncate(time.Minute)
+	for i := 0; i <= 8 * 24 * 60; i++ {
+		next = next.Add(time.Minute)
+		if(in_test_window(windows, next)) {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+/*
+ * Maintenance mode as set through the admin API.
+ */
+var maintenance = struct {
+	sync.Mutex
+	on     bool
+	reason string
+	since  time.Time
+	until  time.Time
+}{}
+
+type maintenance_report struct {
+	Maintenance bool      `json:"maintenance"`
+	Source      string    `json:"source,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Since       time.Time `json:"since,omitzero"`
+	Until       time.Time `json:"until,omitzero"`
+	Windows     []string  `json:"windows,omitempty"`
+	InWindow    bool      `json:"in_window"`
+	NextWindow  time.Time `json:"next_window,omitzero"`
+}
+
+func current_maintenance(c *configuration, now time.Time) maintenance_report {
+	report := maintenance_report{InWindow: in_test_window(c.test_windows, now), Windows: test_window_texts(c.test_windows)}
+	if(!report.InWindow) {
+		report.NextWindow = next_test_window(c.test_windows, now)
+	}
+
+	maintenance.Lock()
+	if(maintenance.on && !maintenance.until.IsZero() && !now.Before(maintenance.until)) {
+		maintenance.on = false
+		log_at(log_level_info, "Maintenance over.")
+	}
+	if(maintenance.on) {
+		report.Maintenance, report.Source, report.Reason = true, "admin", maintenance.reason
+		report.Since, report.Until = maintenance.since, maintenance.until
+	}
+	maintenance.Unlock()
+
+	if(!report.Maintenance && c.maintenance_file != "") {
+		info, err := os.Stat(c.maintenance_file)
+		if(err == nil) {
+			report.Maintenance, report.Source, report.Since = true, "file", info.ModTime()
+		}
+	}
+	return report
+}
+
+/*
+ * Why tests can't start now, if they can't, and when to try again.
+ */
+func tests_closed(now time.Time) (string, time.Duration) {
+	report := current_maintenance(settings(), now)
+	if(report.Maintenance) {
+		if(!report.Until.IsZero()) {
+			return "maintenance", report.Until.Sub(now)
+		}
+		return "maintenance", maintenance_retry
+	}
+	if(!report.InWindow) {
+		if(report.NextWindow.IsZero()) {
+			return "test_window", maintenance_retry
+		}
+		return "test_window", report.NextWindow.Sub(now)
+	}
+	return "", 0
+}
+
+/*
+ * GET: Whether tests are stopped, and the windows.  POST: Stop them,
+ * optionally with {"reason": "...", "for": "2h"}.  DELETE: Start them
+ * again, unless the -maintenance-file is still there.
+ */
+func route_admin_maintenance(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD", "":
+	case "POST", "PUT":
+		var body struct {
+			Reason string `json:"reason"`
+			For    string `json:"for"`
+		}
+		err := json.NewDecoder(io.LimitReader(req.Body, 64 * 1024)).Decode(&body)
+		if(err != nil && err != io.EOF) {
+			res.WriteHeader(400) // Bad Request
+			io.WriteString(res, "Invalid JSON: " + err.Error())
+			return
+		}
+		var until time.Time
+		if(body.For != "") {
+			d, err := parse_span(body.For)
+			if(err != nil || d <= 0) {
+				res.WriteHeader(400) // Bad Request
+				io.WriteString(res, "for must be a positive duration such as 2h")
+				return
+			}
+			until = time.Now().Add(d)
+		}
+		maintenance.Lock()
+		maintenance.on, maintenance.reason, maintenance.since, maintenance.until = true, body.Reason, time.Now(), until
+		maintenance.Unlock()
+		log_fields(log_level_info, "maintenance on", "reason", body.Reason, "until", until, "remote", client_ip(req))
+	case "DELETE":
+		maintenance.Lock()
+		maintenance.on = false
+		maintenance.Unlock()
+		log_fields(log_level_info, "maintenance off", "remote", client_ip(req))
+	default:
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+	write_json(res, 200, current_maintenance(settings(), time.Now()))
+}
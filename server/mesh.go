@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * The mesh: every node's peer tests, gathered in one place.  GET /mesh
+ * reports each link between two nodes, as its median latency and
+ * throughput over ?window= (1h by default) along with how its latest
+ * test went.  Nodes with -mesh-push send each of their results to
+ * another node's /mesh, which keeps them alongside its own, so that
+ * one node can show the whole fleet.  Pushing goes through the admin
+ * API's checks, so it needs one of the receiving node's -admin-tokens.
+ */
+const mesh_default_window = time.Hour
+const mesh_push_timeout = 10 * time.Second
+const mesh_push_max = 64 * 1024
+
+type mesh_link struct {
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Tests    int       `json:"tests"`
+	Failures int       `json:"failures"`
+	Latest   time.Time `json:"latest"`
+	Error    string    `json:"error,omitempty"`
+	RTTMs    float64   `json:"rtt_ms"`
+	DownMbps float64   `json:"down_mbps"`
+	UpMbps   float64   `json:"up_mbps"`
+}
+
+type mesh_report struct {
+	Node   string      `json:"node"`
+	Window float64     `json:"window_seconds"`
+	Nodes  []string    `json:"nodes"`
+	Links  []mesh_link `json:"links"`
+}
+
+/*
+ * What a node pushes: who it is and a result of its own.
+ */
+type mesh_push struct {
+	Node   string      `json:"node"`
+	Result peer_result `json:"result"`
+}
+
+/*
+ * The value at fraction p of the way through values, which are sorted
+ * in place.  Zero for none.
+ */
+func percentile(values []float64, p float64) float64 {
+	if(len(values) == 0) {
+		return 0
+	}
+	sort.Float64s(values)
+	return values[int(p * float64(len(values) - 1) + 0.5)]
+}
+
+/*
+ * Summarize each link's results since since.
+ */
+func mesh_links(since time.Time) []mesh_link {
+	peer_results.Lock()
+	defer peer_results.Unlock()
+
+	links := []mesh_link{}
+	for key, results := range peer_results.bylink {
+		link := mesh_link{From: key.from, To: key.to}
+		var rtts, downs, ups []float64
+		for _, r := range results {
+			if(r.Started.Before(since)) {
+				continue
+			}
+			link.Tests++
+			if(r.Error != "") {
+				link.Failures++
+			}
+			if(r.Latency != nil) {
+				rtts = append(rtts, r.Latency.AvgMs)
+			}
+			if(r.Download != nil) {
+				downs = append(downs, r.Download.Mbps)
+			}
+			if(r.Upload != nil) {
+				ups = append(ups, r.Upload.Mbps)
+			}
+		}
+		if(link.Tests == 0) {
+			continue
+		}
+
+		latest := results[len(results) - 1]
+		link.Latest = latest.Started
+		link.Error = latest.Error
+		link.RTTMs = percentile(rtts, 0.5)
+		link.DownMbps = percentile(downs, 0.5)
+		link.UpMbps = percentile(ups, 0.5)
+		links = append(links, link)
+	}
+
+	sort.Slice(links, func(i, j int) bool {
+		if(links[i].From != links[j].From) {
+			return links[i].From < links[j].From
+		}
+		return links[i].To < links[j].To
+	})
+	return links
+}
+
+/*
+ * GET: The mesh as this node sees it.  POST: Take a result pushed by
+ * another node.
+ */
+func route_mesh(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD", "":
+	case "POST":
+		require_admin(route_mesh_push)(res, req)
+		return
+	default:
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+
+	window := mesh_default_window
+	value := req.URL.Query().Get("window")
+	if(value != "") {
+		d, err := time.ParseDuration(value)
+		if(err != nil || d <= 0) {
+			res.WriteHeader(400) // Bad Request
+			io.WriteString(res, "window must be a positive duration")
+			return
+		}
+		window = d
+	}
+
+	c := settings()
+	report := mesh_report{
+		Node:   c.node_name,
+		Window: window.Seconds(),
+		Nodes:  []string{c.node_name},
+		Links:  mesh_links(time.Now().Add(-window)),
+	}
+	for _, link := range report.Links {
+		for _, name := range []string{link.From, link.To} {
+			if(!slices.Contains(report.Nodes, name)) {
+				report.Nodes = append(report.Nodes, name)
+			}
+		}
+	}
+	sort.Strings(report.Nodes)
+	write_json(res, 200, report)
+}
+
+func route_mesh_push(res http.ResponseWriter, req *http.Request) {
+	var push mesh_push
+	err := json.NewDecoder(http.MaxBytesReader(res, req.Body, mesh_push_max)).Decode(&push)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+	if(push.Node == "" || push.Result.Peer == "" || push.Result.Started.IsZero()) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, "A push needs a node, and a result with a peer and a start time")
+		return
+	}
+	if(push.Node == settings().node_name) {
+		res.WriteHeader(409) // Conflict
+		io.WriteString(res, "That's this node's name")
+		return
+	}
+
+	store_peer_result(push.Node, push.Result)
+	res.WriteHeader(204) // No Content
+}
+
+/*
+ * Send one of our results to the node in -mesh-push, if there is one.
+ */
+func push_peer_result(c *configuration, result peer_result) {
+	if(c.mesh_push == "") {
+		return
+	}
+
+	body, _ := json.Marshal(mesh_push{Node: c.node_name, Result: result})
+	target := strings.TrimSuffix(c.mesh_push, "/") + "/mesh"
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if(err != nil) {
+		log_at(log_level_error, "Can't push to %s: %v", target, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if(c.mesh_token != "") {
+		req.Header.Set("Authorization", "Bearer " + c.mesh_token)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: c.mesh_insecure}
+	client := &http.Client{Transport: transport, Timeout: mesh_push_timeout}
+	res, err := client.Do(req)
+	if(err != nil) {
+		log_at(log_level_error, "Can't push to %s: %v", target, err)
+		return
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if(res.StatusCode != 204) {
+		log_at(log_level_error, "Can't push to %s: %s", target, res.Status)
+	}
+}
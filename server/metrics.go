@@ -0,0 +1,307 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * A minimal Prometheus text-format exporter.  Each metric carries at
+ * most one label, which covers everything gost needs to report without
+ * pulling in a client library.
+ */
+type metric interface {
+	write_to(w io.Writer)
+}
+
+var metric_registry []metric
+
+/*
+ * A monotonically increasing count, split by one label.
+ */
+type counter_vec struct {
+	name   string
+	help   string
+	label  string
+	kind   string
+	mu     sync.Mutex
+	values map[string]*atomic.Int64
+}
+
+func new_counter_vec(name string, help string, label string) *counter_vec {
+	c := &counter_vec{name: name, help: help, label: label, kind: "counter", values: map[string]*atomic.Int64{}}
+	metric_registry = append(metric_registry, c)
+	return c
+}
+
+/*
+ * A gauge is a counter_vec that is allowed to go down.
+ */
+func new_gauge_vec(name string, help string, label string) *counter_vec {
+	c := new_counter_vec(name, help, label)
+	c.kind = "gauge"
+	return c
+}
+
+func (c *counter_vec) with(value string) *atomic.Int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.values[value]
+	if(!ok) {
+		v = new(atomic.Int64)
+		c.values[value] = v
+	}
+	return v
+}
+
+func (c *counter_vec) add(value string, n int64) {
+	c.with(value).Add(n)
+}
+
+func (c *counter_vec) write_to(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, c.kind)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sorted_keys(c.values) {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", c.name, c.label, strconv.Quote(key), c.values[key].Load())
+	}
+}
+
+/*
+ * A gauge whose value is computed when scraped.
+ */
+type gauge_func struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func new_gauge_func(name string, help string, fn func() float64) *gauge_func {
+	g := &gauge_func{name: name, help: help, fn: fn}
+	metric_registry = append(metric_registry, g)
+	return g
+}
+
+func (g *gauge_func) write_to(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, format_float(g.fn()))
+}
+
+/*
+ * A cumulative histogram, split by one label.
+ */
+type histogram_vec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram_series
+}
+
+type histogram_series struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func new_histogram_vec(name string, help string, label string, buckets []float64) *histogram_vec {
+	h := &histogram_vec{name: name, help: help, label: label, buckets: buckets, series: map[string]*histogram_series{}}
+	metric_registry = append(metric_registry, h)
+	return h
+}
+
+func (h *histogram_vec) observe(value string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[value]
+	if(!ok) {
+		s = &histogram_series{counts: make([]uint64, len(h.buckets))}
+		h.series[value] = s
+	}
+
+	for i, bound := range h.buckets {
+		if(v <= bound) {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogram_vec) write_to(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sorted_keys(h.series) {
+		s := h.series[key]
+		label := h.label + "=" + strconv.Quote(key)
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", h.name, label, format_float(bound), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, label, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, label, format_float(s.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, label, s.count)
+	}
+}
+
+func format_float(v float64) string {
+	if(math.IsInf(v, 1)) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sorted_keys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+ * The metrics gost exports.
+ */
+var (
+	metric_requests = new_counter_vec("gost_http_requests_total",
+		"Requests handled, by route.", "route")
+	metric_responses = new_counter_vec("gost_http_responses_total",
+		"Responses sent, by status code.", "code")
+	metric_response_bytes = new_counter_vec("gost_http_response_bytes_total",
+		"Response body bytes sent, by route.", "route")
+	metric_request_duration = new_histogram_vec("gost_http_request_duration_seconds",
+		"Time from a request arriving to its response finishing, by route.", "route",
+		[]float64{0.001, 0.005, 0.025, 0.1, 0.5, 1, 5, 10, 30, 60, 300})
+	metric_test_bytes = new_counter_vec("gost_test_bytes_total",
+		"Payload bytes moved by bandwidth tests, by direction.", "direction")
+	metric_test_duration = new_histogram_vec("gost_test_duration_seconds",
+		"Wall-clock duration of bandwidth tests, by direction.", "direction",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300})
+	metric_tests_active = new_gauge_func("gost_tests_active",
+		"Bandwidth tests currently running.",
+		func() float64 { return float64(test_tracker.active.Load()) })
+	metric_tests_refused = new_counter_vec("gost_tests_refused_total",
+		"Tests turned away with 429, by reason.", "reason")
+	metric_test_verdicts = new_counter_vec("gost_test_expectations_total",
+		"Tests run with ?expect=, by whether they passed or failed.", "verdict")
+	metric_webhook_deliveries = new_counter_vec("gost_webhook_deliveries_total",
+		"Webhook attempts: delivered, retried, or dead when given up on.", "outcome")
+	metric_trace_spans = new_counter_vec("gost_trace_spans_total",
+		"Trace spans exported over OTLP, or dropped.", "outcome")
+	metric_tenant_tests = new_counter_vec("gost_tenant_tests_total",
+		"Tests finished, by tenant.", "tenant")
+	metric_tenant_bytes = new_counter_vec("gost_tenant_bytes_total",
+		"Payload bytes tests moved, by tenant.", "tenant")
+	metric_tenant_active = new_gauge_vec("gost_tenant_active_tests",
+		"Tests currently running, by tenant.", "tenant")
+	metric_jwt_checks = new_counter_vec("gost_jwt_checks_total",
+		"Bearer JWTs checked, by whether they were accepted, rejected, or valid but not allowed.", "outcome")
+	metric_aggregate_rate = new_gauge_func("gost_aggregate_bits_per_second",
+		"Combined throughput of all running tests over the last second.",
+		aggregate_rate)
+	metric_tls_handshake = new_histogram_vec("gost_tls_handshake_seconds",
+		"Time from ClientHello to the handshake completing, by TLS version.", "version",
+		[]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1})
+	metric_connections = new_counter_vec("gost_connections_total",
+		"Connections accepted, by listener.", "listener")
+	metric_connections_open = new_gauge_vec("gost_connections_open",
+		"Connections currently open, by listener.", "listener")
+)
+
+/*
+ * Routes that are polled all day, and so are logged at debug level.
+ */
+var quiet_routes = map[string]bool{
+	health_probe_path: true,
+	"/healthz":        true,
+	"/readyz":         true,
+	"/metrics":        true,
+}
+
+/*
+ * Wrap a handler so each request is counted against its route pattern
+ * rather than its raw path, which would explode the label set, and
+ * logged once its response is done.  Every response also tells the
+ * client which protocol it arrived over, since throughput over HTTP/2
+ * can differ a lot from HTTP/1.1.
+ */
+func instrument(pattern string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		metric_requests.add(pattern, 1)
+		req = with_request_id(res, req)
+		connection_of(req).requests.Add(1)
+		span, req := start_request_span(req, pattern, start)
+		res.Header().Set("X-Gost-Protocol", req.Proto)
+
+		recorder := &response_recorder{ResponseWriter: res}
+		if(wants_json_errors(req)) {
+			held := &error_writer{ResponseWriter: recorder, req: req}
+			handler(held, req)
+			held.finish()
+		} else {
+			handler(recorder, req)
+		}
+		if(recorder.status == 0) {
+			recorder.status = 200
+		}
+
+		elapsed := time.Since(start)
+		metric_responses.add(strconv.Itoa(recorder.status), 1)
+		metric_response_bytes.add(pattern, recorder.bytes)
+		metric_request_duration.observe(pattern, elapsed.Seconds())
+		span.finish(req, recorder, start.Add(elapsed))
+		log_access(req, recorder, elapsed, quiet_routes[pattern])
+	}
+}
+
+/*
+ * An http.Server ConnState hook that counts connections for the named
+ * listener.
+ */
+func track_connections(listener string) func(net.Conn, http.ConnState) {
+	return func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			metric_connections.add(listener, 1)
+			metric_connections_open.add(listener, 1)
+		case http.StateClosed, http.StateHijacked:
+			metric_connections_open.add(listener, -1)
+		}
+	}
+}
+
+/*
+ * Record a finished test.
+ */
+func observe_test(direction string, bytes int64, elapsed time.Duration) {
+	metric_test_bytes.add(direction, bytes)
+	metric_test_duration.observe(direction, elapsed.Seconds())
+}
+
+/*
+ * Prometheus scrape endpoint.
+ */
+func route_metrics(res http.ResponseWriter, req *http.Request) {
+	var out strings.Builder
+	for _, m := range metric_registry {
+		m.write_to(&out)
+	}
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(res, out.String())
+}
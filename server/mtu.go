@@ -0,0 +1,151 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+/*
+ * Path MTU probing over the UDP echo, for clients that can't send
+ * ICMP.  POST /mtu starts a probe and says which port to send to.  The
+ * client sends echo datagrams with the probe's ID, padded to the sizes
+ * it wants to try, and gost echoes them with the don't-fragment bit set
+ * and its own idea of the path MTU ignored.  An echo too big for the
+ * path is dropped by the router that can't forward it, rather than
+ * fragmented, so the biggest one that makes it back gives the path MTU
+ * towards the client: its size plus 28 bytes of IPv4 and UDP headers,
+ * or 48 over IPv6.  When an echo doesn't come back, GET /mtu/{id} says
+ * whether the datagram reached gost at all, which tells a blackhole on
+ * the way there from one on the way back, and which sizes gost's own
+ * interface was too small to send.
+ *
+ * Setting don't-fragment is only supported on Linux; elsewhere echoes
+ * go out as usual, and the probe says so.
+ */
+const mtu_prefix = "/mtu/"
+
+// Distinct sizes tracked per probe.
+const mtu_max_sizes = 256
+
+type mtu_probe struct {
+	received map[int]bool
+	echoed   map[int]bool
+	too_big  map[int]bool
+}
+
+type mtu_report struct {
+	ID           string `json:"id"`
+	UDPPort      int    `json:"udp_port,omitempty"`
+	DontFragment bool   `json:"dont_fragment"`
+	Received     []int  `json:"received"`
+	Echoed       []int  `json:"echoed"`
+	TooBig       []int  `json:"too_big"`
+}
+
+/*
+ * Note a datagram of size bytes for the probe, and how echoing it went.
+ */
+func (s *udp_session) observe_mtu(size int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.mtu
+	if(len(p.received) >= mtu_max_sizes && !p.received[size]) {
+		return
+	}
+	p.received[size] = true
+	if(err == nil) {
+		p.echoed[size] = true
+	} else if(errors.Is(err, syscall.EMSGSIZE)) {
+		p.too_big[size] = true
+	}
+}
+
+/*
+ * Whether the session is an MTU probe.
+ */
+func (s *udp_session) probing_mtu() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mtu != nil
+}
+
+/*
+ * The sizes in set, smallest first.
+ */
+func sorted_sizes(set map[int]bool) []int {
+	sizes := []int{}
+	for size := range set {
+		sizes = append(sizes, size)
+	}
+	slices.Sort(sizes)
+	return sizes
+}
+
+func (s *udp_session) mtu_report() mtu_report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return mtu_report{
+		ID:           s.id,
+		DontFragment: mtu_dont_fragment,
+		Received:     sorted_sizes(s.mtu.received),
+		Echoed:       sorted_sizes(s.mtu.echoed),
+		TooBig:       sorted_sizes(s.mtu.too_big),
+	}
+}
+
+/*
+ * POST /mtu: Start a probe.
+ * GET /mtu/{id}: What the probe has seen so far.
+ */
+func route_mtu(res http.ResponseWriter, req *http.Request) {
+	if(udp_echo_port == 0) {
+		res.WriteHeader(404)
+		io.WriteString(res, "UDP echo is off")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, "/mtu"), "/")
+	if(id == "") {
+		if(req.Method != "POST") {
+			res.WriteHeader(405) // Method Not Allowed
+			io.WriteString(res, "Method Not Allowed")
+			return
+		}
+
+		s := udp_session_for(new_uuid(), client_ip(req))
+		if(s == nil) {
+			res.WriteHeader(503) // Service Unavailable
+			io.WriteString(res, "Too many UDP tests")
+			return
+		}
+		s.mu.Lock()
+		s.mtu = &mtu_probe{received: map[int]bool{}, echoed: map[int]bool{}, too_big: map[int]bool{}}
+		s.mu.Unlock()
+
+		report := s.mtu_report()
+		report.UDPPort = udp_echo_port
+		write_json(res, 201, report)
+		return
+	}
+
+	if(req.Method != "GET" && req.Method != "HEAD" && req.Method != "") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+	udp_sessions.Lock()
+	s, ok := udp_sessions.byid[id]
+	udp_sessions.Unlock()
+	if(!ok || !s.probing_mtu()) {
+		res.WriteHeader(404)
+		io.WriteString(res, "Not Found")
+		return
+	}
+	write_json(res, 200, s.mtu_report())
+}
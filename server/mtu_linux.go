@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+const mtu_dont_fragment = true
+
+/*
+ * Send packet to addr with the don't-fragment bit set and the kernel's
+ * idea of the path MTU ignored, then put the socket back how it was.
+ * Only serve_udp writes to conn, so nothing else sends in between.
+ */
+func write_unfragmented(conn net.PacketConn, packet []byte, addr net.Addr) error {
+	sc, ok := conn.(syscall.Conn)
+	if(!ok) {
+		_, err := conn.WriteTo(packet, addr)
+		return err
+	}
+	raw, err := sc.SyscallConn()
+	if(err != nil) {
+		return err
+	}
+
+	// A dual-stack socket needs both set; one of them failing is fine.
+	v4, v6 := -1, -1
+	raw.Control(func(fd uintptr) {
+		s := int(fd)
+		old, err := syscall.GetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER)
+		if(err == nil) {
+			v4 = old
+			syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		}
+		old, err = syscall.GetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER)
+		if(err == nil) {
+			v6 = old
+			syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+		}
+	})
+
+	_, err = conn.WriteTo(packet, addr)
+
+	raw.Control(func(fd uintptr) {
+		s := int(fd)
+		if(v4 >= 0) {
+			syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, v4)
+		}
+		if(v6 >= 0) {
+			syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, v6)
+		}
+	})
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package server
+
+import (
+	"net"
+)
+
+const mtu_dont_fragment = false
+
+func write_unfragmented(conn net.PacketConn, packet []byte, addr net.Addr) error {
+	_, err := conn.WriteTo(packet, addr)
+	return err
+}
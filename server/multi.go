@@ -0,0 +1,450 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Multi-stream downloads.  One TCP stream often can't fill a link with
+ * a large bandwidth-delay product, so the client can ask for several
+ * that the server accounts for as a single test:
+ *
+ *	POST /down/multi?streams=4&bytes=100M   creates the test
+ *	GET  /down/multi/{id}/{stream}          fetches one stream
+ *	GET  /down/multi/{id}                   reports the combined result
+ *
+ * Combined throughput is the total bytes over the time from the first
+ * stream starting to the last one finishing.  DELETE /tests/{id}
+ * cancels the whole test.
+ */
+const multi_prefix = "/down/multi"
+const multi_max_streams = 64
+
+/*
+ * A test that hasn't had all its streams finish by then is recorded as
+ * aborted with whatever was moved.
+ */
+const multi_expiry = 10 * time.Minute
+
+type multi_stream struct {
+	grouped_part
+	state   string
+	bytes   int64
+	started time.Time
+	ended   time.Time
+}
+
+type multi_test struct {
+	mu         sync.Mutex
+	id         string
+	request_id string
+	tenant     string
+	vhost      string
+	protocol   string
+	per        int64
+	jwt_limit  int64
+	client_ip  string
+	streams    []multi_stream
+	finished   int
+	failed     error
+	result     *test_result
+	expiry     *time.Timer
+
+	// Bytes all the streams have moved, against the token's limit.
+	moved atomic.Int64
+
+	// Set once the test's cancelled, which stops its streams' writes.
+	cancelled bool
+	stop      atomic.Bool
+	done      chan struct{}
+}
+
+var multi_tests = struct {
+	sync.Mutex
+	byid map[string]*multi_test
+}{byid: map[string]*multi_test{}}
+
+/*
+ * What POST /down/multi hands back.
+ */
+type multi_plan struct {
+	ID             string   `json:"id"`
+	Streams        int      `json:"streams"`
+	BytesPerStream int64    `json:"bytes_per_stream"`
+	URLs           []string `json:"urls"`
+}
+
+/*
+ * What GET /down/multi/{id} reports.
+ */
+type multi_status struct {
+	ID      string            `json:"id"`
+	State   string            `json:"state"`
+	Bytes   int64             `json:"bytes"`
+	Seconds float64           `json:"seconds"`
+	Mbps    float64           `json:"mbps"`
+	Streams []multi_status_of `json:"streams"`
+}
+
+type multi_status_of struct {
+	State   string  `json:"state"`
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+	Mbps    float64 `json:"mbps"`
+}
+
+/*
+ * The span from the first stream's start to the last stream's end so
+ * far, and the total bytes moved.  Called with mu held.
+ */
+func (m *multi_test) totals(now time.Time) (int64, time.Duration) {
+	var total int64
+	var first, last time.Time
+
+	for i := range m.streams {
+		s := &m.streams[i]
+		total += s.bytes
+		if(s.started.IsZero()) {
+			continue
+		}
+		if(first.IsZero() || s.started.Before(first)) {
+			first = s.started
+		}
+		end := s.ended
+		if(end.IsZero()) {
+			end = now
+		}
+		if(end.After(last)) {
+			last = end
+		}
+	}
+
+	if(first.IsZero()) {
+		return total, 0
+	}
+	return total, last.Sub(first)
+}
+
+/*
+ * Record the combined result.  Called with mu held, once.
+ */
+func (m *multi_test) conclude(protocol string) {
+	m.expiry.Stop()
+
+	total, span := m.totals(time.Now())
+	first := time.Now()
+	for i := range m.streams {
+		s := &m.streams[i]
+		if(!s.started.IsZero() && s.started.Before(first)) {
+			first = s.started
+		}
+	}
+
+	result := test_result{
+		ID:        m.id,
+		RequestID: m.request_id,
+		Direction: "down",
+		Started:   first,
+		Bytes:     total,
+		Requested: m.per * int64(len(m.streams)),
+		Streams:   len(m.streams),
+		Seconds:   span.Seconds(),
+		Mbps:      mbps(total, span),
+		ClientIP:  m.client_ip,
+		Tenant:    m.tenant,
+		Vhost:     m.vhost,
+		Protocol:  protocol,
+		Outcome:   "completed",
+	}
+	if(m.failed != nil) {
+		result.Outcome = "aborted"
+		result.Error = m.failed.Error()
+	}
+
+	result.locate()
+	m.result = &result
+	metric_test_duration.observe("down", span.Seconds())
+	finish_result(result)
+	close(m.done)
+	grouped_tests.Delete(m.id)
+}
+
+func (m *multi_test) status() multi_status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	total, span := m.totals(now)
+	out := multi_status{ID: m.id, State: "running", Bytes: total, Seconds: span.Seconds(), Mbps: mbps(total, span)}
+	if(m.result != nil) {
+		out.State = m.result.Outcome
+	}
+
+	for i := range m.streams {
+		s := &m.streams[i]
+		end := s.ended
+		if(end.IsZero()) {
+			end = now
+		}
+		elapsed := time.Duration(0)
+		if(!s.started.IsZero()) {
+			elapsed = end.Sub(s.started)
+		}
+		out.Streams = append(out.Streams, multi_status_of{
+			State: s.state, Bytes: s.bytes, Seconds: elapsed.Seconds(), Mbps: mbps(s.bytes, elapsed),
+		})
+	}
+	return out
+}
+
+func (m *multi_test) owned_by(client string, tenant string) bool {
+	return m.client_ip == client && m.tenant == tenant
+}
+
+/*
+ * Cancel the test: interrupt the streams running, and conclude it now
+ * if none are.
+ */
+func (m *multi_test) cancel() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if(m.result != nil || m.cancelled) {
+		return
+	}
+	m.cancelled = true
+	m.stop.Store(true)
+	if(m.failed == nil) {
+		m.failed = test_cancelled
+	}
+	for i := range m.streams {
+		s := &m.streams[i]
+		switch s.state {
+		case "running":
+			s.grouped_part.cancel(m.client_ip, m.tenant, m.vhost)
+		case "pending":
+			s.state = "cancelled"
+			m.finished++
+		}
+	}
+	if(m.finished == len(m.streams)) {
+		m.conclude(m.protocol)
+	}
+}
+
+func (m *multi_test) concluded() <-chan struct{} {
+	return m.done
+}
+
+func (m *multi_test) final() *test_result {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.result
+}
+
+func (m *multi_test) so_far() any {
+	return m.status()
+}
+
+/*
+ * Look up a multi-stream test by ID.
+ */
+func find_multi_test(id string) *multi_test {
+	multi_tests.Lock()
+	defer multi_tests.Unlock()
+	return multi_tests.byid[id]
+}
+
+/*
+ * Dispatch /down/multi and everything beneath it.
+ */
+func route_down_multi(res http.ResponseWriter, req *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(req.URL.Path, multi_prefix), "/")
+	parts := strings.Split(rest, "/")
+
+	switch {
+	case rest == "" && req.Method == "POST":
+		multi_create(res, req)
+	case rest != "" && len(parts) == 1 && req.Method == "GET":
+		multi_report(res, req, parts[0])
+	case len(parts) == 2 && req.Method == "GET":
+		multi_serve_stream(res, req, parts[0], parts[1])
+	case rest == "" || len(parts) <= 2:
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+	default:
+		res.WriteHeader(404)
+		io.WriteString(res, "Not Found")
+	}
+}
+
+/*
+ * POST /down/multi: set up a test and tell the client where to fetch
+ * each stream from.  ?bytes= is per stream.
+ */
+func multi_create(res http.ResponseWriter, req *http.Request) {
+	streams, err := query_int(req, "streams", 4)
+	if(err != nil || streams < 1 || streams > multi_max_streams) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, "streams must be between 1 and " + strconv.Itoa(multi_max_streams))
+		return
+	}
+
+	per, err := requested_bytes(req, down_default_bytes)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+	if(per * int64(streams) > request_settings(req).max_test_bytes) {
+		res.WriteHeader(413) // Request Entity Too Large
+		io.WriteString(res, "Requested size exceeds the server limit")
+		return
+	}
+	limit := jwt_test_limit(req)
+	if(limit > 0 && per * int64(streams) > limit) {
+		set_error_code(res, "token_limit")
+		res.WriteHeader(403) // Forbidden
+		io.WriteString(res, fmt.Sprintf("Tests over %d bytes aren't allowed with this token", limit))
+		return
+	}
+
+	m := &multi_test{
+		id:         new_uuid(),
+		request_id: request_id(req),
+		per:        per,
+		jwt_limit:  limit,
+		client_ip:  client_ip(req),
+		tenant:     request_tenant(req),
+		vhost:      request_vhost(req),
+		protocol:   req.Proto,
+		streams:    make([]multi_stream, streams),
+		done:       make(chan struct{}),
+	}
+	for i := range m.streams {
+		m.streams[i].state = "pending"
+	}
+
+	m.expiry = time.AfterFunc(multi_expiry, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if(m.result == nil) {
+			m.failed = errors.New("not all streams finished in time")
+			m.conclude(m.protocol)
+		}
+	})
+
+	multi_tests.Lock()
+	multi_tests.byid[m.id] = m
+	multi_tests.Unlock()
+	grouped_tests.Store(m.id, m)
+
+	// Forget finished tests after a while; their results live on in
+	// /results.
+	time.AfterFunc(2 * multi_expiry, func() {
+		multi_tests.Lock()
+		delete(multi_tests.byid, m.id)
+		multi_tests.Unlock()
+	})
+
+	plan := multi_plan{ID: m.id, Streams: streams, BytesPerStream: per}
+	for i := 0; i < streams; i++ {
+		plan.URLs = append(plan.URLs, mount_prefix + multi_prefix + "/" + m.id + "/" + strconv.Itoa(i))
+	}
+	res.Header().Set("X-Gost-Test-Id", m.id)
+	write_json(res, 201, plan)
+}
+
+/*
+ * GET /down/multi/{id}: the combined result so far.  Like the streams,
+ * only for the client that set the test up.
+ */
+func multi_report(res http.ResponseWriter, req *http.Request, id string) {
+	m := find_multi_test(id)
+	if(m == nil || !m.owned_by(client_ip(req), request_tenant(req))) {
+		res.WriteHeader(404)
+		io.WriteString(res, "No such test")
+		return
+	}
+	write_json(res, 200, m.status())
+}
+
+/*
+ * GET /down/multi/{id}/{stream}: one of the test's streams.  Each
+ * stream may be fetched once, by the client that set the test up, from
+ * the same address and as the same tenant.
+ */
+func multi_serve_stream(res http.ResponseWriter, req *http.Request, id string, which string) {
+	m := find_multi_test(id)
+	k, err := strconv.Atoi(which)
+	if(m == nil || err != nil || !m.owned_by(client_ip(req), request_tenant(req))) {
+		res.WriteHeader(404)
+		io.WriteString(res, "No such stream")
+		return
+	}
+
+	m.mu.Lock()
+	if(k < 0 || k >= len(m.streams)) {
+		m.mu.Unlock()
+		res.WriteHeader(404)
+		io.WriteString(res, "No such stream")
+		return
+	}
+	s := &m.streams[k]
+	if(m.cancelled) {
+		m.mu.Unlock()
+		res.WriteHeader(409) // Conflict
+		io.WriteString(res, "Test cancelled")
+		return
+	}
+	if(s.state != "pending" || m.result != nil) {
+		m.mu.Unlock()
+		res.WriteHeader(409) // Conflict
+		io.WriteString(res, "Stream already used")
+		return
+	}
+	if(!admit_test(res, m.client_ip, m.tenant, m.vhost)) {
+		m.mu.Unlock()
+		return
+	}
+	s.state = "running"
+	s.started = time.Now()
+	s.begin(res, req)
+	m.mu.Unlock()
+
+	res.Header().Set("X-Gost-Test-Id", m.id)
+	write_payload_headers(res, m.per)
+
+	w := jwt_limit_writer(res, &m.moved, m.jwt_limit)
+	written, err := write_payload(progress_writer{w, &s.moved, &m.stop}, m.per)
+	metric_test_bytes.add("down", written)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if(err != nil && m.cancelled) {
+		err = test_cancelled
+	}
+	s.end(m.client_ip, m.tenant, m.vhost, written, err)
+	s.bytes = written
+	s.ended = time.Now()
+	s.state = "completed"
+	if(err != nil) {
+		s.state = "aborted"
+		if(m.failed == nil) {
+			m.failed = err
+		}
+	}
+
+	m.finished++
+	if(m.finished == len(m.streams) && m.result == nil) {
+		m.conclude(m.protocol)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMultiTotals(t *testing.T) {
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return base.Add(time.Duration(seconds) * time.Second)
+	}
+	now := at(100)
+
+	tests := []struct {
+		name    string
+		streams []multi_stream
+		total   int64
+		span    time.Duration
+	}{
+		{"none started", []multi_stream{{}, {}}, 0, 0},
+		{"one finished", []multi_stream{{bytes: 100, started: at(0), ended: at(10)}}, 100, 10 * time.Second},
+		{"one running", []multi_stream{{bytes: 100, started: at(50)}}, 100, 50 * time.Second},
+		{"overlapping", []multi_stream{
+			{bytes: 100, started: at(0), ended: at(10)},
+			{bytes: 200, started: at(5), ended: at(20)},
+		}, 300, 20 * time.Second},
+		{"one after the other", []multi_stream{
+			{bytes: 100, started: at(30), ended: at(40)},
+			{bytes: 100, started: at(0), ended: at(10)},
+		}, 200, 40 * time.Second},
+		{"one not started", []multi_stream{
+			{bytes: 100, started: at(10), ended: at(20)},
+			{},
+		}, 100, 10 * time.Second},
+		{"one finished, one running", []multi_stream{
+			{bytes: 100, started: at(0), ended: at(10)},
+			{bytes: 100, started: at(5)},
+		}, 200, 100 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &multi_test{streams: test.streams}
+			total, span := m.totals(now)
+			if(total != test.total || span != test.span) {
+				t.Fatalf("got %d bytes over %v, want %d over %v", total, span, test.total, test.span)
+			}
+		})
+	}
+}
+
+/*
+ * A step in a multi-stream test: fetch a stream, cancel the test, or
+ * ask for its report, from client, expecting status.
+ */
+type multi_step struct {
+	op     string
+	stream string
+	client string
+	status int
+}
+
+func TestMultiStreams(t *testing.T) {
+	const streams = 3
+	const per = 1000
+	const owner = "192.0.2.1"
+
+	fetch := func(stream int, client string, status int) multi_step {
+		return multi_step{op: "fetch", stream: strconv.Itoa(stream), client: client, status: status}
+	}
+
+	tests := []struct {
+		name   string
+		steps  []multi_step
+		state  string
+		bytes  int64
+		states []string
+	}{
+		{"all fetched", []multi_step{
+			fetch(0, owner, 200), fetch(1, owner, 200), fetch(2, owner, 200),
+		}, "completed", streams * per, []string{"completed", "completed", "completed"}},
+		{"some fetched", []multi_step{
+			fetch(0, owner, 200), fetch(2, owner, 200),
+		}, "running", 2 * per, []string{"completed", "pending", "completed"}},
+		{"a stream fetched twice", []multi_step{
+			fetch(0, owner, 200), fetch(0, owner, 409),
+		}, "running", per, []string{"completed", "pending", "pending"}},
+		{"no such stream", []multi_step{
+			fetch(streams, owner, 404), fetch(-1, owner, 404), {op: "fetch", stream: "x", client: owner, status: 404},
+		}, "running", 0, []string{"pending", "pending", "pending"}},
+		{"another client", []multi_step{
+			fetch(0, "192.0.2.2", 404), {op: "report", client: "192.0.2.2", status: 404},
+		}, "running", 0, []string{"pending", "pending", "pending"}},
+		{"cancelled part way", []multi_step{
+			fetch(0, owner, 200), {op: "cancel"}, fetch(1, owner, 409),
+		}, "aborted", per, []string{"completed", "cancelled", "cancelled"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := defaults
+			admitting(t, c, 0)
+
+			req := httptest.NewRequest("POST", multi_prefix + "?streams=" + strconv.Itoa(streams) + "&bytes=" + strconv.Itoa(per), nil)
+			req.RemoteAddr = owner + ":1234"
+			res := httptest.NewRecorder()
+			route_down_multi(res, req)
+			var plan multi_plan
+			err := json.Unmarshal(res.Body.Bytes(), &plan)
+			if(res.Code != 201 || err != nil) {
+				t.Fatalf("creating got %d %q", res.Code, res.Body.String())
+			}
+			m := find_multi_test(plan.ID)
+			t.Cleanup(func() {
+				m.expiry.Stop()
+				grouped_tests.Delete(m.id)
+			})
+
+			for i, step := range test.steps {
+				path := multi_prefix + "/" + plan.ID
+				switch step.op {
+				case "cancel":
+					m.cancel()
+					continue
+				case "fetch":
+					path += "/" + step.stream
+				}
+				req := httptest.NewRequest("GET", path, nil)
+				req.RemoteAddr = step.client + ":1234"
+				res := httptest.NewRecorder()
+				route_down_multi(res, req)
+				if(res.Code != step.status) {
+					t.Fatalf("step %d: %s %s got %d, want %d", i + 1, step.op, step.stream, res.Code, step.status)
+				}
+				if(step.op == "fetch" && res.Code == 200 && res.Body.Len() != per) {
+					t.Fatalf("step %d: stream of %d bytes, want %d", i + 1, res.Body.Len(), per)
+				}
+			}
+
+			status := m.status()
+			if(status.State != test.state || status.Bytes != test.bytes) {
+				t.Fatalf("got %s with %d bytes, want %s with %d", status.State, status.Bytes, test.state, test.bytes)
+			}
+			for i, s := range status.Streams {
+				if(s.State != test.states[i]) {
+					t.Fatalf("stream %d is %s, want %s", i, s.State, test.states[i])
+				}
+			}
+			if(test_tracker.active.Load() != 0) {
+				t.Fatalf("%d tests still hold slots", test_tracker.active.Load())
+			}
+			client_quotas.Lock()
+			u := client_quotas.byip[owner]
+			var active int
+			var used int64
+			if(u != nil) {
+				length, slot := quota_slot(time.Now(), c.ip_window)
+				active = u.active
+				used, _ = u.window_bytes(slot, length, time.Now())
+			}
+			client_quotas.Unlock()
+			if(active != 0 || used != test.bytes) {
+				t.Fatalf("client has %d running and %d bytes used, want none running and %d", active, used, test.bytes)
+			}
+		})
+	}
+}
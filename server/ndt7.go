@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+/*
+ * The ndt7 protocol from M-Lab, so its clients and JavaScript library
+ * can test against gost.  Both tests run over a WebSocket with the
+ * net.measurementlab.ndt.v7 subprotocol.  For /ndt/v7/download gost
+ * sends binary messages of payload for ndt7_runtime, starting at 8 KiB
+ * and doubling whenever a message would be less than 1/16 of what's
+ * been sent so far, up to 16 MiB.  For /ndt/v7/upload the client sends
+ * them and gost counts what arrives.  Either way, gost sends a
+ * measurement as a JSON text message every ndt7_interval, with the
+ * bytes moved, the time taken and, on Linux, what the kernel knows of
+ * the TCP connection.  The client may send measurements of its own,
+ * which are read and ignored.
+ */
+const ndt7_prefix = "/ndt/v7/"
+const ndt7_protocol = "net.measurementlab.ndt.v7"
+
+const ndt7_runtime = 10 * time.Second
+const ndt7_max_runtime = 15 * time.Second
+const ndt7_interval = 250 * time.Millisecond
+
+const ndt7_initial_message = 1 << 13
+const ndt7_max_message = 1 << 24
+const ndt7_scaling_fraction = 16
+
+type ndt7_app_info struct {
+	ElapsedTime int64 `json:"ElapsedTime"`
+	NumBytes    int64 `json:"NumBytes"`
+}
+
+type ndt7_connection_info struct {
+	Client string `json:"Client"`
+	Server string `json:"Server"`
+	UUID   string `json:"UUID"`
+}
+
+/*
+ * The TCP_INFO fields gost reads, in ndt7's units: microseconds and
+ * bytes per second.
+ */
+type ndt7_tcp_info struct {
+	ElapsedTime  int64   `json:"ElapsedTime"`
+	RTT          int64   `json:"RTT"`
+	RTTVar       int64   `json:"RTTVar"`
+	SndMSS       uint32  `json:"SndMSS"`
+	SndCwnd      uint32  `json:"SndCwnd"`
+	TotalRetrans uint32  `json:"TotalRetrans"`
+	DeliveryRate float64 `json:"DeliveryRate"`
+}
+
+type ndt7_measurement struct {
+	AppInfo        *ndt7_app_info        `json:"AppInfo,omitempty"`
+	ConnectionInfo *ndt7_connection_info `json:"ConnectionInfo,omitempty"`
+	Origin         string                `json:"Origin"`
+	Test           string                `json:"Test"`
+	TCPInfo        *ndt7_tcp_info        `json:"TCPInfo,omitempty"`
+}
+
+/*
+ * Dispatch /ndt/v7/* requests.
+ */
+func route_ndt7(res http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case ndt7_prefix + "download":
+		ndt7_test(res, req, "download")
+	case ndt7_prefix + "upload":
+		ndt7_test(res, req, "upload")
+	default:
+		res.WriteHeader(404)
+		io.WriteString(res, "Not Found")
+	}
+}
+
+/*
+ * Send a measurement of the test so far.  The first one also says
+ * which connection it's about.
+ */
+func ndt7_measure(ws *ws_conn, t *test_run, test string, first bool) error {
+	elapsed := time.Since(t.start)
+	m := ndt7_measurement{
+		AppInfo: &ndt7_app_info{ElapsedTime: elapsed.Microseconds(), NumBytes: t.moved.Load()},
+		Origin:  "server",
+		Test:    test,
+	}
+	if(first) {
+		m.ConnectionInfo = &ndt7_connection_info{
+			Client: ws.conn.RemoteAddr().String(),
+			Server: ws.conn.LocalAddr().String(),
+			UUID:   t.id,
+		}
+	}
+	stats := read_tcp_info(ws.conn)
+	if(stats != nil) {
+		m.TCPInfo = &ndt7_tcp_info{
+			ElapsedTime:  elapsed.Microseconds(),
+			RTT:          int64(stats.RTTMs * 1000),
+			RTTVar:       int64(stats.RTTVarMs * 1000),
+			SndMSS:       stats.MSS,
+			SndCwnd:      stats.Cwnd,
+			TotalRetrans: stats.Retransmits,
+			DeliveryRate: stats.DeliveryMbps * 1e6 / 8,
+		}
+	}
+
+	message, _ := json.Marshal(m)
+	return ws.write_message(ws_op_text, message)
+}
+
+/*
+ * Run an ndt7 download or upload test.
+ */
+func ndt7_test(res http.ResponseWriter, req *http.Request, test string) {
+	direction := "down"
+	if(test == "upload") {
+		direction = "up"
+	}
+	t := begin_test(res, req, direction, 0)
+	if(t == nil) {
+		return
+	}
+	t.protocol = "ndt7"
+
+	ws, err := ws_upgrade(res, req, []string{ndt7_protocol})
+	if(err != nil) {
+		log_request(req, log_level_debug, "ndt7 upgrade failed", "remote", req.RemoteAddr, "error", err)
+		t.end(0, err)
+		return
+	}
+	defer ws.conn.Close()
+	ws.max_message = ndt7_max_message
+
+	c := request_settings(req)
+	runtime := min(ndt7_runtime, c.max_test_duration)
+	ws.conn.SetDeadline(t.start.Add(min(ndt7_max_runtime, c.max_test_duration + time.Second)))
+
+	// Whatever the client sends, counted if it's an upload.  read_message
+	// answers pings and close frames on the way.
+	if(direction == "up") {
+		ws.rw = bufio.NewReadWriter(bufio.NewReader(t.reader(ws.rw.Reader)), ws.rw.Writer)
+	}
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			_, _, err := ws.read_message()
+			if(err != nil) {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	err = ndt7_measure(ws, t, test, true)
+	measured := time.Now()
+	size := int64(ndt7_initial_message)
+	var sent int64
+	for err == nil && time.Since(t.start) < runtime {
+		if(direction == "down") {
+			size = min(size, c.max_test_bytes - sent)
+			if(size <= 0) {
+				break
+			}
+			var n int64
+			n, err = ws.write_payload_message(t.writer(ws.conn), size)
+			sent += n
+			if(size < ndt7_max_message && size <= sent / ndt7_scaling_fraction) {
+				size *= 2
+			}
+		} else {
+			if(t.moved.Load() >= c.max_test_bytes) {
+				break
+			}
+			select {
+			case err = <-closed:
+			case <-time.After(ndt7_interval):
+			}
+		}
+
+		select {
+		case err = <-closed:
+		default:
+		}
+		if(err == nil && time.Since(measured) >= ndt7_interval) {
+			err = ndt7_measure(ws, t, test, false)
+			measured = time.Now()
+		}
+	}
+	if(err == ws_err_closed) {
+		// read_message has answered the client's close, and nothing
+		// may follow that.
+		err = nil
+	} else if(err == nil) {
+		ndt7_measure(ws, t, test, false)
+		ws.close(ws_close_normal, "")
+	}
+	t.end(t.moved.Load(), err)
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+/*
+ * Open a WebSocket to path as an ndt7 client would, offering protocol,
+ * or return the status the server refused it with.
+ */
+func ndt7_dial(t *testing.T, server *httptest.Server, path string, protocol string) (*ws_conn, int) {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	req, _ := http.NewRequest("GET", server.URL + path, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if(protocol != "") {
+		req.Header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	err = req.Write(rw)
+	if(err == nil) {
+		err = rw.Flush()
+	}
+	var res *http.Response
+	if(err == nil) {
+		res, err = http.ReadResponse(rw.Reader, req)
+	}
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	if(res.StatusCode != 101) {
+		return nil, res.StatusCode
+	}
+	if(res.Header.Get("Sec-WebSocket-Protocol") != ndt7_protocol) {
+		t.Fatalf("subprotocol %q, want %q", res.Header.Get("Sec-WebSocket-Protocol"), ndt7_protocol)
+	}
+	return &ws_conn{conn: conn, rw: rw, max_message: ndt7_max_message, client: true}, 101
+}
+
+/*
+ * The sizes of the binary messages a download of limit bytes is sent
+ * in, as far as they go.
+ */
+func ndt7_message_sizes(limit int64, count int) []int64 {
+	sizes := []int64{}
+	size := int64(ndt7_initial_message)
+	var sent int64
+	for len(sizes) < count && sent < limit {
+		size = min(size, limit - sent)
+		sizes = append(sizes, size)
+		sent += size
+		if(size < ndt7_max_message && size <= sent / ndt7_scaling_fraction) {
+			size *= 2
+		}
+	}
+	return sizes
+}
+
+/*
+ * Wait for one more result than before to be recorded, and return it.
+ */
+func wait_for_result(t *testing.T, before int) test_result {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		all := results_so_far()
+		if(len(all) > before) {
+			return all[0]
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("no result was recorded")
+	return test_result{}
+}
+
+func TestNDT7(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(route_ndt7))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name      string
+		path      string
+		protocol  string
+		status    int
+		max_bytes int64
+		upload    []int
+	}{
+		{"download for the runtime", "download", ndt7_protocol, 101, 0, nil},
+		{"download of the most allowed", "download", ndt7_protocol, 101, 1000000, nil},
+		{"upload", "upload", ndt7_protocol, 101, 0, []int{10000, 20000, 70000}},
+		{"upload of more than allowed", "upload", ndt7_protocol, 101, 100000, []int{60000, 60000}},
+
+		{"no subprotocol", "download", "", 400, 0, nil},
+		{"another subprotocol", "download", "chat", 400, 0, nil},
+		{"no such test", "sideways", ndt7_protocol, 404, 0, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := defaults
+			c.max_test_duration = time.Second
+			if(test.max_bytes > 0) {
+				c.max_test_bytes = test.max_bytes
+			}
+			admitting(t, c, 0)
+			before := len(results_so_far())
+
+			ws, status := ndt7_dial(t, server, ndt7_prefix + test.path, test.protocol)
+			if(status != test.status) {
+				t.Fatalf("status %d, want %d", status, test.status)
+			}
+			if(ws == nil) {
+				return
+			}
+
+			// What an upload sends on the wire, frames and all, which
+			// is what the server counts.
+			var sent int64
+			for _, n := range test.upload {
+				err := ws.write_message(ws_op_binary, make([]byte, n))
+				if(err != nil) {
+					t.Fatal(err)
+				}
+				sent += int64(2 + 4 + n)
+				switch {
+				case n >= 126 && n <= 0xffff:
+					sent += 2
+				case n > 0xffff:
+					sent += 8
+				}
+			}
+			client_closes := test.upload != nil && test.max_bytes == 0
+			if(client_closes) {
+				ws.write_message(ws_op_close, binary.BigEndian.AppendUint16(nil, ws_close_normal))
+				sent += 2 + 4 + 2
+			}
+
+			var measurements []ndt7_measurement
+			var sizes []int64
+			var received int64
+			for {
+				opcode, message, err := ws.read_message()
+				if(err == ws_err_closed) {
+					break
+				}
+				if(err != nil) {
+					t.Fatalf("after %d measurements and %d messages: %v", len(measurements), len(sizes), err)
+				}
+				if(opcode == ws_op_binary) {
+					sizes = append(sizes, int64(len(message)))
+					received += int64(len(message))
+					continue
+				}
+				var m ndt7_measurement
+				err = json.Unmarshal(message, &m)
+				if(opcode != ws_op_text || err != nil) {
+					t.Fatalf("message of opcode %d, %v", opcode, err)
+				}
+				measurements = append(measurements, m)
+			}
+
+			want := "download"
+			moved := received
+			if(test.upload != nil) {
+				want = "upload"
+				moved = sent
+			}
+			// Once the client has closed, there's no last word.
+			if(len(measurements) == 0 || (len(measurements) < 2 && !client_closes)) {
+				t.Fatalf("%d measurements, want at least the first and last", len(measurements))
+			}
+			if(measurements[0].ConnectionInfo == nil || measurements[0].ConnectionInfo.UUID == "") {
+				t.Fatal("the first measurement doesn't say which connection it's about")
+			}
+			var last int64
+			for i, m := range measurements {
+				if(m.Origin != "server" || m.Test != want || m.AppInfo == nil) {
+					t.Fatalf("measurement %d is %+v", i, m)
+				}
+				if(i > 0 && m.ConnectionInfo != nil) {
+					t.Fatalf("measurement %d says which connection it's about again", i)
+				}
+				if(m.AppInfo.NumBytes < last) {
+					t.Fatalf("measurement %d went back from %d to %d bytes", i, last, m.AppInfo.NumBytes)
+				}
+				last = m.AppInfo.NumBytes
+			}
+			if(last > moved || (test.upload == nil && last != moved)) {
+				t.Fatalf("last measurement says %d bytes, want %d", last, moved)
+			}
+
+			if(test.upload == nil) {
+				limit := c.max_test_bytes
+				if(test.max_bytes == 0) {
+					limit = received
+				}
+				expected := ndt7_message_sizes(limit, len(sizes))
+				if(len(expected) != len(sizes)) {
+					t.Fatalf("%d messages, want %d", len(sizes), len(expected))
+				}
+				for i := range sizes {
+					if(sizes[i] != expected[i]) {
+						t.Fatalf("message %d of %d bytes, want %d", i, sizes[i], expected[i])
+					}
+				}
+			}
+
+			result := wait_for_result(t, before)
+			if(test.upload != nil && test.max_bytes > 0) {
+				// Cut off part way through what was sent.
+				moved = result.Bytes
+			}
+			if(result.Protocol != "ndt7" || result.Outcome != "completed" || result.Bytes != moved || result.ID != measurements[0].ConnectionInfo.UUID) {
+				t.Fatalf("recorded %+v, want a completed ndt7 test of %d bytes", result, moved)
+			}
+			if(test.max_bytes > 0 && result.Bytes < test.max_bytes) {
+				t.Fatalf("stopped at %d bytes, short of %d", result.Bytes, test.max_bytes)
+			}
+		})
+	}
+}
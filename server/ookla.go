@@ -0,0 +1,119 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * The legacy Ookla HTTP protocol, as spoken by speedtest mini and the
+ * simple test clients built into routers and set-top boxes.  They fetch
+ * /speedtest/random<N>x<N>.jpg for download, POST to
+ * /speedtest/upload.php for upload, and time /speedtest/latency.txt for
+ * latency.  The "images" are gost's usual payload at the sizes of the
+ * stock files, which is all those clients look at.
+ */
+const ookla_prefix = "/speedtest/"
+
+var ookla_images = map[string]int64{
+	"350":  245388,
+	"500":  505544,
+	"750":  1118012,
+	"1000": 1986284,
+	"1500": 4468241,
+	"2000": 7907740,
+	"2500": 12407926,
+	"3000": 17816816,
+	"3500": 24262167,
+	"4000": 31625365,
+}
+
+/*
+ * Dispatch /speedtest/* requests.
+ */
+func route_ookla(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	res.Header().Set("Pragma", "no-cache")
+
+	name := strings.TrimPrefix(req.URL.Path, ookla_prefix)
+	switch {
+	case name == "upload.php" || name == "upload.aspx" || name == "upload.jsp":
+		ookla_upload(res, req)
+	case name == "latency.txt":
+		res.Header().Set("Content-Type", "text/plain")
+		io.WriteString(res, "test=test\n")
+	case strings.HasPrefix(name, "random") && strings.HasSuffix(name, ".jpg"):
+		ookla_download(res, req, strings.TrimSuffix(strings.TrimPrefix(name, "random"), ".jpg"))
+	default:
+		res.WriteHeader(404)
+		io.WriteString(res, "Not Found")
+	}
+}
+
+/*
+ * Download: random<N>x<N>.jpg, as big as the stock image of that size.
+ */
+func ookla_download(res http.ResponseWriter, req *http.Request, dimensions string) {
+	side, other, _ := strings.Cut(dimensions, "x")
+	n, ok := ookla_images[side]
+	if(!ok || other != side) {
+		res.WriteHeader(404)
+		io.WriteString(res, "Not Found")
+		return
+	}
+	if(req.Method != "GET" && req.Method != "HEAD" && req.Method != "") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+	n = min(n, request_settings(req).max_test_bytes)
+
+	if(req.Method == "HEAD") {
+		write_payload_headers(res, n)
+		res.Header().Set("Content-Type", "image/jpeg")
+		return
+	}
+
+	test := begin_test(res, req, "down", n)
+	if(test == nil) {
+		return
+	}
+
+	write_payload_headers(res, n)
+	res.Header().Set("Content-Type", "image/jpeg")
+
+	written, err := write_payload(test.writer(res), n)
+	test.end(written, err)
+}
+
+/*
+ * Upload sink.  The client learns how much arrived from the size=
+ * reply.
+ */
+func ookla_upload(res http.ResponseWriter, req *http.Request) {
+	if(req.Method != "POST") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+
+	test := begin_test(res, req, "up", req.ContentLength)
+	if(test == nil) {
+		return
+	}
+	slow := watch_upload_rate(res, &test.moved)
+	n, err := drain_body(test.reader(upload_body(res, req)))
+	if(slow()) {
+		err = upload_too_slow
+	}
+	connection_of(req).uploaded.Add(n)
+	test.end(n, err)
+	if(err != nil) {
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/plain")
+	io.WriteString(res, "size=" + strconv.FormatInt(n, 10))
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+/*
+ * Payloads come from one block of random bytes, made once at startup
+ * and written over and over, so producing them costs nothing next to
+ * the network.  A 1MB period is far beyond what a deflate or brotli
+ * window can see, so on the wire it's as incompressible as fresh
+ * randomness.  With -payload zero they're zeros instead, for finding
+ * links that compress.
+ */
+const payload_block_size = 1024 * 1024
+
+var payload_fills = map[string]bool{"random": true, "zero": true}
+
+var random_block = func() []byte {
+	b := make([]byte, payload_block_size)
+	rand.Read(b)
+	return b
+}()
+
+var zero_block = make([]byte, payload_block_size)
+
+/*
+ * Walks through the block set by -payload, handing out slices of it.
+ * Callers must only read what they're given.
+ */
+type payload_source struct {
+	block  []byte
+	offset int
+}
+
+func new_payload_source() *payload_source {
+	block := random_block
+	if(settings().payload_fill == "zero") {
+		block = zero_block
+	}
+	return &payload_source{block: block}
+}
+
+/*
+ * Up to the next n bytes of payload, stopping short at the end of the
+ * block, so that the payload is the block repeated exactly and any
+ * offset into it can be found again.
+ */
+func (s *payload_source) next(n int) []byte {
+	if(s.offset == len(s.block)) {
+		s.offset = 0
+	}
+	p := s.block[s.offset:min(s.offset + n, len(s.block))]
+	s.offset += len(p)
+	return p
+}
+
+/*
+ * Move to offset bytes into the payload.
+ */
+func (s *payload_source) seek(offset int64) {
+	s.offset = int(offset % int64(len(s.block)))
+}
+
+/*
+ * An ETag for n bytes of payload, which stays the same for as long as
+ * the block does, so that a client resuming with If-Range can tell if
+ * it's still getting the same bytes.
+ */
+func payload_etag(n int64) string {
+	block := random_block
+	if(settings().payload_fill == "zero") {
+		block = zero_block
+	}
+	sum := sha256.Sum256(block[:4096])
+	return fmt.Sprintf(`"%x-%d"`, sum[:8], n)
+}
+
+func (s *payload_source) Read(p []byte) (int, error) {
+	return copy(p, s.next(min(len(p), payload_block_size))), nil
+}
+
+/*
+ * A reader producing exactly n bytes of payload, for when it has to be
+ * read rather than written, as in client-mode uploads.
+ */
+func payload_reader(n int64) io.Reader {
+	return io.LimitReader(new_payload_source(), n)
+}
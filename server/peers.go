@@ -0,0 +1,186 @@
+package server
+
+import (
+	"math/rand/v2"
+	"net/url"
+	"sync"
+	"time"
+)
+
+/*
+ * Scheduled tests against other gost servers, so that a fleet of them
+ * watches the bandwidth between each other.  Each peer listed in the
+ * config file is tested on its own cron-style schedule, delayed by a
+ * random amount up to its jitter so that a fleet on the same schedule
+ * doesn't test all at once, with the same latency, download and upload
+ * tests client mode runs.  The results are kept in memory, the newest
+ * peer_results_kept for each link between two nodes, and logged.
+ */
+const peer_results_kept = 100
+const peer_default_schedule = "*/15 * * * *"
+const peer_default_bytes = 25 * 1000 * 1000
+const peer_test_timeout = 2 * time.Minute
+
+type peer_spec struct {
+	name     string
+	url      *url.URL
+	schedule *cron_schedule
+	jitter   time.Duration
+	enabled  bool
+	bytes    int64
+	token    string
+	insecure bool
+}
+
+/*
+ * What one scheduled test of a peer found.
+ */
+type peer_result struct {
+	Peer     string           `json:"peer"`
+	URL      string           `json:"url"`
+	Started  time.Time        `json:"started"`
+	Seconds  float64          `json:"seconds"`
+	Latency  *latency_report  `json:"latency,omitempty"`
+	Download *transfer_report `json:"download,omitempty"`
+	Upload   *transfer_report `json:"upload,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+/*
+ * A link between two nodes in the mesh, by name, as tested from from.
+ */
+type mesh_key struct {
+	from string
+	to   string
+}
+
+var peer_results = struct {
+	sync.Mutex
+	bylink map[mesh_key][]peer_result
+}{bylink: map[mesh_key][]peer_result{}}
+
+/*
+ * Peers with a test under way, so that a slow one isn't started again
+ * on top of itself.
+ */
+var peers_running sync.Map
+
+/*
+ * When a peer is next due after now, or the zero time if never.
+ */
+func (p peer_spec) next_run(now time.Time) time.Time {
+	t := p.schedule.next(now)
+	if(t.IsZero() || p.jitter <= 0) {
+		return t
+	}
+	return t.Add(time.Duration(rand.Int64N(int64(p.jitter))))
+}
+
+/*
+ * Test each enabled peer whenever it's due.  The peers come from the
+ * configuration in force, so a reload can add, drop or reschedule them.
+ */
+func go_schedule_peers() {
+	go func() {
+		due := map[string]time.Time{}
+		schedules := map[string]string{}
+
+		for now := range time.Tick(time.Second) {
+			for _, p := range settings().peers {
+				key := p.schedule.text + " " + p.jitter.String()
+				if(!p.enabled) {
+					delete(schedules, p.name)
+					continue
+				}
+				if(schedules[p.name] != key) {
+					schedules[p.name] = key
+					due[p.name] = p.next_run(now)
+					continue
+				}
+				if(due[p.name].IsZero() || now.Before(due[p.name])) {
+					continue
+				}
+				due[p.name] = p.next_run(now)
+
+				_, busy := peers_running.LoadOrStore(p.name, true)
+				if(busy) {
+					log_at(log_level_error, "Skipping peer %s, whose last test is still running", p.name)
+					continue
+				}
+				go func(p peer_spec) {
+					defer peers_running.Delete(p.name)
+					result := test_peer(p)
+					c := settings()
+					store_peer_result(c.node_name, result)
+					log_peer_result(result)
+					push_peer_result(c, result)
+				}(p)
+			}
+		}
+	}()
+}
+
+/*
+ * Run the client tests against a peer.
+ */
+func test_peer(p peer_spec) peer_result {
+	o := client_options{
+		server:   p.url,
+		bytes:    p.bytes,
+		pings:    10,
+		streams:  1,
+		insecure: p.insecure,
+		token:    p.token,
+		timeout:  peer_test_timeout,
+	}
+
+	start := time.Now()
+	report, err := run_client_tests(new_test_client(o), o)
+	result := peer_result{
+		Peer:     p.name,
+		URL:      p.url.String(),
+		Started:  start,
+		Seconds:  time.Since(start).Seconds(),
+		Latency:  report.Latency,
+		Download: report.Download,
+		Upload:   report.Upload,
+	}
+	if(err != nil) {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+/*
+ * Keep a result from node from, ours or one pushed to /mesh.
+ */
+func store_peer_result(from string, result peer_result) {
+	key := mesh_key{from, result.Peer}
+	peer_results.Lock()
+	defer peer_results.Unlock()
+
+	kept := append(peer_results.bylink[key], result)
+	if(len(kept) > peer_results_kept) {
+		kept = kept[len(kept) - peer_results_kept:]
+	}
+	peer_results.bylink[key] = kept
+}
+
+func log_peer_result(result peer_result) {
+	fields := []any{"peer", result.Peer, "duration_ms", result.Seconds * 1000}
+	if(result.Latency != nil) {
+		fields = append(fields, "rtt_ms", result.Latency.AvgMs)
+	}
+	if(result.Download != nil) {
+		fields = append(fields, "down_mbps", result.Download.Mbps)
+	}
+	if(result.Upload != nil) {
+		fields = append(fields, "up_mbps", result.Upload.Mbps)
+	}
+	if(result.Error != "") {
+		fields = append(fields, "error", result.Error)
+		log_fields(log_level_error, "peer test failed", fields...)
+		return
+	}
+	log_fields(log_level_info, "peer test finished", fields...)
+}
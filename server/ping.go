@@ -0,0 +1,153 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Timestamps are reported as nanoseconds on the monotonic clock since
+ * the process started.  They are only meaningful relative to each
+ * other, which is all a client needs to separate server time from
+ * network time.
+ */
+var process_start = time.Now()
+
+func monotonic_ns() int64 {
+	return int64(time.Since(process_start))
+}
+
+/*
+ * Largest series a client may request with ?count=.
+ */
+const ping_max_count = 10000
+
+/*
+ * A run of pings over one connection, started by ?count=N.
+ */
+type ping_series struct {
+	want    int
+	seen    int
+	last_ns int64
+	gap_min int64
+	gap_max int64
+	gap_sum int64
+}
+
+/*
+ * The reply to a single ping.  The summary only appears on the final
+ * ping of a ?count= series.
+ */
+type ping_reply struct {
+	Seq        int           `json:"seq"`
+	Connection uint64        `json:"connection"`
+	RecvNs     int64         `json:"recv_ns"`
+	SendNs     int64         `json:"send_ns"`
+	Remaining  int           `json:"remaining,omitempty"`
+	Summary    *ping_summary `json:"summary,omitempty"`
+}
+
+/*
+ * What the server saw across a ping series.  Gaps are the time between
+ * consecutive pings arriving, which on a keep-alive connection with one
+ * ping in flight approximates the client's round trip.
+ */
+type ping_summary struct {
+	Count    int   `json:"count"`
+	GapMinNs int64 `json:"gap_min_ns"`
+	GapAvgNs int64 `json:"gap_avg_ns"`
+	GapMaxNs int64 `json:"gap_max_ns"`
+}
+
+/*
+ * Fold one ping arriving at now into the series and fill in reply.
+ */
+func (s *ping_series) record(now int64, reply *ping_reply) {
+	if(s.seen > 0) {
+		gap := now - s.last_ns
+		if(s.seen == 1 || gap < s.gap_min) {
+			s.gap_min = gap
+		}
+		if(gap > s.gap_max) {
+			s.gap_max = gap
+		}
+		s.gap_sum += gap
+	}
+	s.seen++
+	s.last_ns = now
+
+	reply.Seq = s.seen
+	reply.Remaining = s.want - s.seen
+	if(s.seen < s.want) {
+		return
+	}
+
+	reply.Summary = &ping_summary{Count: s.seen, GapMinNs: s.gap_min, GapMaxNs: s.gap_max}
+	if(s.seen > 1) {
+		reply.Summary.GapAvgNs = s.gap_sum / int64(s.seen - 1)
+	}
+	*s = ping_series{}
+}
+
+/*
+ * GET: Answer as quickly as possible with the server's receive and
+ * send timestamps, in headers and in a small JSON body.  ?count=N
+ * starts a series of N pings on this connection; the last reply in the
+ * series summarizes the gaps between them.  ?test_id= counts the ping
+ * towards that test's bufferbloat figure.  ?delay= and ?jitter= hold
+ * the reply back.
+ */
+func route_ping(res http.ResponseWriter, req *http.Request) {
+	recv := monotonic_ns()
+	if(req.Method != "GET" && req.Method != "HEAD" && req.Method != "") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+
+	impair, err := requested_impairment(req)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	conn := connection_of(req)
+	reply := ping_reply{Connection: conn.id, RecvNs: recv}
+
+	conn.mu.Lock()
+	count := req.URL.Query().Get("count")
+	if(count != "") {
+		n, err := strconv.Atoi(count)
+		if(err != nil || n < 1 || n > ping_max_count) {
+			conn.mu.Unlock()
+			res.WriteHeader(400) // Bad Request
+			io.WriteString(res, "count must be between 1 and " + strconv.Itoa(ping_max_count))
+			return
+		}
+		if(conn.ping.want == 0) {
+			conn.ping.want = n
+		}
+	}
+	if(conn.ping.want > 0) {
+		conn.ping.record(recv, &reply)
+	}
+	conn.mu.Unlock()
+
+	test := strings.ToLower(req.URL.Query().Get("test_id"))
+	if(valid_test_id(test)) {
+		note_test_ping(test, conn.id, recv)
+	}
+
+	h := res.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Gost-Recv-Ns", strconv.FormatInt(recv, 10))
+
+	impair.pause()
+	reply.SendNs = monotonic_ns()
+	h.Set("X-Gost-Send-Ns", strconv.FormatInt(reply.SendNs, 10))
+	write_json(res, 200, reply)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/pprof"
+)
+
+/*
+ * Go's profiler and execution tracer, for finding out where the time
+ * goes when gost pegs a core pushing 25GbE.  They're served on the
+ * admin listener under /debug/pprof/, where go tool pprof expects
+ * them, only with -pprof, and only with an admin token or JWT: the
+ * tests' tokens never open them.  The trace endpoint captures a
+ * runtime/trace for ?seconds=.
+ */
+const pprof_prefix = "/debug/pprof/"
+
+func register_pprof_routes(mux *http.ServeMux) {
+	mux.HandleFunc(pprof_prefix, instrument(pprof_prefix, require_pprof(pprof.Index)))
+	mux.HandleFunc(pprof_prefix + "cmdline", instrument(pprof_prefix, require_pprof(pprof.Cmdline)))
+	mux.HandleFunc(pprof_prefix + "profile", instrument(pprof_prefix, require_pprof(pprof.Profile)))
+	mux.HandleFunc(pprof_prefix + "symbol", instrument(pprof_prefix, require_pprof(pprof.Symbol)))
+	mux.HandleFunc(pprof_prefix + "trace", instrument(pprof_prefix, require_pprof(pprof.Trace)))
+}
+
+/*
+ * Wrap a profiling handler so that it's only there with -pprof and
+ * admin credentials to guard it, and then only for those.
+ */
+func require_pprof(handler http.HandlerFunc) http.HandlerFunc {
+	authed := require_admin(handler)
+	return func(res http.ResponseWriter, req *http.Request) {
+		c := settings()
+		if(!c.admin_pprof || (admin_tokens.current() == nil && !c.jwt_enabled())) {
+			res.WriteHeader(404)
+			io.WriteString(res, "Not Found")
+			return
+		}
+		authed(res, req)
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+ * Live progress for a running test as Server-Sent Events.  A client
+ * opens /progress/{id} alongside a transfer and gets a "progress"
+ * event every interval, then a single "result" event when the test
+ * finishes.
+ */
+const progress_prefix = "/progress/"
+const progress_default_interval = 250 * time.Millisecond
+const progress_min_interval = 50 * time.Millisecond
+
+type progress_event struct {
+	ID      string  `json:"id"`
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+	Mbps    float64 `json:"mbps"`
+	AvgMbps float64 `json:"avg_mbps"`
+
+	// Download throughput samples taken since the last event.
+	Samples []float64 `json:"samples_mbps,omitempty"`
+}
+
+/*
+ * Write one SSE event and push it out.
+ */
+func write_event(res http.ResponseWriter, event string, v interface{}) error {
+	data, _ := json.Marshal(v)
+	_, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event, data)
+	if(err != nil) {
+		return err
+	}
+	return http.NewResponseController(res).Flush()
+}
+
+/*
+ * Start an SSE response.
+ */
+func write_event_headers(res http.ResponseWriter) {
+	h := res.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Accel-Buffering", "no")
+	res.WriteHeader(200)
+}
+
+/*
+ * Find a finished test's result among the ones req may see, recent or
+ * in the results database.
+ */
+func find_result(req *http.Request, id string) (test_result, bool) {
+	results, _ := results_store(req).page(result_filter{id: id}, 0, 1)
+	if(len(results) == 0 && results_db != nil) {
+		// Too old for the ring, perhaps.
+		results, _, _ = results_db.page(scope_filter(req, result_filter{id: id}), 0, 1)
+	}
+	if(len(results) == 0) {
+		return test_result{}, false
+	}
+	return results[0], true
+}
+
+/*
+ * GET: Stream progress for the test with the given ID.  ?interval=
+ * sets how often, e.g. 100ms.
+ */
+func route_progress(res http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, progress_prefix)
+	interval := progress_default_interval
+	value := req.URL.Query().Get("interval")
+	if(value != "") {
+		d, err := time.ParseDuration(value)
+		if(err != nil || d < progress_min_interval) {
+			res.WriteHeader(400) // Bad Request
+			io.WriteString(res, "interval must be a duration of at least " + progress_min_interval.String())
+			return
+		}
+		interval = d
+	}
+
+	v, running := active_runs.Load(id)
+	if(!running) {
+		result, ok := find_result(req, id)
+		if(!ok) {
+			res.WriteHeader(404)
+			io.WriteString(res, "No such test")
+			return
+		}
+		write_event_headers(res)
+		write_event(res, "result", result)
+		return
+	}
+	t := v.(*test_run)
+
+	write_event_headers(res)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last_bytes := int64(0)
+	last_time := t.start
+	sampled := 0
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-t.done:
+			write_event(res, "result", t.result)
+			return
+		case now := <-ticker.C:
+			bytes := t.moved.Load()
+			event := progress_event{
+				ID:      t.id,
+				Bytes:   bytes,
+				Seconds: now.Sub(t.start).Seconds(),
+				Mbps:    mbps(bytes - last_bytes, now.Sub(last_time)),
+				AvgMbps: mbps(bytes, now.Sub(t.start)),
+				Samples: t.samples_since(sampled),
+			}
+			last_bytes, last_time = bytes, now
+			sampled += len(event.Samples)
+
+			err := write_event(res, "progress", event)
+			if(err != nil) {
+				return
+			}
+		}
+	}
+}
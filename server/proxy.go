@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * The PROXY protocol, versions 1 and 2, as sent by HAProxy and cloud
+ * load balancers ahead of each connection to say who the client is.
+ * With -proxy-protocol every connection to the HTTP listeners must
+ * start with a header.  The address in it is believed from any peer,
+ * or only from -trusted-proxies if any are listed; otherwise the peer's
+ * own address stands.  See
+ * https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt.
+ */
+const proxy_header_timeout = 5 * time.Second
+const proxy_v1_max = 107
+
+var proxy_v2_signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxy_listener struct {
+	net.Listener
+}
+
+/*
+ * Wrap l to read a PROXY header from each connection, if configured.
+ */
+func proxy_listen(l net.Listener, c *configuration) net.Listener {
+	if(!c.proxy_protocol) {
+		return l
+	}
+	return proxy_listener{l}
+}
+
+func (l proxy_listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if(err != nil) {
+		return nil, err
+	}
+	return &proxy_conn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+/*
+ * A connection whose PROXY header is read on first use, from the
+ * connection's own goroutine rather than the accept loop.
+ */
+type proxy_conn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (p *proxy_conn) header() error {
+	p.once.Do(func() {
+		p.remote = p.Conn.RemoteAddr()
+		p.Conn.SetReadDeadline(time.Now().Add(proxy_header_timeout))
+		source, err := read_proxy_header(p.reader)
+		p.Conn.SetReadDeadline(time.Time{})
+		if(err != nil) {
+			p.err = fmt.Errorf("PROXY header from %v: %v", p.remote, err)
+			log_at(log_level_debug, "%v", p.err)
+			return
+		}
+
+		peer, _ := netip.ParseAddrPort(p.remote.String())
+		c := settings()
+		if(source.IsValid() && (len(c.trusted_proxies) == 0 || trusted_proxy(c, peer.Addr()))) {
+			p.remote = net.TCPAddrFromAddrPort(source)
+		}
+	})
+	return p.err
+}
+
+func (p *proxy_conn) Read(b []byte) (int, error) {
+	err := p.header()
+	if(err != nil) {
+		return 0, err
+	}
+	return p.reader.Read(b)
+}
+
+func (p *proxy_conn) RemoteAddr() net.Addr {
+	p.header()
+	return p.remote
+}
+
+/*
+ * Let writes from a file still go out by sendfile().
+ */
+func (p *proxy_conn) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := p.Conn.(io.ReaderFrom)
+	if(!ok) {
+		return io.Copy(struct{ io.Writer }{p.Conn}, src)
+	}
+	return rf.ReadFrom(src)
+}
+
+func (p *proxy_conn) NetConn() net.Conn {
+	return p.Conn
+}
+
+/*
+ * Read a v1 or v2 header and return the client address it gives.  A
+ * header that doesn't name one, such as a load balancer's own health
+ * check, gives the zero AddrPort.
+ */
+func read_proxy_header(r *bufio.Reader) (netip.AddrPort, error) {
+	start, err := r.Peek(len(proxy_v2_signature))
+	if(err != nil) {
+		return netip.AddrPort{}, err
+	}
+	if(bytes.Equal(start, proxy_v2_signature)) {
+		return read_proxy_v2(r)
+	}
+	if(bytes.HasPrefix(start, []byte("PROXY "))) {
+		return read_proxy_v1(r)
+	}
+	return netip.AddrPort{}, errors.New("no PROXY header")
+}
+
+/*
+ * "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+ */
+func read_proxy_v1(r *bufio.Reader) (netip.AddrPort, error) {
+	var line []byte
+	for len(line) < proxy_v1_max {
+		b, err := r.ReadByte()
+		if(err != nil) {
+			return netip.AddrPort{}, err
+		}
+		line = append(line, b)
+		if(b == '\n') {
+			break
+		}
+	}
+	if(!bytes.HasSuffix(line, []byte("\r\n"))) {
+		return netip.AddrPort{}, errors.New("v1 header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if(len(fields) >= 2 && fields[1] == "UNKNOWN") {
+		return netip.AddrPort{}, nil
+	}
+	if(len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6")) {
+		return netip.AddrPort{}, errors.New("malformed v1 header")
+	}
+
+	addr, err := netip.ParseAddr(fields[2])
+	if(err != nil) {
+		return netip.AddrPort{}, err
+	}
+	if(addr.Is4() != (fields[1] == "TCP4")) {
+		return netip.AddrPort{}, errors.New("v1 address isn't of the header's family")
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if(err != nil) {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+/*
+ * The binary header: signature, version and command, family, length,
+ * then addresses and any TLVs, which are skipped.
+ */
+func read_proxy_v2(r *bufio.Reader) (netip.AddrPort, error) {
+	head := make([]byte, 16)
+	_, err := io.ReadFull(r, head)
+	if(err != nil) {
+		return netip.AddrPort{}, err
+	}
+	if(head[12] >> 4 != 2) {
+		return netip.AddrPort{}, fmt.Errorf("unsupported version %d", head[12] >> 4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	_, err = io.ReadFull(r, body)
+	if(err != nil) {
+		return netip.AddrPort{}, err
+	}
+
+	// LOCAL: the proxy talking for itself.
+	if(head[12] & 0x0f == 0) {
+		return netip.AddrPort{}, nil
+	}
+
+	switch head[13] >> 4 {
+	case 1:
+		if(len(body) < 12) {
+			return netip.AddrPort{}, errors.New("short v2 IPv4 addresses")
+		}
+		addr := netip.AddrFrom4([4]byte(body[0:4]))
+		return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[8:10])), nil
+	case 2:
+		if(len(body) < 36) {
+			return netip.AddrPort{}, errors.New("short v2 IPv6 addresses")
+		}
+		addr := netip.AddrFrom16([16]byte(body[0:16]))
+		return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[32:34])), nil
+	}
+	return netip.AddrPort{}, nil
+}
+
+/*
+ * Dial for gost's own health probes, which must speak the PROXY
+ * protocol too when the listeners expect it.
+ */
+func proxy_dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if(err != nil || !settings().proxy_protocol) {
+		return conn, err
+	}
+
+	_, err = io.WriteString(conn, "PROXY UNKNOWN\r\n")
+	if(err != nil) {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
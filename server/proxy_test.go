@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+/*
+ * A v2 header: version and command, family and protocol, then body,
+ * with its length as given, or the body's own if length is negative.
+ */
+func proxy_v2(command byte, family byte, body []byte, length int) []byte {
+	if(length < 0) {
+		length = len(body)
+	}
+	header := append([]byte{}, proxy_v2_signature...)
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(length))
+	return append(header, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, netip.MustParseAddr("2001:db8::1").AsSlice())
+	copy(ipv6[16:], netip.MustParseAddr("2001:db8::2").AsSlice())
+	binary.BigEndian.PutUint16(ipv6[32:], 56324)
+	binary.BigEndian.PutUint16(ipv6[34:], 443)
+
+	tests := []struct {
+		name   string
+		input  []byte
+		client string
+		fails  string
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET"), "192.0.2.1:56324", ""},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", ""},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", ""},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1 198.51"), "", "EOF"},
+		{"v1 without CR", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"), "", "too long"},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), "", "too long"},
+		{"v1 missing a field", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"), "", "malformed"},
+		{"v1 unknown protocol", []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "", "malformed"},
+		{"v1 bad address", []byte("PROXY TCP4 192.0.2.999 198.51.100.1 56324 443\r\n"), "", "ParseAddr"},
+		{"v1 IPv6 as TCP4", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n"), "", "family"},
+		{"v1 IPv4 as TCP6", []byte("PROXY TCP6 192.0.2.1 198.51.100.1 56324 443\r\n"), "", "family"},
+		{"v1 port too big", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"), "", "out of range"},
+
+		{"v2 IPv4", proxy_v2(0x21, 0x11, ipv4, -1), "192.0.2.1:56324", ""},
+		{"v2 IPv6", proxy_v2(0x21, 0x21, ipv6, -1), "[2001:db8::1]:56324", ""},
+		{"v2 IPv4 with TLVs", proxy_v2(0x21, 0x11, append(append([]byte{}, ipv4...), 0x04, 0x00, 0x01, 0x00), -1), "192.0.2.1:56324", ""},
+		{"v2 LOCAL", proxy_v2(0x20, 0x00, nil, -1), "", ""},
+		{"v2 unspecified family", proxy_v2(0x21, 0x00, nil, -1), "", ""},
+		{"v2 truncated signature", proxy_v2_signature[:8], "", "EOF"},
+		{"v2 truncated header", proxy_v2(0x21, 0x11, ipv4, -1)[:14], "", "EOF"},
+		{"v2 truncated body", proxy_v2(0x21, 0x11, ipv4, 20), "", "EOF"},
+		{"v2 short IPv4 addresses", proxy_v2(0x21, 0x11, ipv4[:8], -1), "", "short v2 IPv4"},
+		{"v2 short IPv6 addresses", proxy_v2(0x21, 0x21, ipv6[:32], -1), "", "short v2 IPv6"},
+		{"v2 version 1", proxy_v2(0x11, 0x11, ipv4, -1), "", "unsupported version"},
+
+		{"no header", []byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"), "", "no PROXY header"},
+		{"empty", nil, "", "EOF"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := read_proxy_header(bufio.NewReader(bytes.NewReader(test.input)))
+			if(test.fails != "") {
+				if(err == nil || !strings.Contains(err.Error(), test.fails)) {
+					t.Fatalf("got %v, %v; want an error about %q", client, err, test.fails)
+				}
+				return
+			}
+			if(err != nil) {
+				t.Fatalf("rejected: %v", err)
+			}
+			want := netip.AddrPort{}
+			if(test.client != "") {
+				want = netip.MustParseAddrPort(test.client)
+			}
+			if(client != want) {
+				t.Fatalf("client %v, want %v", client, want)
+			}
+		})
+	}
+}
+
+/*
+ * What's left after a header should be the connection's own bytes.
+ */
+func TestReadProxyHeaderLeavesTheRest(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n"))
+	_, err := read_proxy_header(r)
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	rest, _ := r.ReadString('\n')
+	if(rest != "GET / HTTP/1.1\r\n") {
+		t.Fatalf("left %q", rest)
+	}
+}
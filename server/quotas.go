@@ -0,0 +1,155 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+ * Per-client quotas, so that a public server can't be used as a free
+ * traffic generator.  Each client address may run at most
+ * -ip-max-active tests at once, and move at most -ip-max-bytes in any
+ * -ip-window.  Bytes are tallied in quota_slots slots across the
+ * window, which slides along a slot at a time.  They're counted as each
+ * test finishes, so a client can go over by what its last tests moved.
+ */
+const quota_slots = 24
+
+type client_usage struct {
+	active int
+
+	// Bytes moved in each slot, and which slot of all time it was.
+	bytes [quota_slots]int64
+	slot  [quota_slots]int64
+}
+
+var client_quotas = struct {
+	sync.Mutex
+	once sync.Once
+	byip map[string]*client_usage
+}{byip: map[string]*client_usage{}}
+
+/*
+ * How long each slot of window lasts, and which one now falls in.
+ */
+func quota_slot(now time.Time, window time.Duration) (time.Duration, int64) {
+	length := window / quota_slots
+	return length, now.UnixNano() / int64(length)
+}
+
+/*
+ * Bytes moved in the window up to slot now, and how long until the
+ * oldest of them drop out of it.
+ */
+func (u *client_usage) window_bytes(now int64, length time.Duration, at time.Time) (int64, time.Duration) {
+	var total int64
+	oldest := now
+	for i := range u.bytes {
+		if(u.bytes[i] == 0 || u.slot[i] <= now - quota_slots) {
+			continue
+		}
+		total += u.bytes[i]
+		oldest = min(oldest, u.slot[i])
+	}
+	expiry := time.Unix(0, (oldest + quota_slots) * int64(length))
+	return total, expiry.Sub(at)
+}
+
+/*
+ * Reserve a test for client, or say why not and when to try again.  A
+ * reservation must be given back with release_client().
+ */
+func reserve_client(client string) (string, time.Duration) {
+	c := settings()
+	client_quotas.once.Do(go_prune_quotas)
+	client_quotas.Lock()
+	defer client_quotas.Unlock()
+
+	u := client_quotas.byip[client]
+	if(u == nil) {
+		u = &client_usage{}
+		client_quotas.byip[client] = u
+	}
+
+	if(c.ip_max_active > 0 && u.active >= c.ip_max_active) {
+		metric_tests_refused.add("client_concurrency", 1)
+		return "client concurrency", 5 * time.Second
+	}
+	if(c.ip_max_bytes > 0) {
+		now := time.Now()
+		length, slot := quota_slot(now, c.ip_window)
+		used, expiry := u.window_bytes(slot, length, now)
+		if(used >= c.ip_max_bytes) {
+			metric_tests_refused.add("client_quota", 1)
+			return "client quota", max(expiry, time.Second)
+		}
+	}
+
+	u.active++
+	return "", 0
+}
+
+/*
+ * Give back client's reservation for a test that moved n bytes.
+ */
+func release_client(client string, n int64) {
+	_, slot := quota_slot(time.Now(), settings().ip_window)
+	client_quotas.Lock()
+	defer client_quotas.Unlock()
+
+	u := client_quotas.byip[client]
+	if(u == nil) {
+		return
+	}
+	u.active = max(u.active - 1, 0)
+	u.add_bytes(slot, n)
+}
+
+/*
+ * Count n more bytes against client's quota, for a test whose
+ * reservation was given back before it finished.
+ */
+func charge_client(client string, n int64) {
+	_, slot := quota_slot(time.Now(), settings().ip_window)
+	client_quotas.Lock()
+	defer client_quotas.Unlock()
+
+	u := client_quotas.byip[client]
+	if(u == nil) {
+		return
+	}
+	u.add_bytes(slot, n)
+}
+
+/*
+ * Count n bytes as moved in slot.
+ */
+func (u *client_usage) add_bytes(slot int64, n int64) {
+	i := slot % quota_slots
+	if(u.slot[i] != slot) {
+		u.slot[i] = slot
+		u.bytes[i] = 0
+	}
+	u.bytes[i] += n
+}
+
+/*
+ * Forget clients with nothing running and nothing left in the window,
+ * every so often.
+ */
+func go_prune_quotas() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			now := time.Now()
+			length, slot := quota_slot(now, settings().ip_window)
+			client_quotas.Lock()
+			for ip, u := range client_quotas.byip {
+				used, _ := u.window_bytes(slot, length, now)
+				if(u.active == 0 && used == 0) {
+					delete(client_quotas.byip, ip)
+				}
+			}
+			client_quotas.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClientQuotas(t *testing.T) {
+	reserve := func(client string, want string) admission {
+		return admission{op: "reserve", client: client, want: want}
+	}
+	release := func(client string, bytes int64) admission {
+		return admission{op: "release", client: client, bytes: bytes}
+	}
+	charge := func(client string, bytes int64) admission {
+		return admission{op: "charge", client: client, bytes: bytes}
+	}
+
+	tests := []struct {
+		name      string
+		ip_active int
+		ip_bytes  int64
+		steps     []admission
+	}{
+		{"up to the client's limit", 2, 0, []admission{
+			reserve("192.0.2.1", ""), reserve("192.0.2.1", ""),
+		}},
+		{"over the client's limit", 2, 0, []admission{
+			reserve("192.0.2.1", ""), reserve("192.0.2.1", ""), reserve("192.0.2.1", "client concurrency"),
+		}},
+		{"another client", 1, 0, []admission{
+			reserve("192.0.2.1", ""), reserve("192.0.2.1", "client concurrency"), reserve("192.0.2.2", ""),
+		}},
+		{"a slot given back", 1, 0, []admission{
+			reserve("192.0.2.1", ""), release("192.0.2.1", 0), reserve("192.0.2.1", ""),
+		}},
+		{"under the quota", 0, 1000, []admission{
+			reserve("192.0.2.1", ""), release("192.0.2.1", 999), reserve("192.0.2.1", ""),
+		}},
+		{"at the quota", 0, 1000, []admission{
+			reserve("192.0.2.1", ""), release("192.0.2.1", 1000), reserve("192.0.2.1", "client quota"),
+		}},
+		{"over the quota by the last test", 0, 1000, []admission{
+			reserve("192.0.2.1", ""), reserve("192.0.2.1", ""), release("192.0.2.1", 600), release("192.0.2.1", 600),
+			reserve("192.0.2.1", "client quota"),
+		}},
+		{"charged after the slot was given back", 0, 1000, []admission{
+			reserve("192.0.2.1", ""), release("192.0.2.1", 500), reserve("192.0.2.1", ""), charge("192.0.2.1", 500),
+			reserve("192.0.2.1", "client quota"),
+		}},
+		{"concurrency before quota", 1, 1000, []admission{
+			reserve("192.0.2.1", ""), charge("192.0.2.1", 1000), reserve("192.0.2.1", "client concurrency"),
+		}},
+		{"quota of another client", 0, 1000, []admission{
+			reserve("192.0.2.1", ""), release("192.0.2.1", 1000), reserve("192.0.2.2", ""),
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := defaults
+			c.ip_max_active = test.ip_active
+			c.ip_max_bytes = test.ip_bytes
+			admitting(t, c, 0)
+			run_admissions(t, test.steps)
+		})
+	}
+}
+
+/*
+ * Bytes count in the window for quota_slots slots, and the wait is
+ * until the oldest of them drops out.
+ */
+func TestClientUsageWindow(t *testing.T) {
+	const length = time.Hour
+	const now = int64(1000)
+	at := time.Unix(0, now * int64(length))
+
+	tests := []struct {
+		name   string
+		used   map[int64]int64
+		total  int64
+		expiry time.Duration
+	}{
+		{"nothing", nil, 0, quota_slots * length},
+		{"this slot", map[int64]int64{now: 100}, 100, quota_slots * length},
+		{"the oldest slot in the window", map[int64]int64{now - quota_slots + 1: 100}, 100, length},
+		{"just out of the window", map[int64]int64{now - quota_slots: 100}, 0, quota_slots * length},
+		{"several slots", map[int64]int64{now: 1, now - 5: 10, now - 23: 100}, 111, length},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := &client_usage{}
+			for slot, n := range test.used {
+				u.add_bytes(slot, n)
+			}
+			total, expiry := u.window_bytes(now, length, at)
+			if(total != test.total || expiry != test.expiry) {
+				t.Fatalf("got %d bytes, expiring in %v; want %d in %v", total, expiry, test.total, test.expiry)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Replayed traffic, for reproducing how an application really moves
+ * data, a video player's segment fetches or a game's update bursts,
+ * rather than a flat-rate stream.  A profile is a list of bursts, each
+ * a number of bytes and the gap from its start to the next one's:
+ *
+ *	POST   /profiles          stores one, and says its ID
+ *	GET    /profiles          lists them
+ *	GET    /profiles/{id}     shows one
+ *	DELETE /profiles/{id}     forgets one
+ *	GET    /down?profile={id} replays it
+ *
+ * A profile is JSON, {"name":…,"repeat":1,"bursts":[{"bytes":…,
+ * "gap_ms":…},…]}, or plain text with a burst on each line, a size and
+ * a gap such as "2M 4s", as might be cut from a capture's packet
+ * lengths and time deltas; lines starting with # are comments.  The
+ * replay keeps to the profile's clock: a burst the link can't carry
+ * before the next is due makes that one late, and the result says how
+ * late the worst was and how many were.  Profiles are kept in memory,
+ * up to profile_max_kept of them, the oldest going first, and with
+ * tenants, each tenant sees only its own.
+ */
+const profile_prefix = "/profiles"
+
+const (
+	profile_max_kept   = 100
+	profile_max_bursts = 10000
+	profile_max_body   = 1 << 20
+)
+
+type profile_burst struct {
+	Bytes int64   `json:"bytes"`
+	GapMs float64 `json:"gap_ms"`
+}
+
+type transfer_profile struct {
+	ID      string          `json:"id"`
+	Name    string          `json:"name,omitempty"`
+	Repeat  int             `json:"repeat"`
+	Bursts  []profile_burst `json:"bursts"`
+	Bytes   int64           `json:"bytes"`
+	Seconds float64         `json:"seconds"`
+	Created time.Time       `json:"created"`
+
+	tenant string
+}
+
+/*
+ * How a replay kept to its profile, in the test's result.
+ */
+type replay_report struct {
+	Profile    string  `json:"profile"`
+	Name       string  `json:"name,omitempty"`
+	Bursts     int     `json:"bursts"`
+	LateBursts int     `json:"late_bursts"`
+	MaxLateMs  float64 `json:"max_late_ms"`
+}
+
+var transfer_profiles = struct {
+	sync.Mutex
+	byid  map[string]*transfer_profile
+	order []string
+}{byid: map[string]*transfer_profile{}}
+
+/*
+ * Parse a profile from a request body, as JSON or as lines of text.
+ */
+func parse_profile(body []byte, content_type string) (*transfer_profile, error) {
+	p := &transfer_profile{Repeat: 1}
+	if(strings.HasPrefix(content_type, "application/json") || strings.HasPrefix(strings.TrimSpace(string(body)), "{")) {
+		err := json.Unmarshal(body, p)
+		if(err != nil) {
+			return nil, fmt.Errorf("bad profile: %v", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(strings.NewReader(string(body)))
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if(text == "" || strings.HasPrefix(text, "#")) {
+				continue
+			}
+			fields := strings.Fields(text)
+			if(len(fields) != 2) {
+				return nil, fmt.Errorf("line %d: want a size and a gap", line)
+			}
+			n, err := parse_size(fields[0])
+			if(err != nil) {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			gap, err := time.ParseDuration(fields[1])
+			if(err != nil) {
+				var f float64
+				f, err = strconv.ParseFloat(fields[1], 64)
+				gap = time.Duration(f * float64(time.Second))
+			}
+			if(err != nil) {
+				return nil, fmt.Errorf("line %d: invalid gap %q", line, fields[1])
+			}
+			p.Bursts = append(p.Bursts, profile_burst{Bytes: n, GapMs: float64(gap.Microseconds()) / 1000})
+		}
+	}
+
+	if(len(p.Bursts) == 0) {
+		return nil, errors.New("a profile needs at least one burst")
+	}
+	if(len(p.Bursts) > profile_max_bursts) {
+		return nil, fmt.Errorf("a profile can have at most %d bursts", profile_max_bursts)
+	}
+	if(p.Repeat < 1) {
+		return nil, errors.New("repeat must be at least 1")
+	}
+	var bytes int64
+	var ms float64
+	for i, b := range p.Bursts {
+		if(b.Bytes < 0 || b.GapMs < 0) {
+			return nil, fmt.Errorf("burst %d: bytes and gap must not be negative", i)
+		}
+		bytes += b.Bytes
+		ms += b.GapMs
+	}
+	c := settings()
+	p.Bytes = bytes * int64(p.Repeat)
+	p.Seconds = ms * float64(p.Repeat) / 1000
+	if(bytes > c.max_test_bytes || p.Bytes > c.max_test_bytes) {
+		return nil, errors.New("the profile's bursts are more than the largest test allows")
+	}
+	if(p.Seconds > c.max_test_duration.Seconds()) {
+		return nil, fmt.Errorf("the profile's gaps come to more than the server limit of %v", c.max_test_duration)
+	}
+	return p, nil
+}
+
+/*
+ * The profile with id, if the request's tenant may use it.
+ */
+func find_profile(req *http.Request, id string) *transfer_profile {
+	transfer_profiles.Lock()
+	defer transfer_profiles.Unlock()
+	p := transfer_profiles.byid[id]
+	if(p == nil || p.tenant != request_tenant(req)) {
+		return nil
+	}
+	return p
+}
+
+/*
+ * The profile a download asked to replay with ?profile=, or nil, if
+ * it's within the limits of the host it was asked of.
+ */
+func requested_profile(req *http.Request) (*transfer_profile, error) {
+	id := req.URL.Query().Get("profile")
+	if(id == "") {
+		return nil, nil
+	}
+	p := find_profile(req, id)
+	if(p == nil) {
+		return nil, fmt.Errorf("no profile %q", id)
+	}
+	c := request_settings(req)
+	if(p.Bytes > c.max_test_bytes || p.Seconds > c.max_test_duration.Seconds()) {
+		return nil, fmt.Errorf("profile %q is larger or longer than this host allows", id)
+	}
+	return p, nil
+}
+
+/*
+ * /profiles and /profiles/{id}.
+ */
+func route_profiles(res http.ResponseWriter, req *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, profile_prefix), "/")
+
+	switch {
+	case id == "" && req.Method == "POST":
+		profile_create(res, req)
+	case id == "" && (req.Method == "GET" || req.Method == "HEAD"):
+		tenant := request_tenant(req)
+		transfer_profiles.Lock()
+		list := []*transfer_profile{}
+		for _, id := range transfer_profiles.order {
+			if(transfer_profiles.byid[id].tenant == tenant) {
+				list = append(list, transfer_profiles.byid[id])
+			}
+		}
+		transfer_profiles.Unlock()
+		write_json(res, 200, list)
+	case id != "" && !strings.Contains(id, "/") && (req.Method == "GET" || req.Method == "HEAD" || req.Method == "DELETE"):
+		p := find_profile(req, id)
+		if(p == nil) {
+			res.WriteHeader(404)
+			io.WriteString(res, "Not Found")
+			return
+		}
+		if(req.Method == "DELETE") {
+			forget_profile(id)
+			res.WriteHeader(204) // No Content
+			return
+		}
+		write_json(res, 200, p)
+	case strings.Contains(id, "/"):
+		res.WriteHeader(404)
+		io.WriteString(res, "Not Found")
+	default:
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+	}
+}
+
+/*
+ * POST /profiles: store a profile, making room if need be.
+ */
+func profile_create(res http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(res, req.Body, profile_max_body))
+	if(err != nil) {
+		res.WriteHeader(413) // Request Entity Too Large
+		io.WriteString(res, "Profile too large")
+		return
+	}
+	p, err := parse_profile(body, req.Header.Get("Content-Type"))
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+	p.ID = new_uuid()
+	p.Created = time.Now().UTC()
+	p.tenant = request_tenant(req)
+
+	transfer_profiles.Lock()
+	for len(transfer_profiles.order) >= profile_max_kept {
+		delete(transfer_profiles.byid, transfer_profiles.order[0])
+		transfer_profiles.order = transfer_profiles.order[1:]
+	}
+	transfer_profiles.byid[p.ID] = p
+	transfer_profiles.order = append(transfer_profiles.order, p.ID)
+	transfer_profiles.Unlock()
+
+	log_request(req, log_level_info, "profile stored", "profile", p.ID, "name", p.Name, "bursts", len(p.Bursts), "bytes", p.Bytes)
+	res.Header().Set("Location", mount_prefix + profile_prefix + "/" + p.ID)
+	write_json(res, 201, p)
+}
+
+func forget_profile(id string) {
+	transfer_profiles.Lock()
+	defer transfer_profiles.Unlock()
+	delete(transfer_profiles.byid, id)
+	for i, kept := range transfer_profiles.order {
+		if(kept == id) {
+			transfer_profiles.order = append(transfer_profiles.order[:i], transfer_profiles.order[i + 1:]...)
+			break
+		}
+	}
+}
+
+/*
+ * Replay p down res, each burst flushed as it's written and started on
+ * the profile's clock.
+ */
+func serve_profile(res http.ResponseWriter, req *http.Request, p *transfer_profile, dress *disguise) {
+	if(req.Method == "HEAD") {
+		write_payload_headers(res, p.Bytes)
+		dress.apply(res)
+		return
+	}
+
+	test := begin_test(res, req, "down", p.Bytes)
+	if(test == nil) {
+		return
+	}
+	write_payload_headers(res, p.Bytes)
+	res.Header().Set("Trailer", measurement_headers)
+	dress.apply(res)
+
+	report := &replay_report{Profile: p.ID, Name: p.Name}
+	rc := http.NewResponseController(res)
+	out := test.writer(res)
+	source := new_payload_source()
+	due := test.start
+	var written int64
+	var err error
+
+replay:
+	for range p.Repeat {
+		for _, b := range p.Bursts {
+			wait := time.Until(due)
+			if(wait > 0) {
+				select {
+				case <-time.After(wait):
+				case <-test.ctx.Done():
+					err = test.ctx.Err()
+					break replay
+				}
+			} else if(wait <= -time.Millisecond) {
+				report.LateBursts++
+				report.MaxLateMs = max(report.MaxLateMs, -float64(wait.Microseconds()) / 1000)
+			}
+
+			var n int64
+			n, err = write_source_until(source, out, b.Bytes, time.Time{})
+			written += n
+			if(err == nil) {
+				err = rc.Flush()
+			}
+			if(err != nil) {
+				break replay
+			}
+			report.Bursts++
+			due = due.Add(time.Duration(b.GapMs * float64(time.Millisecond)))
+		}
+	}
+
+	test.as = dress.String()
+	test.replay = report
+	write_measurement_headers(res, test.end(written, err))
+	if(err != nil) {
+		log_at(log_level_debug, "Replay to %s aborted after %d bytes: %v", req.RemoteAddr, written, err)
+	}
+}
@@ -0,0 +1,524 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * The record kept for every bandwidth test.  Field names are exported
+ * only so encoding/json can see them.
+ */
+type test_result struct {
+	ID        string     `json:"id"`
+	RequestID string     `json:"request_id,omitempty"`
+	Direction string     `json:"direction"`
+	Started   time.Time  `json:"started"`
+	Bytes     int64      `json:"bytes"`
+	Requested int64      `json:"requested,omitempty"`
+	Streams   int        `json:"streams,omitempty"`
+	Seconds   float64    `json:"seconds"`
+	Mbps      float64    `json:"mbps"`
+	ClientIP  string     `json:"client_ip"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Vhost     string     `json:"vhost,omitempty"`
+	Country   string     `json:"country,omitempty"`
+	ASN       uint       `json:"asn,omitempty"`
+	ASOrg     string     `json:"as_org,omitempty"`
+	Protocol  string     `json:"protocol"`
+	Outcome   string     `json:"outcome"`
+	SHA256    string     `json:"sha256,omitempty"`
+	Match     *bool      `json:"sha256_match,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	TCP       *tcp_stats `json:"tcp,omitempty"`
+	DSCP      string     `json:"dscp,omitempty"`
+	TraceID   string     `json:"trace_id,omitempty"`
+	SampleMs  int64      `json:"sample_ms,omitempty"`
+	Samples   []float64  `json:"samples_mbps,omitempty"`
+
+	OmitSeconds  float64 `json:"omit_seconds,omitempty"`
+	OmittedBytes int64   `json:"omitted_bytes,omitempty"`
+	ExpectMbps   float64 `json:"expect_mbps,omitempty"`
+	Verdict      string  `json:"verdict,omitempty"`
+	Encoding     string  `json:"encoding,omitempty"`
+	ContentBytes int64   `json:"content_bytes,omitempty"`
+	As           string  `json:"as,omitempty"`
+
+	Bufferbloat *bufferbloat_report `json:"bufferbloat,omitempty"`
+	Duplex      *duplex_report      `json:"duplex,omitempty"`
+	Asym        *asym_report        `json:"asym,omitempty"`
+	Replay      *replay_report      `json:"replay,omitempty"`
+}
+
+/*
+ * A random (version 4) UUID.
+ */
+func new_uuid() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6] & 0x0f | 0x40
+	b[8] = b[8] & 0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+/*
+ * The most recent results, in a ring that overwrites the oldest once
+ * it's full.
+ */
+type result_ring struct {
+	mu      sync.Mutex
+	entries []test_result
+	next    int
+	full    bool
+}
+
+var recent_results result_ring
+
+/*
+ * Add a finished test, keeping at most keep of them.
+ */
+func (r *result_ring) add(result test_result, keep int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if(len(r.entries) != keep) {
+		r.resize(keep)
+	}
+
+	r.entries[r.next] = result
+	r.next = (r.next + 1) % keep
+	if(r.next == 0) {
+		r.full = true
+	}
+}
+
+/*
+ * Change the capacity of the ring, keeping as many of the newest
+ * entries as fit.  Called with mu held.
+ */
+func (r *result_ring) resize(keep int) {
+	newest := r.newest_first()
+	if(len(newest) > keep) {
+		newest = newest[:keep]
+	}
+
+	r.entries = make([]test_result, keep)
+	r.next = 0
+	r.full = false
+	for i := len(newest) - 1; i >= 0; i-- {
+		r.entries[r.next] = newest[i]
+		r.next = (r.next + 1) % keep
+		if(r.next == 0) {
+			r.full = true
+		}
+	}
+}
+
+/*
+ * Everything in the ring, newest first.  Called with mu held.
+ */
+func (r *result_ring) newest_first() []test_result {
+	count := r.next
+	if(r.full) {
+		count = len(r.entries)
+	}
+
+	out := make([]test_result, 0, count)
+	for i := 1; i <= count; i++ {
+		out = append(out, r.entries[(r.next - i + len(r.entries)) % len(r.entries)])
+	}
+	return out
+}
+
+/*
+ * Which results a query wants.  Zero values match everything.
+ */
+type result_filter struct {
+	id        string
+	since     time.Time
+	request   string
+	client    string
+	direction string
+	country   string
+	asn       uint
+	tenant    string
+	vhost     string
+}
+
+func (f result_filter) match(result test_result) bool {
+	if(f.id != "" && result.ID != f.id) {
+		return false
+	}
+	if(!f.since.IsZero() && result.Started.Before(f.since)) {
+		return false
+	}
+	if(f.request != "" && result.RequestID != f.request) {
+		return false
+	}
+	if(f.client != "" && result.ClientIP != f.client) {
+		return false
+	}
+	if(f.direction != "" && result.Direction != f.direction) {
+		return false
+	}
+	if(f.country != "" && !strings.EqualFold(result.Country, f.country)) {
+		return false
+	}
+	if(f.asn != 0 && result.ASN != f.asn) {
+		return false
+	}
+	if(f.tenant != "" && result.Tenant != f.tenant) {
+		return false
+	}
+	if(f.vhost != "" && result.Vhost != f.vhost) {
+		return false
+	}
+	return true
+}
+
+/*
+ * A page of matching results, newest first, and how many matched in
+ * total.  Results past the retention age are never returned, even if
+ * they haven't been pruned yet.
+ */
+func (r *result_ring) page(filter result_filter, offset int, limit int) ([]test_result, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := settings()
+	now := time.Now()
+	all := []test_result{}
+	for _, result := range r.newest_first() {
+		if(filter.match(result) && c.result_retained(result, now)) {
+			all = append(all, result)
+		}
+	}
+
+	if(offset > len(all)) {
+		offset = len(all)
+	}
+	end := min(offset + limit, len(all))
+	return all[offset:end], len(all)
+}
+
+/*
+ * The body of a /results response.
+ */
+type results_page struct {
+	Total   int           `json:"total"`
+	Offset  int           `json:"offset"`
+	Limit   int           `json:"limit"`
+	Results []test_result `json:"results"`
+}
+
+const results_default_limit = 50
+const results_max_limit = 1000
+
+/*
+ * Read a non-negative integer query parameter.
+ */
+func query_int(req *http.Request, name string, fallback int) (int, error) {
+	value := req.URL.Query().Get(name)
+	if(value == "") {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if(err != nil || n < 0) {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return n, nil
+}
+
+/*
+ * Read ?since=, which may be an RFC 3339 timestamp or a duration back
+ * from now such as 24h.
+ */
+func query_since(req *http.Request) (time.Time, error) {
+	value := req.URL.Query().Get("since")
+	if(value == "") {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if(err == nil) {
+		return t, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if(err != nil || d < 0) {
+		return time.Time{}, fmt.Errorf("since must be an RFC 3339 time or a duration")
+	}
+	return time.Now().Add(-d), nil
+}
+
+/*
+ * Tag a result with where its client is, when there are GeoIP
+ * databases to say.
+ */
+func (r *test_result) locate() {
+	addr, _ := netip.ParseAddr(r.ClientIP)
+	r.Country, r.ASN, r.ASOrg = locate(addr)
+}
+
+/*
+ * Read the ?request_id=, ?client=, ?direction=, ?country=, ?asn=,
+ * ?tenant= and ?vhost= a request narrows results down by.
+ */
+func query_filter(req *http.Request) (result_filter, error) {
+	query := req.URL.Query()
+	filter := result_filter{
+		request:   query.Get("request_id"),
+		client:    query.Get("client"),
+		direction: query.Get("direction"),
+		country:   query.Get("country"),
+		tenant:    query.Get("tenant"),
+		vhost:     query.Get("vhost"),
+	}
+	if(query.Get("asn") != "") {
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(query.Get("asn")), "AS"), 10, 32)
+		if(err != nil) {
+			return filter, fmt.Errorf("asn must be a number such as 13335 or AS13335")
+		}
+		filter.asn = uint(asn)
+	}
+	return filter, nil
+}
+
+/*
+ * GET: Recent test results, newest first, paginated with ?offset= and
+ * ?limit=.  ?since=, ?request_id=, ?client=, ?direction=, ?country=,
+ * ?asn=, ?tenant= and ?vhost= narrow them down.  A tenant's token shows
+ * only that tenant's results, and a virtual host only its own.
+ */
+func route_results(res http.ResponseWriter, req *http.Request) {
+	if(req.Method != "GET" && req.Method != "HEAD" && req.Method != "") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+
+	page, err := query_results(req)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+	write_json(res, 200, page)
+}
+
+/*
+ * The page of results req asks for with ?offset=, ?limit= and the
+ * filters.
+ */
+func query_results(req *http.Request) (results_page, error) {
+	filter, err := query_filter(req)
+	offset, limit := 0, 0
+	if(err == nil) {
+		offset, err = query_int(req, "offset", 0)
+	}
+	if(err == nil) {
+		limit, err = query_int(req, "limit", results_default_limit)
+	}
+	if(err == nil) {
+		filter.since, err = query_since(req)
+	}
+	if(err != nil) {
+		return results_page{}, err
+	}
+
+	limit = max(1, min(limit, results_max_limit))
+	if(results_db != nil) {
+		results, total, err := results_db.page(scope_filter(req, filter), offset, limit)
+		if(err != nil) {
+			return results_page{}, err
+		}
+		return results_page{Total: total, Offset: offset, Limit: limit, Results: results}, nil
+	}
+	results, total := results_store(req).page(filter, offset, limit)
+	return results_page{Total: total, Offset: offset, Limit: limit, Results: results}, nil
+}
+
+/*
+ * Results can also be kept in a file so history survives a restart.
+ * The file is a log of one JSON result per line, appended as tests
+ * finish and rewritten from the in-memory ring once it has grown to
+ * twice the retained size.  For more history than the ring holds,
+ * there's the results database.
+ */
+type result_file struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	lines int
+}
+
+var results_log *result_file
+
+/*
+ * Open (creating if needed) the results file and load what it holds
+ * into the ring, subject to retention, unless the results database is
+ * to do that.
+ */
+func open_results_file(c *configuration) error {
+	if(c.results_file == "") {
+		return nil
+	}
+
+	f := &result_file{path: c.results_file}
+	data, err := os.ReadFile(f.path)
+	if(err != nil && !os.IsNotExist(err)) {
+		return err
+	}
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if(len(bytes.TrimSpace(line)) == 0) {
+			continue
+		}
+
+		var result test_result
+		err = json.Unmarshal(line, &result)
+		if(err != nil) {
+			log_at(log_level_error, "Skipping bad line in %s: %v", f.path, err)
+			continue
+		}
+		f.lines++
+		if(c.results_db == "" && c.result_retained(result, time.Now())) {
+			recent_results.add(result, c.results_kept)
+			if(result.Tenant != "") {
+				tenant_state(result.Tenant).results.add(result, c.results_kept)
+			}
+			if(result.Vhost != "") {
+				vhost_state(result.Vhost).results.add(result, c.results_kept)
+			}
+		}
+	}
+
+	results_log = f
+	return f.compact(c)
+}
+
+/*
+ * Is a result still within the retention window?
+ */
+func (c *configuration) result_retained(result test_result, now time.Time) bool {
+	return c.results_max_age == 0 || now.Sub(result.Started) <= c.results_max_age
+}
+
+/*
+ * Add a result to the file, compacting it when it has grown too big.
+ */
+func (f *result_file) append(c *configuration, result test_result) {
+	line, _ := json.Marshal(result)
+
+	f.mu.Lock()
+	_, err := f.file.Write(append(line, '\n'))
+	f.lines++
+	too_big := f.lines >= 2 * c.results_kept
+	f.mu.Unlock()
+
+	if(err != nil) {
+		log_at(log_level_error, "Can't record result in %s: %v", f.path, err)
+		return
+	}
+
+	if(too_big) {
+		err = f.compact(c)
+		if(err != nil) {
+			log_at(log_level_error, "Can't compact %s: %v", f.path, err)
+		}
+	}
+}
+
+/*
+ * Rewrite the file with just the retained results, oldest first.  The
+ * new file is written alongside and renamed into place, so a crash
+ * part way leaves the old one intact.
+ */
+func (f *result_file) compact(c *configuration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	recent_results.mu.Lock()
+	all := recent_results.newest_first()
+	recent_results.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path) + ".*")
+	if(err != nil) {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	lines := 0
+	now := time.Now()
+	for i := len(all) - 1; i >= 0; i-- {
+		if(!c.result_retained(all[i], now)) {
+			continue
+		}
+		line, _ := json.Marshal(all[i])
+		w.Write(line)
+		w.WriteByte('\n')
+		lines++
+	}
+
+	err = w.Flush()
+	if(err == nil) {
+		err = tmp.Close()
+	}
+	if(err == nil) {
+		err = os.Rename(tmp.Name(), f.path)
+	}
+	if(err != nil) {
+		tmp.Close()
+		return err
+	}
+
+	if(f.file != nil) {
+		f.file.Close()
+	}
+	f.file, err = os.OpenFile(f.path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+	f.lines = lines
+	return err
+}
+
+/*
+ * Can we still write next to the results file?  Compaction needs to
+ * make a new file there, not just append.
+ */
+func (f *result_file) writable() error {
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path) + ".*")
+	if(err != nil) {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+/*
+ * Keep a finished result, in memory and on disk if so configured.
+ */
+func store_result(result test_result) {
+	c := settings()
+	recent_results.add(result, c.results_kept)
+	store_tenant_result(c, result)
+	store_vhost_result(c, result)
+	if(results_log != nil) {
+		results_log.append(c, result)
+	}
+	if(results_db != nil) {
+		results_db.insert(result)
+	}
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+/*
+ * Results can be kept in an SQLite database as well, for history that
+ * goes back further than the ring does.  Each result is a row, with
+ * the columns /results filters on pulled out of its JSON so SQLite can
+ * do the filtering, and the database is pruned to -results-db-rows
+ * rows and -results-max-age as results arrive.  Finished tests hand
+ * their results to a writer of its own, which inserts them in batches
+ * while tests carry on, so a slow disk never holds up a test.  The
+ * driver is pure Go, so gost still builds without cgo.
+ *
+ * With a results file as well, the database is what's loaded into the
+ * rings and what /results asks, and the file is only appended to.
+ */
+type result_db struct {
+	db   *sql.DB
+	path string
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan test_result
+	done   chan struct{}
+}
+
+var results_db *result_db
+
+const (
+	// Results waiting for the writer before more are dropped.
+	result_db_queue = 4096
+	// Most results inserted in one transaction.
+	result_db_batch = 256
+)
+
+const result_db_schema = `
+CREATE TABLE IF NOT EXISTS results (
+	seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+	id         TEXT NOT NULL UNIQUE,
+	started    INTEGER NOT NULL,
+	request_id TEXT NOT NULL,
+	client_ip  TEXT NOT NULL,
+	direction  TEXT NOT NULL,
+	country    TEXT NOT NULL,
+	asn        INTEGER NOT NULL,
+	tenant     TEXT NOT NULL,
+	vhost      TEXT NOT NULL,
+	result     TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS results_started ON results (started);
+CREATE INDEX IF NOT EXISTS results_client ON results (client_ip, started);
+`
+
+/*
+ * Open (creating if needed) the results database, load the newest
+ * results into the rings, so /stats and alerts pick up where they left
+ * off, and start its writer.
+ */
+func open_results_db(c *configuration) error {
+	if(c.results_db == "") {
+		return nil
+	}
+
+	db, err := sql.Open("sqlite", "file:" + c.results_db + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if(err != nil) {
+		return err
+	}
+	// One writer at a time is all SQLite has anyway.
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(result_db_schema)
+	if(err != nil) {
+		db.Close()
+		return err
+	}
+
+	d := &result_db{db: db, path: c.results_db, queue: make(chan test_result, result_db_queue), done: make(chan struct{})}
+	err = d.prune(c)
+	if(err == nil) {
+		err = d.load(c)
+	}
+	if(err != nil) {
+		db.Close()
+		return err
+	}
+	go d.write()
+	results_db = d
+	return nil
+}
+
+/*
+ * Put the newest results_kept results back in the rings, oldest first.
+ */
+func (d *result_db) load(c *configuration) error {
+	results, _, err := d.page(result_filter{}, 0, c.results_kept)
+	if(err != nil) {
+		return err
+	}
+	for i := len(results) - 1; i >= 0; i-- {
+		result := results[i]
+		recent_results.add(result, c.results_kept)
+		if(result.Tenant != "") {
+			tenant_state(result.Tenant).results.add(result, c.results_kept)
+		}
+		if(result.Vhost != "") {
+			vhost_state(result.Vhost).results.add(result, c.results_kept)
+		}
+	}
+	return nil
+}
+
+/*
+ * Hand a result to the writer.  If it's that far behind, the result is
+ * dropped from the database, though not from the rings or the file.
+ */
+func (d *result_db) insert(result test_result) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if(d.closed) {
+		return
+	}
+	select {
+	case d.queue <- result:
+	default:
+		log_at(log_level_error, "Results database %s is behind, dropping result %s", d.path, result.ID)
+	}
+}
+
+/*
+ * Insert results as they come, as many at a time as are waiting, and
+ * prune back to retention after each batch.
+ */
+func (d *result_db) write() {
+	defer close(d.done)
+	for result := range d.queue {
+		batch := []test_result{result}
+		for more := true; more && len(batch) < result_db_batch; {
+			select {
+			case result, more = <-d.queue:
+				if(more) {
+					batch = append(batch, result)
+				}
+			default:
+				more = false
+			}
+		}
+
+		err := d.insert_batch(batch)
+		if(err == nil) {
+			err = d.prune(settings())
+		}
+		if(err != nil) {
+			log_at(log_level_error, "Can't record %d results in %s: %v", len(batch), d.path, err)
+		}
+	}
+}
+
+func (d *result_db) insert_batch(batch []test_result) error {
+	tx, err := d.db.Begin()
+	if(err != nil) {
+		return err
+	}
+	for _, result := range batch {
+		body, _ := json.Marshal(result)
+		_, err = tx.Exec(`INSERT OR REPLACE INTO results
+			(id, started, request_id, client_ip, direction, country, asn, tenant, vhost, result)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			result.ID, result.Started.UnixNano(), result.RequestID, result.ClientIP, result.Direction,
+			result.Country, int64(result.ASN), result.Tenant, result.Vhost, string(body))
+		if(err != nil) {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/*
+ * Write out what's waiting and stop taking results, for shutting down.
+ */
+func (d *result_db) flush() {
+	d.mu.Lock()
+	if(!d.closed) {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mu.Unlock()
+	<-d.done
+}
+
+/*
+ * Forget results past the retention age, and the oldest of any more
+ * than results_db_rows.
+ */
+func (d *result_db) prune(c *configuration) error {
+	if(c.results_max_age > 0) {
+		_, err := d.db.Exec(`DELETE FROM results WHERE started < ?`, time.Now().Add(-c.results_max_age).UnixNano())
+		if(err != nil) {
+			return err
+		}
+	}
+	_, err := d.db.Exec(`DELETE FROM results WHERE seq <= (SELECT seq FROM results ORDER BY seq DESC LIMIT 1 OFFSET ?)`, c.results_db_rows)
+	return err
+}
+
+/*
+ * A page of matching results, newest first, and how many matched in
+ * total, as result_ring.page() gives them.
+ */
+func (d *result_db) page(filter result_filter, offset int, limit int) ([]test_result, int, error) {
+	var where []string
+	var args []any
+	add := func(clause string, arg any) {
+		where = append(where, clause)
+		args = append(args, arg)
+	}
+	if(filter.id != "") {
+		add("id = ?", filter.id)
+	}
+	if(!filter.since.IsZero()) {
+		add("started >= ?", filter.since.UnixNano())
+	}
+	c := settings()
+	if(c.results_max_age > 0) {
+		add("started >= ?", time.Now().Add(-c.results_max_age).UnixNano())
+	}
+	if(filter.request != "") {
+		add("request_id = ?", filter.request)
+	}
+	if(filter.client != "") {
+		add("client_ip = ?", filter.client)
+	}
+	if(filter.direction != "") {
+		add("direction = ?", filter.direction)
+	}
+	if(filter.country != "") {
+		add("country = ? COLLATE NOCASE", filter.country)
+	}
+	if(filter.asn != 0) {
+		add("asn = ?", int64(filter.asn))
+	}
+	if(filter.tenant != "") {
+		add("tenant = ?", filter.tenant)
+	}
+	if(filter.vhost != "") {
+		add("vhost = ?", filter.vhost)
+	}
+	clause := ""
+	if(len(where) > 0) {
+		clause = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM results` + clause, args...).Scan(&total)
+	if(err != nil) {
+		return nil, 0, err
+	}
+
+	rows, err := d.db.Query(`SELECT result FROM results` + clause + ` ORDER BY started DESC, seq DESC LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
+	if(err != nil) {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	results := []test_result{}
+	for rows.Next() {
+		var body string
+		err = rows.Scan(&body)
+		if(err != nil) {
+			return nil, 0, err
+		}
+		var result test_result
+		err = json.Unmarshal([]byte(body), &result)
+		if(err != nil) {
+			log_at(log_level_error, "Skipping bad result in %s: %v", d.path, err)
+			continue
+		}
+		results = append(results, result)
+	}
+	return results, total, rows.Err()
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net"
+)
+
+/*
+ * Several sockets on one address with SO_REUSEPORT, for -acceptors.
+ * The kernel spreads new connections across them, and each has an
+ * accept loop of its own, so a flood of short connections isn't held
+ * up behind one goroutine accepting them, and the work spreads over
+ * more cores.  Only Linux balances connections this way.
+ */
+func listen_acceptors(network string, addr string, n int) ([]net.Listener, error) {
+	first, err := listen_reuseport(network, addr)
+	if(err != nil) {
+		return nil, err
+	}
+
+	// Port 0 picks the port once; the rest join it.
+	listeners := []net.Listener{first}
+	for len(listeners) < n {
+		l, err := listen_reuseport(network, first.Addr().String())
+		if(err != nil) {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+/*
+ * Check that SO_REUSEPORT sockets can be opened here.
+ */
+func check_reuseport() error {
+	listeners, err := listen_acceptors("tcp", "127.0.0.1:0", 2)
+	if(err != nil) {
+		return err
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package server
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+/*
+ * SO_REUSEPORT, which the syscall package leaves out.  It's 15 on
+ * every architecture but MIPS.
+ */
+const so_reuseport = 0xf
+
+/*
+ * A listening socket that others can share with SO_REUSEPORT.
+ */
+func listen_reuseport(network string, addr string) (net.Listener, error) {
+	config := net.ListenConfig{
+		Control: func(network string, address string, raw syscall.RawConn) error {
+			var set_err error
+			err := raw.Control(func(fd uintptr) {
+				set_err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, so_reuseport, 1)
+			})
+			if(err != nil) {
+				return err
+			}
+			return set_err
+		},
+	}
+	return config.Listen(context.Background(), network, addr)
+}
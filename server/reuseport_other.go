@@ -0,0 +1,12 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+func listen_reuseport(network string, addr string) (net.Listener, error) {
+	return nil, errors.New("several acceptors are only supported on Linux")
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+)
+
+/*
+ * Every route gost answers, registered on the listener managers' own
+ * muxes rather than http.DefaultServeMux, so that nothing imported can
+ * add routes behind our back.  Routes come in groups by what they're
+ * for, and each is instrumented under the pattern it's counted as.
+ */
+func register_routes(mux *http.ServeMux) {
+	register_test_routes(mux)
+	register_status_routes(mux)
+	register_service_routes(mux)
+}
+
+/*
+ * Speed tests and the things clients call around them.
+ */
+func register_test_routes(mux *http.ServeMux) {
+	mux.HandleFunc("/down", instrument("/down", with_cors(require_auth(route_down))))
+	mux.HandleFunc(compressible_path, instrument(compressible_path, with_cors(require_auth(route_down_compressible))))
+	mux.HandleFunc(multi_prefix, instrument(multi_prefix, require_auth(route_down_multi)))
+	mux.HandleFunc(multi_prefix + "/", instrument(multi_prefix, require_auth(route_down_multi)))
+	mux.HandleFunc(duplex_prefix, instrument(duplex_prefix, require_auth(route_duplex)))
+	mux.HandleFunc(duplex_prefix + "/", instrument(duplex_prefix, require_auth(route_duplex)))
+	mux.HandleFunc(profile_prefix, instrument(profile_prefix, require_auth(route_profiles)))
+	mux.HandleFunc(profile_prefix + "/", instrument(profile_prefix, require_auth(route_profiles)))
+	mux.HandleFunc("/up", instrument("/up", with_cors(require_auth(route_up))))
+	mux.HandleFunc(tests_prefix, instrument(tests_prefix, require_auth(route_test_cancel)))
+	mux.HandleFunc("/ping", instrument("/ping", with_cors(route_ping)))
+	mux.HandleFunc("/connsetup", instrument("/connsetup", route_connsetup))
+	mux.HandleFunc("/ip", instrument("/ip", with_cors(route_ip)))
+	mux.HandleFunc("/stack", instrument("/stack", with_cors(route_stack)))
+	mux.HandleFunc("/ws", instrument("/ws", route_ws))
+	mux.HandleFunc("/asym", instrument("/asym", require_auth(route_asym)))
+	mux.HandleFunc(librespeed_prefix, instrument(librespeed_prefix, require_auth(route_librespeed)))
+	mux.HandleFunc(ookla_prefix, instrument(ookla_prefix, require_auth(route_ookla)))
+	mux.HandleFunc(ndt7_prefix, instrument(ndt7_prefix, require_auth(route_ndt7)))
+
+	// Browser speed test.
+	mux.HandleFunc("/ui", instrument("/ui/", route_ui))
+	mux.HandleFunc("/ui/", instrument("/ui/", route_ui))
+}
+
+/*
+ * Status, health, metrics, results, the mesh and alerts.
+ */
+func register_status_routes(mux *http.ServeMux) {
+	mux.HandleFunc("/status/", instrument("/status/", route_status))
+	mux.HandleFunc(health_probe_path, instrument(health_probe_path, route_probe))
+	mux.HandleFunc("/capabilities", instrument("/capabilities", with_cors(route_capabilities)))
+	mux.HandleFunc("/healthz", instrument("/healthz", route_healthz))
+	mux.HandleFunc("/readyz", instrument("/readyz", route_readyz))
+	mux.HandleFunc("/metrics", instrument("/metrics", route_metrics))
+	mux.HandleFunc("/results", instrument("/results", route_results))
+	mux.HandleFunc(api_prefix, instrument(api_prefix, route_api))
+	mux.HandleFunc("/stats", instrument("/stats", route_stats))
+	mux.HandleFunc("/mesh", instrument("/mesh", route_mesh))
+	mux.HandleFunc("/alerts", instrument("/alerts", route_alerts))
+	mux.HandleFunc(progress_prefix, instrument(progress_prefix, route_progress))
+	mux.HandleFunc("/events", instrument("/events", with_cors(route_events)))
+	mux.HandleFunc(udp_report_prefix, instrument(udp_report_prefix, route_udp_report))
+	mux.HandleFunc("/mtu", instrument("/mtu", route_mtu))
+	mux.HandleFunc(mtu_prefix, instrument("/mtu", route_mtu))
+}
+
+/*
+ * What the server needs for itself: ACME challenges, and the default,
+ * all-matching route.
+ */
+func register_service_routes(mux *http.ServeMux) {
+	mux.HandleFunc(acme_challenge_prefix, instrument(acme_challenge_prefix, route_acme_challenge))
+	mux.HandleFunc("/", instrument("/", route_default))
+}
+
+/*
+ * The admin API, on the admin listener alone.
+ */
+func register_admin_routes(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/config", instrument("/admin/config", require_admin(route_admin_config)))
+	mux.HandleFunc("/admin/tests", instrument("/admin/tests", require_admin(route_admin_tests)))
+	mux.HandleFunc("/admin/maintenance", instrument("/admin/maintenance", require_admin(route_admin_maintenance)))
+	mux.HandleFunc("/admin/tenants", instrument("/admin/tenants", require_admin(route_admin_tenants)))
+	mux.HandleFunc(admin_tests_prefix, instrument(admin_tests_prefix, require_admin(route_admin_test)))
+	register_pprof_routes(mux)
+	register_status_routes(mux)
+}
+
+/*
+ * The gRPC service, on the gRPC listener alone, and the health probe
+ * that says the listener's answering.
+ */
+func register_grpc_routes(mux *http.ServeMux) {
+	mux.HandleFunc(grpc_service_prefix, instrument(grpc_service_prefix, require_auth(route_grpc)))
+	mux.HandleFunc(health_probe_path, instrument(health_probe_path, route_probe))
+}
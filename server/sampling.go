@@ -0,0 +1,58 @@
+package server
+
+import (
+	"math"
+	"time"
+)
+
+/*
+ * Throughput over time for downloads.  Every sample_interval the bytes
+ * sent since the last sample become a goodput figure, so a result
+ * shows the ramp-up as the congestion window opens, the sawtooth of a
+ * bloated buffer or BBR's probing, and where it settled, rather than
+ * only the average.  Only the first sample_max samples are kept, five
+ * minutes' worth.
+ */
+const sample_interval = 100 * time.Millisecond
+const sample_max = 3000
+
+/*
+ * Sample the test's throughput until it ends.
+ */
+func (t *test_run) go_sample() {
+	go func() {
+		ticker := time.NewTicker(sample_interval)
+		defer ticker.Stop()
+
+		last_bytes := int64(0)
+		last_time := t.start
+		for {
+			select {
+			case <-t.done:
+				return
+			case now := <-ticker.C:
+				bytes := t.moved.Load()
+				rate := math.Round(mbps(bytes - last_bytes, now.Sub(last_time)) * 100) / 100
+				last_bytes, last_time = bytes, now
+
+				t.samples_mu.Lock()
+				if(len(t.samples) < sample_max) {
+					t.samples = append(t.samples, rate)
+				}
+				t.samples_mu.Unlock()
+			}
+		}
+	}()
+}
+
+/*
+ * The samples from the from'th on.
+ */
+func (t *test_run) samples_since(from int) []float64 {
+	t.samples_mu.Lock()
+	defer t.samples_mu.Unlock()
+	if(from >= len(t.samples)) {
+		return nil
+	}
+	return append([]float64(nil), t.samples[from:]...)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Cron-style schedules: the usual five fields (minute, hour, day of
+ * month, month, day of week) with *, lists, ranges and /steps, in local
+ * time, or @hourly, @daily, @weekly, @monthly, or "@every 90s".  When
+ * both the day of month and day of week are restricted, either will do,
+ * as in cron.
+ */
+type cron_schedule struct {
+	text  string
+	every time.Duration
+
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+
+	dom_any bool
+	dow_any bool
+}
+
+var schedule_aliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+/*
+ * How far ahead next() looks before deciding a schedule never fires,
+ * such as one for 30 February.
+ */
+const schedule_horizon = 4 * 366 * 24 * time.Hour
+
+func parse_schedule(text string) (*cron_schedule, error) {
+	s := &cron_schedule{text: text}
+	spec := strings.TrimSpace(text)
+
+	if(strings.HasPrefix(spec, "@every ")) {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if(err != nil || d < time.Second) {
+			return nil, fmt.Errorf("schedule %q: @every needs a duration of at least 1s", text)
+		}
+		s.every = d
+		return s, nil
+	}
+
+	alias, ok := schedule_aliases[spec]
+	if(ok) {
+		spec = alias
+	}
+
+	fields := strings.Fields(spec)
+	if(len(fields) != 5) {
+		return nil, fmt.Errorf("schedule %q: want five fields", text)
+	}
+
+	var err error
+	s.minute, err = parse_cron_field(fields[0], 0, 59)
+	if(err == nil) {
+		s.hour, err = parse_cron_field(fields[1], 0, 23)
+	}
+	if(err == nil) {
+		s.dom, err = parse_cron_field(fields[2], 1, 31)
+	}
+	if(err == nil) {
+		s.month, err = parse_cron_field(fields[3], 1, 12)
+	}
+	if(err == nil) {
+		s.dow, err = parse_cron_field(fields[4], 0, 7)
+	}
+	if(err != nil) {
+		return nil, fmt.Errorf("schedule %q: %v", text, err)
+	}
+
+	// Sunday is both 0 and 7.
+	if(s.dow & (1 << 7) != 0) {
+		s.dow |= 1
+	}
+	s.dom_any = fields[2] == "*"
+	s.dow_any = fields[4] == "*"
+	return s, nil
+}
+
+/*
+ * Parse one field into a bit set of the values it allows.
+ */
+func parse_cron_field(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		at := strings.Index(part, "/")
+		if(at >= 0) {
+			n, err := strconv.Atoi(part[at + 1:])
+			if(err != nil || n < 1) {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+			part = part[:at]
+		}
+
+		low, high := min, max
+		if(part != "*") {
+			dash := strings.Index(part, "-")
+			var err error
+			if(dash >= 0) {
+				low, err = strconv.Atoi(part[:dash])
+				if(err == nil) {
+					high, err = strconv.Atoi(part[dash + 1:])
+				}
+			} else {
+				low, err = strconv.Atoi(part)
+				high = low
+				if(at >= 0) {
+					high = max
+				}
+			}
+			if(err != nil) {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+		}
+		if(low < min || high > max || low > high) {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	if(bits == 0) {
+		return 0, errors.New("empty field")
+	}
+	return bits, nil
+}
+
+/*
+ * Whether the schedule fires in the minute starting at t.
+ */
+func (s *cron_schedule) matches(t time.Time) bool {
+	if(s.minute & (1 << uint(t.Minute())) == 0 || s.hour & (1 << uint(t.Hour())) == 0 ||
+		s.month & (1 << uint(t.Month())) == 0) {
+		return false
+	}
+
+	dom := s.dom & (1 << uint(t.Day())) != 0
+	dow := s.dow & (1 << uint(t.Weekday())) != 0
+	if(s.dom_any || s.dow_any) {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+/*
+ * The first time after t the schedule fires, or the zero time if it
+ * never does.
+ */
+func (s *cron_schedule) next(t time.Time) time.Time {
+	if(s.every > 0) {
+		return t.Add(s.every)
+	}
+
+	end := t.Add(schedule_horizon)
+	for t = t.Truncate(time.Minute).Add(time.Minute); t.Before(end); t = t.Add(time.Minute) {
+		if(s.matches(t)) {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+/*
+ * When there's no cert and key on disk and ACME is off, make up a
+ * self-signed certificate so the TLS listener can still start.
+ * Clients will need to skip verification, as with any self-signed
+ * certificate.
+ */
+const self_signed_lifetime = 365 * 24 * time.Hour
+
+/*
+ * Are both the cert and key files missing?  If only one is there,
+ * something's amiss and ListenAndServeTLS should say so.
+ */
+func certificate_files_missing(c *configuration) bool {
+	_, cert_err := os.Stat(c.cert_file)
+	_, key_err := os.Stat(c.key_file)
+	return os.IsNotExist(cert_err) && os.IsNotExist(key_err)
+}
+
+/*
+ * Names the certificate should cover: loopback, this host, and the
+ * bind address if there is one.
+ */
+func self_signed_names(c *configuration) ([]string, []net.IP) {
+	names := []string{"localhost"}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+
+	hostname, err := os.Hostname()
+	if(err == nil && hostname != "localhost") {
+		names = append(names, hostname)
+	}
+
+	if(c.bind_address != "") {
+		ip := net.ParseIP(c.bind_address)
+		if(ip != nil) {
+			ips = append(ips, ip)
+		} else {
+			names = append(names, c.bind_address)
+		}
+	}
+
+	return names, ips
+}
+
+/*
+ * Make a self-signed certificate, writing it to the configured cert
+ * and key paths if asked to.
+ */
+func self_signed_certificate(c *configuration) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if(err != nil) {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if(err != nil) {
+		return nil, err
+	}
+
+	names, ips := self_signed_names(c)
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[0], Organization: []string{"gost"}},
+		DNSNames:              names,
+		IPAddresses:           ips,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(self_signed_lifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if(err != nil) {
+		return nil, err
+	}
+
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if(err != nil) {
+		return nil, err
+	}
+
+	cert_pem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	key_pem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der})
+
+	if(c.self_signed_save) {
+		err = os.WriteFile(c.key_file, key_pem, 0600)
+		if(err == nil) {
+			err = os.WriteFile(c.cert_file, cert_pem, 0644)
+		}
+		if(err != nil) {
+			return nil, err
+		}
+	}
+
+	cert, err := tls.X509KeyPair(cert_pem, key_pem)
+	if(err != nil) {
+		return nil, err
+	}
+	return &cert, nil
+}
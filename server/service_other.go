@@ -0,0 +1,16 @@
+//go:build !windows
+
+package server
+
+import (
+	"fmt"
+	"os"
+)
+
+func run_service(args []string) int {
+	fmt.Fprintln(os.Stderr, "gost service: Windows services are only on Windows; elsewhere, use systemd or the like with gost serve")
+	return 2
+}
+
+func service_stopped() {
+}
@@ -0,0 +1,339 @@
+//go:build windows
+
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+/*
+ * Running as a Windows service, for test rigs with nothing else to
+ * supervise gost:
+ *
+ *	gost service install [-name gost] [-- server flags]
+ *	gost service start|stop|status|remove [-name gost]
+ *
+ * install registers gost to start with Windows, running
+ * "gost service run" with the server flags given after --.  When the
+ * service manager starts it, run tells the manager it's starting, then
+ * running once /readyz would pass; a stop, or Windows shutting down,
+ * drains tests as SIGTERM does.  Run from a console instead, it just
+ * serves.
+ */
+const (
+	service_win32_own_process  = 0x10
+	service_auto_start         = 2
+	service_error_normal       = 1
+	service_config_description = 1
+
+	service_stopped_state = 1
+	service_start_pending = 2
+	service_stop_pending  = 3
+	service_running       = 4
+
+	service_accept_stop     = 1
+	service_accept_shutdown = 4
+
+	service_control_stop        = 1
+	service_control_interrogate = 4
+	service_control_shutdown    = 5
+
+	sc_manager_all_access = 0xf003f
+	service_all_access    = 0xf01ff
+
+	error_call_not_implemented              = 120
+	error_failed_service_controller_connect = 1063
+)
+
+var (
+	advapi32                   = syscall.NewLazyDLL("advapi32.dll")
+	proc_open_sc_manager       = advapi32.NewProc("OpenSCManagerW")
+	proc_create_service        = advapi32.NewProc("CreateServiceW")
+	proc_open_service          = advapi32.NewProc("OpenServiceW")
+	proc_delete_service        = advapi32.NewProc("DeleteService")
+	proc_start_service         = advapi32.NewProc("StartServiceW")
+	proc_control_service       = advapi32.NewProc("ControlService")
+	proc_query_service_status  = advapi32.NewProc("QueryServiceStatus")
+	proc_close_service_handle  = advapi32.NewProc("CloseServiceHandle")
+	proc_change_service_config = advapi32.NewProc("ChangeServiceConfig2W")
+	proc_service_dispatcher    = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	proc_service_ctrl_handler  = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	proc_set_service_status    = advapi32.NewProc("SetServiceStatus")
+)
+
+type service_status struct {
+	service_type  uint32
+	current_state uint32
+	accepted      uint32
+	exit_code     uint32
+	specific_code uint32
+	check_point   uint32
+	wait_hint     uint32
+}
+
+type service_table_entry struct {
+	name *uint16
+	proc uintptr
+}
+
+var service_state_names = map[uint32]string{
+	1: "stopped", 2: "starting", 3: "stopping", 4: "running", 5: "resuming", 6: "pausing", 7: "paused",
+}
+
+/*
+ * The service as the manager sees it, while gost runs as one.
+ */
+var service = struct {
+	sync.Mutex
+	name    *uint16
+	handle  uintptr
+	status  service_status
+	serving atomic.Bool
+}{}
+
+func run_service(args []string) int {
+	if(len(args) == 0) {
+		fmt.Fprintln(os.Stderr, "Usage: gost service install|remove|start|stop|status|run [-name gost] [-- server flags]")
+		return 2
+	}
+	action := args[0]
+	flags := flag.NewFlagSet("gost service " + action, flag.ContinueOnError)
+	name := flags.String("name", "gost", "the service's name")
+	display := flags.String("display", "gost network test server", "the service's display name, for install")
+	err := flags.Parse(args[1:])
+	if(err == flag.ErrHelp) {
+		return 0
+	}
+	if(err != nil) {
+		return 2
+	}
+
+	switch action {
+	case "run":
+		return run_as_service(*name, flags.Args())
+	case "install":
+		err = install_service(*name, *display, flags.Args())
+	case "remove", "uninstall":
+		err = with_service(*name, func(h uintptr) error {
+			return service_call(proc_delete_service, h)
+		})
+	case "start":
+		err = with_service(*name, func(h uintptr) error {
+			return service_call(proc_start_service, h, 0, 0)
+		})
+	case "stop":
+		err = with_service(*name, func(h uintptr) error {
+			var status service_status
+			return service_call(proc_control_service, h, service_control_stop, uintptr(unsafe.Pointer(&status)))
+		})
+	case "status":
+		err = with_service(*name, func(h uintptr) error {
+			var status service_status
+			err := service_call(proc_query_service_status, h, uintptr(unsafe.Pointer(&status)))
+			if(err == nil) {
+				fmt.Printf("%s: %s\n", *name, service_state_names[status.current_state])
+			}
+			return err
+		})
+	default:
+		fmt.Fprintf(os.Stderr, "gost service: unknown action %q\n", action)
+		return 2
+	}
+	if(err != nil) {
+		fmt.Fprintf(os.Stderr, "gost service %s: %v\n", action, err)
+		return 1
+	}
+	return 0
+}
+
+/*
+ * Call an advapi32 function that returns zero on failure.
+ */
+func service_call(proc *syscall.LazyProc, args ...uintptr) error {
+	r, _, err := proc.Call(args...)
+	if(r == 0) {
+		return err
+	}
+	return nil
+}
+
+func utf16(s string) *uint16 {
+	p, _ := syscall.UTF16PtrFromString(s)
+	return p
+}
+
+func open_sc_manager() (uintptr, error) {
+	scm, _, err := proc_open_sc_manager.Call(0, 0, sc_manager_all_access)
+	if(scm == 0) {
+		return 0, fmt.Errorf("can't open the service manager: %v", err)
+	}
+	return scm, nil
+}
+
+/*
+ * Open the service called name and do f with it.
+ */
+func with_service(name string, f func(h uintptr) error) error {
+	scm, err := open_sc_manager()
+	if(err != nil) {
+		return err
+	}
+	defer proc_close_service_handle.Call(scm)
+
+	h, _, err := proc_open_service.Call(scm, uintptr(unsafe.Pointer(utf16(name))), service_all_access)
+	if(h == 0) {
+		return fmt.Errorf("can't open service %s: %v", name, err)
+	}
+	defer proc_close_service_handle.Call(h)
+	return f(h)
+}
+
+func install_service(name string, display string, server_flags []string) error {
+	exe, err := os.Executable()
+	if(err == nil) {
+		exe, err = filepath.Abs(exe)
+	}
+	if(err != nil) {
+		return err
+	}
+	command := []string{syscall.EscapeArg(exe), "service", "run", "-name", syscall.EscapeArg(name), "--"}
+	for _, arg := range server_flags {
+		command = append(command, syscall.EscapeArg(arg))
+	}
+
+	scm, err := open_sc_manager()
+	if(err != nil) {
+		return err
+	}
+	defer proc_close_service_handle.Call(scm)
+
+	h, _, err := proc_create_service.Call(scm,
+		uintptr(unsafe.Pointer(utf16(name))), uintptr(unsafe.Pointer(utf16(display))), service_all_access,
+		service_win32_own_process, service_auto_start, service_error_normal,
+		uintptr(unsafe.Pointer(utf16(strings.Join(command, " ")))), 0, 0, 0, 0, 0)
+	if(h == 0) {
+		return fmt.Errorf("can't create service %s: %v", name, err)
+	}
+	defer proc_close_service_handle.Call(h)
+
+	description := struct{ text *uint16 }{utf16("Network throughput tests over HTTP")}
+	proc_change_service_config.Call(h, service_config_description, uintptr(unsafe.Pointer(&description)))
+	fmt.Printf("Installed service %s: %s\n", name, strings.Join(command, " "))
+	return nil
+}
+
+/*
+ * Serve, and if the service manager started us, tell it how that's
+ * going.
+ */
+func run_as_service(name string, args []string) int {
+	service.name = utf16(name)
+	dispatched := make(chan error, 1)
+	go func() {
+		table := []service_table_entry{{service.name, syscall.NewCallback(service_main)}, {}}
+		dispatched <- service_call(proc_service_dispatcher, uintptr(unsafe.Pointer(&table[0])))
+	}()
+
+	server_args = args
+	receive_configuration()
+	go_reload_on_hangup()
+	start_rate_meter()
+	go_serve()
+	service.serving.Store(true)
+
+	select {
+	case err := <-dispatched:
+		if(errors.Is(err, syscall.Errno(error_failed_service_controller_connect))) {
+			log_at(log_level_info, "Not started by the service manager; serving from the console.")
+		} else if(err != nil) {
+			log_at(log_level_error, "Can't run as a service: %v", err)
+		}
+	case <-time.After(time.Second):
+	}
+	wait_for_death()
+	return 0
+}
+
+/*
+ * ServiceMain: register for controls, and say we're starting until
+ * /readyz would pass.  It never returns; the process exits once
+ * the service has stopped.
+ */
+func service_main(argc uintptr, argv uintptr) uintptr {
+	h, _, _ := proc_service_ctrl_handler.Call(uintptr(unsafe.Pointer(service.name)), syscall.NewCallback(service_control), 0)
+	service.Lock()
+	service.handle = h
+	service.Unlock()
+	set_service_state(service_start_pending, 30 * time.Second)
+
+	for !service.serving.Load() || !ready() {
+		time.Sleep(250 * time.Millisecond)
+		set_service_state(service_start_pending, 30 * time.Second)
+	}
+	set_service_state(service_running, 0)
+	select {}
+}
+
+/*
+ * HandlerEx: a stop or shutdown drains tests as SIGTERM would.
+ */
+func service_control(control uintptr, event uintptr, data uintptr, context uintptr) uintptr {
+	switch control {
+	case service_control_stop, service_control_shutdown:
+		set_service_state(service_stop_pending, settings().drain_timeout + 10 * time.Second)
+		select {
+		case death <- syscall.SIGTERM:
+		default:
+		}
+	case service_control_interrogate:
+		set_service_state(0, 0)
+	default:
+		return error_call_not_implemented
+	}
+	return 0
+}
+
+/*
+ * Tell the manager the service's state, or repeat the current one when
+ * state is zero.  A pending state gets a new check point each time, so
+ * the manager knows we're getting on with it.
+ */
+func set_service_state(state uint32, wait time.Duration) {
+	service.Lock()
+	defer service.Unlock()
+	if(service.handle == 0) {
+		return
+	}
+	s := &service.status
+	if(state != 0) {
+		if(state != s.current_state) {
+			s.check_point = 0
+		}
+		s.current_state, s.wait_hint = state, uint32(wait / time.Millisecond)
+	}
+	s.service_type, s.accepted = service_win32_own_process, 0
+	if(s.current_state == service_running) {
+		s.accepted = service_accept_stop | service_accept_shutdown
+	}
+	if(s.current_state == service_start_pending || s.current_state == service_stop_pending) {
+		s.check_point++
+	}
+	proc_set_service_status.Call(service.handle, uintptr(unsafe.Pointer(s)))
+}
+
+/*
+ * Tell the manager the service has stopped, before exiting.
+ */
+func service_stopped() {
+	set_service_state(service_stopped_state, 0)
+}
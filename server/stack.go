@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+/*
+ * Which IP version a request came over, for telling whether a client's
+ * Happy Eyeballs picked IPv6 or fell back to IPv4.  The client's family
+ * is that of its address as gost records it, so behind a trusted proxy
+ * it's the proxy's client's; the server's is the address the connection
+ * reached, which for IPv4 over a dual-stack socket is still IPv4.
+ */
+type stack_report struct {
+	Family       string `json:"family"`
+	ClientIP     string `json:"client_ip"`
+	Forwarded    bool   `json:"forwarded"`
+	ServerFamily string `json:"server_family,omitempty"`
+	ServerIP     string `json:"server_ip,omitempty"`
+	ServerPort   int    `json:"server_port,omitempty"`
+}
+
+/*
+ * "ipv4" or "ipv6" for an address, or "unix" for no address at all.
+ */
+func family_of(addr netip.Addr) string {
+	switch {
+	case !addr.IsValid():
+		return "unix"
+	case addr.Unmap().Is4():
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+/*
+ * The family a request arrived over.
+ */
+func request_family(req *http.Request) string {
+	addr, _, _ := client_address(req)
+	return family_of(addr)
+}
+
+/*
+ * GET: Report the address family of this connection at each end.
+ */
+func route_stack(res http.ResponseWriter, req *http.Request) {
+	addr, _, forwarded := client_address(req)
+	report := stack_report{Family: family_of(addr), ClientIP: client_ip(req), Forwarded: forwarded}
+
+	local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if(ok) {
+		server, err := netip.ParseAddrPort(local.String())
+		if(err == nil) {
+			report.ServerFamily = family_of(server.Addr())
+			report.ServerIP = server.Addr().Unmap().String()
+			report.ServerPort = int(server.Port())
+		}
+	}
+	write_json(res, 200, report)
+}
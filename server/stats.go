@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Test results summed up over time, for graphing.  /stats answers with
+ * a flat JSON array of buckets, one per ?step= over the last ?range=,
+ * which Grafana's Infinity data source reads as a table with a time
+ * column.  Grafana's own time range can be passed as ?from=${__from}
+ * and ?to=${__to} instead of ?range=.  The figures come from the
+ * results gost keeps, so they reach back as far as -results-kept and
+ * -results-max-age allow.
+ */
+const stats_default_range = 24 * time.Hour
+const stats_default_step = 5 * time.Minute
+const stats_max_buckets = 5000
+
+type stats_bucket struct {
+	Time      time.Time `json:"time"`
+	Tests     int       `json:"tests"`
+	Completed int       `json:"completed"`
+	Aborted   int       `json:"aborted"`
+	Bytes     int64     `json:"bytes"`
+	P50Mbps   float64   `json:"p50_mbps"`
+	P95Mbps   float64   `json:"p95_mbps"`
+}
+
+/*
+ * Parse a duration that may also be given in days, such as 7d.
+ */
+func parse_span(value string) (time.Duration, error) {
+	days, ok := strings.CutSuffix(value, "d")
+	if(ok) {
+		n, err := strconv.Atoi(days)
+		if(err != nil) {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+/*
+ * Parse a time as Grafana sends it, in milliseconds since the epoch,
+ * or as RFC 3339.
+ */
+func parse_stats_time(value string) (time.Time, error) {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if(err == nil) {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+/*
+ * The span a /stats request asks about, and its step.
+ */
+func stats_window(req *http.Request) (time.Time, time.Time, time.Duration, error) {
+	query := req.URL.Query()
+	end := time.Now()
+	span := stats_default_range
+	step := stats_default_step
+	var err error
+
+	if(query.Get("range") != "") {
+		span, err = parse_span(query.Get("range"))
+		if(err != nil || span <= 0) {
+			return end, end, 0, fmt.Errorf("range must be a positive duration such as 24h or 7d")
+		}
+	}
+	if(query.Get("step") != "") {
+		step, err = parse_span(query.Get("step"))
+		if(err != nil || step < time.Second) {
+			return end, end, 0, fmt.Errorf("step must be a duration of at least 1s")
+		}
+	}
+	start := end.Add(-span)
+
+	if(query.Get("from") != "" || query.Get("to") != "") {
+		start, err = parse_stats_time(query.Get("from"))
+		if(err == nil && query.Get("to") != "") {
+			end, err = parse_stats_time(query.Get("to"))
+		}
+		if(err != nil || !start.Before(end)) {
+			return end, end, 0, fmt.Errorf("from and to must be milliseconds since the epoch or RFC 3339 times, from before to")
+		}
+	}
+
+	if(end.Sub(start) / step > stats_max_buckets) {
+		return end, end, 0, fmt.Errorf("at most %d steps per request", stats_max_buckets)
+	}
+	return start, end, step, nil
+}
+
+/*
+ * GET: Results in buckets, oldest first.  ?direction= counts only
+ * downloads or uploads, and ?client=, ?country= or ?asn= only those
+ * clients.
+ * Throughput percentiles are of completed tests.
+ */
+func route_stats(res http.ResponseWriter, req *http.Request) {
+	if(req.Method != "GET" && req.Method != "HEAD" && req.Method != "") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+
+	start, end, step, err := stats_window(req)
+	filter, ferr := query_filter(req)
+	if(err == nil) {
+		err = ferr
+	}
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return
+	}
+
+	first := start.Truncate(step)
+	buckets := []stats_bucket{}
+	for t := first; t.Before(end); t = t.Add(step) {
+		buckets = append(buckets, stats_bucket{Time: t.UTC()})
+	}
+	rates := make([][]float64, len(buckets))
+
+	filter.since = first
+	results, _ := results_store(req).page(filter, 0, settings().results_kept)
+	for _, result := range results {
+		if(!result.Started.Before(end)) {
+			continue
+		}
+		i := int(result.Started.Sub(first) / step)
+		b := &buckets[i]
+		b.Tests++
+		b.Bytes += result.Bytes
+		if(result.Outcome == "completed") {
+			b.Completed++
+			rates[i] = append(rates[i], result.Mbps)
+		} else {
+			b.Aborted++
+		}
+	}
+
+	for i := range buckets {
+		buckets[i].P50Mbps = percentile(rates[i], 0.5)
+		buckets[i].P95Mbps = percentile(rates[i], 0.95)
+	}
+	write_json(res, 200, buckets)
+}
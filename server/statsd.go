@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+ * StatsD emission, for shops whose metrics go through a StatsD or
+ * Datadog agent rather than a Prometheus scraper.  With -statsd set to
+ * the agent's host:port, every finished test sends
+ *
+ *	<prefix>test.completed or test.aborted   a counter
+ *	<prefix>test.throughput_mbps             a timing of its Mbps
+ *	<prefix>test.duration                    a timing, in milliseconds
+ *	<prefix>bytes.served                     a counter of its bytes
+ *
+ * With -dogstatsd, timings go as histograms and every metric is tagged
+ * with its direction and the node's name; plain StatsD has no tags, so
+ * there the direction goes in the name instead, as test.down.completed.
+ * Lines are batched into packets of at most statsd_packet bytes and
+ * sent at least every statsd_flush.  StatsD is fire and forget: when
+ * the agent isn't there or gost is emitting faster than it can send,
+ * metrics are dropped rather than tests slowed.
+ */
+const (
+	statsd_packet = 1432
+	statsd_flush  = time.Second
+)
+
+var statsd_lines = make(chan string, 4096)
+
+/*
+ * Queue one metric line, unless the queue is full.
+ */
+func statsd_emit(c *configuration, name string, value string, kind string, direction string) {
+	if(c.statsd_address == "") {
+		return
+	}
+	var line string
+	if(c.dogstatsd) {
+		if(kind == "ms") {
+			kind = "h"
+		}
+		line = fmt.Sprintf("%s%s:%s|%s|#direction:%s,node:%s", c.statsd_prefix, name, value, kind, direction, c.node_name)
+	} else {
+		group, metric, _ := strings.Cut(name, ".")
+		line = fmt.Sprintf("%s%s.%s.%s:%s|%s", c.statsd_prefix, group, direction, metric, value, kind)
+	}
+	select {
+	case statsd_lines <- line:
+	default:
+	}
+}
+
+/*
+ * Send a finished test's metrics.
+ */
+func statsd_result(result test_result) {
+	c := settings()
+	if(c.statsd_address == "") {
+		return
+	}
+	outcome := "test.completed"
+	if(result.Outcome != "completed") {
+		outcome = "test.aborted"
+	}
+	statsd_emit(c, outcome, "1", "c", result.Direction)
+	statsd_emit(c, "bytes.served", fmt.Sprint(result.Bytes), "c", result.Direction)
+	statsd_emit(c, "test.duration", format_float(result.Seconds * 1000), "ms", result.Direction)
+	if(result.Outcome == "completed") {
+		statsd_emit(c, "test.throughput_mbps", format_float(result.Mbps), "ms", result.Direction)
+	}
+}
+
+/*
+ * Batch queued lines into packets and send them to wherever -statsd
+ * says now, dialing again when that changes.
+ */
+func go_send_statsd() {
+	go func() {
+		var conn net.Conn
+		var address string
+		var packet []byte
+		flush := time.NewTicker(statsd_flush)
+
+		send := func() {
+			want := settings().statsd_address
+			if(want != address) {
+				if(conn != nil) {
+					conn.Close()
+					conn = nil
+				}
+				address = want
+				if(address != "") {
+					var err error
+					conn, err = net.Dial("udp", address)
+					if(err != nil) {
+						log_at(log_level_error, "Can't reach StatsD at %s: %v", address, err)
+					}
+				}
+			}
+			if(conn != nil && len(packet) > 0) {
+				conn.Write(packet)
+			}
+			packet = packet[:0]
+		}
+
+		for {
+			select {
+			case line := <-statsd_lines:
+				if(len(packet) > 0 && len(packet) + 1 + len(line) > statsd_packet) {
+					send()
+				}
+				if(len(packet) > 0) {
+					packet = append(packet, '\n')
+				}
+				packet = append(packet, line...)
+			case <-flush.C:
+				send()
+			}
+		}
+	}()
+}
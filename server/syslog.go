@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Logging to syslog, for sites where that's all that collects logs.
+ * -syslog takes local, for the machine's own daemon on /dev/log, or
+ * udp://, tcp:// or tls:// and a host:port.  Every record goes out in
+ * RFC 5424 form, with its level as the severity, -syslog-facility and
+ * -syslog-tag as the app name; over a stream, each message is framed
+ * with its length as RFC 6587 has it.  The message itself is the usual
+ * text or JSON line, less the time, which the header has.  The
+ * connection is made on the first record and made again after it
+ * fails; while the daemon can't be reached, records go to stderr, and
+ * it's only tried again every syslog_retry.
+ */
+const (
+	syslog_timeout = 5 * time.Second
+	syslog_retry   = 10 * time.Second
+)
+
+var syslog_local_paths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+var syslog_facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "ntp": 12, "security": 13, "console": 14,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+/*
+ * Syslog severities for slog's levels.
+ */
+func syslog_severity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3 // err
+	case level >= slog.LevelWarn:
+		return 4 // warning
+	case level >= slog.LevelInfo:
+		return 6 // info
+	}
+	return 7 // debug
+}
+
+/*
+ * The network and address a -syslog means.
+ */
+func parse_syslog_address(s string) (network string, address string, err error) {
+	if(s == "local") {
+		return "unixgram", "", nil
+	}
+	u, err := url.Parse(s)
+	if(err != nil || u.Host == "" || (u.Scheme != "udp" && u.Scheme != "tcp" && u.Scheme != "tls")) {
+		return "", "", fmt.Errorf("syslog must be local, or udp://, tcp:// or tls:// and host:port, not %q", s)
+	}
+	address = u.Host
+	if(u.Port() == "") {
+		port := "514"
+		if(u.Scheme == "tls") {
+			port = "6514"
+		}
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u.Scheme, address, nil
+}
+
+/*
+ * Where records go: the connection to the daemon, and what the header
+ * of each says.  severity is that of the record being written, set by
+ * the handler around each one.
+ */
+type syslog_sink struct {
+	mu       sync.Mutex
+	target   string
+	network  string
+	address  string
+	conn     net.Conn
+	retry_at time.Time
+	facility int
+	tag      string
+	hostname string
+	severity int
+}
+
+var syslog_sinks = struct {
+	sync.Mutex
+	current *syslog_sink
+}{}
+
+/*
+ * The sink for c's -syslog, the one already in use if it's the same
+ * target.
+ */
+func syslog_sink_for(c *configuration) (*syslog_sink, error) {
+	network, address, err := parse_syslog_address(c.syslog_address)
+	if(err != nil) {
+		return nil, err
+	}
+
+	syslog_sinks.Lock()
+	defer syslog_sinks.Unlock()
+	s := syslog_sinks.current
+	if(s == nil || s.target != c.syslog_address) {
+		if(s != nil) {
+			s.close()
+		}
+		s = &syslog_sink{target: c.syslog_address, network: network, address: address}
+		syslog_sinks.current = s
+	}
+	s.mu.Lock()
+	s.facility, s.tag, s.hostname = syslog_facilities[c.syslog_facility], c.syslog_tag, c.node_name
+	s.mu.Unlock()
+	return s, nil
+}
+
+func (s *syslog_sink) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if(s.conn != nil) {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *syslog_sink) dial() (net.Conn, error) {
+	switch s.network {
+	case "unixgram":
+		for _, path := range syslog_local_paths {
+			conn, err := net.DialTimeout("unixgram", path, syslog_timeout)
+			if(err == nil) {
+				return conn, nil
+			}
+		}
+		return nil, errors.New("no local syslog daemon")
+	case "tls":
+		dialer := &net.Dialer{Timeout: syslog_timeout}
+		host, _, _ := net.SplitHostPort(s.address)
+		return tls.DialWithDialer(dialer, "tcp", s.address, &tls.Config{ServerName: host})
+	}
+	return net.DialTimeout(s.network, s.address, syslog_timeout)
+}
+
+/*
+ * Send one formatted record, as the handler gives it, with mu held by
+ * the handler.
+ */
+func (s *syslog_sink) Write(p []byte) (int, error) {
+	text := strings.TrimRight(string(p), "\n")
+	message := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		s.facility * 8 + s.severity, time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslog_field(s.hostname), syslog_field(s.tag), os.Getpid(), text)
+	frame := []byte(message)
+	if(s.network == "tcp" || s.network == "tls") {
+		frame = []byte(strconv.Itoa(len(message)) + " " + message)
+	}
+
+	// One try on the connection there is, then one on a fresh one.
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if(s.conn == nil) {
+			if(time.Now().Before(s.retry_at)) {
+				err = errors.New("not connected")
+				break
+			}
+			s.conn, err = s.dial()
+			if(err != nil) {
+				s.retry_at = time.Now().Add(syslog_retry)
+				break
+			}
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(syslog_timeout))
+		_, err = s.conn.Write(frame)
+		if(err == nil) {
+			return len(p), nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	fmt.Fprintf(os.Stderr, "%s (syslog: %v)\n", text, err)
+	return len(p), nil
+}
+
+/*
+ * A header field: printable ASCII without spaces, or "-" for none.
+ */
+func syslog_field(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if(r <= ' ' || r > '~') {
+			return '_'
+		}
+		return r
+	}, s)
+	if(s == "") {
+		return "-"
+	}
+	return s
+}
+
+/*
+ * A slog.Handler that has inner format each record into the sink,
+ * having told the sink its severity.
+ */
+type syslog_handler struct {
+	inner slog.Handler
+	sink  *syslog_sink
+}
+
+func (h *syslog_handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *syslog_handler) Handle(ctx context.Context, r slog.Record) error {
+	h.sink.mu.Lock()
+	defer h.sink.mu.Unlock()
+	h.sink.severity = syslog_severity(r.Level)
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *syslog_handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslog_handler{h.inner.WithAttrs(attrs), h.sink}
+}
+
+func (h *syslog_handler) WithGroup(name string) slog.Handler {
+	return &syslog_handler{h.inner.WithGroup(name), h.sink}
+}
+
+/*
+ * Leave the time out of records for syslog, as well as shortening the
+ * source.
+ */
+func syslog_replace(groups []string, a slog.Attr) slog.Attr {
+	if(a.Key == slog.TimeKey && len(groups) == 0) {
+		return slog.Attr{}
+	}
+	return short_source(groups, a)
+}
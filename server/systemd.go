@@ -0,0 +1,226 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Running under systemd.  With socket activation systemd binds the
+ * ports and hands them over as file descriptors from 3 up, named after
+ * the listener they're for with FileDescriptorName=: an HTTP
+ * listener's name, iperf, udp, admin or grpc.  Unnamed ones go to the
+ * HTTP listeners in order, and more than one with the same name are
+ * its -acceptors.  With Type=notify gost says READY=1 once /readyz
+ * would pass, and with WatchdogSec= it pats the watchdog only while
+ * every listener is healthy, so that systemd restarts a wedged gost.
+ */
+const systemd_fds_start = 3
+
+var systemd_fds = map[string]*os.File{}
+
+/*
+ * Any more sockets for a listener after its first, and where they all
+ * came from: systemd, or the gost we're taking over from.
+ */
+var (
+	systemd_extra_fds = map[string][]*os.File{}
+	systemd_fds_from  = "systemd"
+)
+
+/*
+ * Collect any sockets systemd passed us, and clear the variables so
+ * children don't think they're for them.
+ */
+func collect_systemd_sockets(c *configuration) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	handed := handed_over()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if((err != nil || pid != os.Getpid()) && !handed) {
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if(err != nil || count < 1) {
+		return
+	}
+
+	known := map[string]bool{"iperf": true, "udp": true, "h3": true, "admin": true, "grpc": true}
+	if(handed) {
+		// Only what the configuration still has.
+		systemd_fds_from = "the old gost"
+		known = map[string]bool{
+			"iperf": c.iperf_port != 0,
+			"udp":   c.udp_port != 0,
+			"h3":    c.h3_port != 0,
+			"admin": c.admin_address != "",
+			"grpc":  c.grpc_address != "",
+		}
+	}
+	var unnamed []string
+	for _, spec := range c.listener_specs() {
+		known[spec.name] = true
+		unnamed = append(unnamed, spec.name)
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < count; i++ {
+		name := ""
+		if(i < len(names)) {
+			name = names[i]
+		}
+		if(!known[name] && handed) {
+			log_at(log_level_info, "Closing the %s socket, which is no longer configured", name)
+			os.NewFile(uintptr(systemd_fds_start + i), name).Close()
+			continue
+		}
+		if(!known[name]) {
+			if(len(unnamed) == 0) {
+				log_at(log_level_error, "Ignoring socket %q from systemd", name)
+				continue
+			}
+			name = unnamed[0]
+		}
+		for j, n := range unnamed {
+			if(n == name) {
+				unnamed = append(unnamed[:j], unnamed[j + 1:]...)
+				break
+			}
+		}
+		f := os.NewFile(uintptr(systemd_fds_start + i), name)
+		if(systemd_fds[name] != nil) {
+			systemd_extra_fds[name] = append(systemd_extra_fds[name], f)
+			continue
+		}
+		systemd_fds[name] = f
+	}
+}
+
+/*
+ * Whether systemd passed a socket for the named listener.
+ */
+func systemd_socket(name string) bool {
+	return systemd_fds[name] != nil
+}
+
+/*
+ * The named listener's socket from systemd, or a fresh one on addr
+ * over network, "tcp", "tcp4" or "tcp6".  A socket from systemd is
+ * whatever family it was made with.
+ */
+func listen_tcp(name string, network string, addr string) (net.Listener, error) {
+	f := systemd_fds[name]
+	if(f == nil) {
+		return net.Listen(network, addr)
+	}
+	log_at(log_level_info, "Using the %s socket from %s", name, systemd_fds_from)
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+/*
+ * The named listener's other acceptors' sockets, if it was passed more
+ * than one.
+ */
+func listen_tcp_extra(name string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, f := range systemd_extra_fds[name] {
+		l, err := net.FileListener(f)
+		f.Close()
+		if(err != nil) {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+/*
+ * Likewise for a datagram socket.
+ */
+func listen_udp(name string, addr string) (net.PacketConn, error) {
+	f := systemd_fds[name]
+	if(f == nil) {
+		return net.ListenPacket("udp", addr)
+	}
+	log_at(log_level_info, "Using the %s socket from %s", name, systemd_fds_from)
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
+
+/*
+ * The port a listener ended up on.
+ */
+func port_of(addr net.Addr) int {
+	_, port, _ := net.SplitHostPort(addr.String())
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+/*
+ * Send a state change to systemd, if it's listening.
+ */
+func sd_notify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if(path == "") {
+		return
+	}
+	if(path[0] == '@') {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if(err != nil) {
+		log_at(log_level_error, "Can't notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
+
+/*
+ * How often systemd wants to hear from us, or zero if it doesn't.
+ */
+func sd_watchdog_interval() time.Duration {
+	pid := os.Getenv("WATCHDOG_PID")
+	if(pid != "" && pid != strconv.Itoa(os.Getpid())) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if(err != nil || usec <= 0) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+/*
+ * Tell systemd we're ready once we are, then keep its watchdog fed
+ * for as long as the listeners stay healthy.
+ */
+func go_notify_systemd() {
+	if(os.Getenv("NOTIFY_SOCKET") == "") {
+		return
+	}
+
+	go func() {
+		for !ready() {
+			time.Sleep(250 * time.Millisecond)
+		}
+		sd_notify("READY=1\nSTATUS=Serving")
+
+		interval := sd_watchdog_interval()
+		if(interval == 0) {
+			return
+		}
+		for range time.Tick(interval / 2) {
+			if(listeners_healthy()) {
+				sd_notify("WATCHDOG=1")
+			}
+		}
+	}()
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net"
+)
+
+/*
+ * What the kernel knows about a test's TCP connection, read as the test
+ * ends.  A low throughput number with lots of retransmits, or a small
+ * congestion window, says where to look.  Only Linux fills this in.
+ */
+type tcp_stats struct {
+	Retransmits  uint32  `json:"retransmits"`
+	RTTMs        float64 `json:"rtt_ms"`
+	RTTVarMs     float64 `json:"rttvar_ms"`
+	DeliveryMbps float64 `json:"delivery_rate_mbps"`
+	Cwnd         uint32  `json:"cwnd"`
+	MSS          uint32  `json:"mss"`
+	Congestion   string  `json:"congestion,omitempty"`
+}
+
+/*
+ * Dig the TCP connection out from under TLS and the PROXY protocol, if
+ * they're there.
+ */
+func tcp_conn_of(conn net.Conn) *net.TCPConn {
+	for {
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if(!ok) {
+			break
+		}
+		conn = wrapped.NetConn()
+	}
+	tcp, _ := conn.(*net.TCPConn)
+	return tcp
+}
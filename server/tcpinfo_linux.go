@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+/*
+ * Offsets into struct tcp_info from <linux/tcp.h>.  The layout only
+ * ever grows at the end, so these hold for any kernel that has
+ * tcpi_delivery_rate (4.9 and up); older ones just leave it zero.
+ */
+const (
+	tcpi_snd_mss       = 16
+	tcpi_rtt           = 68
+	tcpi_rttvar        = 72
+	tcpi_snd_cwnd      = 80
+	tcpi_total_retrans = 100
+	tcpi_delivery_rate = 160
+)
+
+/*
+ * Read TCP_INFO for conn, or nil if it isn't TCP or the kernel won't
+ * say.
+ */
+func read_tcp_info(conn net.Conn) *tcp_stats {
+	tcp := tcp_conn_of(conn)
+	if(tcp == nil) {
+		return nil
+	}
+	raw, err := tcp.SyscallConn()
+	if(err != nil) {
+		return nil
+	}
+
+	var buf [256]byte
+	size := uint32(len(buf))
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if(err != nil || errno != 0 || size < tcpi_total_retrans + 4) {
+		return nil
+	}
+
+	u32 := func(off int) uint32 { return binary.NativeEndian.Uint32(buf[off:]) }
+	s := &tcp_stats{
+		Retransmits: u32(tcpi_total_retrans),
+		RTTMs:       float64(u32(tcpi_rtt)) / 1000,
+		RTTVarMs:    float64(u32(tcpi_rttvar)) / 1000,
+		Cwnd:        u32(tcpi_snd_cwnd),
+		MSS:         u32(tcpi_snd_mss),
+		Congestion:  congestion_of(conn),
+	}
+	if(size >= tcpi_delivery_rate + 8) {
+		s.DeliveryMbps = float64(binary.NativeEndian.Uint64(buf[tcpi_delivery_rate:])) * 8 / 1e6
+	}
+	return s
+}
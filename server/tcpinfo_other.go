@@ -0,0 +1,14 @@
+//go:build !linux
+
+package server
+
+import (
+	"net"
+)
+
+/*
+ * TCP_INFO is Linux-only; elsewhere results just go without.
+ */
+func read_tcp_info(conn net.Conn) *tcp_stats {
+	return nil
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+ * Tenants, so that one gost can serve several teams or customers and
+ * account for each apart.  The config file's "tenants" list gives each
+ * one a name and tokens of its own, which authenticate as -tokens do,
+ * by bearer token or signed URL.  A test run with a tenant's token
+ * belongs to that tenant: it counts against the tenant's own limits,
+ * max_active tests at once and max_bytes in each window, on top of the
+ * server's and the client's, and its result carries the tenant's name.
+ * Each tenant keeps its own ring of results_kept recent results, which
+ * is what /results, /stats and the API show a request made with its
+ * token, so a busy tenant can't push out another's history and none
+ * sees another's.  The gost_tenant_* metrics count tests, bytes and
+ * running tests by tenant, and GET /admin/tenants reports each one.
+ */
+const tenant_default_window = 24 * time.Hour
+
+type tenant_spec struct {
+	name       string
+	tokens     []string
+	max_active int
+	max_bytes  int64
+	window     time.Duration
+}
+
+/*
+ * What each tenant is up to, by name.  Kept across reloads, so that
+ * a tenant's usage and results don't reset when the file is re-read.
+ */
+type tenant_usage struct {
+	client_usage
+	results result_ring
+}
+
+var tenant_states = struct {
+	sync.Mutex
+	byname map[string]*tenant_usage
+}{byname: map[string]*tenant_usage{}}
+
+func tenant_state(name string) *tenant_usage {
+	tenant_states.Lock()
+	defer tenant_states.Unlock()
+	u := tenant_states.byname[name]
+	if(u == nil) {
+		u = &tenant_usage{}
+		tenant_states.byname[name] = u
+	}
+	return u
+}
+
+func (c *configuration) tenant_named(name string) *tenant_spec {
+	for i := range c.tenants {
+		if(c.tenants[i].name == name) {
+			return &c.tenants[i]
+		}
+	}
+	return nil
+}
+
+/*
+ * The tenant whose token the request carries, or "" for none.
+ */
+func request_tenant(req *http.Request) string {
+	for _, t := range settings().tenants {
+		if(bearer_ok(req, t.tokens) || signature_ok(req, t.tokens)) {
+			return t.name
+		}
+	}
+	return ""
+}
+
+/*
+ * Reserve a test for tenant, or say why not and when to try again.  A
+ * reservation must be given back with release_tenant().
+ */
+func reserve_tenant(name string) (string, time.Duration) {
+	t := settings().tenant_named(name)
+	if(t == nil) {
+		return "", 0
+	}
+	u := tenant_state(name)
+	tenant_states.Lock()
+	defer tenant_states.Unlock()
+
+	if(t.max_active > 0 && u.active >= t.max_active) {
+		metric_tests_refused.add("tenant_concurrency", 1)
+		return "tenant concurrency", 5 * time.Second
+	}
+	if(t.max_bytes > 0) {
+		now := time.Now()
+		length, slot := quota_slot(now, t.window)
+		used, expiry := u.window_bytes(slot, length, now)
+		if(used >= t.max_bytes) {
+			metric_tests_refused.add("tenant_quota", 1)
+			return "tenant quota", max(expiry, time.Second)
+		}
+	}
+
+	u.active++
+	metric_tenant_active.add(name, 1)
+	return "", 0
+}
+
+/*
+ * Give back tenant's reservation for a test that moved n bytes.
+ */
+func release_tenant(name string, n int64) {
+	t := settings().tenant_named(name)
+	if(name == "" || t == nil) {
+		return
+	}
+	_, slot := quota_slot(time.Now(), t.window)
+	u := tenant_state(name)
+	tenant_states.Lock()
+	defer tenant_states.Unlock()
+
+	u.active = max(u.active - 1, 0)
+	metric_tenant_active.add(name, -1)
+	u.add_bytes(slot, n)
+}
+
+/*
+ * Count n more bytes against tenant name's quota.
+ */
+func charge_tenant(name string, n int64) {
+	t := settings().tenant_named(name)
+	if(name == "" || t == nil) {
+		return
+	}
+	_, slot := quota_slot(time.Now(), t.window)
+	u := tenant_state(name)
+	tenant_states.Lock()
+	defer tenant_states.Unlock()
+	u.add_bytes(slot, n)
+}
+
+/*
+ * Keep a finished result in its tenant's ring, and count it.
+ */
+func store_tenant_result(c *configuration, result test_result) {
+	if(result.Tenant == "") {
+		return
+	}
+	tenant_state(result.Tenant).results.add(result, c.results_kept)
+	metric_tenant_tests.add(result.Tenant, 1)
+	metric_tenant_bytes.add(result.Tenant, result.Bytes)
+}
+
+/*
+ * The results a request may see: its tenant's, or with no tenant, its
+ * virtual host's, or on the server's own host, all of them.
+ */
+func results_store(req *http.Request) *result_ring {
+	name := request_tenant(req)
+	if(name != "") {
+		return &tenant_state(name).results
+	}
+	vhost := request_vhost(req)
+	if(vhost != "") {
+		return &vhost_state(vhost).results
+	}
+	return &recent_results
+}
+
+/*
+ * filter, narrowed to the results req may see, as results_store()
+ * would, for the results database, which holds everyone's.
+ */
+func scope_filter(req *http.Request, filter result_filter) result_filter {
+	name := request_tenant(req)
+	if(name != "") {
+		filter.tenant = name
+		return filter
+	}
+	vhost := request_vhost(req)
+	if(vhost != "") {
+		filter.vhost = vhost
+	}
+	return filter
+}
+
+/*
+ * Each tenant as GET /admin/tenants reports it.
+ */
+type tenant_report struct {
+	Name      string `json:"name"`
+	Tokens    int    `json:"tokens"`
+	Active    int    `json:"active"`
+	MaxActive int    `json:"max_active,omitempty"`
+	Bytes     int64  `json:"window_bytes"`
+	MaxBytes  int64  `json:"max_bytes,omitempty"`
+	Window    string `json:"window"`
+	Tests     int64  `json:"tests"`
+	Moved     int64  `json:"bytes"`
+	Results   int    `json:"results"`
+}
+
+func tenant_reports(c *configuration) []tenant_report {
+	now := time.Now()
+	reports := []tenant_report{}
+	for _, t := range c.tenants {
+		u := tenant_state(t.name)
+		length, slot := quota_slot(now, t.window)
+		tenant_states.Lock()
+		used, _ := u.window_bytes(slot, length, now)
+		active := u.active
+		tenant_states.Unlock()
+		_, kept := u.results.page(result_filter{}, 0, 0)
+
+		reports = append(reports, tenant_report{
+			Name:      t.name,
+			Tokens:    len(t.tokens),
+			Active:    active,
+			MaxActive: t.max_active,
+			Bytes:     used,
+			MaxBytes:  t.max_bytes,
+			Window:    t.window.String(),
+			Tests:     metric_tenant_tests.with(t.name).Load(),
+			Moved:     metric_tenant_bytes.with(t.name).Load(),
+			Results:   kept,
+		})
+	}
+	return reports
+}
+
+/*
+ * GET: Each tenant's limits, usage and totals.
+ */
+func route_admin_tenants(res http.ResponseWriter, req *http.Request) {
+	if(req.Method != "GET" && req.Method != "HEAD" && req.Method != "") {
+		res.WriteHeader(405) // Method Not Allowed
+		io.WriteString(res, "Method Not Allowed")
+		return
+	}
+	write_json(res, 200, tenant_reports(settings()))
+}
@@ -0,0 +1,583 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Bookkeeping for bandwidth tests.  Every /down and /up call brackets
+ * its transfer with begin_test() and test_run.end() so that shutdown
+ * can wait for them and report how they fared.
+ */
+var test_tracker struct {
+	running   sync.WaitGroup
+	active    atomic.Int64
+	completed atomic.Int64
+	aborted   atomic.Int64
+}
+
+/*
+ * A single test in progress.
+ */
+type test_run struct {
+	id         string
+	request_id string
+	direction  string
+	start      time.Time
+	client_ip  string
+	tenant     string
+	vhost      string
+	protocol   string
+	requested  int64
+
+	// The SHA-256 digest of the payload, when the test asked for one,
+	// and for uploads that said what to expect, whether it matched.
+	checksum       string
+	checksum_match *bool
+
+	// The most bytes the client's JWT lets it move, or zero.
+	jwt_limit int64
+
+	// The connection the test ran over, for its TCP statistics.  May be
+	// nil.
+	conn net.Conn
+
+	// Bytes moved so far, for progress reports, and the final result,
+	// published by closing done.
+	moved  atomic.Int64
+	done   chan struct{}
+	result test_result
+
+	// Set to stop the test at its next read or write.  Cancelling
+	// also cancels ctx, which the test waits on in place of its
+	// request's, and interrupts whatever read or write it's blocked in,
+	// until it has finished.
+	cancelled atomic.Bool
+	ctx       context.Context
+	stop      context.CancelFunc
+	interrupt func()
+	finishing sync.Mutex
+	finished  bool
+
+	// Whether the test's reservation has been given back, which a
+	// cancelled test does at once rather than when it finishes, and
+	// how many bytes were charged to its quotas then.  Guarded by
+	// finishing.
+	released bool
+	charged  int64
+
+	// Throughput every sample_interval, for downloads.
+	samples_mu sync.Mutex
+	samples    []float64
+
+	// How long the test's start is left out of its throughput for, and
+	// how far it had got by then, taken when the time's up.
+	omit       time.Duration
+	omit_timer *time.Timer
+	omit_bytes atomic.Int64
+	omit_taken atomic.Bool
+
+	// The rate the client expects the test to reach, in bits per
+	// second, or zero.
+	expect_bps int64
+
+	// For /down/compressible, the Content-Encoding it was sent with,
+	// and how much content went into it.
+	encoding      string
+	content_bytes int64
+
+	// The Content-Type a download was disguised with by ?as=.
+	as string
+
+	// The span of the request that ran the test, when tracing.
+	span *trace_span
+
+	// What an /asym test found.
+	asym *asym_report
+
+	// How a replayed profile kept to time.
+	replay *replay_report
+}
+
+var test_cancelled = errors.New("test cancelled")
+
+/*
+ * Tests in progress, by ID.
+ */
+var active_runs sync.Map
+
+/*
+ * Does s look like one of our test IDs?
+ */
+func valid_test_id(s string) bool {
+	if(len(s) != 36) {
+		return false
+	}
+	for i, r := range s {
+		if(i == 8 || i == 13 || i == 18 || i == 23) {
+			if(r != '-') {
+				return false
+			}
+		} else if(!strings.ContainsRune("0123456789abcdef", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Note that a test has started.  direction is "down" or "up", and
+ * requested is the size the client asked for, if it said.  The test's
+ * ID goes out in the X-Gost-Test-Id header, so this must be called
+ * before the response is written.  A client that wants to watch an
+ * upload's progress needs the ID before the upload ends, so it may pick
+ * one itself with ?test_id=.
+ *
+ * ?congestion= picks the TCP congestion control for the test, and
+ * ?dscp= the DSCP mark on what gost sends.  Over HTTP/2 they change the
+ * whole connection.
+ *
+ * ?omit= leaves the first part of the test out of its throughput, as
+ * iperf's -O does, so that TCP slow start doesn't drag a short test's
+ * figure down.  The omitted bytes are still sent and counted in its
+ * size.
+ *
+ * ?expect=300Mbps has the result pass or fail by whether the test got
+ * within -expect-tolerance of that rate.
+ *
+ * Returns nil, having already answered the request, when the test is
+ * refused by admit_test() or the congestion control or mark can't be
+ * set.
+ */
+func begin_test(res http.ResponseWriter, req *http.Request, direction string, requested int64) *test_run {
+	omit, err := requested_omit(req)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return nil
+	}
+
+	expect, err := requested_expect(req)
+	if(err != nil) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, err.Error())
+		return nil
+	}
+
+	limit := jwt_test_limit(req)
+	if(limit > 0 && requested > limit) {
+		set_error_code(res, "token_limit")
+		res.WriteHeader(403) // Forbidden
+		io.WriteString(res, fmt.Sprintf("Tests over %d bytes aren't allowed with this token", limit))
+		return nil
+	}
+
+	tenant := request_tenant(req)
+	vhost := request_vhost(req)
+	if(!admit_test(res, client_ip(req), tenant, vhost)) {
+		return nil
+	}
+
+	// Only once the test's admitted, so that a refused one leaves the
+	// connection as it was for the next request on it.
+	conn := connection_of(req).conn
+	algorithm := req.URL.Query().Get("congestion")
+	if(algorithm != "" && conn != nil) {
+		err := set_congestion(conn, algorithm)
+		if(err != nil) {
+			unreserve_test(client_ip(req), tenant, vhost)
+			res.WriteHeader(400) // Bad Request
+			io.WriteString(res, "Can't use congestion control " + algorithm + ": " + err.Error())
+			return nil
+		}
+	}
+
+	dscp := req.URL.Query().Get("dscp")
+	if(dscp != "" && conn != nil) {
+		mark, err := parse_dscp(dscp)
+		if(err == nil) {
+			err = set_dscp(conn, mark)
+		}
+		if(err != nil) {
+			unreserve_test(client_ip(req), tenant, vhost)
+			res.WriteHeader(400) // Bad Request
+			io.WriteString(res, "Can't mark with DSCP " + dscp + ": " + err.Error())
+			return nil
+		}
+	}
+
+	t := new_test_run(req.Context(), strings.ToLower(req.URL.Query().Get("test_id")), request_id(req), direction, client_ip(req), req.Proto, requested)
+	t.tenant = tenant
+	t.vhost = vhost
+	t.jwt_limit = limit
+	t.conn = conn
+	t.expect_bps = expect
+	t.span = request_span(req)
+	t.finishing.Lock()
+	t.interrupt = interrupter(res, req)
+	t.finishing.Unlock()
+	if(omit > 0) {
+		t.omit = omit
+		t.omit_timer = time.AfterFunc(omit, func() {
+			t.omit_bytes.Store(t.moved.Load())
+			t.omit_taken.Store(true)
+		})
+	}
+	res.Header().Set("X-Gost-Test-Id", t.id)
+	return t
+}
+
+/*
+ * Something that makes the read or write req's handler is blocked in
+ * fail, to cancel its test.
+ */
+func interrupter(res http.ResponseWriter, req *http.Request) func() {
+	conn := connection_of(req).conn
+	rc := http.NewResponseController(res)
+	return func() {
+		now := time.Now()
+		err := errors.Join(rc.SetReadDeadline(now), rc.SetWriteDeadline(now))
+		if(err != nil && conn != nil && req.ProtoMajor == 1) {
+			// Hijacked, for a WebSocket.  Over HTTP/2 the
+			// connection is shared, and mustn't be touched.
+			conn.SetDeadline(now)
+		}
+	}
+}
+
+/*
+ * Start tracking a test that has already been admitted.  id is used if
+ * it's a valid, unused test ID; otherwise the test gets a fresh one.
+ * request is the ID of the request that started it, if any, and ctx
+ * its context.
+ */
+func new_test_run(ctx context.Context, id string, request string, direction string, client string, protocol string, requested int64) *test_run {
+	t := &test_run{
+		id:         id,
+		request_id: request,
+		direction:  direction,
+		start:      time.Now(),
+		client_ip:  client,
+		protocol:   protocol,
+		requested:  max(requested, 0),
+		done:       make(chan struct{}),
+	}
+	t.ctx, t.stop = context.WithCancel(ctx)
+
+	if(!valid_test_id(t.id)) {
+		t.id = new_uuid()
+	}
+	_, taken := active_runs.LoadOrStore(t.id, t)
+	for taken {
+		t.id = new_uuid()
+		_, taken = active_runs.LoadOrStore(t.id, t)
+	}
+	if(direction == "down") {
+		t.go_sample()
+	}
+	publish_event("start", t.report(t.start))
+	return t
+}
+
+/*
+ * Wrap w so that bytes written through it count towards the test's
+ * progress.
+ */
+func (t *test_run) writer(w io.Writer) io.Writer {
+	if(t.jwt_limit > 0) {
+		w = jwt_limited_writer{w, jwt_limited{&t.moved, t.jwt_limit}}
+	}
+	return progress_writer{w, &t.moved, &t.cancelled}
+}
+
+/*
+ * Wrap r so that bytes read through it count towards the test's
+ * progress.
+ */
+func (t *test_run) reader(r io.Reader) io.Reader {
+	if(t.jwt_limit > 0) {
+		r = jwt_limited_reader{r, jwt_limited{&t.moved, t.jwt_limit}}
+	}
+	return progress_reader{r, &t.moved, &t.cancelled}
+}
+
+/*
+ * Stop a running test.  Its reservation is given back now, and it
+ * ends, aborted, as soon as the read or write it's in fails.
+ */
+func (t *test_run) cancel() {
+	t.cancelled.Store(true)
+	t.stop()
+	t.finishing.Lock()
+	if(!t.finished && t.interrupt != nil) {
+		t.interrupt()
+	}
+	t.finishing.Unlock()
+	t.release()
+}
+
+/*
+ * Give back the test's reservation, once, counting what it has moved
+ * so far against the client's and tenant's quotas.
+ */
+func (t *test_run) release() {
+	t.finishing.Lock()
+	defer t.finishing.Unlock()
+	if(t.released) {
+		return
+	}
+	t.released = true
+	t.charged = t.moved.Load()
+	release_test(t.client_ip, t.tenant, t.vhost, t.charged)
+}
+
+/*
+ * Counts what's written into moved, and fails once stop is set, if
+ * there is one.
+ */
+type progress_writer struct {
+	w     io.Writer
+	moved *atomic.Int64
+	stop  *atomic.Bool
+}
+
+func (p progress_writer) Write(b []byte) (int, error) {
+	if(p.stop != nil && p.stop.Load()) {
+		return 0, test_cancelled
+	}
+	n, err := p.w.Write(b)
+	p.moved.Add(int64(n))
+	payload_bytes_moved.Add(int64(n))
+	return n, err
+}
+
+type progress_reader struct {
+	r     io.Reader
+	moved *atomic.Int64
+	stop  *atomic.Bool
+}
+
+func (p progress_reader) Read(b []byte) (int, error) {
+	if(p.stop != nil && p.stop.Load()) {
+		return 0, test_cancelled
+	}
+	n, err := p.r.Read(b)
+	p.moved.Add(int64(n))
+	payload_bytes_moved.Add(int64(n))
+	return n, err
+}
+
+/*
+ * Note that a test has finished after moving n bytes, successfully if
+ * err is nil.
+ */
+func (t *test_run) end(n int64, err error) test_result {
+	elapsed := time.Since(t.start)
+	t.finishing.Lock()
+	t.finished = true
+	released := t.released
+	t.released = true
+	t.finishing.Unlock()
+	t.stop()
+	if(err != nil && t.cancelled.Load()) {
+		// Whatever the interrupted read or write said.
+		err = test_cancelled
+	}
+	observe_test(t.direction, n, elapsed)
+
+	result := test_result{
+		ID:        t.id,
+		RequestID: t.request_id,
+		Direction: t.direction,
+		Started:   t.start,
+		Bytes:     n,
+		Requested: t.requested,
+		Seconds:   elapsed.Seconds(),
+		Mbps:      mbps(n, elapsed),
+		ClientIP:  t.client_ip,
+		Tenant:    t.tenant,
+		Vhost:     t.vhost,
+		Protocol:  t.protocol,
+		Outcome:   "completed",
+		SHA256:    t.checksum,
+		Match:     t.checksum_match,
+		TraceID:   t.span.trace_hex(),
+	}
+	if(err != nil) {
+		result.Outcome = "aborted"
+		result.Error = err.Error()
+	}
+	if(t.omit_timer != nil) {
+		t.omit_timer.Stop()
+	}
+	if(t.omit_taken.Load()) {
+		result.OmitSeconds = t.omit.Seconds()
+		result.OmittedBytes = t.omit_bytes.Load()
+		result.Mbps = mbps(n - result.OmittedBytes, elapsed - t.omit)
+	}
+	result.Encoding = t.encoding
+	result.ContentBytes = t.content_bytes
+	result.As = t.as
+	result.Asym = t.asym
+	result.Replay = t.replay
+	if(t.expect_bps > 0) {
+		result.judge(t.expect_bps, settings().expect_tolerance)
+	}
+	if(t.conn != nil) {
+		result.TCP = read_tcp_info(t.conn)
+		result.DSCP = dscp_report(t.conn)
+	}
+	result.Bufferbloat = take_bufferbloat(t.id)
+	result.Samples = t.samples_since(0)
+	if(len(result.Samples) > 0) {
+		result.SampleMs = sample_interval.Milliseconds()
+	}
+	result.locate()
+	t.span.ran_test(t.start, t.start.Add(elapsed), result)
+	finish_result(result)
+	if(released) {
+		// What was still in flight when it was cancelled.
+		charge_test(t.client_ip, t.tenant, t.vhost, n - t.charged)
+		count_end(err)
+	} else {
+		track_end(t.client_ip, t.tenant, t.vhost, n, err)
+	}
+
+	t.result = result
+	close(t.done)
+	active_runs.Delete(t.id)
+
+	return result
+}
+
+/*
+ * Pass or fail the result against the rate it was expected to reach,
+ * in bits per second, allowing tolerance percent short of it.  Aborted
+ * tests fail.
+ */
+func (r *test_result) judge(expect_bps int64, tolerance int) {
+	r.ExpectMbps = float64(expect_bps) / 1e6
+	r.Verdict = "fail"
+	if(r.Outcome == "completed" && r.Mbps >= r.ExpectMbps * float64(100 - tolerance) / 100) {
+		r.Verdict = "pass"
+	}
+	metric_test_verdicts.add(r.Verdict, 1)
+}
+
+/*
+ * Count a transfer from client, tenant and vhost admitted by
+ * admit_test() as finished after moving n bytes, successfully if err is
+ * nil.
+ */
+func track_end(client string, tenant string, vhost string, n int64, err error) {
+	release_test(client, tenant, vhost, n)
+	count_end(err)
+}
+
+/*
+ * Give back the slot admit_test() reserved for a test from client,
+ * tenant and vhost that moved n bytes, so that another may start.
+ */
+func release_test(client string, tenant string, vhost string, n int64) {
+	release_client(client, n)
+	release_tenant(tenant, n)
+	release_vhost(vhost, n)
+	test_tracker.active.Add(-1)
+}
+
+/*
+ * Give back a reservation for a test that never started.
+ */
+func unreserve_test(client string, tenant string, vhost string) {
+	release_test(client, tenant, vhost, 0)
+	test_tracker.running.Done()
+}
+
+/*
+ * Count n more bytes against the quotas of a test from client, tenant
+ * and vhost whose slot has already been given back.
+ */
+func charge_test(client string, tenant string, vhost string, n int64) {
+	if(n <= 0) {
+		return
+	}
+	charge_client(client, n)
+	charge_tenant(tenant, n)
+	charge_vhost(vhost, n)
+}
+
+/*
+ * Count a test as finished, once its slot has been given back.
+ */
+func count_end(err error) {
+	if(err != nil) {
+		test_tracker.aborted.Add(1)
+	} else {
+		test_tracker.completed.Add(1)
+	}
+	test_tracker.running.Done()
+}
+
+/*
+ * Store, log and announce a finished test's result.
+ */
+func finish_result(result test_result) {
+	store_result(result)
+	publish_event("finish", result)
+	notify_webhooks(result)
+	statsd_result(result)
+
+	fields := []any{
+		"test", result.ID,
+		"direction", result.Direction,
+		"client", result.ClientIP,
+		"bytes", result.Bytes,
+		"duration_ms", result.Seconds * 1000,
+		"mbps", result.Mbps,
+		"outcome", result.Outcome,
+	}
+	if(result.RequestID != "") {
+		fields = append(fields, "request_id", result.RequestID)
+	}
+	if(result.Tenant != "") {
+		fields = append(fields, "tenant", result.Tenant)
+	}
+	if(result.Streams > 1) {
+		fields = append(fields, "streams", result.Streams)
+	}
+	if(result.Error != "") {
+		fields = append(fields, "error", result.Error)
+	}
+	if(result.TraceID != "") {
+		fields = append(fields, "trace_id", result.TraceID)
+	}
+	log_fields(log_level_info, "test finished", fields...)
+}
+
+/*
+ * Wait up to timeout for running tests to finish.  Reports whether
+ * they all did.
+ */
+func wait_for_tests(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		test_tracker.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+ * ?limit=50Mbps paces a test to a known rate, so clients can check
+ * their measurements against it.  A token bucket fills at the rate and
+ * holds at most the burst size; each write or read waits for enough
+ * tokens to cover it.  Downloads are paced on the way out.  Uploads are
+ * paced by reading slowly, leaving TCP flow control to hold the client
+ * back, so what the client sees lags the limit by its socket buffers.
+ */
+type token_bucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func new_token_bucket(bits_per_second int64, burst int64) *token_bucket {
+	return &token_bucket{
+		rate:   float64(bits_per_second) / 8,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+/*
+ * Wait until n bytes may go.  n must not exceed the burst size.
+ */
+func (b *token_bucket) wait(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens + now.Sub(b.last).Seconds() * b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	short := -b.tokens
+	b.mu.Unlock()
+
+	if(short > 0) {
+		time.Sleep(time.Duration(short / b.rate * float64(time.Second)))
+	}
+}
+
+/*
+ * The most a single write or read may move before waiting again.
+ */
+func (b *token_bucket) step() int {
+	return max(1, int(b.burst))
+}
+
+type throttled_writer struct {
+	w      io.Writer
+	bucket *token_bucket
+}
+
+func (t throttled_writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), t.bucket.step())
+		t.bucket.wait(n)
+		m, err := t.w.Write(p[:n])
+		written += m
+		if(err != nil) {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+type throttled_reader struct {
+	r      io.Reader
+	bucket *token_bucket
+}
+
+func (t throttled_reader) Read(p []byte) (int, error) {
+	n := min(len(p), t.bucket.step())
+	t.bucket.wait(n)
+	return t.r.Read(p[:n])
+}
+
+/*
+ * Work out the pacing a client asked for with ?limit= and ?burst=, or
+ * nil if it didn't.  The burst defaults to the configured one.
+ */
+func requested_limit(req *http.Request) (*token_bucket, error) {
+	query := req.URL.Query()
+	value := query.Get("limit")
+	if(value == "") {
+		return nil, nil
+	}
+
+	rate, err := parse_rate(value)
+	if(err != nil || rate <= 0) {
+		return nil, fmt.Errorf("invalid limit %q", value)
+	}
+
+	burst := settings().throttle_burst
+	if(query.Get("burst") != "") {
+		burst, err = parse_size(query.Get("burst"))
+		if(err != nil || burst <= 0) {
+			return nil, fmt.Errorf("invalid burst %q", query.Get("burst"))
+		}
+	}
+	return new_token_bucket(rate, burst), nil
+}
+
+/*
+ * Pace w with bucket, if there is one.
+ */
+func throttle_writer(w io.Writer, bucket *token_bucket) io.Writer {
+	if(bucket == nil) {
+		return w
+	}
+	return throttled_writer{w, bucket}
+}
+
+/*
+ * Pace r with bucket, if there is one.
+ */
+func throttle_reader(r io.Reader, bucket *token_bucket) io.Reader {
+	if(bucket == nil) {
+		return r
+	}
+	return throttled_reader{r, bucket}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+/*
+ * TLS policy.  The lowest TLS version, the TLS 1.2 cipher suites and
+ * the key exchange curves on offer can be narrowed from Go's defaults,
+ * and the ALPN protocols reordered or cut down.  TLS 1.3 suites aren't
+ * configurable; Go picks those itself.
+ *
+ * With a client CA bundle, the TLS listeners ask for a client
+ * certificate and check any they're given against it, and the
+ * endpoints that need a token accept a verified certificate instead.
+ * Without a token file, they need one.  A certificate isn't demanded
+ * in the handshake itself, so /healthz, the UI and gost's own probes
+ * keep working without one.
+ */
+var tls_versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tls_curves = []tls.CurveID{
+	tls.X25519MLKEM768,
+	tls.X25519,
+	tls.CurveP256,
+	tls.CurveP384,
+	tls.CurveP521,
+}
+
+var tls_alpn_protocols = map[string]bool{"h2": true, "http/1.1": true}
+
+/*
+ * The items of a comma-separated list, without blanks.
+ */
+func split_list(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if(item != "") {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+/*
+ * The cipher suites named in a comma-separated list.  Only Go's secure
+ * TLS 1.2 suites can be named.
+ */
+func parse_cipher_suites(s string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range split_list(s) {
+		var found *tls.CipherSuite
+		for _, suite := range tls.CipherSuites() {
+			if(strings.EqualFold(suite.Name, name)) {
+				found = suite
+			}
+		}
+		if(found == nil) {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		if(len(found.SupportedVersions) == 1 && found.SupportedVersions[0] == tls.VersionTLS13) {
+			return nil, fmt.Errorf("TLS 1.3 cipher suite %s isn't configurable", found.Name)
+		}
+		ids = append(ids, found.ID)
+	}
+	return ids, nil
+}
+
+/*
+ * The curves named in a comma-separated list, as Go names them or as
+ * P-256, P-384 and P-521.
+ */
+func parse_curves(s string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range split_list(s) {
+		var found tls.CurveID
+		for _, curve := range tls_curves {
+			alias := strings.Replace(curve.String(), "CurveP", "P-", 1)
+			if(strings.EqualFold(curve.String(), name) || strings.EqualFold(alias, name)) {
+				found = curve
+			}
+		}
+		if(found == 0) {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		ids = append(ids, found)
+	}
+	return ids, nil
+}
+
+/*
+ * The ALPN protocols in a comma-separated list, most preferred first.
+ */
+func parse_alpn(s string) ([]string, error) {
+	protos := split_list(s)
+	for _, proto := range protos {
+		if(!tls_alpn_protocols[proto]) {
+			return nil, fmt.Errorf("unknown ALPN protocol %q", proto)
+		}
+	}
+	return protos, nil
+}
+
+/*
+ * Check the TLS policy, short of reading the client CA bundle.
+ */
+func (c *configuration) validate_tls_policy() error {
+	if(c.tls_min_version != "" && tls_versions[c.tls_min_version] == 0) {
+		return fmt.Errorf("unknown TLS version %q; use 1.0, 1.1, 1.2 or 1.3", c.tls_min_version)
+	}
+	_, err := parse_cipher_suites(c.tls_ciphers)
+	if(err != nil) {
+		return err
+	}
+	_, err = parse_curves(c.tls_curves)
+	if(err != nil) {
+		return err
+	}
+	_, err = parse_alpn(c.tls_alpn)
+	return err
+}
+
+/*
+ * Apply c's TLS policy to cfg.
+ */
+func apply_tls_policy(cfg *tls.Config, c *configuration) error {
+	err := c.validate_tls_policy()
+	if(err != nil) {
+		return err
+	}
+
+	cfg.MinVersion = tls_versions[c.tls_min_version]
+	cfg.CipherSuites, _ = parse_cipher_suites(c.tls_ciphers)
+	cfg.CurvePreferences, _ = parse_curves(c.tls_curves)
+	cfg.NextProtos, _ = parse_alpn(c.tls_alpn)
+
+	if(c.tls_client_ca != "") {
+		pem, err := os.ReadFile(c.tls_client_ca)
+		if(err != nil) {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if(!pool.AppendCertsFromPEM(pem)) {
+			return errors.New(c.tls_client_ca + ": no certificates found")
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return nil
+}
+
+/*
+ * Did the request come with a client certificate that checked out
+ * against the client CA?
+ */
+func client_certificate_ok(req *http.Request) bool {
+	return req.TLS != nil && len(req.TLS.VerifiedChains) > 0
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+ * A TCP traceroute to the server, for client mode's -traceroute, so a
+ * bad throughput figure comes with the path it was measured over.
+ * Each probe is a connection to the server's own port with a small
+ * TTL: a router where the TTL runs out sends back an ICMP time
+ * exceeded quoting the probe's TCP ports, and the server itself
+ * answers the SYN.  Using the server's port means the probes take the
+ * path, and get through the firewalls, the tests do.  Hearing the ICMP
+ * takes a raw socket, so it needs root or CAP_NET_RAW, and setting the
+ * TTL per connection needs Linux.
+ */
+const (
+	traceroute_max_hops = 30
+	traceroute_probes   = 3
+	traceroute_timeout  = time.Second
+)
+
+/*
+ * One TTL's probes: who answered, and the round trip of each probe
+ * that was answered.  Unreachable is an ICMP destination unreachable,
+ * after which there's no going on.
+ */
+type trace_hop struct {
+	TTL         int       `json:"ttl"`
+	Address     string    `json:"address,omitempty"`
+	RTTsMs      []float64 `json:"rtts_ms"`
+	Lost        int       `json:"lost,omitempty"`
+	Unreachable bool      `json:"unreachable,omitempty"`
+}
+
+type traceroute_report struct {
+	Target  string      `json:"target"`
+	Reached bool        `json:"reached"`
+	Hops    []trace_hop `json:"hops,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+/*
+ * An ICMP error quoting one of our probes, by its source port.
+ */
+type trace_reply struct {
+	port        int
+	from        string
+	at          time.Time
+	unreachable bool
+}
+
+/*
+ * The source port of the TCP segment an ICMP time exceeded or
+ * destination unreachable quotes, or false if it's something else.
+ * Go hands raw IPv4 sockets' packets over without their IP header, as
+ * it does IPv6's.
+ */
+func parse_trace_icmp(b []byte, v6 bool) (port int, unreachable bool, ok bool) {
+	if(len(b) < 8) {
+		return 0, false, false
+	}
+	exceeded, unreach := byte(11), byte(3)
+	if(v6) {
+		exceeded, unreach = 3, 1
+	}
+	if(b[0] != exceeded && b[0] != unreach) {
+		return 0, false, false
+	}
+	inner := b[8:]
+	var tcp []byte
+	if(v6) {
+		if(len(inner) < 44 || inner[6] != syscall.IPPROTO_TCP) {
+			return 0, false, false
+		}
+		tcp = inner[40:]
+	} else {
+		if(len(inner) < 20 || inner[9] != syscall.IPPROTO_TCP) {
+			return 0, false, false
+		}
+		header := int(inner[0] & 0x0f) * 4
+		if(len(inner) < header + 4) {
+			return 0, false, false
+		}
+		tcp = inner[header:]
+	}
+	return int(binary.BigEndian.Uint16(tcp)), b[0] == unreach, true
+}
+
+/*
+ * Trace the path to the server.  Failing to is reported, not fatal.
+ */
+func client_traceroute(o client_options) *traceroute_report {
+	port := o.server.Port()
+	if(port == "") {
+		port = map[string]string{"http": "80", "https": "443"}[o.server.Scheme]
+	}
+	r := &traceroute_report{Target: net.JoinHostPort(o.server.Hostname(), port)}
+	if(!traceroute_supported) {
+		r.Error = "traceroute needs Linux"
+		return r
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", o.server.Hostname())
+	cancel()
+	if(err != nil) {
+		r.Error = err.Error()
+		return r
+	}
+	target := ips[0]
+	for _, ip := range ips {
+		if(ip.To4() != nil) {
+			target = ip
+			break
+		}
+	}
+	r.Target = net.JoinHostPort(target.String(), port)
+
+	v6 := target.To4() == nil
+	network, listen := "tcp4", "ip4:icmp"
+	if(v6) {
+		network, listen = "tcp6", "ip6:ipv6-icmp"
+	}
+	icmp, err := net.ListenPacket(listen, "")
+	if(err != nil) {
+		r.Error = fmt.Sprintf("can't hear ICMP, which needs root or CAP_NET_RAW: %v", err)
+		return r
+	}
+	defer icmp.Close()
+
+	replies := make(chan trace_reply, 64)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := icmp.ReadFrom(buf)
+			if(err != nil) {
+				return
+			}
+			p, unreachable, ok := parse_trace_icmp(buf[:n], v6)
+			if(!ok) {
+				continue
+			}
+			select {
+			case replies <- trace_reply{p, from.String(), time.Now(), unreachable}:
+			default:
+			}
+		}
+	}()
+
+	for ttl := 1; ttl <= traceroute_max_hops && !r.Reached; ttl++ {
+		hop := trace_hop{TTL: ttl, RTTsMs: []float64{}}
+		for range traceroute_probes {
+			trace_probe(network, r.Target, target.String(), ttl, replies, &hop, &r.Reached)
+		}
+		r.Hops = append(r.Hops, hop)
+		if(hop.Unreachable) {
+			break
+		}
+	}
+	return r
+}
+
+/*
+ * Send one probe with ttl and wait for whoever answers it.
+ */
+func trace_probe(network string, address string, target string, ttl int, replies chan trace_reply, hop *trace_hop, reached *bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), traceroute_timeout)
+	defer cancel()
+	var port atomic.Int32
+	dialed := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		conn, err := dial_ttl(ctx, network, address, ttl, func(p int) { port.Store(int32(p)) })
+		if(err == nil) {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+
+	answered := func(from string, at time.Time) {
+		if(hop.Address == "") {
+			hop.Address = from
+		}
+		hop.RTTsMs = append(hop.RTTsMs, float64(at.Sub(start).Microseconds()) / 1000)
+	}
+	timeout := ctx.Done()
+	for {
+		select {
+		case reply := <-replies:
+			if(reply.port != int(port.Load())) {
+				continue
+			}
+			answered(reply.from, reply.at)
+			hop.Unreachable = hop.Unreachable || reply.unreachable
+			cancel()
+			if(dialed != nil) {
+				<-dialed
+			}
+			return
+		case err := <-dialed:
+			// The server answering at all, even with a reset, means
+			// the probe got there.
+			if(err == nil || errors.Is(err, syscall.ECONNREFUSED)) {
+				answered(target, time.Now())
+				*reached = true
+				return
+			}
+			if(ctx.Err() == nil) {
+				// Failed for some other reason; wait out the probe
+				// in case an ICMP error explains it.
+				dialed = nil
+				continue
+			}
+			hop.Lost++
+			return
+		case <-timeout:
+			timeout = nil
+			if(dialed == nil) {
+				hop.Lost++
+				return
+			}
+		}
+	}
+}
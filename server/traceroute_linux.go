@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+const traceroute_supported = true
+
+/*
+ * Connect to address over network, "tcp4" or "tcp6", with packets that
+ * go no more than ttl hops.  The socket's bound before it connects, so
+ * that bound can be told its source port while the SYN is on its way.
+ */
+func dial_ttl(ctx context.Context, network string, address string, ttl int, bound func(port int)) (net.Conn, error) {
+	dialer := net.Dialer{Control: func(network string, address string, c syscall.RawConn) error {
+		var set_err error
+		err := c.Control(func(fd uintptr) {
+			s := int(fd)
+			if(network == "tcp6") {
+				set_err = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+				if(set_err == nil) {
+					set_err = syscall.Bind(s, &syscall.SockaddrInet6{})
+				}
+			} else {
+				set_err = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+				if(set_err == nil) {
+					set_err = syscall.Bind(s, &syscall.SockaddrInet4{})
+				}
+			}
+			if(set_err != nil) {
+				return
+			}
+			var local syscall.Sockaddr
+			local, set_err = syscall.Getsockname(s)
+			switch a := local.(type) {
+			case *syscall.SockaddrInet4:
+				bound(a.Port)
+			case *syscall.SockaddrInet6:
+				bound(a.Port)
+			}
+		})
+		if(err != nil) {
+			return err
+		}
+		return set_err
+	}}
+	return dialer.DialContext(ctx, network, address)
+}
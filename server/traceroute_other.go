@@ -0,0 +1,15 @@
+//go:build !linux
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+const traceroute_supported = false
+
+func dial_ttl(ctx context.Context, network string, address string, ttl int, bound func(port int)) (net.Conn, error) {
+	return nil, errors.New("traceroute needs Linux")
+}
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * OpenTelemetry tracing of test requests, exported over OTLP/HTTP as
+ * JSON, which any collector takes, without pulling in the SDK.  With
+ * -otlp set to the collector, each request that runs a test becomes a
+ * server span named for its route, with child spans for
+ *
+ *	handshake    the TLS handshake, on a connection's first request
+ *	first byte   from the request arriving to the download's first byte
+ *	transfer     the test moving its payload
+ *	teardown     from the payload finishing to the response completing
+ *
+ * A W3C traceparent on the request puts the span in the caller's trace,
+ * so a test through a chain of proxies that pass it on can be followed
+ * end to end; a traceparent that isn't sampled isn't exported.  The
+ * result carries the trace ID.  Spans are batched and sent every
+ * trace_flush, and dropped if the collector can't take them.
+ */
+const (
+	trace_flush     = 5 * time.Second
+	trace_batch     = 512
+	trace_path      = "/v1/traces"
+	trace_timeout   = 10 * time.Second
+	span_kind_inner = 1
+	span_kind_serve = 2
+)
+
+type trace_span struct {
+	trace_id [16]byte
+	id       [8]byte
+	parent   [8]byte
+	sampled  bool
+	name     string
+	start    time.Time
+
+	// The TLS handshake, if the request is the first on its connection.
+	handshake_at time.Time
+	handshake    time.Duration
+
+	mu         sync.Mutex
+	test_start time.Time
+	test_end   time.Time
+	result     *test_result
+}
+
+type trace_span_key struct{}
+
+/*
+ * Spans as OTLP/JSON has them.
+ */
+type otlp_span struct {
+	TraceID      string           `json:"traceId"`
+	SpanID       string           `json:"spanId"`
+	ParentSpanID string           `json:"parentSpanId,omitempty"`
+	Name         string           `json:"name"`
+	Kind         int              `json:"kind"`
+	Start        string           `json:"startTimeUnixNano"`
+	End          string           `json:"endTimeUnixNano"`
+	Attributes   []otlp_attribute `json:"attributes,omitempty"`
+	Status       *otlp_status     `json:"status,omitempty"`
+}
+
+type otlp_attribute struct {
+	Key   string     `json:"key"`
+	Value otlp_value `json:"value"`
+}
+
+type otlp_value struct {
+	String *string  `json:"stringValue,omitempty"`
+	Int    *string  `json:"intValue,omitempty"`
+	Double *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlp_status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlp_string(key string, value string) otlp_attribute {
+	return otlp_attribute{key, otlp_value{String: &value}}
+}
+
+func otlp_int(key string, value int64) otlp_attribute {
+	s := strconv.FormatInt(value, 10)
+	return otlp_attribute{key, otlp_value{Int: &s}}
+}
+
+func otlp_double(key string, value float64) otlp_attribute {
+	return otlp_attribute{key, otlp_value{Double: &value}}
+}
+
+var trace_spans = make(chan otlp_span, 4096)
+
+/*
+ * The trace and parent span IDs in a W3C traceparent header, and
+ * whether the caller sampled it.
+ */
+func parse_traceparent(header string) (trace [16]byte, parent [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if(len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2) {
+		return trace, parent, false, false
+	}
+	if(parts[0] == "00" && len(parts) != 4) {
+		return trace, parent, false, false
+	}
+	for _, part := range parts[:4] {
+		if(strings.Trim(part, "0123456789abcdef") != "") {
+			// Upper case isn't allowed either.
+			return trace, parent, false, false
+		}
+	}
+	_, err1 := hex.Decode(trace[:], []byte(parts[1]))
+	_, err2 := hex.Decode(parent[:], []byte(parts[2]))
+	flags, err3 := hex.DecodeString(parts[3])
+	if(err1 != nil || err2 != nil || err3 != nil || trace == [16]byte{} || parent == [8]byte{}) {
+		return trace, parent, false, false
+	}
+	return trace, parent, flags[0] & 1 == 1, true
+}
+
+func new_span_id() [8]byte {
+	var id [8]byte
+	for id == [8]byte{} {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+/*
+ * Start the span for a request, if tracing is on.  Returns the request
+ * to carry on with, which knows its span.
+ */
+func start_request_span(req *http.Request, pattern string, start time.Time) (*trace_span, *http.Request) {
+	if(settings().otlp_endpoint == "") {
+		return nil, req
+	}
+
+	span := &trace_span{id: new_span_id(), sampled: true, name: req.Method + " " + pattern, start: start}
+	trace, parent, sampled, ok := parse_traceparent(req.Header.Get("traceparent"))
+	if(ok) {
+		span.trace_id, span.parent, span.sampled = trace, parent, sampled
+	} else {
+		rand.Read(span.trace_id[:])
+	}
+
+	info := connection_of(req)
+	if(info.requests.Load() == 1) {
+		info.mu.Lock()
+		span.handshake_at, span.handshake = info.handshake_at, info.handshake
+		info.mu.Unlock()
+	}
+	return span, req.WithContext(context.WithValue(req.Context(), trace_span_key{}, span))
+}
+
+/*
+ * The span of the request, or nil.
+ */
+func request_span(req *http.Request) *trace_span {
+	span, _ := req.Context().Value(trace_span_key{}).(*trace_span)
+	return span
+}
+
+func (s *trace_span) trace_hex() string {
+	if(s == nil) {
+		return ""
+	}
+	return hex.EncodeToString(s.trace_id[:])
+}
+
+/*
+ * Record the test the request ran, and when.
+ */
+func (s *trace_span) ran_test(start time.Time, end time.Time, result test_result) {
+	if(s == nil) {
+		return
+	}
+	s.mu.Lock()
+	s.test_start, s.test_end, s.result = start, end, &result
+	s.mu.Unlock()
+}
+
+/*
+ * Turn the request's span and its children into OTLP spans and queue
+ * them for export.  Requests that didn't run a test aren't exported.
+ */
+func (s *trace_span) finish(req *http.Request, recorder *response_recorder, end time.Time) {
+	if(s == nil || !s.sampled) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if(s.result == nil) {
+		return
+	}
+
+	trace := hex.EncodeToString(s.trace_id[:])
+	id := hex.EncodeToString(s.id[:])
+	child := func(name string, start time.Time, end time.Time) otlp_span {
+		child_id := new_span_id()
+		return otlp_span{
+			TraceID:      trace,
+			SpanID:       hex.EncodeToString(child_id[:]),
+			ParentSpanID: id,
+			Name:         name,
+			Kind:         span_kind_inner,
+			Start:        strconv.FormatInt(start.UnixNano(), 10),
+			End:          strconv.FormatInt(end.UnixNano(), 10),
+		}
+	}
+
+	root := otlp_span{
+		TraceID: trace,
+		SpanID:  id,
+		Name:    s.name,
+		Kind:    span_kind_serve,
+		Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+		End:     strconv.FormatInt(end.UnixNano(), 10),
+		Attributes: []otlp_attribute{
+			otlp_string("http.request.method", req.Method),
+			otlp_string("url.path", req.URL.Path),
+			otlp_int("http.response.status_code", int64(recorder.status)),
+			otlp_string("client.address", s.result.ClientIP),
+			otlp_string("network.protocol.version", strings.TrimPrefix(req.Proto, "HTTP/")),
+			otlp_string("gost.test.id", s.result.ID),
+			otlp_string("gost.test.direction", s.result.Direction),
+			otlp_string("gost.test.outcome", s.result.Outcome),
+			otlp_int("gost.test.bytes", s.result.Bytes),
+			otlp_double("gost.test.mbps", s.result.Mbps),
+		},
+	}
+	if(s.parent != [8]byte{}) {
+		root.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if(s.result.Error != "") {
+		root.Status = &otlp_status{Code: 2, Message: s.result.Error}
+	}
+	spans := []otlp_span{root}
+
+	if(s.handshake > 0) {
+		spans = append(spans, child("handshake", s.handshake_at, s.handshake_at.Add(s.handshake)))
+	}
+	transfer_start := s.test_start
+	if(!recorder.first.IsZero() && recorder.first.Before(s.test_end)) {
+		spans = append(spans, child("first byte", s.start, recorder.first))
+		transfer_start = max_time(transfer_start, recorder.first)
+	}
+	transfer := child("transfer", transfer_start, s.test_end)
+	transfer.Attributes = []otlp_attribute{otlp_int("gost.test.bytes", s.result.Bytes)}
+	spans = append(spans, transfer, child("teardown", s.test_end, end))
+
+	for _, span := range spans {
+		select {
+		case trace_spans <- span:
+		default:
+			metric_trace_spans.add("dropped", 1)
+		}
+	}
+}
+
+func max_time(a time.Time, b time.Time) time.Time {
+	if(a.After(b)) {
+		return a
+	}
+	return b
+}
+
+/*
+ * Where to POST spans: -otlp, with the standard path if it has none.
+ */
+func otlp_traces_url(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if(err == nil && (u.Path == "" || u.Path == "/")) {
+		u.Path = trace_path
+		return u.String()
+	}
+	return endpoint
+}
+
+/*
+ * Send queued spans to the collector in batches.
+ */
+func go_export_traces() {
+	go func() {
+		client := &http.Client{Timeout: trace_timeout}
+		flush := time.NewTicker(trace_flush)
+		var batch []otlp_span
+		send := func() {
+			if(len(batch) == 0) {
+				return
+			}
+			err := export_spans(client, settings(), batch)
+			if(err != nil) {
+				metric_trace_spans.add("dropped", int64(len(batch)))
+				log_at(log_level_error, "Can't export %d spans: %v", len(batch), err)
+			} else {
+				metric_trace_spans.add("exported", int64(len(batch)))
+			}
+			batch = batch[:0]
+		}
+
+		for {
+			select {
+			case span := <-trace_spans:
+				batch = append(batch, span)
+				if(len(batch) >= trace_batch) {
+					send()
+				}
+			case <-flush.C:
+				send()
+			}
+		}
+	}()
+}
+
+func export_spans(client *http.Client, c *configuration, spans []otlp_span) error {
+	if(c.otlp_endpoint == "") {
+		return nil
+	}
+	body, _ := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlp_attribute{
+				otlp_string("service.name", "gost"),
+				otlp_string("service.version", version),
+				otlp_string("service.instance.id", c.node_name),
+			}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "gost"},
+				"spans": spans,
+			}},
+		}},
+	})
+
+	res, err := client.Post(otlp_traces_url(c.otlp_endpoint), "application/json", bytes.NewReader(body))
+	if(err != nil) {
+		return err
+	}
+	res.Body.Close()
+	if(res.StatusCode / 100 != 2) {
+		return fmt.Errorf("collector said %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const trace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parent = "00f067aa0ba902b7"
+
+	tests := []struct {
+		name    string
+		header  string
+		sampled bool
+		fails   bool
+	}{
+		{"sampled", "00-" + trace + "-" + parent + "-01", true, false},
+		{"not sampled", "00-" + trace + "-" + parent + "-00", false, false},
+		{"other flags", "00-" + trace + "-" + parent + "-03", true, false},
+		{"surrounding space", " 00-" + trace + "-" + parent + "-01 ", true, false},
+		{"a later version", "01-" + trace + "-" + parent + "-01", true, false},
+		{"a later version, with more", "01-" + trace + "-" + parent + "-01-what-next", true, false},
+
+		{"empty", "", false, true},
+		{"version 00 with more", "00-" + trace + "-" + parent + "-01-more", false, true},
+		{"version ff", "ff-" + trace + "-" + parent + "-01", false, true},
+		{"version not hex", "zz-" + trace + "-" + parent + "-01", false, true},
+		{"upper case", "00-" + "4BF92F3577B34DA6A3CE929D0E0E4736" + "-" + parent + "-01", false, true},
+		{"short trace ID", "00-" + trace[2:] + "-" + parent + "-01", false, true},
+		{"short parent ID", "00-" + trace + "-" + parent[2:] + "-01", false, true},
+		{"trace ID not hex", "00-" + "4bf92f3577b34da6a3ce929d0e0e473g" + "-" + parent + "-01", false, true},
+		{"trace ID all zero", "00-00000000000000000000000000000000-" + parent + "-01", false, true},
+		{"parent ID all zero", "00-" + trace + "-0000000000000000-01", false, true},
+		{"flags not hex", "00-" + trace + "-" + parent + "-0x", false, true},
+		{"no flags", "00-" + trace + "-" + parent, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got_trace, got_parent, sampled, ok := parse_traceparent(test.header)
+			if(test.fails) {
+				if(ok) {
+					t.Fatalf("got %x-%x, want it refused", got_trace, got_parent)
+				}
+				return
+			}
+			if(!ok) {
+				t.Fatal("refused")
+			}
+			if(hex.EncodeToString(got_trace[:]) != trace || hex.EncodeToString(got_parent[:]) != parent || sampled != test.sampled) {
+				t.Fatalf("got %x-%x sampled %v, want %s-%s sampled %v", got_trace, got_parent, sampled, trace, parent, test.sampled)
+			}
+		})
+	}
+}
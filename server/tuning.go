@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"net"
+	"runtime"
+)
+
+/*
+ * Knobs for reaching line rate on fast links, where the kernel's and
+ * Go's defaults can cap a test: each listener's socket buffer sizes
+ * and Nagle's algorithm, how much a download hands the connection per
+ * write, and GOMAXPROCS.  Pinning to CPUs is left to taskset or
+ * systemd's CPUAffinity=.
+ */
+
+/*
+ * The smallest -write-size.
+ */
+const min_write_size = 1024
+
+/*
+ * Wrap a ConnContext hook so that every connection the listener
+ * accepts gets its socket options.  Go turns Nagle's algorithm off by
+ * default; nagle turns it back on.
+ */
+func with_socket_tuning(spec listener_spec, next func(context.Context, net.Conn) context.Context) func(context.Context, net.Conn) context.Context {
+	return func(ctx context.Context, conn net.Conn) context.Context {
+		tcp := tcp_conn_of(conn)
+		if(tcp != nil) {
+			var err error
+			if(spec.sndbuf > 0) {
+				err = tcp.SetWriteBuffer(spec.sndbuf)
+			}
+			if(err == nil && spec.rcvbuf > 0) {
+				err = tcp.SetReadBuffer(spec.rcvbuf)
+			}
+			if(err == nil && spec.nagle) {
+				err = tcp.SetNoDelay(false)
+			}
+			if(err != nil) {
+				log_at(log_level_error, "Can't tune sockets on the %s listener: %v", spec.name, err)
+			}
+		}
+		return next(ctx, conn)
+	}
+}
+
+/*
+ * Put -gomaxprocs into force, or Go's own choice for zero.
+ */
+func apply_gomaxprocs(c *configuration) {
+	if(c.gomaxprocs > 0) {
+		runtime.GOMAXPROCS(c.gomaxprocs)
+	} else {
+		runtime.SetDefaultGOMAXPROCS()
+	}
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * UDP echo, for the packet loss and jitter HTTP can't see.  The client
+ * picks a test ID and sends numbered datagrams; gost stamps each with
+ * its receive and send times and returns it, then reports what it
+ * observed at /udp/report/{id}.
+ *
+ * A datagram is at least udp_header_size bytes, big-endian:
+ *
+ *	0   4  magic "GOST"
+ *	4  16  test ID, the UUID's 16 bytes
+ *	20  8  sequence number, from 0
+ *	28  8  client send time, ns, any epoch
+ *	36  8  server receive time, ns since gost started (filled in)
+ *	44  8  server send time, ns since gost started (filled in)
+ *
+ * Anything after that is padding and comes back untouched.  Replies
+ * are never bigger than what arrived, so the echo can't be used to
+ * amplify traffic.
+ */
+const udp_report_prefix = "/udp/report/"
+const udp_header_size = 52
+const udp_max_datagram = 65535
+
+/*
+ * Sessions are forgotten this long after their last datagram, and
+ * there are never more than udp_max_sessions at once.  Sequence
+ * numbers past udp_max_seq aren't tracked.
+ */
+const udp_expiry = 10 * time.Minute
+const udp_max_sessions = 10000
+const udp_max_seq = 1 << 20
+
+var udp_magic = []byte("GOST")
+
+// Where the echo ended up listening, or zero when it's off.
+var udp_echo_port int
+
+type udp_session struct {
+	mu           sync.Mutex
+	id           string
+	client       string
+	received     int64
+	bytes        int64
+	duplicates   int64
+	reordered    int64
+	untracked    int64
+	highest      int64
+	seen         []uint64
+	first_seen   time.Time
+	last_seen    time.Time
+	last_transit int64
+	jitter       float64
+	expiry       *time.Timer
+
+	// Set for path MTU probes started with POST /mtu.
+	mtu *mtu_probe
+}
+
+var udp_sessions = struct {
+	sync.Mutex
+	byid map[string]*udp_session
+}{byid: map[string]*udp_session{}}
+
+/*
+ * What GET /udp/report/{id} returns.  Jitter is the RFC 3550
+ * interarrival jitter, which doesn't need the clocks in sync.
+ */
+type udp_report struct {
+	ID          string    `json:"id"`
+	Client      string    `json:"client"`
+	Received    int64     `json:"received"`
+	Bytes       int64     `json:"bytes"`
+	Duplicates  int64     `json:"duplicates"`
+	Reordered   int64     `json:"reordered"`
+	Lost        int64     `json:"lost"`
+	LossPercent float64   `json:"loss_percent"`
+	JitterMs    float64   `json:"jitter_ms"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+/*
+ * Format a UUID's bytes the way new_uuid does.
+ */
+func format_uuid(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+/*
+ * Find a session, starting one if there's room.
+ */
+func udp_session_for(id string, client string) *udp_session {
+	udp_sessions.Lock()
+	defer udp_sessions.Unlock()
+
+	s, ok := udp_sessions.byid[id]
+	if(ok) {
+		return s
+	}
+	if(len(udp_sessions.byid) >= udp_max_sessions) {
+		return nil
+	}
+
+	s = &udp_session{id: id, client: client, highest: -1}
+	s.expiry = time.AfterFunc(udp_expiry, func() {
+		udp_sessions.Lock()
+		delete(udp_sessions.byid, id)
+		udp_sessions.Unlock()
+	})
+	udp_sessions.byid[id] = s
+	return s
+}
+
+/*
+ * Account for one datagram.
+ */
+func (s *udp_session) observe(seq uint64, sent_ns int64, recv_ns int64, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if(s.received == 0) {
+		s.first_seen = now
+	}
+	s.last_seen = now
+	s.received++
+	s.bytes += int64(size)
+	s.expiry.Reset(udp_expiry)
+
+	if(seq >= udp_max_seq) {
+		s.untracked++
+		return
+	}
+
+	word, bit := seq / 64, uint64(1) << (seq % 64)
+	for uint64(len(s.seen)) <= word {
+		s.seen = append(s.seen, 0)
+	}
+	if(s.seen[word] & bit != 0) {
+		s.duplicates++
+		return
+	}
+	s.seen[word] |= bit
+
+	if(int64(seq) < s.highest) {
+		s.reordered++
+	} else {
+		s.highest = int64(seq)
+	}
+
+	transit := recv_ns - sent_ns
+	if(s.received - s.duplicates > 1) {
+		d := math.Abs(float64(transit - s.last_transit))
+		s.jitter += (d - s.jitter) / 16
+	}
+	s.last_transit = transit
+}
+
+/*
+ * Sum up the session.  Loss counts the gaps below the highest sequence
+ * number seen, so datagrams lost off the end don't show.
+ */
+func (s *udp_session) report() udp_report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unique := s.received - s.duplicates - s.untracked
+	lost := s.highest + 1 - unique
+	r := udp_report{
+		ID:         s.id,
+		Client:     s.client,
+		Received:   s.received,
+		Bytes:      s.bytes,
+		Duplicates: s.duplicates,
+		Reordered:  s.reordered,
+		Lost:       lost,
+		JitterMs:   s.jitter / 1e6,
+		FirstSeen:  s.first_seen,
+		LastSeen:   s.last_seen,
+	}
+	if(s.highest >= 0) {
+		r.LossPercent = 100 * float64(lost) / float64(s.highest + 1)
+	}
+	return r
+}
+
+/*
+ * Echo datagrams until the socket closes.
+ */
+func serve_udp(conn net.PacketConn) error {
+	buf := make([]byte, udp_max_datagram)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if(err != nil) {
+			return err
+		}
+		recv_ns := monotonic_ns()
+
+		packet := buf[:n]
+		if(n < udp_header_size || !bytes.Equal(packet[0:4], udp_magic)) {
+			continue
+		}
+
+		host, _, _ := net.SplitHostPort(addr.String())
+		s := udp_session_for(format_uuid(packet[4:20]), host)
+		if(s == nil) {
+			continue
+		}
+		s.observe(binary.BigEndian.Uint64(packet[20:28]), int64(binary.BigEndian.Uint64(packet[28:36])), recv_ns, n)
+
+		binary.BigEndian.PutUint64(packet[36:44], uint64(recv_ns))
+		binary.BigEndian.PutUint64(packet[44:52], uint64(monotonic_ns()))
+		if(s.probing_mtu()) {
+			s.observe_mtu(n, write_unfragmented(conn, packet, addr))
+		} else {
+			conn.WriteTo(packet, addr)
+		}
+	}
+}
+
+/*
+ * Start the UDP echo listener, if it's configured.
+ */
+func go_serve_udp(c *configuration) error {
+	if(c.udp_port == 0 && !systemd_socket("udp")) {
+		return nil
+	}
+
+	addr := net.JoinHostPort(c.bind_address, strconv.Itoa(c.udp_port))
+	conn, err := listen_udp("udp", addr)
+	if(err != nil) {
+		return err
+	}
+	log_at(log_level_info, "Echoing UDP on %s", conn.LocalAddr())
+	udp_echo_port = port_of(conn.LocalAddr())
+	share_socket("udp", conn, true)
+
+	go func() {
+		err := serve_udp(conn)
+		if(!errors.Is(err, net.ErrClosed)) {
+			log_at(log_level_error, "UDP echo stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+/*
+ * GET: What the server saw of a UDP echo test.
+ */
+func route_udp_report(res http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, udp_report_prefix)
+	udp_sessions.Lock()
+	s, ok := udp_sessions.byid[id]
+	udp_sessions.Unlock()
+
+	if(!ok) {
+		res.WriteHeader(404)
+		io.WriteString(res, "Not Found")
+		return
+	}
+
+	write_json(res, 200, s.report())
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+/*
+ * The browser speed test lives in ui/ and is compiled into the binary,
+ * so a lone gost executable is a complete appliance.
+ */
+//go:embed ui
+var ui_assets embed.FS
+
+var ui_files = func() http.Handler {
+	sub, err := fs.Sub(ui_assets, "ui")
+	if(err != nil) {
+		panic(err)
+	}
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(sub)))
+}()
+
+/*
+ * GET: The embedded speed test page and its assets.
+ */
+func route_ui(res http.ResponseWriter, req *http.Request) {
+	// A relative Location, which http.Redirect would make absolute,
+	// still works behind a proxy that mounts gost under a path.
+	if(req.URL.Path == "/ui") {
+		res.Header().Set("Location", "ui/")
+		res.WriteHeader(301) // Moved Permanently
+		return
+	}
+
+	ui_files.ServeHTTP(res, req)
+}
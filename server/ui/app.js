@@ -0,0 +1,125 @@
+"use strict";
+
+/*
+ * A minimal speed test client for the endpoints gost serves: /ping for
+ * latency and jitter, /down for download and /up for upload.  Paths are
+ * relative to /ui/ so the page works wherever gost is mounted.
+ */
+const base = new URL("..", document.baseURI);
+const ping_samples = 20;
+
+function gauge(id, value, max, digits) {
+	const el = document.getElementById("gauge-" + id);
+	const fill = el.querySelector(".fill");
+	const length = fill.getTotalLength();
+	const fraction = Math.min(Math.log10(1 + value) / Math.log10(1 + max), 1);
+
+	fill.style.strokeDasharray = (fraction * length) + " 1000";
+	el.querySelector(".value").textContent = value.toFixed(digits);
+}
+
+function status(text) {
+	document.getElementById("status").textContent = text;
+}
+
+function mbps(bytes, ms) {
+	return ms > 0 ? bytes * 8 / ms / 1000 : 0;
+}
+
+async function test_ping() {
+	const rtts = [];
+
+	for (let i = 0; i < ping_samples; i++) {
+		const start = performance.now();
+		const res = await fetch(new URL("ping", base), { cache: "no-store" });
+		await res.text();
+		rtts.push(performance.now() - start);
+		gauge("ping", Math.min(...rtts), 1000, 1);
+	}
+
+	let jitter = 0;
+	for (let i = 1; i < rtts.length; i++) {
+		jitter += Math.abs(rtts[i] - rtts[i - 1]);
+	}
+	document.getElementById("jitter").textContent = (jitter / (rtts.length - 1)).toFixed(1);
+}
+
+async function test_down(size) {
+	const start = performance.now();
+	const res = await fetch(new URL("down?bytes=" + size, base), { cache: "no-store" });
+	if (!res.ok) {
+		throw new Error("download failed: " + res.status);
+	}
+
+	const reader = res.body.getReader();
+	let bytes = 0;
+	for (;;) {
+		const { done, value } = await reader.read();
+		if (done) {
+			break;
+		}
+		bytes += value.length;
+		gauge("down", mbps(bytes, performance.now() - start), 10000, 0);
+	}
+}
+
+function random_blob(bytes) {
+	const chunk = new Uint8Array(65536);
+	crypto.getRandomValues(chunk);
+
+	const parts = [];
+	for (let n = 0; n < bytes; n += chunk.length) {
+		parts.push(chunk.subarray(0, Math.min(chunk.length, bytes - n)));
+	}
+	return new Blob(parts);
+}
+
+function parse_size(size) {
+	const units = { K: 1e3, M: 1e6, G: 1e9 };
+	const unit = size.slice(-1);
+	return units[unit] ? parseInt(size, 10) * units[unit] : parseInt(size, 10);
+}
+
+function test_up(size) {
+	return new Promise((resolve, reject) => {
+		const xhr = new XMLHttpRequest();
+		const start = performance.now();
+
+		xhr.upload.onprogress = (e) => gauge("up", mbps(e.loaded, performance.now() - start), 10000, 0);
+		xhr.onload = () => {
+			if (xhr.status !== 200) {
+				reject(new Error("upload failed: " + xhr.status));
+				return;
+			}
+			const summary = JSON.parse(xhr.responseText);
+			gauge("up", summary.mbps, 10000, 0);
+			resolve(summary);
+		};
+		xhr.onerror = () => reject(new Error("upload failed"));
+
+		xhr.open("PUT", new URL("up", base));
+		xhr.send(random_blob(parse_size(size)));
+	});
+}
+
+document.getElementById("controls").addEventListener("submit", async (e) => {
+	e.preventDefault();
+
+	const button = document.getElementById("start");
+	const size = document.getElementById("size").value;
+	button.disabled = true;
+
+	try {
+		status("Measuring latency…");
+		await test_ping();
+		status("Measuring download…");
+		await test_down(size);
+		status("Measuring upload…");
+		await test_up(size);
+		status("Done.");
+	} catch (err) {
+		status(err.message);
+	} finally {
+		button.disabled = false;
+	}
+});
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Decimal multipliers for human-friendly sizes.  Network folks count in
+ * powers of ten, so "100M" is 100,000,000 bytes.
+ */
+var size_suffixes = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"G", 1000 * 1000 * 1000},
+	{"M", 1000 * 1000},
+	{"K", 1000},
+}
+
+/*
+ * Parse a size such as "512", "64K", "100M" or "1G".  A trailing "B" is
+ * tolerated.
+ */
+func parse_size(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(value, "B")
+	multiplier := int64(1)
+
+	for _, entry := range size_suffixes {
+		if(strings.HasSuffix(value, entry.suffix)) {
+			multiplier = entry.multiplier
+			value = strings.TrimSuffix(value, entry.suffix)
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if(err != nil || n < 0) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if(n > (1<<63-1)/multiplier) {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * multiplier, nil
+}
+
+/*
+ * Parse a rate in bits per second such as "50Mbps", "2G" or "800k".
+ * Rates, like sizes, are decimal.
+ */
+func parse_rate(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(value, "BPS")
+	value = strings.TrimSuffix(value, "BIT/S")
+
+	n, err := parse_size(value)
+	if(err != nil) {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return n, nil
+}
+
+/*
+ * A rate in bits per second as parse_rate takes it, such as "100Mbps".
+ */
+func format_rate(bps int64) string {
+	for _, entry := range size_suffixes {
+		if(bps >= entry.multiplier && bps % entry.multiplier == 0) {
+			return strconv.FormatInt(bps / entry.multiplier, 10) + entry.suffix + "bps"
+		}
+	}
+	return strconv.FormatInt(bps, 10) + "bps"
+}
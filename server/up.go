@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * What the server observed during an upload test.  Field names are
+ * exported only so encoding/json can see them.
+ */
+type upload_summary struct {
+	ID          string  `json:"id"`
+	Bytes       int64   `json:"bytes"`
+	Seconds     float64 `json:"seconds"`
+	Mbps        float64 `json:"mbps"`
+	SHA256      string  `json:"sha256,omitempty"`
+	SHA256Match *bool   `json:"sha256_match,omitempty"`
+	Verdict     string  `json:"verdict,omitempty"`
+}
+
+/*
+ * Throughput in megabits per second, guarding against a zero duration.
+ */
+func mbps(bytes int64, elapsed time.Duration) float64 {
+	if(elapsed <= 0) {
+		return 0
+	}
+	return float64(bytes) * 8 / elapsed.Seconds() / 1e6
+}
+
+var upload_too_slow = errors.New("upload too slow")
+
+/*
+ * The body of an upload test, cut off with a MaxBytesError past
+ * -max-bytes or whatever's left of -max-conn-upload for its connection.
+ * The caller adds what it read to the connection's count.
+ */
+func upload_body(res http.ResponseWriter, req *http.Request) io.Reader {
+	c := request_settings(req)
+	limit := c.max_test_bytes
+	if(c.max_conn_upload > 0) {
+		limit = min(limit, max(c.max_conn_upload - connection_of(req).uploaded.Load(), 0))
+	}
+	return http.MaxBytesReader(res, req.Body, limit)
+}
+
+/*
+ * A watchdog for uploads trickling in below -min-upload-rate, which
+ * could otherwise hold a connection and a test slot for as long as
+ * they like.  Every -min-rate-window it checks how far moved has got,
+ * and if that's short of the minimum, cuts off the read with a
+ * deadline.  The returned function stops it, and reports whether it
+ * fired.
+ */
+func watch_upload_rate(res http.ResponseWriter, moved *atomic.Int64) func() bool {
+	c := settings()
+	if(c.min_upload_bps <= 0) {
+		return func() bool { return false }
+	}
+
+	least := int64(float64(c.min_upload_bps) / 8 * c.min_rate_window.Seconds())
+	var fired atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(c.min_rate_window)
+		defer ticker.Stop()
+		last := moved.Load()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := moved.Load()
+				if(now - last < least) {
+					fired.Store(true)
+					http.NewResponseController(res).SetReadDeadline(time.Now())
+					return
+				}
+				last = now
+			}
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return fired.Load()
+	}
+}
+
+/*
+ * Read and throw away everything in body, returning how much there was.
+ */
+func drain_body(body io.Reader) (int64, error) {
+	bufp := down_buffers.Get().(*[]byte)
+	defer down_buffers.Put(bufp)
+
+	return io.CopyBuffer(io.Discard, body, *bufp)
+}
+
+/*
+ * Like drain_body, but stop cleanly at deadline.  A read deadline on
+ * the connection makes sure a stalled client can't hold us past it.
+ */
+func drain_body_until(res http.ResponseWriter, body io.Reader, deadline time.Time) (int64, error) {
+	rc := http.NewResponseController(res)
+	rc.SetReadDeadline(deadline)
+	defer rc.SetReadDeadline(time.Time{})
+
+	n, err := drain_body(body)
+	if(errors.Is(err, os.ErrDeadlineExceeded) || !time.Now().Before(deadline)) {
+		err = nil
+	}
+	return n, err
+}
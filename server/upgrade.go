@@ -0,0 +1,231 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Upgrading without dropping tests.  On SIGUSR2 gost starts the binary
+ * it was run from, which by then is usually a new one, with the same
+ * arguments and environment, and hands it every listening socket the
+ * way systemd would: from fd 3 up, named in LISTEN_FDNAMES.  The new
+ * gost reads its configuration afresh but serves the sockets it's
+ * given rather than binding its own, so a listener that's moved needs a
+ * restart, and says so once /readyz would pass.  Then the old one stops
+ * accepting and gives its tests until the drain timeout to finish, as
+ * it would for SIGTERM, and exits; nobody is refused in between.  If
+ * the new gost exits, or isn't ready within upgrade_timeout, it's
+ * killed and the old one carries on.  Under systemd the new gost takes
+ * over as the main process, which needs NotifyAccess=all.  Windows has
+ * neither the signal nor the sockets to pass.
+ */
+const upgrade_timeout = 30 * time.Second
+
+/*
+ * A socket to hand over.  Standalone ones aren't a listener manager's,
+ * so draining closes them itself.
+ */
+type shared_socket struct {
+	name       string
+	socket     interface{ File() (*os.File, error) }
+	standalone bool
+}
+
+var shared_sockets = struct {
+	sync.Mutex
+	list []shared_socket
+}{}
+
+/*
+ * Whether an upgrade's under way, or done and draining.
+ */
+var upgrading atomic.Bool
+
+/*
+ * Hand socket over to the next gost as the named listener's.
+ */
+func share_socket(name string, socket any, standalone bool) {
+	s, ok := socket.(interface{ File() (*os.File, error) })
+	if(!ok) {
+		return
+	}
+	shared_sockets.Lock()
+	defer shared_sockets.Unlock()
+	shared_sockets.list = append(shared_sockets.list, shared_socket{name, s, standalone})
+}
+
+/*
+ * Stop the sockets no listener manager shuts down.
+ */
+func close_standalone_sockets() {
+	shared_sockets.Lock()
+	defer shared_sockets.Unlock()
+	for _, s := range shared_sockets.list {
+		c, ok := s.socket.(interface{ Close() error })
+		if(s.standalone && ok) {
+			c.Close()
+		}
+	}
+}
+
+/*
+ * Whether the sockets in LISTEN_FDS are the gost's that started us.
+ */
+func handed_over() bool {
+	return upgrade_supported && os.Getenv("GOST_UPGRADE_FROM") == strconv.Itoa(os.Getppid())
+}
+
+/*
+ * Upgrade whenever we get a SIGUSR2.
+ */
+func go_upgrade_on_signal() {
+	if(!upgrade_supported) {
+		return
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, upgrade_signal)
+
+	go func() {
+		for range sig {
+			if(!upgrading.CompareAndSwap(false, true)) {
+				log_at(log_level_error, "Already upgrading.")
+				continue
+			}
+			sd_notify("RELOADING=1")
+			pid, err := upgrade()
+			if(err != nil) {
+				sd_notify("READY=1")
+				log_at(log_level_error, "Upgrade failed, carrying on: %v", err)
+				upgrading.Store(false)
+				continue
+			}
+			log_at(log_level_info, "Handed over to pid %d.", pid)
+			keep_unix_sockets()
+			death <- upgrade_signal
+			return
+		}
+	}()
+}
+
+/*
+ * Start the next gost with our sockets and wait for it to be ready,
+ * returning its pid.
+ */
+func upgrade() (int, error) {
+	executable, err := os.Executable()
+	if(err != nil) {
+		return 0, err
+	}
+
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	shared_sockets.Lock()
+	for _, s := range shared_sockets.list {
+		f, err := s.socket.File()
+		if(err != nil) {
+			shared_sockets.Unlock()
+			return 0, fmt.Errorf("can't pass the %s socket: %v", s.name, err)
+		}
+		files = append(files, f)
+		names = append(names, s.name)
+	}
+	shared_sockets.Unlock()
+
+	ready_r, ready_w, err := os.Pipe()
+	if(err != nil) {
+		return 0, err
+	}
+	defer ready_r.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, ready_w)
+	cmd.Env = append(os.Environ(),
+		"LISTEN_FDS=" + strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES=" + strings.Join(names, ":"),
+		"GOST_UPGRADE_FROM=" + strconv.Itoa(os.Getpid()),
+		"GOST_UPGRADE_READY=" + strconv.Itoa(systemd_fds_start + len(files)))
+	log_at(log_level_info, "Upgrading to %s with %d sockets.", executable, len(files))
+	err = cmd.Start()
+	ready_w.Close()
+	if(err != nil) {
+		return 0, err
+	}
+
+	// The pipe closes unread if it exits first.
+	readied := make(chan bool, 1)
+	go func() {
+		n, _ := ready_r.Read(make([]byte, 1))
+		readied <- n == 1
+	}()
+	select {
+	case ok := <-readied:
+		if(ok) {
+			go cmd.Wait()
+			return cmd.Process.Pid, nil
+		}
+		err = fmt.Errorf("pid %d exited before it was ready", cmd.Process.Pid)
+	case <-time.After(upgrade_timeout):
+		err = fmt.Errorf("pid %d wasn't ready after %v", cmd.Process.Pid, upgrade_timeout)
+	}
+	cmd.Process.Kill()
+	go cmd.Wait()
+	return 0, err
+}
+
+/*
+ * If we're an upgrade, tell the old gost once we're ready, so it can
+ * drain, and tell systemd we're its main process now.
+ */
+func go_report_upgraded() {
+	handed := handed_over()
+	fd, err := strconv.Atoi(os.Getenv("GOST_UPGRADE_READY"))
+	os.Unsetenv("GOST_UPGRADE_FROM")
+	os.Unsetenv("GOST_UPGRADE_READY")
+	if(!handed || err != nil) {
+		return
+	}
+
+	pipe := os.NewFile(uintptr(fd), "upgrade")
+	from := os.Getppid()
+	go func() {
+		defer pipe.Close()
+		for !ready() {
+			time.Sleep(250 * time.Millisecond)
+		}
+		sd_notify(fmt.Sprintf("MAINPID=%d", os.Getpid()))
+		pipe.Write([]byte{1})
+		log_at(log_level_info, "Took over from pid %d.", from)
+	}()
+}
+
+/*
+ * Stop a unix socket being removed when its listener closes, now that
+ * the next gost is serving it.
+ */
+func keep_unix_sockets() {
+	shared_sockets.Lock()
+	defer shared_sockets.Unlock()
+	for _, s := range shared_sockets.list {
+		u, ok := s.socket.(*net.UnixListener)
+		if(ok) {
+			u.SetUnlinkOnClose(false)
+		}
+	}
+}
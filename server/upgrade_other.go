@@ -0,0 +1,9 @@
+//go:build !windows
+
+package server
+
+import "syscall"
+
+const upgrade_supported = true
+
+var upgrade_signal = syscall.SIGUSR2
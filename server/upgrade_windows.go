@@ -0,0 +1,12 @@
+//go:build windows
+
+package server
+
+import "syscall"
+
+const upgrade_supported = false
+
+/*
+ * Never sent; only there for wait_for_death() to tell it apart.
+ */
+var upgrade_signal = syscall.Signal(-1)
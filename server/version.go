@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+/*
+ * Set at build time, e.g.
+ *
+ *   go build -ldflags "-X github.com/musl/gost/server.version=1.2.0 -X github.com/musl/gost/server.git_commit=$(git rev-parse HEAD) -X github.com/musl/gost/server.build_date=$(date -u +%FT%TZ)"
+ *
+ * Without them, the commit and date come from the Go toolchain's VCS
+ * stamp when there is one.
+ */
+var version = "dev"
+var git_commit = ""
+var build_date = ""
+
+type build_info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+type runtime_stats struct {
+	Goroutines int    `json:"goroutines"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	HeapAlloc  uint64 `json:"heap_alloc_bytes"`
+	HeapSys    uint64 `json:"heap_sys_bytes"`
+	NumGC      uint32 `json:"gc_runs"`
+}
+
+/*
+ * What was built, from the linker flags or the VCS stamp.
+ */
+func current_build() build_info {
+	b := build_info{
+		Version:   version,
+		Commit:    git_commit,
+		BuildDate: build_date,
+		GoVersion: runtime.Version(),
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if(!ok) {
+		return b
+	}
+	for _, s := range info.Settings {
+		if(s.Key == "vcs.revision" && b.Commit == "") {
+			b.Commit = s.Value
+		}
+		if(s.Key == "vcs.time" && b.BuildDate == "") {
+			b.BuildDate = s.Value
+		}
+	}
+	return b
+}
+
+/*
+ * A snapshot of the Go runtime.  ReadMemStats stops the world briefly,
+ * which is fine at status-page rates.
+ */
+func current_runtime() runtime_stats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return runtime_stats{
+		Goroutines: runtime.NumGoroutine(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		HeapAlloc:  m.HeapAlloc,
+		HeapSys:    m.HeapSys,
+		NumGC:      m.NumGC,
+	}
+}
+
+/*
+ * How long we've been up, in whole seconds.
+ */
+func uptime_seconds() int64 {
+	return int64(time.Since(process_start) / time.Second)
+}
+
+/*
+ * For -version.
+ */
+func print_version() {
+	b := current_build()
+	fmt.Printf("gost %s\n", b.Version)
+	if(b.Commit != "") {
+		fmt.Printf("commit %s\n", b.Commit)
+	}
+	if(b.BuildDate != "") {
+		fmt.Printf("built %s\n", b.BuildDate)
+	}
+	fmt.Printf("%s %s/%s\n", b.GoVersion, runtime.GOOS, runtime.GOARCH)
+}
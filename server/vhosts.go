@@ -0,0 +1,254 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Virtual hosts, so that one gost can serve speedtest.example.com to
+ * the world and internal.test.lan to the office with different
+ * policies.  The config file's "vhosts" list gives each one the host
+ * names it answers to, exactly or by a leading "*.", and optionally a
+ * certificate of its own, presented to clients that ask for one of its
+ * names by SNI, and limits of its own: max_test_bytes and
+ * max_test_seconds in place of the server's, and max_active tests at
+ * once and max_bytes in each window on top of them, as a tenant's are.
+ * A request is the virtual host's whose name its Host header gives;
+ * anything else is the server's own, under the server's limits.  Each
+ * virtual host keeps its own ring of recent results, which is what
+ * /results, /stats and the API show a request made to it, and results
+ * carry the host's name, under "vhost".
+ */
+type vhost_spec struct {
+	name              string
+	hosts             []string
+	cert_file         string
+	key_file          string
+	max_test_bytes    int64
+	max_test_duration time.Duration
+	max_active        int
+	max_bytes         int64
+	window            time.Duration
+}
+
+/*
+ * What each virtual host is up to, by name, kept just as tenants' is.
+ */
+var vhost_states = struct {
+	sync.Mutex
+	byname map[string]*tenant_usage
+}{byname: map[string]*tenant_usage{}}
+
+/*
+ * The virtual hosts' certificates, by name, loaded by
+ * load_vhost_certificates().
+ */
+var vhost_certificates atomic.Pointer[map[string]*tls.Certificate]
+
+func vhost_state(name string) *tenant_usage {
+	vhost_states.Lock()
+	defer vhost_states.Unlock()
+	u := vhost_states.byname[name]
+	if(u == nil) {
+		u = &tenant_usage{}
+		vhost_states.byname[name] = u
+	}
+	return u
+}
+
+/*
+ * Does host match pattern, a name or "*." and the name under it?
+ */
+func vhost_matches(pattern string, host string) bool {
+	rest, wildcard := strings.CutPrefix(pattern, "*.")
+	if(!wildcard) {
+		return host == pattern
+	}
+	label, parent, found := strings.Cut(host, ".")
+	return found && label != "" && parent == rest
+}
+
+/*
+ * The virtual host for a Host header or SNI name, with or without a
+ * port, or nil.
+ */
+func (c *configuration) vhost_for(host string) *vhost_spec {
+	if(len(c.vhosts) == 0 || host == "") {
+		return nil
+	}
+	name, _, err := net.SplitHostPort(host)
+	if(err == nil) {
+		host = name
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for i := range c.vhosts {
+		for _, pattern := range c.vhosts[i].hosts {
+			if(vhost_matches(pattern, host)) {
+				return &c.vhosts[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (c *configuration) vhost_named(name string) *vhost_spec {
+	for i := range c.vhosts {
+		if(c.vhosts[i].name == name) {
+			return &c.vhosts[i]
+		}
+	}
+	return nil
+}
+
+/*
+ * The virtual host the request is addressed to, or "" for the server's
+ * own.
+ */
+func request_vhost(req *http.Request) string {
+	v := settings().vhost_for(req.Host)
+	if(v == nil) {
+		return ""
+	}
+	return v.name
+}
+
+/*
+ * The settings a test requested with req runs under: the server's,
+ * with its virtual host's limits in place of the server's.
+ */
+func request_settings(req *http.Request) *configuration {
+	c := settings()
+	v := c.vhost_for(req.Host)
+	if(v == nil) {
+		return c
+	}
+	limited := *c
+	if(v.max_test_bytes > 0) {
+		limited.max_test_bytes = v.max_test_bytes
+	}
+	if(v.max_test_duration > 0) {
+		limited.max_test_duration = v.max_test_duration
+	}
+	return &limited
+}
+
+/*
+ * Reserve a test for virtual host name, or say why not and when to try
+ * again.  A reservation must be given back with release_vhost().
+ */
+func reserve_vhost(name string) (string, time.Duration) {
+	v := settings().vhost_named(name)
+	if(v == nil) {
+		return "", 0
+	}
+	u := vhost_state(name)
+	vhost_states.Lock()
+	defer vhost_states.Unlock()
+
+	if(v.max_active > 0 && u.active >= v.max_active) {
+		metric_tests_refused.add("vhost_concurrency", 1)
+		return "vhost concurrency", 5 * time.Second
+	}
+	if(v.max_bytes > 0) {
+		now := time.Now()
+		length, slot := quota_slot(now, v.window)
+		used, expiry := u.window_bytes(slot, length, now)
+		if(used >= v.max_bytes) {
+			metric_tests_refused.add("vhost_quota", 1)
+			return "vhost quota", max(expiry, time.Second)
+		}
+	}
+
+	u.active++
+	return "", 0
+}
+
+/*
+ * Give back virtual host name's reservation for a test that moved n
+ * bytes.
+ */
+func release_vhost(name string, n int64) {
+	v := settings().vhost_named(name)
+	if(name == "" || v == nil) {
+		return
+	}
+	_, slot := quota_slot(time.Now(), v.window)
+	u := vhost_state(name)
+	vhost_states.Lock()
+	defer vhost_states.Unlock()
+
+	u.active = max(u.active - 1, 0)
+	u.add_bytes(slot, n)
+}
+
+/*
+ * Count n more bytes against virtual host name's quota.
+ */
+func charge_vhost(name string, n int64) {
+	v := settings().vhost_named(name)
+	if(name == "" || v == nil) {
+		return
+	}
+	_, slot := quota_slot(time.Now(), v.window)
+	u := vhost_state(name)
+	vhost_states.Lock()
+	defer vhost_states.Unlock()
+	u.add_bytes(slot, n)
+}
+
+/*
+ * Keep a finished result in its virtual host's ring.
+ */
+func store_vhost_result(c *configuration, result test_result) {
+	if(result.Vhost == "") {
+		return
+	}
+	vhost_state(result.Vhost).results.add(result, c.results_kept)
+}
+
+/*
+ * Load the virtual hosts' certificates, all or none, for the
+ * configuration about to come into force.
+ */
+func load_vhost_certificates(c *configuration) error {
+	certs := map[string]*tls.Certificate{}
+	for _, v := range c.vhosts {
+		if(v.cert_file == "") {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(v.cert_file, v.key_file)
+		if(err != nil) {
+			return fmt.Errorf("vhost %s: %v", v.name, err)
+		}
+		certs[v.name] = &cert
+	}
+	vhost_certificates.Store(&certs)
+	return nil
+}
+
+/*
+ * Present each virtual host's certificate to clients that ask for it
+ * by name, and what tls_config would have otherwise.
+ */
+func with_vhost_certificates(tls_config *tls.Config) {
+	fallback := tls_config.GetCertificate
+	tls_config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		v := settings().vhost_for(hello.ServerName)
+		certs := vhost_certificates.Load()
+		if(v != nil && certs != nil && (*certs)[v.name] != nil) {
+			return (*certs)[v.name], nil
+		}
+		if(fallback == nil) {
+			// Use tls_config.Certificates.
+			return nil, nil
+		}
+		return fallback(hello)
+	}
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ * Webhooks POST finished results to other systems, such as incident
+ * tooling, as they come in.  Each webhook listed in the config file
+ * can take only results slower than a rate, or only one direction.
+ * With a secret, the body is signed with HMAC-SHA256 in
+ * X-Gost-Signature, as "sha256=" and the hex digest, so the receiver
+ * can check it came from us.  A delivery that fails is tried again
+ * with exponential backoff; one that never gets through is appended to
+ * -webhook-dead-letters, or logged, so nothing is lost silently.
+ */
+const webhook_timeout = 10 * time.Second
+const webhook_attempts = 5
+const webhook_first_retry = time.Second
+
+/*
+ * Deliveries under way or waiting to retry.  Past this, new ones go
+ * straight to the dead letters rather than pile up behind a webhook
+ * that's down.
+ */
+const webhook_max_pending = 256
+
+type webhook_spec struct {
+	name      string
+	url       *url.URL
+	secret    string
+	below_bps int64
+	direction string
+	insecure  bool
+}
+
+/*
+ * What a webhook is sent: a result, or an alert that started or
+ * stopped firing.
+ */
+type webhook_payload struct {
+	Event    string       `json:"event"`
+	Delivery string       `json:"delivery"`
+	Node     string       `json:"node,omitempty"`
+	Result   *test_result `json:"result,omitempty"`
+	Alert    *alert_state `json:"alert,omitempty"`
+}
+
+/*
+ * A line in the dead letters file.
+ */
+type dead_letter struct {
+	Webhook  string          `json:"webhook"`
+	URL      string          `json:"url"`
+	Failed   time.Time       `json:"failed"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+var webhook_pending = make(chan struct{}, webhook_max_pending)
+
+var dead_letters sync.Mutex
+
+/*
+ * Whether the webhook wants result.
+ */
+func (w webhook_spec) wants(result test_result) bool {
+	if(w.direction != "" && w.direction != result.Direction) {
+		return false
+	}
+	return w.below_bps == 0 || result.Mbps * 1e6 < float64(w.below_bps)
+}
+
+/*
+ * Send result to every webhook that wants it, in the background.
+ */
+func notify_webhooks(result test_result) {
+	c := settings()
+	for _, w := range c.webhooks {
+		if(w.wants(result)) {
+			send_webhook(c, w, webhook_payload{Event: "result", Result: &result})
+		}
+	}
+}
+
+/*
+ * Send an alert's change of state to every webhook, whatever results
+ * they take.
+ */
+func notify_webhooks_alert(alert alert_state) {
+	c := settings()
+	for _, w := range c.webhooks {
+		send_webhook(c, w, webhook_payload{Event: "alert", Alert: &alert})
+	}
+}
+
+/*
+ * Deliver payload to w in the background, unless too many deliveries
+ * are pending already.
+ */
+func send_webhook(c *configuration, w webhook_spec, payload webhook_payload) {
+	payload.Delivery = new_uuid()
+	payload.Node = c.node_name
+	body, _ := json.Marshal(payload)
+	select {
+	case webhook_pending <- struct{}{}:
+		go func() {
+			defer func() { <-webhook_pending }()
+			deliver_webhook(c, w, payload.Event, payload.Delivery, body)
+		}()
+	default:
+		metric_webhook_deliveries.add("dead", 1)
+		write_dead_letter(c, w, body, 0, fmt.Errorf("more than %d deliveries pending", webhook_max_pending))
+	}
+}
+
+/*
+ * Deliver body to w, retrying with backoff, and give up to the dead
+ * letters.
+ */
+func deliver_webhook(c *configuration, w webhook_spec, event string, delivery string, body []byte) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: w.insecure}
+	client := &http.Client{Transport: transport, Timeout: webhook_timeout}
+	defer transport.CloseIdleConnections()
+
+	wait := webhook_first_retry
+	var err error
+	for attempt := 1; attempt <= webhook_attempts; attempt++ {
+		err = post_webhook(client, w, event, delivery, body)
+		if(err == nil) {
+			metric_webhook_deliveries.add("delivered", 1)
+			return
+		}
+		if(attempt == webhook_attempts) {
+			break
+		}
+		metric_webhook_deliveries.add("retried", 1)
+		log_at(log_level_debug, "Webhook %s failed, retrying in %s: %v", w.name, wait, err)
+		time.Sleep(wait + rand.N(wait / 2))
+		wait *= 2
+	}
+	metric_webhook_deliveries.add("dead", 1)
+	write_dead_letter(c, w, body, webhook_attempts, err)
+}
+
+/*
+ * One attempt at a delivery.  Anything but a 2xx is a failure.
+ */
+func post_webhook(client *http.Client, w webhook_spec, event string, delivery string, body []byte) error {
+	req, err := http.NewRequest("POST", w.url.String(), bytes.NewReader(body))
+	if(err != nil) {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gost/" + current_build().Version)
+	req.Header.Set("X-Gost-Event", event)
+	req.Header.Set("X-Gost-Delivery", delivery)
+	if(w.secret != "") {
+		req.Header.Set("X-Gost-Signature", webhook_signature(w.secret, body))
+	}
+
+	res, err := client.Do(req)
+	if(err != nil) {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64 * 1024))
+	res.Body.Close()
+	if(res.StatusCode < 200 || res.StatusCode > 299) {
+		return fmt.Errorf("%s answered %s", w.url.Redacted(), res.Status)
+	}
+	return nil
+}
+
+/*
+ * The X-Gost-Signature for body.
+ */
+func webhook_signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+ * Record a delivery that didn't get through: a line of JSON in
+ * -webhook-dead-letters, and the log either way.
+ */
+func write_dead_letter(c *configuration, w webhook_spec, body []byte, attempts int, cause error) {
+	log_fields(log_level_error, "webhook undeliverable", "webhook", w.name, "attempts", attempts, "error", cause.Error())
+	if(c.webhook_dead_letters == "") {
+		return
+	}
+
+	line, _ := json.Marshal(dead_letter{
+		Webhook:  w.name,
+		URL:      w.url.Redacted(),
+		Failed:   time.Now().UTC(),
+		Attempts: attempts,
+		Error:    cause.Error(),
+		Payload:  body,
+	})
+
+	dead_letters.Lock()
+	defer dead_letters.Unlock()
+	f, err := os.OpenFile(c.webhook_dead_letters, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+	if(err == nil) {
+		_, err = f.Write(append(line, '\n'))
+		if(err == nil) {
+			err = f.Close()
+		} else {
+			f.Close()
+		}
+	}
+	if(err != nil) {
+		log_at(log_level_error, "Can't write to the webhook dead letters: %v", err)
+	}
+}
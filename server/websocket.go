@@ -0,0 +1,436 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Just enough of RFC 6455 to serve WebSocket clients: the opening
+ * handshake, unfragmented and fragmented data messages, and the
+ * ping/pong/close control frames.  ws_dial() makes the client end, for
+ * client mode, which masks what it sends.
+ */
+const (
+	ws_op_continuation = 0x0
+	ws_op_text         = 0x1
+	ws_op_binary       = 0x2
+	ws_op_close        = 0x8
+	ws_op_ping         = 0x9
+	ws_op_pong         = 0xa
+)
+
+const (
+	ws_close_normal      = 1000
+	ws_close_protocol    = 1002
+	ws_close_unsupported = 1003
+	ws_close_too_big     = 1009
+)
+
+const ws_guid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ws_err_closed = errors.New("websocket closed")
+var ws_err_too_big = errors.New("websocket message too big")
+var ws_err_bad_control = errors.New("fragmented or oversized websocket control frame")
+
+type ws_conn struct {
+	conn        net.Conn
+	rw          *bufio.ReadWriter
+	max_message int64
+	protocol    string
+	client      bool
+
+	write_mu sync.Mutex
+}
+
+/*
+ * Does the comma separated header value contain token?
+ */
+func header_has_token(h http.Header, name string, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if(strings.EqualFold(strings.TrimSpace(part), token)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * Turn an HTTP request into a WebSocket connection.  If protocols is
+ * non-empty the client must offer one of them.  On failure an HTTP
+ * error has already been written.
+ */
+func ws_upgrade(res http.ResponseWriter, req *http.Request, protocols []string) (*ws_conn, error) {
+	if(req.Method != "GET" || !header_has_token(req.Header, "Connection", "upgrade") ||
+		!header_has_token(req.Header, "Upgrade", "websocket")) {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, "WebSocket upgrade required")
+		return nil, errors.New("not a websocket upgrade")
+	}
+
+	if(req.Header.Get("Sec-WebSocket-Version") != "13") {
+		res.Header().Set("Sec-WebSocket-Version", "13")
+		res.WriteHeader(426) // Upgrade Required
+		io.WriteString(res, "Unsupported WebSocket version")
+		return nil, errors.New("unsupported websocket version")
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if(key == "") {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, "Missing Sec-WebSocket-Key")
+		return nil, errors.New("missing websocket key")
+	}
+
+	protocol := ""
+	for _, p := range protocols {
+		if(header_has_token(req.Header, "Sec-WebSocket-Protocol", p)) {
+			protocol = p
+			break
+		}
+	}
+	if(len(protocols) > 0 && protocol == "") {
+		res.WriteHeader(400) // Bad Request
+		io.WriteString(res, "Unsupported WebSocket subprotocol")
+		return nil, errors.New("unsupported websocket subprotocol")
+	}
+
+	conn, rw, err := http.NewResponseController(res).Hijack()
+	if(errors.Is(err, http.ErrNotSupported)) {
+		res.WriteHeader(500) // Internal Server Error
+		io.WriteString(res, "WebSocket unsupported on this connection")
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	if(err != nil) {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + ws_guid))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n")
+	if(protocol != "") {
+		rw.WriteString("Sec-WebSocket-Protocol: " + protocol + "\r\n")
+	}
+	rw.WriteString("\r\n")
+	err = rw.Flush()
+	if(err != nil) {
+		conn.Close()
+		return nil, err
+	}
+
+	// The server no longer owns this connection's deadlines.
+	conn.SetDeadline(time.Time{})
+
+	return &ws_conn{conn: conn, rw: rw, max_message: 1 << 20, protocol: protocol}, nil
+}
+
+/*
+ * Open a WebSocket to path on the server, as client mode.  The
+ * connection's frames are masked, as a client's must be.
+ */
+func ws_dial(o client_options, path string) (*ws_conn, error) {
+	target, _ := url.Parse(o.endpoint(path))
+	address := target.Host
+	if(target.Port() == "") {
+		address = net.JoinHostPort(target.Hostname(), map[string]string{"http": "80", "https": "443"}[target.Scheme])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+	conn, err := o.dial(ctx, "tcp", address)
+	if(err != nil) {
+		return nil, err
+	}
+	if(target.Scheme == "https") {
+		tls_conn := tls.Client(conn, &tls.Config{ServerName: target.Hostname(), InsecureSkipVerify: o.insecure})
+		err = tls_conn.HandshakeContext(ctx)
+		if(err != nil) {
+			conn.Close()
+			return nil, err
+		}
+		conn = tls_conn
+	}
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req, _ := http.NewRequest("GET", target.String(), nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if(o.token != "") {
+		req.Header.Set("Authorization", "Bearer " + o.token)
+	}
+
+	conn.SetDeadline(time.Now().Add(o.timeout))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	err = req.Write(rw)
+	if(err == nil) {
+		err = rw.Flush()
+	}
+	var res *http.Response
+	if(err == nil) {
+		res, err = http.ReadResponse(rw.Reader, req)
+	}
+	if(err != nil) {
+		conn.Close()
+		return nil, err
+	}
+	if(res.StatusCode != 101) {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %s", path, res.Status)
+	}
+	sum := sha1.Sum([]byte(key + ws_guid))
+	if(res.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:])) {
+		conn.Close()
+		return nil, errors.New(path + ": bad Sec-WebSocket-Accept")
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &ws_conn{conn: conn, rw: rw, max_message: 1 << 20, client: true}, nil
+}
+
+/*
+ * Read one frame header and payload.  Client frames are always masked,
+ * and server frames never.
+ */
+func (c *ws_conn) read_frame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	_, err = io.ReadFull(c.rw, head[:])
+	if(err != nil) {
+		return
+	}
+
+	fin = head[0] & 0x80 != 0
+	opcode = head[0] & 0x0f
+	masked := head[1] & 0x80 != 0
+	length := int64(head[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.rw, ext[:])
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.rw, ext[:])
+		length = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+	if(err != nil) {
+		return
+	}
+
+	if(masked == c.client) {
+		err = errors.New("wrongly masked frame")
+		return
+	}
+	// RFC 6455 §5.5: control frames are never fragmented, and carry
+	// at most 125 bytes.
+	if(opcode >= ws_op_close && (!fin || length > 125)) {
+		err = ws_err_bad_control
+		return
+	}
+	if(length > c.max_message) {
+		err = ws_err_too_big
+		return
+	}
+
+	var mask [4]byte
+	if(masked) {
+		_, err = io.ReadFull(c.rw, mask[:])
+		if(err != nil) {
+			return
+		}
+	}
+
+	payload = make([]byte, length)
+	_, err = io.ReadFull(c.rw, payload)
+	for i := range payload {
+		payload[i] ^= mask[i % 4]
+	}
+	return
+}
+
+/*
+ * May a peer close with code?  RFC 6455 §7.4 defines 1000-1003 and
+ * 1007-1011, IANA has since added 1012-1014, and 3000-4999 are for
+ * libraries and applications.  1005, 1006 and 1015 only ever stand for
+ * a missing code locally, and mustn't be sent.
+ */
+func ws_valid_close_code(code uint16) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+/*
+ * Read the next data message, answering control frames on the way.
+ * Returns ws_err_closed once the peer has closed the connection.  A
+ * control frame that's fragmented or over 125 bytes, or a close with a
+ * code nobody may send, closes the connection as a protocol error.
+ */
+func (c *ws_conn) read_message() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+
+	for {
+		fin, op, payload, err := c.read_frame()
+		if(err == ws_err_too_big) {
+			c.close(ws_close_too_big, "message too big")
+			return 0, nil, err
+		}
+		if(err == ws_err_bad_control) {
+			c.close(ws_close_protocol, "bad control frame")
+			return 0, nil, err
+		}
+		if(err != nil) {
+			return 0, nil, err
+		}
+
+		switch op {
+		case ws_op_ping:
+			err = c.write_message(ws_op_pong, payload)
+			if(err != nil) {
+				return 0, nil, err
+			}
+			continue
+		case ws_op_pong:
+			continue
+		case ws_op_close:
+			if(len(payload) == 1 || (len(payload) >= 2 && !ws_valid_close_code(binary.BigEndian.Uint16(payload)))) {
+				c.close(ws_close_protocol, "bad close code")
+				return 0, nil, errors.New("bad websocket close code")
+			}
+			c.write_message(ws_op_close, payload[:min(len(payload), 2)])
+			c.conn.Close()
+			return 0, nil, ws_err_closed
+		case ws_op_continuation:
+			if(opcode == 0) {
+				c.close(ws_close_protocol, "unexpected continuation")
+				return 0, nil, errors.New("unexpected continuation frame")
+			}
+		case ws_op_text, ws_op_binary:
+			if(opcode != 0) {
+				c.close(ws_close_protocol, "expected continuation")
+				return 0, nil, errors.New("interleaved data frames")
+			}
+			opcode = op
+		default:
+			c.close(ws_close_protocol, "unknown opcode")
+			return 0, nil, errors.New("unknown websocket opcode")
+		}
+
+		message = append(message, payload...)
+		if(int64(len(message)) > c.max_message) {
+			c.close(ws_close_too_big, "message too big")
+			return 0, nil, ws_err_too_big
+		}
+		if(fin) {
+			return opcode, message, nil
+		}
+	}
+}
+
+/*
+ * Buffer the header of an unfragmented frame of length bytes, masked
+ * if it's from the client, and return the mask, which is zero if not.
+ * The caller holds write_mu.
+ */
+func (c *ws_conn) write_head(opcode byte, length int64) [4]byte {
+	var head [14]byte
+	var mask [4]byte
+	head[0] = 0x80 | opcode
+	n := 2
+
+	switch {
+	case length < 126:
+		head[1] = byte(length)
+	case length <= 0xffff:
+		head[1] = 126
+		binary.BigEndian.PutUint16(head[2:], uint16(length))
+		n = 4
+	default:
+		head[1] = 127
+		binary.BigEndian.PutUint64(head[2:], uint64(length))
+		n = 10
+	}
+	if(c.client) {
+		head[1] |= 0x80
+		rand.Read(mask[:])
+		n += copy(head[n:], mask[:])
+	}
+	c.rw.Write(head[:n])
+	return mask
+}
+
+/*
+ * Send one unfragmented frame.  Safe for concurrent use.
+ */
+func (c *ws_conn) write_message(opcode byte, payload []byte) error {
+	c.write_mu.Lock()
+	defer c.write_mu.Unlock()
+
+	mask := c.write_head(opcode, int64(len(payload)))
+	if(c.client) {
+		masked := make([]byte, len(payload))
+		for i := range payload {
+			masked[i] = payload[i] ^ mask[i % 4]
+		}
+		payload = masked
+	}
+	c.rw.Write(payload)
+	return c.rw.Flush()
+}
+
+/*
+ * Send a binary frame of n bytes of payload to w, which must end up at
+ * the connection, without holding it all in memory.  Safe for
+ * concurrent use, and for the server end alone.
+ */
+func (c *ws_conn) write_payload_message(w io.Writer, n int64) (int64, error) {
+	c.write_mu.Lock()
+	defer c.write_mu.Unlock()
+
+	c.write_head(ws_op_binary, n)
+	err := c.rw.Flush()
+	if(err != nil) {
+		return 0, err
+	}
+	return write_payload(w, n)
+}
+
+/*
+ * Send a close frame and hang up.
+ */
+func (c *ws_conn) close(code uint16, reason string) {
+	payload := make([]byte, 2, 2 + len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	payload = append(payload, reason...)
+
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.write_message(ws_op_close, payload)
+	c.conn.Close()
+}
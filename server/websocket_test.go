@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+/*
+ * A frame as a client sends it: masked with mask unless mask is nil,
+ * and with the shortest length encoding unless extended says 126 or
+ * 127.
+ */
+func ws_frame(fin bool, opcode byte, payload []byte, mask []byte, extended int) []byte {
+	frame := []byte{opcode}
+	if(fin) {
+		frame[0] |= 0x80
+	}
+	var bit byte
+	if(mask != nil) {
+		bit = 0x80
+	}
+	switch {
+	case extended == 127 || len(payload) > 0xffff:
+		frame = append(frame, bit | 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	case extended == 126 || len(payload) >= 126:
+		frame = append(frame, bit | 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, bit | byte(len(payload)))
+	}
+	if(mask == nil) {
+		return append(frame, payload...)
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b ^ mask[i % 4])
+	}
+	return frame
+}
+
+/*
+ * The server end of a WebSocket reading input, and what it wrote back.
+ */
+func ws_reading(t *testing.T, input []byte, max_message int64) (*ws_conn, *bytes.Buffer) {
+	ours, theirs := net.Pipe()
+	t.Cleanup(func() {
+		ours.Close()
+		theirs.Close()
+	})
+	out := &bytes.Buffer{}
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(input)), bufio.NewWriter(out))
+	return &ws_conn{conn: ours, rw: rw, max_message: max_message}, out
+}
+
+func TestWebSocketReadFrame(t *testing.T) {
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	long := bytes.Repeat([]byte("x"), 300)
+	huge := bytes.Repeat([]byte("y"), 70000)
+	top_bit := ws_frame(true, ws_op_binary, []byte("abcde"), mask, 127)
+	top_bit[2] |= 0x80
+
+	tests := []struct {
+		name    string
+		input   []byte
+		max     int64
+		opcode  byte
+		payload []byte
+		fails   bool
+	}{
+		{"masked text", ws_frame(true, ws_op_text, []byte("Hello"), mask, 0), 1 << 20, ws_op_text, []byte("Hello"), false},
+		{"empty", ws_frame(true, ws_op_binary, nil, mask, 0), 1 << 20, ws_op_binary, []byte{}, false},
+		{"16-bit length", ws_frame(true, ws_op_binary, long, mask, 0), 1 << 20, ws_op_binary, long, false},
+		{"64-bit length", ws_frame(true, ws_op_binary, huge, mask, 0), 1 << 20, ws_op_binary, huge, false},
+		{"short payload in a 16-bit length", ws_frame(true, ws_op_binary, []byte("abc"), mask, 126), 1 << 20, ws_op_binary, []byte("abc"), false},
+		{"unmasked from a client", ws_frame(true, ws_op_text, []byte("Hello"), nil, 0), 1 << 20, 0, nil, true},
+		{"too big", ws_frame(true, ws_op_binary, long, mask, 0), 100, 0, nil, true},
+		{"truncated header", []byte{0x82}, 1 << 20, 0, nil, true},
+		{"truncated length", ws_frame(true, ws_op_binary, long, mask, 0)[:3], 1 << 20, 0, nil, true},
+		{"truncated mask", ws_frame(true, ws_op_binary, []byte("abc"), mask, 0)[:4], 1 << 20, 0, nil, true},
+		{"truncated payload", ws_frame(true, ws_op_binary, long, mask, 0)[:100], 1 << 20, 0, nil, true},
+		{"64-bit length with the top bit set", top_bit, 1 << 20, ws_op_binary, []byte("abcde"), false},
+		{"ping", ws_frame(true, ws_op_ping, []byte("p"), mask, 0), 1 << 20, ws_op_ping, []byte("p"), false},
+		{"ping of 125 bytes", ws_frame(true, ws_op_ping, long[:125], mask, 0), 1 << 20, ws_op_ping, long[:125], false},
+		{"ping of 126 bytes", ws_frame(true, ws_op_ping, long[:126], mask, 0), 1 << 20, 0, nil, true},
+		{"fragmented close", ws_frame(false, ws_op_close, []byte{0x03, 0xe8}, mask, 0), 1 << 20, 0, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := ws_reading(t, test.input, test.max)
+			_, opcode, payload, err := c.read_frame()
+			if(test.fails) {
+				if(err == nil) {
+					t.Fatalf("read opcode %d, %d bytes; want an error", opcode, len(payload))
+				}
+				return
+			}
+			if(err != nil) {
+				t.Fatalf("rejected: %v", err)
+			}
+			if(opcode != test.opcode) {
+				t.Fatalf("opcode %d, want %d", opcode, test.opcode)
+			}
+			if(!bytes.Equal(payload, test.payload)) {
+				t.Fatalf("payload %q, want %q", payload, test.payload)
+			}
+		})
+	}
+}
+
+func TestWebSocketReadMessage(t *testing.T) {
+	mask := []byte{1, 2, 3, 4}
+	join := func(frames ...[]byte) []byte {
+		return bytes.Join(frames, nil)
+	}
+	protocol_error := func(reason string) []byte {
+		return ws_frame(true, ws_op_close, append([]byte{0x03, 0xea}, reason...), nil, 0)
+	}
+
+	tests := []struct {
+		name    string
+		input   []byte
+		opcode  byte
+		message string
+		reply   []byte
+		fails   error
+	}{
+		{"unfragmented", ws_frame(true, ws_op_text, []byte("hello"), mask, 0), ws_op_text, "hello", nil, nil},
+		{"fragmented", join(ws_frame(false, ws_op_binary, []byte("hel"), mask, 0), ws_frame(true, ws_op_continuation, []byte("lo"), mask, 0)), ws_op_binary, "hello", nil, nil},
+		{"ping between fragments", join(ws_frame(false, ws_op_text, []byte("hel"), mask, 0), ws_frame(true, ws_op_ping, []byte("p"), mask, 0), ws_frame(true, ws_op_continuation, []byte("lo"), mask, 0)),
+			ws_op_text, "hello", ws_frame(true, ws_op_pong, []byte("p"), nil, 0), nil},
+		{"pong ignored", join(ws_frame(true, ws_op_pong, nil, mask, 0), ws_frame(true, ws_op_text, []byte("hi"), mask, 0)), ws_op_text, "hi", nil, nil},
+		{"close", ws_frame(true, ws_op_close, []byte{0x03, 0xe8, 'b', 'y', 'e'}, mask, 0), 0, "", ws_frame(true, ws_op_close, []byte{0x03, 0xe8}, nil, 0), ws_err_closed},
+		{"too big fragmented", join(ws_frame(false, ws_op_binary, make([]byte, 60), mask, 0), ws_frame(true, ws_op_continuation, make([]byte, 60), mask, 0)), 0, "", nil, ws_err_too_big},
+		{"continuation first", ws_frame(true, ws_op_continuation, []byte("lo"), mask, 0), 0, "", nil, ws_any_error},
+		{"interleaved data", join(ws_frame(false, ws_op_text, []byte("hel"), mask, 0), ws_frame(true, ws_op_text, []byte("lo"), mask, 0)), 0, "", nil, ws_any_error},
+		{"unknown opcode", ws_frame(true, 0x3, nil, mask, 0), 0, "", nil, ws_any_error},
+
+		{"close without a code", ws_frame(true, ws_op_close, nil, mask, 0), 0, "", ws_frame(true, ws_op_close, []byte{}, nil, 0), ws_err_closed},
+		{"close from an application", ws_frame(true, ws_op_close, []byte{0x0b, 0xb8}, mask, 0), 0, "", ws_frame(true, ws_op_close, []byte{0x0b, 0xb8}, nil, 0), ws_err_closed},
+		{"fragmented ping", ws_frame(false, ws_op_ping, []byte("p"), mask, 0), 0, "", protocol_error("bad control frame"), ws_err_bad_control},
+		{"ping over 125 bytes", ws_frame(true, ws_op_ping, make([]byte, 126), mask, 0), 0, "", protocol_error("bad control frame"), ws_err_bad_control},
+		{"close over 125 bytes", ws_frame(true, ws_op_close, append([]byte{0x03, 0xe8}, make([]byte, 124)...), mask, 0), 0, "", protocol_error("bad control frame"), ws_err_bad_control},
+		{"close with half a code", ws_frame(true, ws_op_close, []byte{0x03}, mask, 0), 0, "", protocol_error("bad close code"), ws_any_error},
+		{"close with 999", ws_frame(true, ws_op_close, []byte{0x03, 0xe7}, mask, 0), 0, "", protocol_error("bad close code"), ws_any_error},
+		{"close with 1005", ws_frame(true, ws_op_close, []byte{0x03, 0xed}, mask, 0), 0, "", protocol_error("bad close code"), ws_any_error},
+		{"close with 1006", ws_frame(true, ws_op_close, []byte{0x03, 0xee}, mask, 0), 0, "", protocol_error("bad close code"), ws_any_error},
+		{"close with 2000", ws_frame(true, ws_op_close, []byte{0x07, 0xd0}, mask, 0), 0, "", protocol_error("bad close code"), ws_any_error},
+		{"close with 5000", ws_frame(true, ws_op_close, []byte{0x13, 0x88}, mask, 0), 0, "", protocol_error("bad close code"), ws_any_error},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, out := ws_reading(t, test.input, 100)
+			opcode, message, err := c.read_message()
+			if(test.fails != nil) {
+				if(err == nil || (test.fails != ws_any_error && err != test.fails)) {
+					t.Fatalf("got %v, want %v", err, test.fails)
+				}
+			} else {
+				if(err != nil) {
+					t.Fatalf("rejected: %v", err)
+				}
+				if(opcode != test.opcode || string(message) != test.message) {
+					t.Fatalf("got %d %q, want %d %q", opcode, message, test.opcode, test.message)
+				}
+			}
+			if(test.reply != nil && !bytes.Equal(out.Bytes(), test.reply)) {
+				t.Fatalf("replied % x, want % x", out.Bytes(), test.reply)
+			}
+		})
+	}
+}
+
+/*
+ * Stands for any error at all in the table.
+ */
+var ws_any_error = errors.New("any error")